@@ -11,16 +11,24 @@ package ltcache
 
 import (
 	"archive/zip"
+	"bufio"
+	"container/heap"
 	"container/list"
+	"context"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unsafe"
 )
 
 const (
@@ -28,13 +36,24 @@ const (
 	DisabledCaching  = 0
 )
 
+// NeverExpires is the remaining time to live returned by GetWithRemaining for items without expiry
+const NeverExpires time.Duration = -1
+
 var ErrDumpIntervalDisabled = errors.New("dumpInterval is disabled")
 
 type cachedItem struct {
-	itemID     string
-	value      any
-	expiryTime time.Time
-	groupIDs   []string // list of group this item belongs to
+	itemID       string
+	value        any
+	expiryTime   time.Time
+	groupIDs     []string  // list of group this item belongs to
+	staticExpiry bool      // expiryTime was set specifically for this item so it is not refreshed on get/set
+	setTime      time.Time // when the item was first set, used to enforce maxAge
+	updateTime   time.Time // when the item was last set, used by RemoveOlderThan
+	lastAccess   time.Time // when the item was last read, only tracked if trackAccess is enabled
+
+	tags map[string]string // labels of the item, used for filtering without removal semantics
+	size int64             // estimated bytes of the item when set, only tracked if maxMemory is set
+	freq int64             // access frequency of the item, only tracked with PolicyLFU
 }
 
 // Cache is an LRU/TTL cache. It is safe for concurrent access.
@@ -45,6 +64,8 @@ type Cache struct {
 	groups map[string]map[string]struct{} // map[groupID]map[itemKey]struct{}
 	// onEvicted will execute specific function if defined when an item will be removed
 	onEvicted []func(itmID string, value any)
+	// onEvictedReason, if not nil, is executed after onEvicted, receiving the reason of the removal
+	onEvictedReason func(itmID string, value any, reason EvictionReason)
 	// maxEntries represents maximum number of entries allowed by LRU cache mechanism
 	// -1 for unlimited caching, 0 for disabling caching
 	maxEntries int
@@ -55,27 +76,68 @@ type Cache struct {
 
 	lruIdx  *list.List
 	lruRefs map[string]*list.Element // index the list element based on it's key in cache
-	ttlIdx  *list.List
-	ttlRefs map[string]*list.Element // index the list element based on it' key in cache
+	ttlIdx  *ttlHeap
+	grpTTLs map[string]time.Time // expiry of the groups set by SetGroupTTL, limiting the expiry of their items
 
 	clone        bool              // if true, a clone of the value when getting value from cache will be returned
 	offCollector *OfflineCollector // used dump cache to files
+	dumpDropped  bool              // the dump folder is removed or archived, removals are no longer stored
+	ttlWake      chan struct{}     // wakes up cleanExpired when an item expiring sooner is indexed
+	cleanerStop  chan struct{}     // closed to stop cleanExpired on Shutdown or when the instance is removed
+
+	clockSkewTolerance time.Duration // items are considered expired only after expiryTime+clockSkewTolerance
+	lockStats          *lockStats    // lock wait times, recorded only when built with ltcache_lockstats tag
+	loadReport         *LoadReport   // statistics of recovering from dump files
+	maxAge             time.Duration // items are expired after maxAge since first set, even if their TTL got refreshed
+
+	evictionChans    []chan EvictionEvent // channels receiving the removed items
+	evictionsDropped int64                // events not delivered to a full eviction channel
+
+	hits      int64 // lookups finding the item, since creation or ResetStats
+	misses    int64 // lookups not finding the item, since creation or ResetStats
+	evictions int64 // items removed by the cache itself, since creation or ResetStats
+
+	loader  Loader               // loads the items missing from cache on Get
+	loadMux sync.Mutex           // protects loads
+	loads   map[string]*loadCall // loadings in progress
+
+	evictionSuspended   bool // maxEntries not enforced until eviction is resumed
+	groupAtomicEviction bool // evicting an item evicts its group siblings as well
+	trackAccess         bool // record when items are read
+
+	tagIdx       map[string]map[string]map[string]struct{} // map[tagKey]map[tagValue]map[itemKey]struct{}
+	lowWaterMark int                                       // items left after evicting over maxEntries, 0 evicts one at a time
+
+	maxMemory       int64 // estimated bytes of the items over which the least recently used are evicted, 0 for no limit
+	defaultItemSize int64 // estimated bytes of the values of unknown size, the interface header if not positive
+	usedBytes       int64 // estimated bytes of the items
+
+	evictionPolicy EvictionPolicy           // order in which items are evicted over maxEntries or maxMemory
+	lfuIdx         map[int64]*list.List     // map[frequency]items, most recently used at the front, only with PolicyLFU
+	lfuRefs        map[string]*list.Element // index the lfu element based on its key in cache
+	lfuMinFreq     int64                    // lowest frequency in lfuIdx, recomputed if its list was emptied
+
+	watchers           map[*watcher]struct{} // subscribers to the changes of items
+	watchEventsDropped int64                 // events not delivered to a full watch channel
+
+	clock Clock // time source of the ttls and expiries, time.Now if nil
 }
 
 // NewCache initializes a new cache.
 func NewCache(maxEntries int, ttl time.Duration, staticTTL, clone bool,
 	onEvicted []func(itmID string, value any)) (c *Cache) {
 	c = &Cache{
-		cache:      make(map[string]*cachedItem),
-		groups:     make(map[string]map[string]struct{}),
-		maxEntries: maxEntries,
-		ttl:        ttl,
-		staticTTL:  staticTTL,
-		lruIdx:     list.New(),
-		lruRefs:    make(map[string]*list.Element),
-		ttlIdx:     list.New(),
-		ttlRefs:    make(map[string]*list.Element),
-		clone:      clone,
+		cache:       make(map[string]*cachedItem),
+		groups:      make(map[string]map[string]struct{}),
+		maxEntries:  maxEntries,
+		ttl:         ttl,
+		staticTTL:   staticTTL,
+		lruIdx:      list.New(),
+		lruRefs:     make(map[string]*list.Element),
+		ttlIdx:      newTTLHeap(),
+		clone:       clone,
+		lockStats:   newLockStats(),
+		cleanerStop: make(chan struct{}),
 	}
 	c.onEvicted = append(c.onEvicted, onEvicted...)
 	if c.ttl > 0 {
@@ -84,33 +146,291 @@ func NewCache(maxEntries int, ttl time.Duration, staticTTL, clone bool,
 	return
 }
 
-// Get looks up a key's value from the cache
+// EvictionReason explains why an item was removed from cache
+type EvictionReason int
+
+const (
+	EvictionRemoved  EvictionReason = iota // item removed explicitly
+	EvictionExpired                        // item TTL expired
+	EvictionCapacity                       // least recently used item removed to make room
+	EvictionCleared                        // cache was cleared
+	EvictionIdle                           // item not accessed for too long
+	EvictionGroup                          // group of the item removed explicitly
+)
+
+// EvictionPolicy selects the items evicted when the cache grows over its limits
+type EvictionPolicy int
+
+const (
+	PolicyLRU EvictionPolicy = iota // least recently used items evicted first
+	PolicyLFU                       // least frequently read items evicted first, the least recently used among them
+)
+
+// EvictionEvent describes an item removed from cache
+type EvictionEvent struct {
+	ItemID string
+	Value  any
+	Reason EvictionReason
+}
+
+// CacheEventKind is the change of an item reported by Watch
+type CacheEventKind int
+
+const (
+	EventSet    CacheEventKind = iota // item set
+	EventRemove                       // item removed explicitly, alone, with its group or by clearing the cache
+	EventEvict                        // item evicted by the cache on capacity, expiry or idleness
+)
+
+// CacheEvent describes a change of an item reported by Watch
+type CacheEvent struct {
+	ItemID string
+	Kind   CacheEventKind
+	Value  any // value set, or the one removed
+}
+
+// watcher receives the changes of the watched items, all if itmIDs is nil
+type watcher struct {
+	itmIDs map[string]struct{}
+	ch     chan CacheEvent
+}
+
+// watchBufferSize is the number of events buffered for a watcher before dropping them
+const watchBufferSize = 128
+
+// GetResult is the outcome of looking up an item in cache
+type GetResult int
+
+const (
+	NotFound GetResult = iota // item was never set or was removed
+	Found                     // item is in cache
+	Expired                   // item expired, being removed from cache on this lookup
+)
+
+// Loader loads an item missing from cache, returning its value, groups and ttl.
+// A zero ttl applies the cache TTL while a negative one returns the value without caching it
+type Loader func(itmID string) (value any, grpIDs []string, ttl time.Duration, err error)
+
+// loadCall is a loading in progress, shared by all the Gets missing the same item
+type loadCall struct {
+	wg    sync.WaitGroup
+	value any
+	err   error
+}
+
+// Get looks up a key's value from the cache, loading it on miss if a Loader is set
 func (c *Cache) Get(itmID string) (value any, ok bool) {
+	value, ok, err := c.GetWithError(itmID)
+	return value, ok && err == nil
+}
+
+// GetWithError looks up a key's value from the cache, loading it on miss if a Loader is set.
+// The error returned by the Loader is passed to the caller
+func (c *Cache) GetWithError(itmID string) (value any, ok bool, err error) {
+	value, result := c.GetDetailed(itmID)
+	if result == Found {
+		return value, true, nil
+	}
+	return c.loadMissing(itmID)
+}
+
+// loadMissing loads the itmID missing from cache if a Loader is set, as GetWithError does on miss
+func (c *Cache) loadMissing(itmID string) (value any, ok bool, err error) {
+	c.RLock()
+	loader := c.loader
+	c.RUnlock()
+	if loader == nil {
+		return nil, false, nil
+	}
+	if value, err = c.load(itmID, loader); err != nil {
+		return nil, false, err
+	}
+	return c.cloned(value), true, nil
+}
+
+// Clock provides the current time to the ttls and expiries of the items, so tests can advance
+// time deterministically instead of sleeping
+type Clock interface {
+	Now() time.Time
+}
+
+// SetClock sets the time source of the ttls and expiries, nil restoring time.Now. Should be set
+// before using the cache. The cleaner waits on real time, so the items expired after advancing
+// the clock are reported missing until removed by ExpireNow
+func (c *Cache) SetClock(clock Clock) {
+	c.Lock()
+	c.clock = clock
+	c.Unlock()
+}
+
+// now returns the current time of the clock of the cache
+func (c *Cache) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+// SetLoader sets the function loading the items missing from cache, nil disables loading
+func (c *Cache) SetLoader(loader Loader) {
+	c.Lock()
+	c.loader = loader
+	c.Unlock()
+}
+
+// load calls loader for itmID and caches its result, coalescing concurrent loads of the same item
+func (c *Cache) load(itmID string, loader Loader) (value any, err error) {
+	c.loadMux.Lock()
+	if lc, has := c.loads[itmID]; has { // already loading, wait for its result
+		c.loadMux.Unlock()
+		lc.wg.Wait()
+		return lc.value, lc.err
+	}
+	lc := new(loadCall)
+	lc.wg.Add(1)
+	if c.loads == nil {
+		c.loads = make(map[string]*loadCall)
+	}
+	c.loads[itmID] = lc
+	c.loadMux.Unlock()
+	defer func() {
+		c.loadMux.Lock()
+		delete(c.loads, itmID)
+		c.loadMux.Unlock()
+		lc.wg.Done()
+	}()
+	var grpIDs []string
+	var ttl time.Duration
+	if lc.value, grpIDs, ttl, lc.err = loader(itmID); lc.err != nil {
+		return nil, lc.err
+	}
+	switch {
+	case ttl > 0:
+		c.SetWithExpiry(itmID, lc.value, grpIDs, ttl)
+	case ttl == 0:
+		c.Set(itmID, lc.value, grpIDs)
+	}
+	return lc.value, nil
+}
+
+// cloned returns a clone of value if the cache is cloning and value is a CacheCloner
+func (c *Cache) cloned(value any) any {
+	if !c.clone {
+		return value
+	}
+	if valClnAny, clnable := value.(CacheCloner); clnable {
+		return valClnAny.CacheClone()
+	}
+	return value
+}
+
+// GetDetailed looks up a key's value from the cache, reporting if a missing item was
+// never there or it just expired
+func (c *Cache) GetDetailed(itmID string) (value any, result GetResult) {
+	c.Lock()
+	defer c.Unlock()
+	return c.getItem(itmID, c.now())
+}
+
+// GetMulti returns the values of the itmIDs found in cache, looked up in one lock acquisition.
+// Missing items are not loaded and absent from the map returned
+func (c *Cache) GetMulti(itmIDs []string) (items map[string]any) {
+	items = make(map[string]any)
 	c.Lock()
 	defer c.Unlock()
+	now := c.now()
+	for _, itmID := range itmIDs {
+		if value, result := c.getItem(itmID, now); result == Found {
+			items[itmID] = value
+		}
+	}
+	return
+}
+
+// getItem looks up an item at now, refreshing its recency and TTL if found (not thread safe)
+func (c *Cache) getItem(itmID string, now time.Time) (value any, result GetResult) {
 	ci, has := c.cache[itmID]
 	if !has {
-		return
+		c.misses++
+		return nil, NotFound
 	}
-	if c.clone { // try cloning to avoid concurrency only if specified
-		if valClnAny, clnable := ci.value.(CacheCloner); clnable {
-			value, ok = valClnAny.CacheClone(), true
-		} else {
-			value, ok = ci.value, true
-		}
-	} else {
-		value, ok = ci.value, true
+	if !ci.expiryTime.IsZero() && c.expired(ci.expiryTime, now) { // expired but not yet cleaned
+		c.misses++
+		c.remove(itmID, EvictionExpired)
+		return nil, Expired
+	}
+	c.hits++
+	// try cloning to avoid concurrency only if specified
+	value, result = c.cloned(ci.value), Found
+	if c.trackAccess {
+		ci.lastAccess = now
 	}
-	if c.maxEntries != UnlimitedCaching { // update lru indexes
+	if c.lruEnabled() { // update lru indexes
 		c.lruIdx.MoveToFront(c.lruRefs[itmID])
 	}
-	if c.ttl > 0 && !c.staticTTL { // update ttl indexes
-		ci.expiryTime = time.Now().Add(c.ttl)
-		c.ttlIdx.MoveToFront(c.ttlRefs[itmID])
+	if c.lfuEnabled() {
+		c.lfuRemove(ci)
+		ci.freq++
+		c.lfuAdd(ci)
+	}
+	if c.ttl > 0 && !c.staticTTL && !ci.staticExpiry { // update ttl indexes
+		c.setExpiry(ci, now.Add(c.ttl), false)
+	}
+	return
+}
+
+// GetCloneable returns the value of an item, as Get would, together with cloneable, true if
+// the stored value is a CacheCloner. The item is looked up under a read lock, without
+// refreshing its recency or TTL
+func (c *Cache) GetCloneable(itmID string) (value any, cloneable bool, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	ci, has := c.cache[itmID]
+	if !has || (!ci.expiryTime.IsZero() && c.expired(ci.expiryTime, c.now())) {
+		return
+	}
+	_, cloneable = ci.value.(CacheCloner)
+	return c.cloned(ci.value), cloneable, true
+}
+
+// GetWithRemaining returns the value of an item together with the time left until it expires,
+// NeverExpires if it has no expiry. As a read only lookup, it does not refresh the recency or TTL
+// of the item
+func (c *Cache) GetWithRemaining(itmID string) (value any, remaining time.Duration, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	ci, has := c.cache[itmID]
+	if !has {
+		return
+	}
+	if ci.expiryTime.IsZero() {
+		return c.cloned(ci.value), NeverExpires, true
 	}
+	now := c.now()
+	if c.expired(ci.expiryTime, now) {
+		return
+	}
+	return c.cloned(ci.value), ci.expiryTime.Sub(now), true
+}
+
+// Peek returns the value of an item without refreshing its recency, TTL or last access, so
+// sampling the cache does not change which items are evicted
+func (c *Cache) Peek(itmID string) (value any, ok bool) {
+	value, _, ok = c.GetCloneable(itmID)
 	return
 }
 
+// peekWithGroups is Peek returning the groups of the item as well, read under the same lock
+func (c *Cache) peekWithGroups(itmID string) (value any, grpIDs []string, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	ci, has := c.cache[itmID]
+	if !has || (!ci.expiryTime.IsZero() && c.expired(ci.expiryTime, c.now())) {
+		return
+	}
+	return c.cloned(ci.value), slices.Clone(ci.groupIDs), true
+}
+
 func (c *Cache) GetItemExpiryTime(itmID string) (exp time.Time, ok bool) {
 	c.RLock()
 	defer c.RUnlock()
@@ -123,6 +443,18 @@ func (c *Cache) GetItemExpiryTime(itmID string) (exp time.Time, ok bool) {
 	return
 }
 
+// GetItemTTLInfo returns the expiry time of an item together with static, true if reading
+// the item will not extend its expiry. ok is false if not found
+func (c *Cache) GetItemTTLInfo(itmID string) (exp time.Time, static bool, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	var ci *cachedItem
+	if ci, ok = c.cache[itmID]; !ok {
+		return
+	}
+	return ci.expiryTime, c.ttl <= 0 || c.staticTTL || ci.staticExpiry, true
+}
+
 func (c *Cache) HasItem(itmID string) (has bool) {
 	c.RLock()
 	_, has = c.cache[itmID]
@@ -132,108 +464,1049 @@ func (c *Cache) HasItem(itmID string) (has bool) {
 
 // Set sets/adds a value to the cache.
 func (c *Cache) Set(itmID string, value any, grpIDs []string) {
+	c.setWithTTL(itmID, value, grpIDs, nil)
+}
+
+// setWithTTL sets/adds a value to the cache expiring after the cache TTL, read under the lock
+// as it can change at runtime, see SetTTL
+func (c *Cache) setWithTTL(itmID string, value any, grpIDs []string, tags map[string]string) {
+	c.Lock()
+	defer c.Unlock()
 	if c.maxEntries == DisabledCaching {
 		return
 	}
+	c.setItem(itmID, value, grpIDs, tags, c.ttlExpiry(c.now()), false)
+}
+
+// ttlExpiry returns the expiry time of an item set at now based on the cache TTL, zero if
+// the TTL is disabled (not thread safe)
+func (c *Cache) ttlExpiry(now time.Time) (expiryTime time.Time) {
+	if c.ttl > 0 {
+		expiryTime = now.Add(c.ttl)
+	}
+	return
+}
+
+// hasTTL returns true if the cache TTL is enabled (thread safe)
+func (c *Cache) hasTTL() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.ttl > 0
+}
+
+// SetCtx is Set returning ctx.Err() if ctx is done while waiting for the cache lock, nothing
+// being set then, or while waiting to write the item through to the dump file. In the latter case
+// the item is set and stays collected, dumped by the next Flush, DumpToFile or Shutdown
+func (c *Cache) SetCtx(ctx context.Context, itmID string, value any, grpIDs []string) error {
+	if err := lockCtx(ctx, c.Lock, c.Unlock); err != nil {
+		return err
+	}
+	defer c.Unlock()
+	if c.maxEntries == DisabledCaching {
+		return nil
+	}
+	return c.setItemCtx(ctx, itmID, value, grpIDs, nil, c.ttlExpiry(c.now()), false)
+}
+
+// lockCtx acquires a lock with lock, returning ctx.Err() instead if ctx is done first, in which
+// case the lock is released with unlock as soon as it is acquired
+func lockCtx(ctx context.Context, lock, unlock func()) error {
+	if ctx.Done() == nil { // never canceled
+		lock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// GetOrSet returns the value of the item if found, with loaded true, otherwise sets it to value and
+// returns value. Only setting the item is dumped. A value which cannot be dumped, see checkEncodable,
+// is returned without being set
+func (c *Cache) GetOrSet(itmID string, value any, grpIDs []string) (actual any, loaded bool) {
 	c.Lock()
-	defer func() {
-		if c.offCollector != nil {
-			if c.offCollector.collectSetEntity { // if collectSet is true collect the itemID to write in dump later in the interval
-				c.offCollector.collect(itmID)
-			} else { // if not write the item in dump instantly
-				c.offCollector.collMux.Lock()
-				defer c.offCollector.collMux.Unlock()
-				if err := c.offCollector.writeEntity(&OfflineCacheEntity{
-					IsSet:      true,
-					ItemID:     itmID,
-					Value:      c.cache[itmID].value,
-					ExpiryTime: c.cache[itmID].expiryTime,
-					GroupIDs:   c.cache[itmID].groupIDs,
-				}); err != nil {
-					c.offCollector.logger.Err(err.Error())
-				}
-			}
+	defer c.Unlock()
+	now := c.now()
+	if actual, result := c.getItem(itmID, now); result == Found {
+		return actual, true
+	}
+	if c.maxEntries == DisabledCaching {
+		return value, false
+	}
+	if err := c.checkEncodable(itmID, value); err != nil {
+		c.offCollector.log().Err(err.Error())
+		return value, false
+	}
+	c.setItem(itmID, value, grpIDs, nil, c.ttlExpiry(now), false)
+	return value, false
+}
+
+// SetIfAbsent sets the item to value only if not found in cache, returning true if it was set.
+// The item found is left untouched. A value which cannot be dumped is not set
+func (c *Cache) SetIfAbsent(itmID string, value any, grpIDs []string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.maxEntries == DisabledCaching {
+		return false
+	}
+	now := c.now()
+	if ci, has := c.cache[itmID]; has {
+		if ci.expiryTime.IsZero() || !c.expired(ci.expiryTime, now) {
+			return false
 		}
-		c.Unlock()
-	}()
-	now := time.Now()
-	if ci, ok := c.cache[itmID]; ok {
-		ci.value = value
-		c.remItemFromGroups(itmID, ci.groupIDs)
-		ci.groupIDs = grpIDs
-		c.addItemToGroups(itmID, grpIDs)
-		if c.maxEntries != UnlimitedCaching { // update lru indexes
-			c.lruIdx.MoveToFront(c.lruRefs[itmID])
+		c.remove(itmID, EvictionExpired)
+	}
+	if err := c.checkEncodable(itmID, value); err != nil {
+		c.offCollector.log().Err(err.Error())
+		return false
+	}
+	c.setItem(itmID, value, grpIDs, nil, c.ttlExpiry(now), false)
+	return true
+}
+
+// Increment adds delta to the int64 value of an item, starting from 0 if missing, returning the
+// new value. Errors with ErrNotInt64 if the value is of another type
+func (c *Cache) Increment(itmID string, delta int64) (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	ci, has := c.cache[itmID]
+	if !has || (!ci.expiryTime.IsZero() && c.expired(ci.expiryTime, now)) {
+		if c.maxEntries == DisabledCaching {
+			return delta, nil
 		}
-		if c.ttl > 0 && !c.staticTTL { // update ttl indexes
-			ci.expiryTime = now.Add(c.ttl)
-			c.ttlIdx.MoveToFront(c.ttlRefs[itmID])
+		if has { // expired, counting from 0 again
+			c.remove(itmID, EvictionExpired)
 		}
-		return
+		c.setItem(itmID, delta, nil, nil, c.ttlExpiry(now), false)
+		return delta, nil
 	}
-	ci := &cachedItem{itemID: itmID, value: value, groupIDs: grpIDs}
-	c.cache[itmID] = ci
-	c.addItemToGroups(itmID, grpIDs)
-	if c.maxEntries != UnlimitedCaching {
-		c.lruRefs[itmID] = c.lruIdx.PushFront(ci)
+	value, ok := ci.value.(int64)
+	if !ok {
+		return 0, fmt.Errorf("item <%s> of type <%T>: %w", itmID, ci.value, ErrNotInt64)
 	}
-	if c.ttl > 0 {
-		ci.expiryTime = now.Add(c.ttl)
-		c.ttlRefs[itmID] = c.ttlIdx.PushFront(ci)
+	value += delta
+	c.updateItem(ci, value, now)
+	return value, nil
+}
+
+// Decrement subtracts delta from the int64 value of an item, see Increment
+func (c *Cache) Decrement(itmID string, delta int64) (int64, error) {
+	return c.Increment(itmID, -delta)
+}
+
+// SetWithTags sets/adds a value to the cache labeled with tags, which can be used to filter
+// items with GetItemsByTag. Setting the item again without tags drops them
+func (c *Cache) SetWithTags(itmID string, value any, grpIDs []string, tags map[string]string) {
+	c.setWithTTL(itmID, value, grpIDs, tags)
+}
+
+// SetWithExpiry sets/adds a value to the cache which expires after ttl, independent of the
+// cache TTL. A ttl of 0 means the item never expires while a negative one means the item is
+// already expired, so it is removed from cache instead.
+func (c *Cache) SetWithExpiry(itmID string, value any, grpIDs []string, ttl time.Duration) {
+	switch {
+	case ttl < 0:
+		c.Remove(itmID)
+	case ttl == 0:
+		c.set(itmID, value, grpIDs, nil, time.Time{}, true)
+	default:
+		c.set(itmID, value, grpIDs, nil, c.now().Add(ttl), true)
 	}
-	if c.maxEntries != UnlimitedCaching {
-		var lElm *list.Element
-		if c.lruIdx.Len() > c.maxEntries {
-			lElm = c.lruIdx.Back()
-		}
-		if lElm != nil {
-			c.remove(lElm.Value.(*cachedItem).itemID)
-		}
+}
+
+// SetWithExpiryTime sets/adds a value to the cache which expires at expiryTime, independent
+// of the cache TTL. A zero expiryTime means the item never expires while one already passed,
+// taking into account the clock skew tolerance, removes the item from cache instead.
+func (c *Cache) SetWithExpiryTime(itmID string, value any, grpIDs []string, expiryTime time.Time) {
+	c.set(itmID, value, grpIDs, nil, expiryTime, true)
+}
+
+// SetClockSkewTolerance sets the duration an item is still kept after its expiryTime passed,
+// trading a small staleness window for resilience to expiry times computed on hosts with
+// skewed clocks
+func (c *Cache) SetClockSkewTolerance(tolerance time.Duration) {
+	c.Lock()
+	c.clockSkewTolerance = tolerance
+	if c.ttlIdx.Len() != 0 { // expiries already indexed need to be rechecked
+		c.wakeCleaner()
 	}
+	c.Unlock()
 }
 
-// Remove removes the provided key from the cache.
-func (c *Cache) Remove(itmID string) {
+// SetAccessTracking enables recording the time each item is read, reported by GetLastAccess
+func (c *Cache) SetAccessTracking(enabled bool) {
 	c.Lock()
-	c.remove(itmID)
+	c.trackAccess = enabled
 	c.Unlock()
 }
 
-// GetItemIDs returns a list of items matching prefix
-func (c *Cache) GetItemIDs(prfx string) (itmIDs []string) {
+// GetLastAccess returns when the item was last read, or last set if it was not read since.
+// Reads are recorded only with access tracking enabled
+func (c *Cache) GetLastAccess(itmID string) (lastAccess time.Time, has bool) {
 	c.RLock()
-	for itmID := range c.cache {
-		if strings.HasPrefix(itmID, prfx) {
-			itmIDs = append(itmIDs, itmID)
+	defer c.RUnlock()
+	ci, has := c.cache[itmID]
+	if !has {
+		return
+	}
+	if ci.lastAccess.IsZero() {
+		return ci.updateTime, true
+	}
+	return ci.lastAccess, true
+}
+
+// EvictIdle removes the items not read, or last set if never read, within idleFor. Returns the
+// number of items removed. Removes nothing with access tracking disabled, the reads not being
+// recorded
+func (c *Cache) EvictIdle(idleFor time.Duration) (evicted int) {
+	c.Lock()
+	defer c.Unlock()
+	if !c.trackAccess {
+		return
+	}
+	defer c.batchRemoves()()
+	now := c.now()
+	for itmID, ci := range c.cache {
+		lastAccess := ci.lastAccess
+		if lastAccess.IsZero() {
+			lastAccess = ci.updateTime
+		}
+		if now.Sub(lastAccess) >= idleFor {
+			c.remove(itmID, EvictionIdle)
+			evicted++
 		}
 	}
-	c.RUnlock()
 	return
 }
 
-// GroupLength returns the length of a group
-func (c *Cache) GroupLength(grpID string) int {
-	c.RLock()
-	defer c.RUnlock()
-	return len(c.groups[grpID])
+// SetMaxAge sets the maximum time an item is kept after it was first set, regardless of its
+// expiry being refreshed on get/set. Applies to the expiries computed afterwards
+func (c *Cache) SetMaxAge(maxAge time.Duration) {
+	c.Lock()
+	c.maxAge = maxAge
+	c.Unlock()
 }
 
-func (c *Cache) getGroupItemIDs(grpID string) (itmIDs []string) {
+// maxAgeExpiry returns expiryTime limited to the maximum age of ci, if maxAge is enabled
+func (c *Cache) maxAgeExpiry(ci *cachedItem, expiryTime time.Time) time.Time {
+	if c.maxAge <= 0 {
+		return expiryTime
+	}
+	if maxExpiry := ci.setTime.Add(c.maxAge); expiryTime.IsZero() || maxExpiry.Before(expiryTime) {
+		return maxExpiry
+	}
+	return expiryTime
+}
+
+// SetGroupTTL expires the items of the grpID group after ttl, including the ones added to the
+// group later, which inherit its remaining lifetime. The expiries of the items are only shortened,
+// the expired items being removed by the cleaner as on item expiry. A ttl of 0 or lower removes
+// the group expiry, the items keeping the expiries already set
+func (c *Cache) SetGroupTTL(grpID string, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	for expGrpID, expiryTime := range c.grpTTLs { // forget the groups already expired
+		if c.expired(expiryTime, now) {
+			delete(c.grpTTLs, expGrpID)
+		}
+	}
+	if ttl <= 0 {
+		delete(c.grpTTLs, grpID)
+		return
+	}
+	if c.grpTTLs == nil {
+		c.grpTTLs = make(map[string]time.Time)
+	}
+	c.grpTTLs[grpID] = now.Add(ttl)
 	for itmID := range c.groups[grpID] {
-		itmIDs = append(itmIDs, itmID)
+		ci := c.cache[itmID]
+		c.setExpiry(ci, ci.expiryTime, ci.staticExpiry)
+		c.storeSetEntity(context.Background(), itmID)
 	}
-	return
 }
 
-func (c *Cache) GetGroupItemIDs(grpID string) (itmIDs []string) {
-	c.RLock()
-	itmIDs = c.getGroupItemIDs(grpID)
-	c.RUnlock()
-	return
+// groupsExpiry returns expiryTime limited to the expiry of the groups of ci set by SetGroupTTL,
+// forgetting the group expiries passed (not thread safe)
+func (c *Cache) groupsExpiry(ci *cachedItem, expiryTime time.Time) time.Time {
+	if len(c.grpTTLs) == 0 {
+		return expiryTime
+	}
+	now := c.now()
+	for _, grpID := range ci.groupIDs {
+		grpExpiry, has := c.grpTTLs[grpID]
+		if !has {
+			continue
+		}
+		if c.expired(grpExpiry, now) { // the group expired before ci was added
+			delete(c.grpTTLs, grpID)
+			continue
+		}
+		if expiryTime.IsZero() || grpExpiry.Before(expiryTime) {
+			expiryTime = grpExpiry
+		}
+	}
+	return expiryTime
 }
 
-func (c *Cache) HasGroup(grpID string) (has bool) {
-	c.RLock()
+// expired returns true if expiryTime passed at now, taking into account clock skew tolerance
+func (c *Cache) expired(expiryTime, now time.Time) bool {
+	return !now.Before(expiryTime.Add(c.clockSkewTolerance))
+}
+
+// set sets/adds a value to the cache expiring at expiryTime, zero meaning never. staticExpiry
+// marks the expiry as item specific so it will not be refreshed based on the cache TTL
+func (c *Cache) set(itmID string, value any, grpIDs []string, tags map[string]string,
+	expiryTime time.Time, staticExpiry bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.maxEntries == DisabledCaching {
+		return
+	}
+	c.setItem(itmID, value, grpIDs, tags, expiryTime, staticExpiry)
+}
+
+// setItem sets/adds a value to the cache expiring at expiryTime and stores it in the
+// offline collector (not thread safe)
+func (c *Cache) setItem(itmID string, value any, grpIDs []string, tags map[string]string,
+	expiryTime time.Time, staticExpiry bool) {
+	c.setItemCtx(context.Background(), itmID, value, grpIDs, tags, expiryTime, staticExpiry)
+}
+
+// setItemCtx is setItem returning ctx.Err() if ctx is done before the item is written through
+// to the dump file, see storeSetEntity (not thread safe)
+func (c *Cache) setItemCtx(ctx context.Context, itmID string, value any, grpIDs []string,
+	tags map[string]string, expiryTime time.Time, staticExpiry bool) (err error) {
+	if !expiryTime.IsZero() && c.expired(expiryTime, c.now()) {
+		c.remove(itmID, EvictionExpired)
+		return
+	}
+	defer func() {
+		if _, has := c.cache[itmID]; !has { // evicted together with its group, removal already stored
+			return
+		}
+		c.notifyWatchers(itmID, EventSet, c.cache[itmID].value)
+		err = c.storeSetEntity(ctx, itmID)
+	}()
+	if ci, ok := c.cache[itmID]; ok {
+		ci.value = value
+		ci.updateTime = c.now()
+		c.remItemFromGroups(itmID, ci.groupIDs)
+		ci.groupIDs = grpIDs
+		c.addItemToGroups(itmID, grpIDs)
+		c.remItemFromTags(itmID, ci.tags)
+		ci.tags = tags
+		c.addItemToTags(itmID, tags)
+		c.resizeItem(ci)
+		if c.lruEnabled() { // update lru indexes
+			c.lruIdx.MoveToFront(c.lruRefs[itmID])
+		}
+		if staticExpiry || ci.staticExpiry ||
+			(c.ttl > 0 && !c.staticTTL) { // update ttl indexes
+			c.setExpiry(ci, expiryTime, staticExpiry)
+		} else if len(c.grpTTLs) != 0 { // the groups can be new
+			c.setExpiry(ci, ci.expiryTime, ci.staticExpiry)
+		}
+		if c.maxMemory > 0 && !c.evictionSuspended { // the new value can be bigger
+			c.evictOverCapacity(ci)
+		}
+		return
+	}
+	now := c.now()
+	ci := &cachedItem{itemID: itmID, value: value, groupIDs: grpIDs, setTime: now, updateTime: now, tags: tags}
+	c.cache[itmID] = ci
+	c.addItemToGroups(itmID, grpIDs)
+	c.addItemToTags(itmID, tags)
+	c.resizeItem(ci)
+	if c.lruEnabled() {
+		c.lruRefs[itmID] = c.lruIdx.PushFront(ci)
+	}
+	if c.lfuEnabled() {
+		ci.freq = 1
+		c.lfuAdd(ci)
+	}
+	c.setExpiry(ci, expiryTime, staticExpiry)
+	if c.lruEnabled() && !c.evictionSuspended {
+		c.evictOverCapacity(ci)
+	}
+	return
+}
+
+// storeSetEntity dumps the item set in cache on file or collects it, if there is an offCollector.
+// If ctx is done before writing the item it is collected instead and ctx.Err() returned (not thread safe)
+func (c *Cache) storeSetEntity(ctx context.Context, itmID string) error {
+	if c.offCollector == nil {
+		return nil
+	}
+	if c.offCollector.collectSetEntity || c.offCollector.degraded.Load() ||
+		c.offCollector.batchingSets { // if collectSet is true collect the itemID to write in dump later in the interval
+		c.offCollector.collect(itmID)
+		return nil
+	}
+	// if not write the item in dump instantly
+	c.offCollector.collMux.Lock()
+	defer c.offCollector.collMux.Unlock()
+	if c.offCollector.coalesce(itmID, c.dumpCoalesced) { // dumped at the end of the window
+		c.offCollector.collection[itmID] = &CollectionEntity{IsSet: true, ItemID: itmID}
+		return nil
+	}
+	if err := c.offCollector.writeEntity(ctx, &OfflineCacheEntity{
+		IsSet:      true,
+		ItemID:     itmID,
+		Value:      c.cache[itmID].value,
+		ExpiryTime: c.cache[itmID].expiryTime,
+		GroupIDs:   c.cache[itmID].groupIDs,
+		Tags:       c.cache[itmID].tags,
+	}); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) { // nothing written, dumped with the collection
+			c.offCollector.collection[itmID] = &CollectionEntity{IsSet: true, ItemID: itmID}
+			return err
+		}
+		c.offCollector.log().Err(err.Error())
+		return nil
+	}
+	delete(c.offCollector.collection, itmID) // collected by an earlier aborted write, now dumped
+	return nil
+}
+
+// lruEnabled returns true if the recency of the items is indexed, needed to evict over
+// maxEntries or maxMemory
+func (c *Cache) lruEnabled() bool {
+	return c.maxEntries != UnlimitedCaching || c.maxMemory > 0
+}
+
+// evictOverCapacity evicts the least recently used items once the cache grows over maxEntries,
+// down to lowWaterMark if set, and while the items are estimated over maxMemory. The set item
+// is evicted last, if not nil (not thread safe)
+func (c *Cache) evictOverCapacity(set *cachedItem) {
+	if c.maxEntries != UnlimitedCaching && c.lruIdx.Len() > c.maxEntries {
+		target := c.maxEntries
+		if c.lowWaterMark > 0 && c.lowWaterMark < c.maxEntries {
+			target = c.lowWaterMark
+		}
+		for c.lruIdx.Len() > target {
+			c.evict(c.evictionCandidate(set))
+		}
+	}
+	for c.maxMemory > 0 && c.usedBytes > c.maxMemory && c.lruIdx.Len() != 0 {
+		c.evict(c.evictionCandidate(set))
+	}
+}
+
+// evictionCandidate returns the next item to evict on capacity reasons: the least frequently read
+// with PolicyLFU, the least recently used otherwise. keep, the item just set, is returned only if
+// alone in cache, not being evicted for having no reads yet. The cache must not be empty (not thread safe)
+func (c *Cache) evictionCandidate(keep *cachedItem) *cachedItem {
+	if !c.lfuEnabled() { // keep is the most recently used
+		return c.lruIdx.Back().Value.(*cachedItem)
+	}
+	freq := c.lfuMin()
+	lElm := c.lfuIdx[freq].Back()
+	if lElm.Value.(*cachedItem) != keep || len(c.lfuRefs) == 1 {
+		return lElm.Value.(*cachedItem)
+	}
+	if prev := lElm.Prev(); prev != nil {
+		return prev.Value.(*cachedItem)
+	}
+	var next int64 // keep alone with the lowest frequency, take the next one
+	for f := range c.lfuIdx {
+		if f > freq && (next == 0 || f < next) {
+			next = f
+		}
+	}
+	return c.lfuIdx[next].Back().Value.(*cachedItem)
+}
+
+// SetEvictionPolicy selects the items evicted when the cache grows over maxEntries or maxMemory
+func (c *Cache) SetEvictionPolicy(policy EvictionPolicy) {
+	c.Lock()
+	c.evictionPolicy = policy
+	c.rebuildLFU()
+	c.Unlock()
+}
+
+// lfuEnabled returns true if the frequency of the items is indexed (not thread safe)
+func (c *Cache) lfuEnabled() bool {
+	return c.evictionPolicy == PolicyLFU && c.lruEnabled()
+}
+
+// rebuildLFU indexes again the frequency of the items, after changing the eviction settings
+// (not thread safe)
+func (c *Cache) rebuildLFU() {
+	c.lfuIdx, c.lfuRefs, c.lfuMinFreq = nil, nil, 0
+	if !c.lfuEnabled() {
+		return
+	}
+	for _, ci := range c.cache {
+		ci.freq = max(ci.freq, 1)
+		c.lfuAdd(ci)
+	}
+}
+
+// lfuAdd indexes ci under its frequency, as the most recently used (not thread safe)
+func (c *Cache) lfuAdd(ci *cachedItem) {
+	if c.lfuIdx == nil {
+		c.lfuIdx = make(map[int64]*list.List)
+		c.lfuRefs = make(map[string]*list.Element)
+	}
+	freqList, has := c.lfuIdx[ci.freq]
+	if !has {
+		freqList = list.New()
+		c.lfuIdx[ci.freq] = freqList
+	}
+	c.lfuRefs[ci.itemID] = freqList.PushFront(ci)
+	if c.lfuMinFreq == 0 || ci.freq < c.lfuMinFreq {
+		c.lfuMinFreq = ci.freq
+	}
+}
+
+// lfuRemove takes ci out of the frequency index (not thread safe)
+func (c *Cache) lfuRemove(ci *cachedItem) {
+	lElm, has := c.lfuRefs[ci.itemID]
+	if !has {
+		return
+	}
+	freqList := c.lfuIdx[ci.freq]
+	freqList.Remove(lElm)
+	if freqList.Len() == 0 {
+		delete(c.lfuIdx, ci.freq)
+	}
+	delete(c.lfuRefs, ci.itemID)
+}
+
+// lfuMin returns the lowest frequency indexed, 0 if none (not thread safe)
+func (c *Cache) lfuMin() int64 {
+	if _, has := c.lfuIdx[c.lfuMinFreq]; !has { // list emptied, find the next one
+		c.lfuMinFreq = 0
+		for freq := range c.lfuIdx {
+			if c.lfuMinFreq == 0 || freq < c.lfuMinFreq {
+				c.lfuMinFreq = freq
+			}
+		}
+	}
+	return c.lfuMinFreq
+}
+
+// resizeItem updates the estimated size of ci after setting its value (not thread safe)
+func (c *Cache) resizeItem(ci *cachedItem) {
+	c.usedBytes -= ci.size
+	ci.size = c.itemSize(ci)
+	c.usedBytes += ci.size
+}
+
+// SetMaxMemory evicts the least recently used items while the estimated bytes of the items are
+// over maxMemory, checked on each set. Values not implementing CacheSizer, nor strings or byte
+// slices, are estimated at defaultItemSize bytes if positive. A maxMemory of 0 disables the limit
+func (c *Cache) SetMaxMemory(maxMemory, defaultItemSize int64) {
+	c.Lock()
+	defer c.Unlock()
+	wasIndexed := c.lruEnabled()
+	c.maxMemory, c.defaultItemSize = max(maxMemory, 0), defaultItemSize
+	c.usedBytes = 0
+	for _, ci := range c.cache {
+		ci.size = 0
+		c.resizeItem(ci)
+	}
+	c.reindexEviction(wasIndexed)
+}
+
+// SetMaxItems changes the maximum number of items at runtime, evicting at once the items over
+// the new limit as on set. Switching from or to DisabledCaching keeps the items already cached
+func (c *Cache) SetMaxItems(maxItems int) {
+	c.Lock()
+	defer c.Unlock()
+	wasIndexed := c.lruEnabled()
+	c.maxEntries = maxItems
+	c.reindexEviction(wasIndexed)
+}
+
+// reindexEviction updates the eviction indexes after changing the limits of the cache, wasIndexed
+// telling if the recency of the items was indexed before, and evicts the items over the limits
+// (not thread safe)
+func (c *Cache) reindexEviction(wasIndexed bool) {
+	switch {
+	case !wasIndexed && c.lruEnabled(): // recency unknown, index the items in any order
+		for itmID, ci := range c.cache {
+			c.lruRefs[itmID] = c.lruIdx.PushFront(ci)
+		}
+	case wasIndexed && !c.lruEnabled():
+		c.lruIdx = c.lruIdx.Init()
+		c.lruRefs = make(map[string]*list.Element)
+	}
+	c.rebuildLFU()
+	if c.lruEnabled() && !c.evictionSuspended {
+		c.evictOverCapacity(nil)
+	}
+}
+
+// SetTTL changes at runtime the ttl of the items set from now on. Without staticTTL the ttl also
+// applies to the items accessed from now on, the expiries already set being kept until then
+func (c *Cache) SetTTL(ttl time.Duration, staticTTL bool) {
+	c.Lock()
+	defer c.Unlock()
+	if ttl > 0 && c.ttl <= 0 {
+		c.wakeCleaner() // started before ttl is changed, if not running
+	}
+	c.ttl, c.staticTTL = ttl, staticTTL
+}
+
+// SetLowWaterMark makes the cache evict down to lowWaterMark items in one batch once it
+// grows over maxEntries, instead of evicting one item on each set. Values not between 0
+// and maxEntries disable it
+func (c *Cache) SetLowWaterMark(lowWaterMark int) {
+	c.Lock()
+	c.lowWaterMark = lowWaterMark
+	c.Unlock()
+}
+
+// SetGroupAtomicEviction makes evicting an item on capacity reasons also evict all the items
+// sharing a group with it, directly or through other groups, so groups are never left partially
+// cached. Evicting a group can take the cache well under maxEntries, including the item just set
+func (c *Cache) SetGroupAtomicEviction(enabled bool) {
+	c.Lock()
+	c.groupAtomicEviction = enabled
+	c.Unlock()
+}
+
+// evict removes ci on capacity reasons, together with its group siblings if
+// groupAtomicEviction is enabled. Returns the items removed
+func (c *Cache) evict(ci *cachedItem) (evicted []*cachedItem) {
+	evicted = []*cachedItem{ci}
+	if c.groupAtomicEviction {
+		queued := map[string]struct{}{ci.itemID: {}}
+		for i := 0; i < len(evicted); i++ { // evicted grows while walking the groups
+			for _, grpID := range evicted[i].groupIDs {
+				for itmID := range c.groups[grpID] {
+					if _, has := queued[itmID]; !has {
+						queued[itmID] = struct{}{}
+						evicted = append(evicted, c.cache[itmID])
+					}
+				}
+			}
+		}
+	}
+	for _, ci := range evicted {
+		c.remove(ci.itemID, EvictionCapacity)
+	}
+	return
+}
+
+// SuspendEviction allows the cache to grow over maxEntries, so bulk loads bigger than the
+// limit do not evict their own items, until ResumeEviction is called
+func (c *Cache) SuspendEviction() {
+	c.Lock()
+	c.evictionSuspended = true
+	c.Unlock()
+}
+
+// ResumeEviction restores the maxEntries limit, evicting at once the least recently used
+// items exceeding it
+func (c *Cache) ResumeEviction() {
+	c.Lock()
+	defer c.Unlock()
+	c.evictionSuspended = false
+	if !c.lruEnabled() {
+		return
+	}
+	c.evictOverCapacity(nil)
+}
+
+// setExpiry sets the expiryTime of ci and updates the ttl indexes. A zero expiryTime
+// means ci never expires so it is taken out of ttl indexes
+func (c *Cache) setExpiry(ci *cachedItem, expiryTime time.Time, staticExpiry bool) {
+	ci.staticExpiry = staticExpiry
+	ci.expiryTime = c.groupsExpiry(ci, c.maxAgeExpiry(ci, expiryTime))
+	if ci.expiryTime.IsZero() {
+		c.ttlIdx.remove(ci.itemID)
+		return
+	}
+	c.ttlIdx.index(ci)
+	if c.ttlIdx.first() == ci { // first to expire, make sure cleanExpired knows about it
+		c.wakeCleaner()
+	}
+}
+
+// ttlHeap indexes the expiring items in a min-heap ordered by expiryTime, implementing
+// heap.Interface. Items expiring after all the indexed ones, as with a uniform ttl, are
+// appended with a single comparison
+type ttlHeap struct {
+	items []*cachedItem
+	refs  map[string]int // position of the items inside items, based on their key in cache
+}
+
+// newTTLHeap returns an empty ttlHeap
+func newTTLHeap() *ttlHeap {
+	return &ttlHeap{refs: make(map[string]int)}
+}
+
+func (h *ttlHeap) Len() int { return len(h.items) }
+
+func (h *ttlHeap) Less(i, j int) bool {
+	return h.items[i].expiryTime.Before(h.items[j].expiryTime)
+}
+
+func (h *ttlHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.refs[h.items[i].itemID] = i
+	h.refs[h.items[j].itemID] = j
+}
+
+func (h *ttlHeap) Push(x any) {
+	ci := x.(*cachedItem)
+	h.refs[ci.itemID] = len(h.items)
+	h.items = append(h.items, ci)
+}
+
+func (h *ttlHeap) Pop() any {
+	last := len(h.items) - 1
+	ci := h.items[last]
+	h.items[last] = nil // not kept alive by the backing array
+	h.items = h.items[:last]
+	delete(h.refs, ci.itemID)
+	return ci
+}
+
+// first returns the item expiring first, nil if none is indexed
+func (h *ttlHeap) first() *cachedItem {
+	if len(h.items) == 0 {
+		return nil
+	}
+	return h.items[0]
+}
+
+// index adds ci to the heap or repositions it after its expiryTime changed
+func (h *ttlHeap) index(ci *cachedItem) {
+	if pos, has := h.refs[ci.itemID]; has {
+		heap.Fix(h, pos)
+		return
+	}
+	heap.Push(h, ci)
+}
+
+// remove takes the item with itmID out of the heap, if indexed
+func (h *ttlHeap) remove(itmID string) {
+	if pos, has := h.refs[itmID]; has {
+		heap.Remove(h, pos)
+	}
+}
+
+// rename moves the position of the item indexed as oldID under newID
+func (h *ttlHeap) rename(oldID, newID string) {
+	if pos, has := h.refs[oldID]; has {
+		delete(h.refs, oldID)
+		h.refs[newID] = pos
+	}
+}
+
+// wakeCleaner starts cleanExpired if not already running and signals it to recheck the
+// ttl index (not thread safe)
+func (c *Cache) wakeCleaner() {
+	if c.ttlWake == nil {
+		c.ttlWake = make(chan struct{}, 1)
+		if c.cleanerStop == nil { // not built by NewCache
+			c.cleanerStop = make(chan struct{})
+		}
+		if c.ttl <= 0 && !c.cleanerStopped() { // cleanExpired not started on construct
+			go c.cleanExpired()
+		}
+	}
+	select {
+	case c.ttlWake <- struct{}{}:
+	default: // already signaled
+	}
+}
+
+// CommitResult holds the number of changes applied by a batch
+type CommitResult struct {
+	Set     int // number of items set
+	Removed int // number of items found and removed
+}
+
+// CommitBatch applies removes followed by sets, attaching groupIDs to the items set, in one
+// lock acquisition
+func (c *Cache) CommitBatch(sets map[string]any, removes []string, groupIDs []string) (cr CommitResult) {
+	c.Lock()
+	defer c.Unlock()
+	endBatch := c.batchRemoves()
+	for _, itmID := range removes {
+		if _, has := c.cache[itmID]; has {
+			c.remove(itmID, EvictionRemoved)
+			cr.Removed++
+		}
+	}
+	endBatch()
+	if c.maxEntries == DisabledCaching {
+		return
+	}
+	for itmID, value := range sets {
+		c.setItem(itmID, value, groupIDs, nil, c.ttlExpiry(c.now()), false)
+		cr.Set++
+	}
+	return
+}
+
+// SetMulti sets the items attached to groupIDs in one lock acquisition, dumping them in one pass
+func (c *Cache) SetMulti(items map[string]any, groupIDs []string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.maxEntries == DisabledCaching {
+		return
+	}
+	endBatch := c.batchSets()
+	defer endBatch()
+	for itmID, value := range items {
+		c.setItem(itmID, value, groupIDs, nil, c.ttlExpiry(c.now()), false)
+	}
+}
+
+// Remove removes the provided key from the cache.
+func (c *Cache) Remove(itmID string) {
+	c.Lock()
+	c.remove(itmID, EvictionRemoved)
+	c.Unlock()
+}
+
+// RemoveMatching removes, under the cache lock, the items for which pred returns true, running
+// the eviction functions and storing the removals as on Remove. pred must not call back into the
+// cache. Returns the number of items removed
+func (c *Cache) RemoveMatching(pred func(itmID string, value any) bool) (removed int) {
+	c.Lock()
+	defer c.Unlock()
+	defer c.batchRemoves()()
+	for itmID, ci := range c.cache {
+		if pred(itmID, ci.value) {
+			c.remove(itmID, EvictionRemoved)
+			removed++
+		}
+	}
+	return
+}
+
+// RemoveOlderThan removes the items not set or updated within age, running the eviction
+// functions and storing the removals as on Remove. Returns the number of items removed
+func (c *Cache) RemoveOlderThan(age time.Duration) (removed int) {
+	c.Lock()
+	defer c.Unlock()
+	defer c.batchRemoves()()
+	oldest := c.now().Add(-age)
+	for itmID, ci := range c.cache {
+		if ci.updateTime.Before(oldest) {
+			c.remove(itmID, EvictionRemoved)
+			removed++
+		}
+	}
+	return
+}
+
+// ExpireNow removes the items expired at the time of the clock of the cache, without waiting for
+// the cleaner, which sleeps on real time. Meant to evict the items expired after advancing a Clock.
+// Returns the number of items removed
+func (c *Cache) ExpireNow() (removed int) {
+	c.Lock()
+	defer c.Unlock()
+	defer c.batchRemoves()()
+	now := c.now()
+	for c.ttlIdx.Len() != 0 && c.expired(c.ttlIdx.first().expiryTime, now) {
+		c.remove(c.ttlIdx.first().itemID, EvictionExpired)
+		removed++
+	}
+	return
+}
+
+// Rename moves the oldID item to newID keeping its groups, tags, expiry and position in the
+// eviction indexes. An item already cached as newID is removed as on Remove. The offline
+// collector stores the removal of oldID and the set of newID. Returns false if oldID is not cached
+func (c *Cache) Rename(oldID, newID string) bool {
+	c.Lock()
+	defer c.Unlock()
+	ci, has := c.cache[oldID]
+	if !has || (!ci.expiryTime.IsZero() && c.expired(ci.expiryTime, c.now())) {
+		return false
+	}
+	if oldID == newID {
+		return true
+	}
+	c.remove(newID, EvictionRemoved)
+	c.remItemFromGroups(oldID, ci.groupIDs)
+	c.remItemFromTags(oldID, ci.tags)
+	delete(c.cache, oldID)
+	ci.itemID = newID
+	c.cache[newID] = ci
+	c.addItemToGroups(newID, ci.groupIDs)
+	c.addItemToTags(newID, ci.tags)
+	for _, refs := range []map[string]*list.Element{c.lruRefs, c.lfuRefs} {
+		if lElm, has := refs[oldID]; has {
+			delete(refs, oldID)
+			refs[newID] = lElm
+		}
+	}
+	c.ttlIdx.rename(oldID, newID)
+	c.resizeItem(ci) // the key is accounted too
+	c.notifyWatchers(oldID, EventRemove, ci.value)
+	c.notifyWatchers(newID, EventSet, ci.value)
+	if c.offCollector != nil && !c.dumpDropped {
+		c.offCollector.storeRemoveEntity(oldID)
+		c.storeSetEntity(context.Background(), newID)
+	}
+	if c.maxMemory > 0 && !c.evictionSuspended { // the longer key can go over maxMemory, the
+		c.evictOverCapacity(nil) // item keeping its recency
+	}
+	return true
+}
+
+// GetItemIDs returns a list of items matching prefix
+func (c *Cache) GetItemIDs(prfx string) (itmIDs []string) {
+	c.RLock()
+	for itmID := range c.cache {
+		if strings.HasPrefix(itmID, prfx) {
+			itmIDs = append(itmIDs, itmID)
+		}
+	}
+	c.RUnlock()
+	return
+}
+
+// rangeItems calls fn for each item not expired, with its value cloned as on Get, while holding
+// the read lock, stopping when fn returns false. Returns false if the iteration was stopped by fn
+func (c *Cache) rangeItems(fn func(itmID string, value any) bool) bool {
+	c.RLock()
+	defer c.RUnlock()
+	now := c.now()
+	for itmID, ci := range c.cache {
+		if !ci.expiryTime.IsZero() && c.expired(ci.expiryTime, now) {
+			continue
+		}
+		if !fn(itmID, c.cloned(ci.value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ForEach calls fn for each item not expired, under the read lock so the items are seen as in a
+// snapshot, stopping when fn returns false. Values are cloned as on Get. fn must not call back
+// into the cache, which would deadlock
+func (c *Cache) ForEach(fn func(itmID string, value any) bool) {
+	c.rangeItems(fn)
+}
+
+// GetItemIDsPage returns limit item IDs matching prefix, sorted and starting from offset,
+// together with the total number of matching items. A limit lower than 1 returns all the
+// items after offset
+func (c *Cache) GetItemIDsPage(prfx string, offset, limit int) (itmIDs []string, total int) {
+	itmIDs = c.GetItemIDs(prfx)
+	total = len(itmIDs)
+	if offset >= total {
+		return nil, total
+	}
+	slices.Sort(itmIDs)
+	itmIDs = itmIDs[max(offset, 0):]
+	if limit > 0 && limit < len(itmIDs) {
+		itmIDs = itmIDs[:limit]
+	}
+	return
+}
+
+// GroupLength returns the length of a group
+func (c *Cache) GroupLength(grpID string) int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.groups[grpID])
+}
+
+// GetGroupStats returns the number of items of each group
+func (c *Cache) GetGroupStats() (grpStats map[string]int) {
+	c.RLock()
+	defer c.RUnlock()
+	grpStats = make(map[string]int, len(c.groups))
+	for grpID, itmIDs := range c.groups {
+		grpStats[grpID] = len(itmIDs)
+	}
+	return
+}
+
+func (c *Cache) getGroupItemIDs(grpID string) (itmIDs []string) {
+	for itmID := range c.groups[grpID] {
+		itmIDs = append(itmIDs, itmID)
+	}
+	return
+}
+
+func (c *Cache) GetGroupItemIDs(grpID string) (itmIDs []string) {
+	c.RLock()
+	itmIDs = c.getGroupItemIDs(grpID)
+	c.RUnlock()
+	return
+}
+
+// GetItemGroups returns a copy of the groups of an item, nil if the item is not cached
+func (c *Cache) GetItemGroups(itmID string) []string {
+	c.RLock()
+	defer c.RUnlock()
+	if ci, has := c.cache[itmID]; has {
+		return slices.Clone(ci.groupIDs)
+	}
+	return nil
+}
+
+// AddToGroup adds an item to the grpID group without setting its value again, storing the new
+// groups in the offline collector. Returns false if the item is not cached
+func (c *Cache) AddToGroup(itmID, grpID string) bool {
+	c.Lock()
+	defer c.Unlock()
+	ci, has := c.cache[itmID]
+	if !has || (!ci.expiryTime.IsZero() && c.expired(ci.expiryTime, c.now())) {
+		return false
+	}
+	if slices.Contains(ci.groupIDs, grpID) {
+		return true
+	}
+	ci.groupIDs = append(slices.Clone(ci.groupIDs), grpID) // the slice can be shared with the caller of Set
+	c.addItemToGroups(itmID, []string{grpID})
+	if _, has := c.grpTTLs[grpID]; has {
+		c.setExpiry(ci, ci.expiryTime, ci.staticExpiry)
+	}
+	c.storeSetEntity(context.Background(), itmID)
+	return true
+}
+
+// RemoveFromGroup removes an item from the grpID group without setting its value again, storing
+// the new groups in the offline collector. Returns false if the item is not cached
+func (c *Cache) RemoveFromGroup(itmID, grpID string) bool {
+	c.Lock()
+	defer c.Unlock()
+	ci, has := c.cache[itmID]
+	if !has || (!ci.expiryTime.IsZero() && c.expired(ci.expiryTime, c.now())) {
+		return false
+	}
+	idx := slices.Index(ci.groupIDs, grpID)
+	if idx == -1 {
+		return true
+	}
+	ci.groupIDs = slices.Delete(slices.Clone(ci.groupIDs), idx, idx+1)
+	c.remItemFromGroups(itmID, []string{grpID})
+	c.storeSetEntity(context.Background(), itmID)
+	return true
+}
+
+func (c *Cache) HasGroup(grpID string) (has bool) {
+	c.RLock()
 	_, has = c.groups[grpID]
 	c.RUnlock()
 	return
@@ -244,57 +1517,518 @@ func (c *Cache) GetGroupItems(grpID string) (itms []any) {
 		itm, _ := c.Get(itmID)
 		itms = append(itms, itm)
 	}
-	return
-}
-
-func (c *Cache) RemoveGroup(grpID string) {
-	c.Lock()
-	for itmID := range c.groups[grpID] {
-		c.remove(itmID)
+	return
+}
+
+func (c *Cache) RemoveGroup(grpID string) {
+	c.RemoveGroups(grpID)
+}
+
+// RemoveGroups removes the items of all grpIDs groups under one lock, batching their removal
+// in the offline collector
+func (c *Cache) RemoveGroups(grpIDs ...string) {
+	c.Lock()
+	defer c.Unlock()
+	defer c.batchRemoves()()
+	for _, grpID := range grpIDs {
+		for itmID := range c.groups[grpID] {
+			c.remove(itmID, EvictionGroup)
+		}
+	}
+}
+
+// UpdateGroup calls fn for each item of the grpID group, under the cache lock, storing the value
+// returned if ok. Updated items keep their groups and tags and are dumped as on Set. fn must not
+// call back into the cache. Returns the number of items updated, stopping at the first value
+// failing encoding when the offline collector validates values
+func (c *Cache) UpdateGroup(grpID string, fn func(itmID string, old any) (value any, ok bool)) (updated int, err error) {
+	c.Lock()
+	defer c.Unlock()
+	itmIDs := make([]string, 0, len(c.groups[grpID])) // setting changes the group while ranging
+	for itmID := range c.groups[grpID] {
+		itmIDs = append(itmIDs, itmID)
+	}
+	now := c.now()
+	for _, itmID := range itmIDs {
+		ci := c.cache[itmID]
+		if !ci.expiryTime.IsZero() && c.expired(ci.expiryTime, now) {
+			continue
+		}
+		value, ok := fn(itmID, ci.value)
+		if !ok {
+			continue
+		}
+		if err = c.checkEncodable(itmID, value); err != nil {
+			return
+		}
+		c.updateItem(ci, value, now)
+		updated++
+	}
+	return
+}
+
+// updateItem replaces the value of ci keeping its groups and tags, refreshing its TTL unless its
+// expiry is static (not thread safe)
+func (c *Cache) updateItem(ci *cachedItem, value any, now time.Time) {
+	expiryTime, staticExpiry := ci.expiryTime, ci.staticExpiry
+	if !staticExpiry && c.ttl > 0 {
+		expiryTime = now.Add(c.ttl)
+	}
+	c.setItem(ci.itemID, value, ci.groupIDs, ci.tags, expiryTime, staticExpiry)
+}
+
+// CompareAndSwap replaces the value of an item with newVal only if the current one is deeply
+// equal to oldVal, returning true if swapped. A newVal which cannot be dumped is not swapped
+func (c *Cache) CompareAndSwap(itmID string, oldVal, newVal any) bool {
+	c.Lock()
+	defer c.Unlock()
+	ci, has := c.cache[itmID]
+	if !has {
+		return false
+	}
+	now := c.now()
+	if (!ci.expiryTime.IsZero() && c.expired(ci.expiryTime, now)) ||
+		!reflect.DeepEqual(ci.value, oldVal) {
+		return false
+	}
+	if err := c.checkEncodable(itmID, newVal); err != nil {
+		c.offCollector.log().Err(err.Error())
+		return false
+	}
+	c.updateItem(ci, newVal, now)
+	return true
+}
+
+// batchRemoves makes the offline collector buffer the removes stored until the returned
+// function is called, writing them in batches of removeBatchSize when dumping on each
+// change. Used by bulk removals to avoid flushing each remove (not thread safe)
+func (c *Cache) batchRemoves() (endBatch func()) {
+	if c.offCollector == nil || c.offCollector.dumpInterval != -1 ||
+		c.offCollector.removeBatchSize <= 1 {
+		return func() {}
+	}
+	c.offCollector.batchingRemoves = true
+	return c.offCollector.endRemoveBatch
+}
+
+// batchSets makes the items set until endBatch is called be collected, dumping them in one pass
+// at the end of the batch when dumping on each change (not thread safe)
+func (c *Cache) batchSets() (endBatch func()) {
+	if c.offCollector == nil || c.offCollector.dumpInterval != -1 {
+		return func() {}
+	}
+	c.offCollector.batchingSets = true
+	return func() {
+		c.offCollector.batchingSets = false
+		c.offCollector.collMux.Lock()
+		defer c.offCollector.collMux.Unlock()
+		if c.offCollector.degraded.Load() { // dumped by Flush
+			return
+		}
+		if err := c.writeCollection(context.Background()); err != nil {
+			c.offCollector.log().Err(err.Error())
+		}
+	}
+}
+
+// CompactGroups removes empty groups and reallocates the groups index to its current size,
+// releasing the memory kept by maps which grew and shrunk afterwards
+func (c *Cache) CompactGroups() {
+	c.Lock()
+	defer c.Unlock()
+	groups := make(map[string]map[string]struct{}, len(c.groups))
+	for grpID, itmIDs := range c.groups {
+		if len(itmIDs) == 0 {
+			continue
+		}
+		grp := make(map[string]struct{}, len(itmIDs))
+		for itmID := range itmIDs {
+			grp[itmID] = struct{}{}
+		}
+		groups[grpID] = grp
+	}
+	c.groups = groups
+}
+
+// remove completely removes an Element from the cache
+func (c *Cache) remove(itmID string, reason EvictionReason) {
+	ci, has := c.cache[itmID]
+	if !has {
+		return
+	}
+	if c.lruEnabled() {
+		c.lruIdx.Remove(c.lruRefs[itmID])
+		delete(c.lruRefs, itmID)
+	}
+	if c.lfuEnabled() {
+		c.lfuRemove(ci)
+	}
+	c.usedBytes -= ci.size
+	c.ttlIdx.remove(itmID)
+	c.remItemFromGroups(ci.itemID, ci.groupIDs)
+	c.remItemFromTags(ci.itemID, ci.tags)
+	delete(c.cache, ci.itemID)
+	c.evicted(ci, reason)
+}
+
+// evicted runs the onEvicted functions for the removed ci, publishes it on the eviction
+// channels and stores the removal in offCollector if there is one
+func (c *Cache) evicted(ci *cachedItem, reason EvictionReason) {
+	for _, onEvicted := range c.onEvicted {
+		onEvicted(ci.itemID, ci.value)
+	}
+	if c.onEvictedReason != nil {
+		c.onEvictedReason(ci.itemID, ci.value, reason)
+	}
+	switch reason {
+	case EvictionExpired, EvictionCapacity, EvictionIdle:
+		c.evictions++
+		c.notifyWatchers(ci.itemID, EventEvict, ci.value)
+	default:
+		c.notifyWatchers(ci.itemID, EventRemove, ci.value)
+	}
+	for _, evCh := range c.evictionChans {
+		select {
+		case evCh <- EvictionEvent{ItemID: ci.itemID, Value: ci.value, Reason: reason}:
+		default: // never block the cache on slow consumers
+			c.evictionsDropped++
+		}
+	}
+	if c.offCollector != nil && !c.dumpDropped {
+		c.offCollector.storeRemoveEntity(ci.itemID)
+	}
+}
+
+// SetOnEvicted replaces the functions executed when an item is removed from cache.
+// Storing the removal for the offline collector is not affected
+func (c *Cache) SetOnEvicted(onEvicted ...func(itmID string, value any)) {
+	c.Lock()
+	c.onEvicted = append([]func(itmID string, value any){}, onEvicted...)
+	c.Unlock()
+}
+
+// SetOnEvictedReason replaces the function executed, after the OnEvicted ones, when an item is
+// removed from cache, receiving the reason of the removal. nil disables it
+func (c *Cache) SetOnEvictedReason(onEvicted func(itmID string, value any, reason EvictionReason)) {
+	c.Lock()
+	c.onEvictedReason = onEvicted
+	c.Unlock()
+}
+
+// EvictionChannel returns a channel with buffer size receiving the items removed from cache.
+// Events are dropped if the buffer is full. The channel is closed on Shutdown
+func (c *Cache) EvictionChannel(buffer int) <-chan EvictionEvent {
+	evCh := make(chan EvictionEvent, buffer)
+	c.Lock()
+	c.evictionChans = append(c.evictionChans, evCh)
+	c.Unlock()
+	return evCh
+}
+
+// closeEvictionChannels closes the channels returned by EvictionChannel and Watch
+func (c *Cache) closeEvictionChannels() {
+	c.Lock()
+	for _, evCh := range c.evictionChans {
+		close(evCh)
+	}
+	c.evictionChans = nil
+	for w := range c.watchers {
+		close(w.ch)
+	}
+	c.watchers = nil
+	c.Unlock()
+}
+
+// Watch returns a channel receiving the changes of the itmIDs items, all if none given, together
+// with the function unsubscribing and closing the channel. Events are delivered without blocking
+// the cache, being dropped with a warning when the channel buffer is full. The channel is also
+// closed on Shutdown
+func (c *Cache) Watch(itmIDs ...string) (<-chan CacheEvent, func()) {
+	w := &watcher{ch: make(chan CacheEvent, watchBufferSize)}
+	if len(itmIDs) != 0 {
+		w.itmIDs = make(map[string]struct{}, len(itmIDs))
+		for _, itmID := range itmIDs {
+			w.itmIDs[itmID] = struct{}{}
+		}
+	}
+	c.Lock()
+	if c.watchers == nil {
+		c.watchers = make(map[*watcher]struct{})
+	}
+	c.watchers[w] = struct{}{}
+	c.Unlock()
+	return w.ch, func() {
+		c.Lock()
+		defer c.Unlock()
+		if _, has := c.watchers[w]; has { // not already closed on Shutdown
+			delete(c.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+// notifyWatchers sends the change of an item to the watchers interested in it (not thread safe)
+func (c *Cache) notifyWatchers(itmID string, kind CacheEventKind, value any) {
+	for w := range c.watchers {
+		if w.itmIDs != nil {
+			if _, watched := w.itmIDs[itmID]; !watched {
+				continue
+			}
+		}
+		select {
+		case w.ch <- CacheEvent{ItemID: itmID, Kind: kind, Value: value}:
+		default: // never block the cache on slow consumers
+			c.watchEventsDropped++
+			if c.offCollector != nil {
+				c.offCollector.log().Warning(fmt.Sprintf("watch event of item <%s> dropped, channel full", itmID))
+			}
+		}
+	}
+}
+
+// itemSize estimates the memory used by ci in bytes. Values not implementing CacheSizer, nor
+// strings or byte slices, account for defaultItemSize if set, otherwise for their interface header
+func (c *Cache) itemSize(ci *cachedItem) (size int64) {
+	size = int64(len(ci.itemID))
+	switch v := ci.value.(type) {
+	case CacheSizer:
+		size += v.CacheSize()
+	case string:
+		size += int64(len(v))
+	case []byte:
+		size += int64(len(v))
+	default:
+		if c.defaultItemSize > 0 {
+			return size + c.defaultItemSize
+		}
+		size += int64(unsafe.Sizeof(ci.value))
+	}
+	return
+}
+
+// UsedBytes returns the estimated memory used by the items in cache
+func (c *Cache) UsedBytes() int64 {
+	c.RLock()
+	defer c.RUnlock()
+	return c.usedBytes
+}
+
+// ReclaimMemory evicts items until at least targetBytes are released, starting with the
+// least recently used ones or, without LRU indexes, with the ones expiring first.
+// Meant to be called on memory pressure signals, returns the estimated number of bytes reclaimed
+func (c *Cache) ReclaimMemory(targetBytes int64) (reclaimed int64) {
+	c.Lock()
+	defer c.Unlock()
+	defer c.batchRemoves()()
+	for reclaimed < targetBytes && len(c.cache) != 0 {
+		var ci *cachedItem
+		switch {
+		case c.lruEnabled():
+			ci = c.evictionCandidate(nil)
+		case c.ttlIdx.Len() != 0:
+			ci = c.ttlIdx.first()
+		default: // no order kept, any item
+			for _, ci = range c.cache {
+				break
+			}
+		}
+		for _, ci := range c.evict(ci) {
+			reclaimed += ci.size
+		}
+	}
+	return
+}
+
+// cleanExpired checks items indexed for TTL and expires them when necessary
+func (c *Cache) cleanExpired() {
+	for {
+		c.Lock()
+		wait := c.ttl // nothing indexed, check again after ttl
+		if c.ttlIdx.Len() != 0 {
+			ci := c.ttlIdx.first()
+			now := c.now()
+			if c.expired(ci.expiryTime, now) {
+				c.remove(ci.itemID, EvictionExpired)
+				c.Unlock()
+				continue
+			}
+			wait = ci.expiryTime.Add(c.clockSkewTolerance).Sub(now)
+		}
+		wake, stop := c.ttlWake, c.cleanerStop
+		c.Unlock()
+		if wait <= 0 { // only item specific expiries, wait for one to be indexed
+			select {
+			case <-wake:
+			case <-stop:
+				return
+			}
+			continue
+		}
+		select {
+		case <-time.After(wait):
+		case <-wake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stopCleaner stops cleanExpired, the expired items being removed only when looked up from then on
+func (c *Cache) stopCleaner() {
+	c.Lock()
+	if c.cleanerStop == nil { // not built by NewCache
+		c.cleanerStop = make(chan struct{})
+	}
+	if !c.cleanerStopped() {
+		close(c.cleanerStop)
+	}
+	c.Unlock()
+}
+
+// cleanerStopped returns true once stopCleaner was called (not thread safe)
+func (c *Cache) cleanerStopped() bool {
+	select {
+	case <-c.cleanerStop:
+		return true
+	default:
+		return false
+	}
+}
+
+// CheckConsistency verifies the invariants of the LRU, TTL, groups and tags indexes, returning
+// the violations found sorted, empty if the cache is healthy
+func (c *Cache) CheckConsistency() (violations []string) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.lruEnabled() {
+		if c.lruIdx.Len() != len(c.cache) || len(c.lruRefs) != len(c.cache) {
+			violations = append(violations, fmt.Sprintf("lru index holds <%d> elements and <%d> references for <%d> items",
+				c.lruIdx.Len(), len(c.lruRefs), len(c.cache)))
+		}
+		for itmID, ci := range c.cache {
+			if lElm, has := c.lruRefs[itmID]; !has || lElm.Value.(*cachedItem) != ci {
+				violations = append(violations, fmt.Sprintf("item <%s> not referenced by the lru index", itmID))
+			}
+		}
+		for lElm := c.lruIdx.Front(); lElm != nil; lElm = lElm.Next() {
+			if ci := lElm.Value.(*cachedItem); c.cache[ci.itemID] != ci {
+				violations = append(violations, fmt.Sprintf("lru index holds item <%s> not in cache", ci.itemID))
+			}
+		}
+	}
+	if c.lfuEnabled() {
+		for itmID, ci := range c.cache {
+			if lElm, has := c.lfuRefs[itmID]; !has || lElm.Value.(*cachedItem) != ci ||
+				c.lfuIdx[ci.freq] == nil {
+				violations = append(violations, fmt.Sprintf("item <%s> not referenced by the lfu index", itmID))
+			}
+		}
+		if len(c.lfuRefs) != len(c.cache) {
+			violations = append(violations, fmt.Sprintf("lfu index holds <%d> references for <%d> items",
+				len(c.lfuRefs), len(c.cache)))
+		}
+	}
+	if c.ttlIdx.Len() != len(c.ttlIdx.refs) {
+		violations = append(violations, fmt.Sprintf("ttl index holds <%d> elements and <%d> references",
+			c.ttlIdx.Len(), len(c.ttlIdx.refs)))
+	}
+	for itmID, ci := range c.cache {
+		pos, has := c.ttlIdx.refs[itmID]
+		switch {
+		case ci.expiryTime.IsZero() && has:
+			violations = append(violations, fmt.Sprintf("item <%s> never expiring but in the ttl index", itmID))
+		case !ci.expiryTime.IsZero() && (!has || pos >= c.ttlIdx.Len() || c.ttlIdx.items[pos] != ci):
+			violations = append(violations, fmt.Sprintf("item <%s> expiring but not referenced by the ttl index", itmID))
+		}
 	}
-	c.Unlock()
-}
-
-// remove completely removes an Element from the cache
-func (c *Cache) remove(itmID string) {
-	ci, has := c.cache[itmID]
-	if !has {
-		return
+	for i, ci := range c.ttlIdx.items {
+		if c.cache[ci.itemID] != ci {
+			violations = append(violations, fmt.Sprintf("ttl index holds item <%s> not in cache", ci.itemID))
+		}
+		if parent := c.ttlIdx.items[(i-1)/2]; i != 0 && ci.expiryTime.Before(parent.expiryTime) {
+			violations = append(violations, fmt.Sprintf("ttl index not ordered, item <%s> expires before <%s>",
+				ci.itemID, parent.itemID))
+		}
 	}
-	if c.maxEntries != UnlimitedCaching {
-		c.lruIdx.Remove(c.lruRefs[itmID])
-		delete(c.lruRefs, itmID)
+	for grpID, itmIDs := range c.groups {
+		for itmID := range itmIDs {
+			if ci, has := c.cache[itmID]; !has || !slices.Contains(ci.groupIDs, grpID) {
+				violations = append(violations, fmt.Sprintf("group <%s> holds item <%s> not part of it", grpID, itmID))
+			}
+		}
 	}
-	if c.ttl > 0 {
-		c.ttlIdx.Remove(c.ttlRefs[itmID])
-		delete(c.ttlRefs, itmID)
+	for tagKey, tagValues := range c.tagIdx {
+		for tagValue, itmIDs := range tagValues {
+			for itmID := range itmIDs {
+				if ci, has := c.cache[itmID]; !has || ci.tags[tagKey] != tagValue {
+					violations = append(violations, fmt.Sprintf("tag <%s:%s> holds item <%s> not tagged with it",
+						tagKey, tagValue, itmID))
+				}
+			}
+		}
 	}
-	c.remItemFromGroups(ci.itemID, ci.groupIDs)
-	delete(c.cache, ci.itemID)
-	for _, onEvicted := range c.onEvicted {
-		onEvicted(ci.itemID, ci.value)
+	for itmID, ci := range c.cache {
+		for _, grpID := range ci.groupIDs {
+			if _, has := c.groups[grpID][itmID]; !has {
+				violations = append(violations, fmt.Sprintf("item <%s> missing from its group <%s>", itmID, grpID))
+			}
+		}
+		for tagKey, tagValue := range ci.tags {
+			if _, has := c.tagIdx[tagKey][tagValue][itmID]; !has {
+				violations = append(violations, fmt.Sprintf("item <%s> missing from its tag <%s:%s>", itmID, tagKey, tagValue))
+			}
+		}
 	}
+	slices.Sort(violations)
+	return
 }
 
-// cleanExpired checks items indexed for TTL and expires them when necessary
-func (c *Cache) cleanExpired() {
-	for {
-		c.Lock()
-		if c.ttlIdx.Len() == 0 {
-			c.Unlock()
-			time.Sleep(c.ttl)
-			continue
+// copyItemsTo copies the items of c into the empty dst cache, keeping their recency and
+// expiry but sharing their values, together with the group expiries not passed. dst should not
+// be in use yet
+func (c *Cache) copyItemsTo(dst *Cache) {
+	c.RLock()
+	defer c.RUnlock()
+	dst.Lock()
+	defer dst.Unlock()
+	for itmID, ci := range c.cache {
+		cpy := *ci
+		cpy.groupIDs = slices.Clone(ci.groupIDs)
+		cpy.tags = maps.Clone(ci.tags)
+		cpy.size = 0
+		dst.resizeItem(&cpy)
+		dst.cache[itmID] = &cpy
+		dst.addItemToGroups(itmID, cpy.groupIDs)
+		dst.addItemToTags(itmID, cpy.tags)
+	}
+	if dst.lruEnabled() { // most recently used pushed last to the front
+		for lElm := c.lruIdx.Back(); lElm != nil; lElm = lElm.Prev() {
+			if ci, has := dst.cache[lElm.Value.(*cachedItem).itemID]; has {
+				dst.lruRefs[ci.itemID] = dst.lruIdx.PushFront(ci)
+			}
+		}
+		for itmID, ci := range dst.cache { // src not keeping the recency
+			if _, has := dst.lruRefs[itmID]; !has {
+				dst.lruRefs[itmID] = dst.lruIdx.PushBack(ci)
+			}
 		}
-		ci := c.ttlIdx.Back().Value.(*cachedItem)
-		now := time.Now()
-		if now.Before(ci.expiryTime) {
-			remainingTTL := ci.expiryTime.Sub(now)
-			c.Unlock()
-			time.Sleep(remainingTTL)
+	}
+	dst.rebuildLFU() // frequencies copied with the items
+	now := c.now()
+	for grpID, expiryTime := range c.grpTTLs { // items added later to the groups still limited
+		if c.expired(expiryTime, now) {
 			continue
 		}
-		c.remove(ci.itemID)
-		c.Unlock()
+		if dst.grpTTLs == nil {
+			dst.grpTTLs = make(map[string]time.Time)
+		}
+		dst.grpTTLs[grpID] = expiryTime
+	}
+	for _, ci := range c.ttlIdx.items { // same expiries, the heap order holds
+		dst.ttlIdx.Push(dst.cache[ci.itemID])
+	}
+	if dst.ttlIdx.Len() != 0 {
+		dst.wakeCleaner()
 	}
 }
 
@@ -318,6 +2052,55 @@ func (c *Cache) remItemFromGroups(itmKey string, groupIDs []string) {
 	}
 }
 
+// addItemToTags indexes an item under each of its tags
+func (c *Cache) addItemToTags(itmKey string, tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+	if c.tagIdx == nil {
+		c.tagIdx = make(map[string]map[string]map[string]struct{})
+	}
+	for tagKey, tagValue := range tags {
+		if _, has := c.tagIdx[tagKey]; !has {
+			c.tagIdx[tagKey] = make(map[string]map[string]struct{})
+		}
+		if _, has := c.tagIdx[tagKey][tagValue]; !has {
+			c.tagIdx[tagKey][tagValue] = make(map[string]struct{})
+		}
+		c.tagIdx[tagKey][tagValue][itmKey] = struct{}{}
+	}
+}
+
+// remItemFromTags removes an item with itemKey from the tags index
+func (c *Cache) remItemFromTags(itmKey string, tags map[string]string) {
+	for tagKey, tagValue := range tags {
+		delete(c.tagIdx[tagKey][tagValue], itmKey)
+		if len(c.tagIdx[tagKey][tagValue]) == 0 {
+			delete(c.tagIdx[tagKey], tagValue)
+		}
+		if len(c.tagIdx[tagKey]) == 0 {
+			delete(c.tagIdx, tagKey)
+		}
+	}
+}
+
+// GetItemsByTag returns the items tagged with tagKey set to tagValue, indexed by their IDs.
+// Expired items not yet cleaned are left out
+func (c *Cache) GetItemsByTag(tagKey, tagValue string) (items map[string]any) {
+	c.RLock()
+	defer c.RUnlock()
+	items = make(map[string]any, len(c.tagIdx[tagKey][tagValue]))
+	now := c.now()
+	for itmID := range c.tagIdx[tagKey][tagValue] {
+		ci := c.cache[itmID]
+		if !ci.expiryTime.IsZero() && c.expired(ci.expiryTime, now) {
+			continue
+		}
+		items[itmID] = c.cloned(ci.value)
+	}
+	return
+}
+
 // Len returns the number of items in the cache.
 func (c *Cache) Len() int {
 	c.RLock()
@@ -329,72 +2112,278 @@ func (c *Cache) Len() int {
 func (c *Cache) Clear() {
 	c.Lock()
 	defer c.Unlock()
-	for _, onEvicted := range c.onEvicted {
-		for _, ci := range c.cache {
-			onEvicted(ci.itemID, ci.value)
+	defer c.batchRemoves()()
+	c.clear()
+}
+
+// Drain returns the values of the items not expired, cloned as on Get, and purges all the
+// stored items from the cache in one step
+func (c *Cache) Drain() (items map[string]any) {
+	c.Lock()
+	defer c.Unlock()
+	items = make(map[string]any, len(c.cache))
+	now := c.now()
+	for itmID, ci := range c.cache {
+		if !ci.expiryTime.IsZero() && c.expired(ci.expiryTime, now) {
+			continue
 		}
+		items[itmID] = c.cloned(ci.value)
+	}
+	defer c.batchRemoves()()
+	c.clear()
+	return
+}
+
+// clearUndumped purges all stored items as Clear does, without storing their removals nor the
+// changes still collected, the dump folder being removed or archived as it is
+func (c *Cache) clearUndumped() {
+	c.Lock()
+	defer c.Unlock()
+	c.dumpDropped = true
+	c.clear()
+	if c.offCollector != nil {
+		c.offCollector.collMux.Lock()
+		c.offCollector.collection = make(map[string]*CollectionEntity)
+		c.offCollector.collMux.Unlock()
+	}
+}
+
+// clear purges all stored items from the cache (not thread safe)
+func (c *Cache) clear() {
+	for _, ci := range c.cache {
+		c.evicted(ci, EvictionCleared)
 	}
 	c.cache = make(map[string]*cachedItem)
 	c.groups = make(map[string]map[string]struct{})
+	c.tagIdx = nil
+	c.usedBytes = 0
+	c.lfuIdx, c.lfuRefs, c.lfuMinFreq = nil, nil, 0
 	c.lruIdx = c.lruIdx.Init()
 	c.lruRefs = make(map[string]*list.Element)
-	c.ttlIdx = c.ttlIdx.Init()
-	c.ttlRefs = make(map[string]*list.Element)
+	c.ttlIdx = newTTLHeap()
 }
 
 type CacheStats struct {
-	Items  int
-	Groups int
+	Items              int
+	Groups             int
+	EvictionsDropped   int64 // eviction events not delivered because an EvictionChannel was full
+	Hits               int64 // lookups finding the item
+	Misses             int64 // lookups not finding the item, including the expired ones
+	Evictions          int64 // items expired or evicted over capacity or idleness, not removed explicitly
+	UsedBytes          int64 // estimated bytes of the items
+	WatchEventsDropped int64 // Watch events not delivered because the channel was full
 }
 
 // GetStats will return the CacheStats for this instance
 func (c *Cache) GetCacheStats() (cs *CacheStats) {
 	c.RLock()
-	cs = &CacheStats{Items: len(c.cache), Groups: len(c.groups)}
+	cs = c.cacheStats()
+	c.RUnlock()
+	return
+}
+
+// cacheStats returns the CacheStats of the instance (not thread safe)
+func (c *Cache) cacheStats() *CacheStats {
+	return &CacheStats{Items: len(c.cache), Groups: len(c.groups),
+		EvictionsDropped: c.evictionsDropped, Hits: c.hits, Misses: c.misses,
+		Evictions: c.evictions, UsedBytes: c.usedBytes, WatchEventsDropped: c.watchEventsDropped}
+}
+
+// ResetStats zeroes the counters reported in CacheStats, starting a new reporting window
+func (c *Cache) ResetStats() {
+	c.Lock()
+	c.hits, c.misses, c.evictions, c.evictionsDropped, c.watchEventsDropped = 0, 0, 0, 0, 0
+	c.Unlock()
+}
+
+// InstanceSnapshot holds the statistics of a cache instance, taken at the same moment
+type InstanceSnapshot struct {
+	CacheStats                // memory statistics
+	Persistent      bool      // true if the instance is dumped to files
+	DiskFiles       int       // number of dump files
+	DiskBytes       int64     // size of the dump files
+	PendingEntities int       // number of collected changes waiting to be dumped
+	LastDump        time.Time // time of the latest dump
+	LastRewrite     time.Time // time of the latest rewrite of dump files
+}
+
+// StatsSnapshot returns the statistics of the cache, blocking changes and dumping while
+// gathering them so they are consistent with each other
+func (c *Cache) StatsSnapshot() (is InstanceSnapshot) {
+	c.RLock()
+	defer c.RUnlock()
+	is.CacheStats = *c.cacheStats()
+	if c.offCollector != nil {
+		c.offCollector.diskSnapshot(&is)
+	}
+	return
+}
+
+// LockStats holds the time waited to acquire the lock of a Cache instance.
+// Only populated when built with the ltcache_lockstats tag
+type LockStats struct {
+	Count   int64         // number of lock acquisitions
+	AvgWait time.Duration // average time waited for the lock
+	MaxWait time.Duration // maximum time waited for the lock
+}
+
+// GetLockStats returns the lock wait statistics for this instance
+func (c *Cache) GetLockStats() *LockStats {
+	return c.lockStats.get()
+}
+
+// LoadReport holds statistics about recovering a Cache instance from its dump files
+type LoadReport struct {
+	Files          int     // number of dump files read
+	Sets           int     // number of SET entities read
+	Removes        int     // number of REMOVE entities read
+	Overwrites     int     // number of SET entities overwriting an item set by a previous entity
+	OverwriteRatio float64 // Overwrites out of Sets, a high ratio means rewriting should happen more often
+}
+
+// CollectorInfo holds the settings an offline collector is running with
+type CollectorInfo struct {
+	FolderPath      string        // folder where the cache is dumped
+	DumpInterval    time.Duration // -1 dumps on each set/remove, 0 disables dumping
+	RewriteInterval time.Duration // -2 rewrites on shutdown, -1 before dumping starts, 0 disables rewriting
+	FileSizeLimit   int64         // size in bytes after which a new dump file is created
+}
+
+// CollectorConfig returns the settings of the offline collector, ok is false if the cache is not dumped
+func (c *Cache) CollectorConfig() (ci CollectorInfo, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.offCollector == nil {
+		return
+	}
+	return CollectorInfo{
+		FolderPath:      c.offCollector.fldrPath,
+		DumpInterval:    c.offCollector.dumpInterval,
+		RewriteInterval: c.offCollector.rewriteInterval,
+		FileSizeLimit:   c.offCollector.fileSizeLimit,
+	}, true
+}
+
+// GetLoadReport returns the statistics of recovering the cache from dump files, nil if not recovered
+func (c *Cache) GetLoadReport() (lr *LoadReport) {
+	c.RLock()
+	lr = c.loadReport
 	c.RUnlock()
 	return
 }
 
 // NewCacheFromFolder construct a new Cache from reading dump files
 func NewCacheFromFolder(offColl *OfflineCollector, maxEntries int, ttl time.Duration, staticTTL, clone bool, onEvicted []func(itmID string, value any)) (cache *Cache, err error) {
-	filePaths, err := getFilePaths(offColl.fldrPath)
-	if err != nil {
-		return nil, fmt.Errorf("error walking the path: %w", err)
+	cache = NewCache(maxEntries, ttl, staticTTL, clone, onEvicted)
+	if err = cache.recoverFromFolder(offColl); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Export gob encodes the items not expired to w as OfflineCacheEntities, sorted by ID, without
+// going through the dump folder. The items are copied under the read lock, so the cache keeps
+// serving while they are written. Values stored as interfaces must be registered with gob.Register
+func (c *Cache) Export(w io.Writer) (err error) {
+	c.RLock()
+	now := c.now()
+	oces := make([]*OfflineCacheEntity, 0, len(c.cache))
+	for itmID, ci := range c.cache {
+		if !ci.expiryTime.IsZero() && c.expired(ci.expiryTime, now) {
+			continue
+		}
+		oces = append(oces, &OfflineCacheEntity{IsSet: true, ItemID: itmID, Value: ci.value,
+			ExpiryTime: ci.expiryTime, GroupIDs: ci.groupIDs, Tags: ci.tags})
+	}
+	c.RUnlock()
+	slices.SortFunc(oces, func(a, b *OfflineCacheEntity) int {
+		return strings.Compare(a.ItemID, b.ItemID)
+	})
+	bw := bufio.NewWriter(w)
+	enc := gob.NewEncoder(bw)
+	for _, oce := range oces {
+		if err = enc.Encode(oce); err != nil {
+			return fmt.Errorf("error exporting item <%s>: %w", oce.ItemID, err)
+		}
 	}
-	paths, err := validateFilePaths(filePaths, offColl.fldrPath)
+	return bw.Flush()
+}
+
+// Import decodes the OfflineCacheEntities written by Export from r, setting or removing their
+// items as on recovery, with the expiry they had when exported. Items are stored by the offline
+// collector as on Set. Fails on the first entity which cannot be decoded, keeping the ones before
+func (c *Cache) Import(r io.Reader) error {
+	return decodeEntities(r, "import", nil, func(oce *OfflineCacheEntity) {
+		switch {
+		case !oce.IsSet:
+			c.Remove(oce.ItemID)
+		case oce.ExpiryTime.IsZero(): // never expiring item
+			c.SetWithTags(oce.ItemID, oce.Value, oce.GroupIDs, oce.Tags)
+		default: // item is removed if already expired
+			c.set(oce.ItemID, oce.Value, oce.GroupIDs, oce.Tags, oce.ExpiryTime, !c.hasTTL())
+		}
+	})
+}
+
+// recoverFromFolder populates c Cache from the dump files of offColl, after which it
+// attaches offColl to c so new sets/removes start being dumped
+func (c *Cache) recoverFromFolder(offColl *OfflineCollector) (err error) {
+	paths, err := offColl.recoveryPaths()
 	if err != nil {
 		return
 	}
-	cache = NewCache(maxEntries, ttl, staticTTL, clone, onEvicted)
-
+	if err = offColl.checkRecoverySize(paths); err != nil {
+		return
+	}
+	lr := &LoadReport{Files: len(paths)}
 	handleEntity := func(oce *OfflineCacheEntity) { // set or remove read item from cache
-		if oce.IsSet {
-			cache.Set(oce.ItemID, oce.Value, oce.GroupIDs)
-		} else {
-			cache.Remove(oce.ItemID)
+		var keep bool
+		if oce, keep = offColl.migrated(oce); !keep {
+			return
+		}
+		if !oce.IsSet {
+			lr.Removes++
+		} else if lr.Sets++; c.HasItem(oce.ItemID) {
+			lr.Overwrites++
+		}
+		switch {
+		case !oce.IsSet:
+			c.Remove(oce.ItemID)
+		case oce.ExpiryTime.IsZero(): // never expiring item
+			c.SetWithTags(oce.ItemID, offColl.loadedValue(oce), oce.GroupIDs, oce.Tags)
+		default: // keep the expiry the item had when dumped, item is removed if already expired
+			c.set(oce.ItemID, offColl.loadedValue(oce), oce.GroupIDs, oce.Tags, oce.ExpiryTime, !c.hasTTL())
 		}
 	}
+	readFile := readAndDecodeFile
+	if offColl.streamRecovery {
+		readFile = readAndDecodeStream
+	}
 	for _, filepath := range paths { // range over all files inside cache dump and set the items read into cache
-		if err = readAndDecodeFile(filepath, handleEntity); err != nil {
+		if err = offColl.recoveryFile(filepath, readFile, handleEntity); err != nil {
 			return
 		}
 	}
-	// populate OfflineCollector of cache after setting all items from dump on cache
-	cache.offCollector = offColl
-	// populate onEvicted funtion for storing remove entities after setting all items from dump on cache
-	cache.onEvicted = append(cache.onEvicted, func(itemID string, _ any) { // ran when an item is removed from cache
-		cache.offCollector.storeRemoveEntity(itemID)
-	})
+	if lr.Sets != 0 {
+		lr.OverwriteRatio = float64(lr.Overwrites) / float64(lr.Sets)
+	}
+	c.Lock()
+	c.loadReport = lr
+	c.Unlock()
+	// populate OfflineCollector of cache after setting all items from dump on cache,
+	// from now on removed items will be stored as remove entities
+	c.offCollector = offColl
 	// populate encoders after reading from files is finished to not needlesly try to read from the new files to be created
-	if cache.offCollector.file, cache.offCollector.writer, cache.offCollector.encoder,
-		err = populateEncoder(cache.offCollector.fldrPath, ""); err != nil {
+	if c.offCollector.file, c.offCollector.writer, c.offCollector.encoder,
+		err = populateEncoder(c.offCollector.fldrPath, "", c.offCollector.writeBufferSize, c.offCollector.codec,
+		c.offCollector.compress); err != nil {
 		return
 	}
 	if offColl.rewriteInterval != 0 && offColl.rewriteInterval != -2 {
-		go cache.asyncRewriteEntities()
+		go c.asyncRewriteEntities()
 	}
 	if offColl.dumpInterval > 0 {
-		go cache.asyncDumpEntities()
+		go c.asyncDumpEntities()
 	}
 	return
 }
@@ -408,14 +2397,15 @@ func (c *Cache) asyncRewriteEntities() {
 	for {
 		select {
 		case <-c.offCollector.stopRewrite: // in case of shutdown before interval, dont wait for it
-			if err := c.RewriteDumpFiles(); err != nil {
-				c.offCollector.logger.Warning(err.Error())
+			err := c.RewriteDumpFiles()
+			if err != nil {
+				c.offCollector.log().Warning(err.Error())
 			}
-			c.offCollector.rewriteStopped <- struct{}{}
+			c.offCollector.rewriteStopped <- err
 			return
 		case <-time.After(c.offCollector.rewriteInterval): // no need to instantly write right after reading from files
 			if err := c.RewriteDumpFiles(); err != nil {
-				c.offCollector.logger.Warning(err.Error())
+				c.offCollector.log().Warning(err.Error())
 			}
 		}
 	}
@@ -425,55 +2415,221 @@ func (c *Cache) asyncRewriteEntities() {
 func (c *Cache) asyncDumpEntities() {
 	for {
 		select {
-		case <-c.offCollector.stopDump: // in case of shutdown before interval, dont wait for it
-			if err := c.DumpToFile(); err != nil {
-				c.offCollector.logger.Warning(err.Error())
+		case ctx := <-c.offCollector.stopDump: // in case of shutdown before interval, dont wait for it
+			err := c.dumpToFile(ctx)
+			if err != nil {
+				c.offCollector.log().Warning(err.Error())
 			}
-			c.offCollector.dumpStopped <- struct{}{}
+			c.offCollector.dumpStopped <- err
 			return
 		case <-time.After(c.offCollector.dumpInterval): // no need to instantly dump right after reading from files
 			if err := c.DumpToFile(); err != nil {
-				c.offCollector.logger.Warning(err.Error())
+				c.offCollector.log().Warning(err.Error())
 			}
 		}
 	}
 }
 
+// VerifyPersistence compares the items in cache with the ones recovered from its dump folder,
+// returning the discrepancies found. Items collected and waiting for the next dump interval
+// are not compared, as well as expiry times since they are refreshed in memory only
+func (c *Cache) VerifyPersistence() (matches bool, diffs []string, err error) {
+	if c.offCollector == nil {
+		return false, nil, fmt.Errorf("couldn't verify persistence, Cache %w", ErrInstanceNotPersistent)
+	}
+	c.RLock()
+	defer c.RUnlock()
+	c.offCollector.collMux.RLock()
+	defer c.offCollector.collMux.RUnlock()
+	c.offCollector.rewriteMux.RLock() // dump files must not be swapped or written while reading them
+	defer c.offCollector.rewriteMux.RUnlock()
+	c.offCollector.fileMux.RLock()
+	defer c.offCollector.fileMux.RUnlock()
+	now := c.now()
+	oceMap, err := readDumpFolder(c.offCollector.fldrPath, nil, c.offCollector.migrateEntity, c.offCollector.codec, now)
+	if err != nil {
+		return
+	}
+	for itmID, ci := range c.cache {
+		if _, pending := c.offCollector.collection[itmID]; pending ||
+			(!ci.expiryTime.IsZero() && c.expired(ci.expiryTime, now)) {
+			continue
+		}
+		oce, has := oceMap[itmID]
+		if !has {
+			diffs = append(diffs, fmt.Sprintf("item <%s> missing on disk", itmID))
+			continue
+		}
+		if dskVal := c.offCollector.loadedValue(oce); !reflect.DeepEqual(ci.value, dskVal) {
+			diffs = append(diffs, fmt.Sprintf("item <%s> value differs, memory <%v>, disk <%v>",
+				itmID, ci.value, dskVal))
+		}
+		if !slices.Equal(ci.groupIDs, oce.GroupIDs) {
+			diffs = append(diffs, fmt.Sprintf("item <%s> groups differ, memory <%v>, disk <%v>",
+				itmID, ci.groupIDs, oce.GroupIDs))
+		}
+		if !maps.Equal(ci.tags, oce.Tags) {
+			diffs = append(diffs, fmt.Sprintf("item <%s> tags differ, memory <%v>, disk <%v>",
+				itmID, ci.tags, oce.Tags))
+		}
+	}
+	for itmID := range oceMap {
+		if _, pending := c.offCollector.collection[itmID]; pending {
+			continue
+		}
+		if _, has := c.cache[itmID]; !has {
+			diffs = append(diffs, fmt.Sprintf("item <%s> missing in memory", itmID))
+		}
+	}
+	slices.Sort(diffs)
+	return len(diffs) == 0, diffs, nil
+}
+
+// checkEncodable makes sure value can be dumped, if the offline collector validates values
+func (c *Cache) checkEncodable(itmID string, value any) error {
+	if c.offCollector == nil {
+		return nil
+	}
+	return c.offCollector.checkEncodable(itmID, value)
+}
+
+// checkEncodableItems checks all items can be dumped, see checkEncodable
+func (c *Cache) checkEncodableItems(items map[string]any) error {
+	for itmID, value := range items {
+		if err := c.checkEncodable(itmID, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreRewrite rolls back the dump files to the state before the rewrite of the given
+// generation (0 being the latest) kept in history
+func (c *Cache) RestoreRewrite(generation int) error {
+	if c.offCollector == nil {
+		return fmt.Errorf("couldn't restore rewrite, Cache %w", ErrInstanceNotPersistent)
+	}
+	c.offCollector.rewriteMux.Lock()
+	defer c.offCollector.rewriteMux.Unlock()
+	c.offCollector.fileMux.Lock()
+	defer c.offCollector.fileMux.Unlock()
+	return c.offCollector.restoreRewrite(generation)
+}
+
+// RewriteSavings returns the fraction of the dumped entities, from 0 to 1, which rewriting the
+// dump files would drop
+func (c *Cache) RewriteSavings() (float64, error) {
+	if c.offCollector == nil {
+		return 0, fmt.Errorf("couldn't compute rewrite savings, Cache %w", ErrInstanceNotPersistent)
+	}
+	return c.offCollector.rewriteSavings()
+}
+
 // RewriteDumpFiles rewrites dump files of specified c Cache
 func (c *Cache) RewriteDumpFiles() error {
 	if c.offCollector == nil {
-		return fmt.Errorf("couldn't rewrite dump files, Cache offCollector is nil")
+		return fmt.Errorf("couldn't rewrite dump files, Cache %w", ErrInstanceNotPersistent)
 	}
 	return c.offCollector.rewriteFiles()
 }
 
 // DumpToFile dumps to file all of collected cache. (is thread safe)
 func (c *Cache) DumpToFile() (err error) {
+	return c.dumpToFile(context.Background())
+}
+
+// dumpToFile is DumpToFile stopping with ctx.Err() once ctx is done, the entities already
+// written staying in the dump file
+func (c *Cache) dumpToFile(ctx context.Context) (err error) {
 	if c.offCollector == nil {
-		return fmt.Errorf("couldn't dump cache to file, Cache offCollector is nil")
+		return fmt.Errorf("couldn't dump cache to file, Cache %w", ErrInstanceNotPersistent)
 	}
 	if c.offCollector.dumpInterval == 0 {
 		return ErrDumpIntervalDisabled
 	}
-	c.RLock()
+	if err = lockCtx(ctx, c.RLock, c.RUnlock); err != nil {
+		return
+	}
 	c.offCollector.collMux.Lock()
 	defer func() {
 		c.offCollector.collMux.Unlock()
 		c.RUnlock()
+		c.offCollector.status.dumped(err)
+	}()
+	return c.writeCollection(ctx)
+}
+
+// Flush dumps the collected changes, resuming first dumping if it was stopped after failed
+// writes, in which case the changes collected meanwhile are dumped as well
+func (c *Cache) Flush() (err error) {
+	return c.flush(context.Background())
+}
+
+// flush is Flush stopping with ctx.Err() once ctx is done, the entities already written
+// staying in the dump file
+func (c *Cache) flush(ctx context.Context) (err error) {
+	if c.offCollector == nil {
+		return fmt.Errorf("couldn't flush cache, Cache %w", ErrInstanceNotPersistent)
+	}
+	if err = lockCtx(ctx, c.Lock, c.Unlock); err != nil { // no changes stored while switching back to writing
+		return
+	}
+	c.offCollector.collMux.Lock()
+	defer func() {
+		c.offCollector.collMux.Unlock()
+		c.Unlock()
+		c.offCollector.status.dumped(err)
 	}()
+	if c.offCollector.degraded.Load() {
+		c.offCollector.fileMux.Lock()
+		err = c.offCollector.resumeWriting()
+		c.offCollector.fileMux.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	return c.writeCollection(ctx)
+}
+
+// dumpCoalesced ends the coalescing window, dumping the latest values of the Sets collected during it
+func (c *Cache) dumpCoalesced() {
+	c.RLock()
+	defer c.RUnlock()
+	c.offCollector.collMux.Lock()
+	defer c.offCollector.collMux.Unlock()
+	c.offCollector.coalesced, c.offCollector.coalesceTimer = nil, nil
+	if c.offCollector.degraded.Load() { // dumped by Flush
+		return
+	}
+	if err := c.writeCollection(context.Background()); err != nil {
+		c.offCollector.log().Err(err.Error())
+	}
+}
+
+// Healthy returns false if dumping stopped after failed writes, see TransCacheOpts.MaxWriteFailures
+func (c *Cache) Healthy() bool {
+	return c.offCollector == nil || !c.offCollector.degraded.Load()
+}
+
+// writeCollection writes the collected changes to the dump file until ctx is done (c and collMux locks held)
+func (c *Cache) writeCollection(ctx context.Context) (err error) {
 	for itemID, collEntity := range c.offCollector.collection {
+		if err = ctx.Err(); err != nil { // the rest stays collected
+			return
+		}
 		if collEntity.IsSet { // Write SET entity to dump file
-			if err = c.offCollector.writeEntity(&OfflineCacheEntity{
+			if err = c.offCollector.writeEntity(ctx, &OfflineCacheEntity{
 				IsSet:      true,
 				ItemID:     itemID,
 				Value:      c.cache[itemID].value,
 				ExpiryTime: c.cache[itemID].expiryTime,
 				GroupIDs:   c.cache[itemID].groupIDs,
+				Tags:       c.cache[itemID].tags,
 			}); err != nil {
 				return
 			}
 		} else { // write REMOVE entity to dump file
-			if err = c.offCollector.writeEntity(&OfflineCacheEntity{
+			if err = c.offCollector.writeEntity(ctx, &OfflineCacheEntity{
 				IsSet:  false,
 				ItemID: itemID,
 			}); err != nil {
@@ -485,32 +2641,99 @@ func (c *Cache) DumpToFile() (err error) {
 	return
 }
 
-// Shutdown depending on dump and rewrite intervals, will dump all thats left in cache collector to file and/or rewrite files, and close dump file
+// Shutdown depending on dump and rewrite intervals, will dump all thats left in cache collector to file and/or rewrite files, and close dump file.
+// Errors of each step are joined, the steps after still running
 func (c *Cache) Shutdown() (err error) {
+	return c.ShutdownCtx(context.Background())
+}
+
+// ShutdownCtx is Shutdown giving up with ctx.Err() once ctx is done. The entities dumped until
+// then stay in the dump file, and an interrupted rewrite leaves the dump files it replaces
+func (c *Cache) ShutdownCtx(ctx context.Context) (err error) {
+	c.stopCleaner()
+	c.closeEvictionChannels()
 	if c.offCollector == nil {
 		return // dont return any errors on caches where collector isnt needed
 	}
+	var errs []error
+	defer func() { err = errors.Join(errs...) }()
 	if c.offCollector.dumpInterval > 0 { // stop dumping intervals goroutine if enabled
-		c.offCollector.stopDump <- struct{}{}
+		select {
+		case c.offCollector.stopDump <- ctx:
+		case <-ctx.Done():
+			errs = append(errs, ctx.Err())
+			return
+		}
 	}
 	if c.offCollector.rewriteInterval > 0 { // stop rewriting intervals goroutine if enabled
-		c.offCollector.stopRewrite <- struct{}{}
+		select {
+		case c.offCollector.stopRewrite <- struct{}{}:
+		case <-ctx.Done():
+			errs = append(errs, ctx.Err())
+			return
+		}
 	}
 
 	if c.offCollector.dumpInterval > 0 {
-		<-c.offCollector.dumpStopped
+		select {
+		case dumpErr := <-c.offCollector.dumpStopped:
+			errs = append(errs, dumpErr)
+		case <-ctx.Done(): // the dump file stays open for the goroutine still writing it
+			errs = append(errs, ctx.Err())
+			return
+		}
+	}
+	if c.offCollector.dumpInterval == -1 && c.offCollector.coalesceWindow > 0 {
+		c.offCollector.collMux.Lock()
+		if c.offCollector.coalesceTimer != nil { // the Sets collected are flushed below
+			c.offCollector.coalesceTimer.Stop()
+		}
+		c.offCollector.collMux.Unlock()
+	}
+	if c.offCollector.dumpInterval == -1 && (!c.Healthy() || c.offCollector.coalesceWindow > 0 ||
+		c.offCollector.hasCollected()) { // try dumping the changes collected meanwhile
+		if flushErr := c.flush(ctx); flushErr != nil {
+			c.offCollector.log().Err(fmt.Sprintf("changes of <%s> not dumped, error <%v>",
+				c.offCollector.fldrPath, flushErr))
+			errs = append(errs, flushErr)
+		}
 	}
 	// close opened cache dump file and delete if empty
-	if err = closeFile(c.offCollector.file); err != nil {
-		return
+	if closeErr := closeFile(c.offCollector.file); closeErr != nil {
+		errs = append(errs, closeErr)
+		if c.offCollector.rewriteInterval == -2 { // not rewriting next to a file in unknown state
+			return
+		}
 	}
 	if c.offCollector.rewriteInterval > 0 {
-		<-c.offCollector.rewriteStopped
+		select {
+		case rewriteErr := <-c.offCollector.rewriteStopped:
+			errs = append(errs, rewriteErr)
+		case <-ctx.Done():
+			errs = append(errs, ctx.Err())
+			return
+		}
 	}
 	if c.offCollector.rewriteInterval == -2 { // rewrite dump files if rewriting on shutdown is enabled (-2)
-		if err = c.RewriteDumpFiles(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			errs = append(errs, ctxErr)
 			return
 		}
+		if threshold := c.offCollector.shutdownRewriteThreshold; threshold > 0 {
+			savings, savingsErr := c.offCollector.rewriteSavings()
+			if savingsErr != nil || savings < threshold { // not worth rewriting
+				errs = append(errs, savingsErr)
+				return
+			}
+		}
+		rewritten := make(chan error, 1)
+		go func() { rewritten <- c.RewriteDumpFiles() }()
+		select {
+		case rewriteErr := <-rewritten:
+			errs = append(errs, rewriteErr)
+		case <-ctx.Done(): // the rewrite replaces the dump files only once finished
+			errs = append(errs, ctx.Err())
+		}
 	}
 	return
 }
@@ -11,12 +11,19 @@ package ltcache
 import (
 	"bufio"
 	"bytes"
+	"container/heap"
+	"context"
 	"encoding/gob"
+	"errors"
 	"log"
 	"math/rand"
 	"os"
 	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -59,8 +66,8 @@ func TestSetGetRemNoIndexes(t *testing.T) {
 	if cache.ttlIdx.Len() != 0 {
 		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx)
 	}
-	if len(cache.ttlRefs) != 0 {
-		t.Errorf("Wrong items in ttl index: %+v", cache.ttlRefs)
+	if len(cache.ttlIdx.refs) != 0 {
+		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx.refs)
 	}
 	if itmIDs := cache.GetItemIDs(""); len(itmIDs) != 5 {
 		t.Errorf("received: %+v", itmIDs)
@@ -85,7 +92,7 @@ func TestSetGetRemNoIndexes(t *testing.T) {
 	if len(cache.cache) != 5 {
 		t.Errorf("wrong keys: %+v", cache.cache)
 	}
-	eCs := &CacheStats{Items: 5, Groups: 4}
+	eCs := &CacheStats{Items: 5, Groups: 4, Hits: 1, UsedBytes: 34}
 	if cs := cache.GetCacheStats(); !reflect.DeepEqual(eCs, cs) {
 		t.Errorf("expecting: %+v, received: %+v", eCs, cs)
 	}
@@ -155,6 +162,30 @@ func TestSetGetRemNoIndexes(t *testing.T) {
 
 }
 
+func TestGetItemIDsPage(t *testing.T) {
+	cache := NewCache(UnlimitedCaching, 0, false, false, nil)
+	for _, itmID := range []string{"b3", "a1", "b1", "b2", "b4"} {
+		cache.Set(itmID, nil, nil)
+	}
+	for _, tcase := range []struct {
+		offset, limit int
+		exp           []string
+	}{
+		{0, 2, []string{"b1", "b2"}},
+		{2, 2, []string{"b3", "b4"}},
+		{3, 2, []string{"b4"}},
+		{1, 0, []string{"b2", "b3", "b4"}},
+		{4, 2, nil},
+	} {
+		if itmIDs, total := cache.GetItemIDsPage("b", tcase.offset, tcase.limit); total != 4 {
+			t.Errorf("expected <4> total, received <%d>", total)
+		} else if !reflect.DeepEqual(tcase.exp, itmIDs) {
+			t.Errorf("offset <%d>, limit <%d>: expected <%v>, received <%v>",
+				tcase.offset, tcase.limit, tcase.exp, itmIDs)
+		}
+	}
+}
+
 func TestGetGroupItems(t *testing.T) {
 	cache := NewCache(UnlimitedCaching, 0, false, false,
 		[]func(itmID string, value any){func(itmID string, v interface{}) { lastEvicted = itmID }})
@@ -197,8 +228,8 @@ func TestSetGetRemLRU(t *testing.T) {
 	if cache.ttlIdx.Len() != 0 {
 		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx)
 	}
-	if len(cache.ttlRefs) != 0 {
-		t.Errorf("Wrong items in ttl index: %+v", cache.ttlRefs)
+	if len(cache.ttlIdx.refs) != 0 {
+		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx.refs)
 	}
 	if _, has := cache.Get("2"); has {
 		t.Error("item still in cache")
@@ -277,8 +308,8 @@ func TestSetGetRemTTLDynamic(t *testing.T) {
 	if cache.ttlIdx.Len() != 5 {
 		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx)
 	}
-	if len(cache.ttlRefs) != 5 {
-		t.Errorf("Wrong items in ttl index: %+v", cache.ttlRefs)
+	if len(cache.ttlIdx.refs) != 5 {
+		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx.refs)
 	}
 	if expTime, has := cache.GetItemExpiryTime(testCIs[0].itemID); !has {
 		t.Errorf("cannot find item with id: %s", testCIs[0].itemID)
@@ -302,8 +333,8 @@ func TestSetGetRemTTLDynamic(t *testing.T) {
 	if cache.ttlIdx.Len() != 1 {
 		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx)
 	}
-	if len(cache.ttlRefs) != 1 {
-		t.Errorf("Wrong items in ttl index: %+v", cache.ttlRefs)
+	if len(cache.ttlIdx.refs) != 1 {
+		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx.refs)
 	}
 }
 
@@ -325,6 +356,139 @@ func TestSetGetRemTTLStatic(t *testing.T) {
 	}
 }
 
+func TestSetWithExpiry(t *testing.T) {
+	cache := NewCache(UnlimitedCaching, 0, false, false, nil)
+	cache.SetWithExpiry("never", "val", nil, 0)
+	if exp, has := cache.GetItemExpiryTime("never"); !has {
+		t.Error("item not in cache")
+	} else if !exp.IsZero() {
+		t.Errorf("expected no expiry, received: %v", exp)
+	}
+	cache.SetWithExpiry("expired", "val", nil, -1)
+	if cache.HasItem("expired") {
+		t.Error("expired item should not be in cache")
+	}
+	cache.SetWithExpiry("never", "val", nil, -1) // negative ttl removes existing item
+	if cache.HasItem("never") {
+		t.Error("expired item should not be in cache")
+	}
+	cache.SetWithExpiry("long", "val", nil, time.Minute)
+	cache.SetWithExpiry("short", "val", nil, 10*time.Millisecond)
+	if exp, has := cache.GetItemExpiryTime("short"); !has {
+		t.Error("item not in cache")
+	} else if time.Now().After(exp) {
+		t.Errorf("wrong time replied: %v", exp)
+	}
+	cache.RLock()
+	if back := cache.ttlIdx.first().itemID; back != "short" {
+		t.Errorf("expected <short> to expire first, received <%s>", back)
+	}
+	cache.RUnlock()
+	time.Sleep(20 * time.Millisecond)
+	if cache.HasItem("short") {
+		t.Error("item should have expired")
+	}
+	if !cache.HasItem("long") {
+		t.Error("item not in cache")
+	}
+	cache.Set("long", "val", nil) // cache without TTL, Set removes the item expiry
+	if exp, _ := cache.GetItemExpiryTime("long"); !exp.IsZero() {
+		t.Errorf("expected no expiry, received: %v", exp)
+	}
+	cache.RLock()
+	if cache.ttlIdx.Len() != 0 {
+		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx)
+	}
+	cache.RUnlock()
+}
+
+func TestSetWithExpiryCacheTTL(t *testing.T) {
+	cache := NewCache(UnlimitedCaching, 10*time.Millisecond, false, false, nil)
+	cache.SetWithExpiry("never", "val", nil, 0)
+	cache.SetWithExpiry("long", "val", nil, time.Minute)
+	cache.Set("dynamic", "val", nil)
+	if exp, _ := cache.GetItemExpiryTime("never"); !exp.IsZero() {
+		t.Errorf("expected no expiry, received: %v", exp)
+	}
+	longExp, _ := cache.GetItemExpiryTime("long")
+	time.Sleep(5 * time.Millisecond)
+	cache.Get("long") // item specific expiry not refreshed on get
+	if exp, _ := cache.GetItemExpiryTime("long"); !exp.Equal(longExp) {
+		t.Errorf("expected <%v>, received <%v>", longExp, exp)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if cache.HasItem("dynamic") {
+		t.Error("item should have expired")
+	}
+	if !cache.HasItem("never") || !cache.HasItem("long") {
+		t.Errorf("Wrong items in cache: %+v", cache.cache)
+	}
+}
+
+func TestSetWithExpiryTimeClockSkewTolerance(t *testing.T) {
+	cache := NewCache(UnlimitedCaching, 0, false, false, nil)
+	cache.SetWithExpiryTime("past", "val", nil, time.Now().Add(-10*time.Millisecond))
+	if cache.HasItem("past") {
+		t.Error("expired item should not be in cache")
+	}
+	cache.SetClockSkewTolerance(50 * time.Millisecond)
+	cache.SetWithExpiryTime("past", "val", nil, time.Now().Add(-10*time.Millisecond))
+	if !cache.HasItem("past") {
+		t.Error("item within clock skew tolerance should be in cache")
+	}
+	cache.SetWithExpiryTime("never", "val", nil, time.Time{})
+	time.Sleep(60 * time.Millisecond)
+	if cache.HasItem("past") {
+		t.Error("item should have expired after clock skew tolerance")
+	}
+	if !cache.HasItem("never") {
+		t.Error("item not in cache")
+	}
+}
+
+func TestGetDetailed(t *testing.T) {
+	cache := NewCache(UnlimitedCaching, 0, false, false, nil)
+	cache.Set("item1", "val", nil)
+	if val, rslt := cache.GetDetailed("item1"); rslt != Found || val != "val" {
+		t.Errorf("expected <%v> <%v>, received <%v> <%v>", "val", Found, val, rslt)
+	}
+	if val, rslt := cache.GetDetailed("item2"); rslt != NotFound || val != nil {
+		t.Errorf("expected <%v> <%v>, received <%v> <%v>", nil, NotFound, val, rslt)
+	}
+	cache.cache["item1"].expiryTime = time.Now().Add(-time.Millisecond) // expired but not indexed for cleanExpired
+	if val, rslt := cache.GetDetailed("item1"); rslt != Expired || val != nil {
+		t.Errorf("expected <%v> <%v>, received <%v> <%v>", nil, Expired, val, rslt)
+	}
+	if _, rslt := cache.GetDetailed("item1"); rslt != NotFound {
+		t.Errorf("expected <%v>, received <%v>", NotFound, rslt)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	cache := NewCache(UnlimitedCaching, 20*time.Millisecond, false, false, nil)
+	cache.SetMaxAge(30 * time.Millisecond)
+	cache.Set("item1", "val", nil)
+	cache.Set("item2", "val", nil)
+	for i := 0; i < 3; i++ { // keep refreshing the ttl
+		time.Sleep(10 * time.Millisecond)
+		cache.Get("item1")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if cache.HasItem("item1") {
+		t.Error("item should have been evicted after max age")
+	}
+	nonTTLCache := NewCache(UnlimitedCaching, 0, false, false, nil)
+	nonTTLCache.SetMaxAge(10 * time.Millisecond)
+	nonTTLCache.Set("item1", "val", nil)
+	if exp, _ := nonTTLCache.GetItemExpiryTime("item1"); exp.IsZero() {
+		t.Error("expected expiry based on max age")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if nonTTLCache.HasItem("item1") {
+		t.Error("item should have been evicted after max age")
+	}
+}
+
 func TestSetGetRemLRUttl(t *testing.T) {
 	nrItems := 3
 	cache := NewCache(nrItems, time.Duration(10*time.Millisecond), false, false, nil)
@@ -343,8 +507,8 @@ func TestSetGetRemLRUttl(t *testing.T) {
 	if cache.ttlIdx.Len() != nrItems {
 		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx)
 	}
-	if len(cache.ttlRefs) != nrItems {
-		t.Errorf("Wrong items in ttl index: %+v", cache.ttlRefs)
+	if len(cache.ttlIdx.refs) != nrItems {
+		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx.refs)
 	}
 	time.Sleep(time.Duration(6 * time.Millisecond))
 	cache.Remove("_4_")
@@ -362,8 +526,8 @@ func TestSetGetRemLRUttl(t *testing.T) {
 	if cache.ttlIdx.Len() != nrItems {
 		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx)
 	}
-	if len(cache.ttlRefs) != nrItems {
-		t.Errorf("Wrong items in ttl index: %+v", cache.ttlRefs)
+	if len(cache.ttlIdx.refs) != nrItems {
+		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx.refs)
 	}
 	time.Sleep(time.Duration(6 * time.Millisecond)) // timeout items which were not modified
 	nrItems = 1
@@ -379,8 +543,8 @@ func TestSetGetRemLRUttl(t *testing.T) {
 	if cache.ttlIdx.Len() != nrItems {
 		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx)
 	}
-	if len(cache.ttlRefs) != nrItems {
-		t.Errorf("Wrong items in ttl index: %+v", cache.ttlRefs)
+	if len(cache.ttlIdx.refs) != nrItems {
+		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx.refs)
 	}
 }
 
@@ -404,8 +568,8 @@ func TestCacheDisabled(t *testing.T) {
 	if cache.ttlIdx.Len() != 0 {
 		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx)
 	}
-	if len(cache.ttlRefs) != 0 {
-		t.Errorf("Wrong items in ttl index: %+v", cache.ttlRefs)
+	if len(cache.ttlIdx.refs) != 0 {
+		t.Errorf("Wrong items in ttl index: %+v", cache.ttlIdx.refs)
 	}
 	cache.Remove("4")
 }
@@ -450,6 +614,321 @@ func TestCacheGetItemExpiryTime(t *testing.T) {
 	}
 }
 
+func TestCacheGetItemTTLInfo(t *testing.T) {
+	c := NewCache(UnlimitedCaching, time.Hour, false, false, nil)
+	c.Set("sliding", "value", nil)
+	c.SetWithExpiry("fixed", "value", nil, time.Minute)
+	if _, _, ok := c.GetItemTTLInfo("missing"); ok {
+		t.Error("expected missing item not to be found")
+	}
+	exp, static, ok := c.GetItemTTLInfo("sliding")
+	if !ok || static || exp.IsZero() {
+		t.Errorf("expected sliding expiry, received <%v> <%v> <%v>", exp, static, ok)
+	}
+	exp, static, ok = c.GetItemTTLInfo("fixed")
+	if !ok || !static || exp.IsZero() {
+		t.Errorf("expected fixed expiry, received <%v> <%v> <%v>", exp, static, ok)
+	}
+
+	staticCache := NewCache(UnlimitedCaching, time.Hour, true, false, nil)
+	staticCache.Set("item1", "value", nil)
+	if _, static, _ = staticCache.GetItemTTLInfo("item1"); !static {
+		t.Error("expected static expiry for a static TTL instance")
+	}
+	noTTLCache := NewCache(UnlimitedCaching, 0, false, false, nil)
+	noTTLCache.Set("item1", "value", nil)
+	if exp, static, _ = noTTLCache.GetItemTTLInfo("item1"); !static || !exp.IsZero() {
+		t.Errorf("expected static zero expiry, received <%v> <%v>", exp, static)
+	}
+}
+
+func TestCacheSetWithTags(t *testing.T) {
+	c := NewCache(UnlimitedCaching, 0, false, false, nil)
+	c.SetWithTags("item1", "value1", []string{"grp1"}, map[string]string{"region": "eu", "tier": "gold"})
+	c.SetWithTags("item2", "value2", nil, map[string]string{"region": "eu"})
+	c.SetWithTags("item3", "value3", nil, map[string]string{"region": "us"})
+	exp := map[string]any{"item1": "value1", "item2": "value2"}
+	if rcv := c.GetItemsByTag("region", "eu"); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	if rcv := c.GetItemsByTag("region", "asia"); len(rcv) != 0 {
+		t.Errorf("expected no items, received <%+v>", rcv)
+	}
+	c.Set("item2", "value2", nil) // setting without tags drops them
+	c.RemoveGroup("grp1")         // removing does not leave item1 indexed
+	exp = map[string]any{}
+	if rcv := c.GetItemsByTag("region", "eu"); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	if len(c.tagIdx) != 1 {
+		t.Errorf("expected only the tag of item3 indexed, received <%+v>", c.tagIdx)
+	}
+}
+
+func TestCacheCheckConsistency(t *testing.T) {
+	c := NewCache(4, time.Hour, false, false, nil)
+	for i, itmID := range []string{"item0", "item1", "item2", "item3", "item4"} {
+		c.Set(itmID, i, []string{"grp1"})
+	}
+	c.SetWithExpiry("item4", 4, nil, 0)
+	c.SetWithTags("item5", 5, nil, map[string]string{"key": "value"})
+	c.Remove("item3")
+	if rcv := c.CheckConsistency(); len(rcv) != 0 {
+		t.Errorf("expected no violations, received <%+v>", rcv)
+	}
+
+	c.groups["grp1"]["item0"] = struct{}{}   // evicted item left in its group
+	c.ttlIdx.Swap(0, c.ttlIdx.refs["item5"]) // latest to expire moved first
+	exp := []string{
+		"group <grp1> holds item <item0> not part of it",
+		"ttl index not ordered, item <item2> expires before <item5>",
+	}
+	if rcv := c.CheckConsistency(); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+}
+
+func TestCacheLowWaterMark(t *testing.T) {
+	var evicted []string
+	c := NewCache(4, 0, false, false, []func(itmID string, value any){
+		func(itmID string, _ any) { evicted = append(evicted, itmID) }})
+	c.SetLowWaterMark(2)
+	for i, itmID := range []string{"item0", "item1", "item2", "item3"} {
+		c.Set(itmID, i, nil)
+	}
+	if len(evicted) != 0 {
+		t.Errorf("expected no evictions, received <%+v>", evicted)
+	}
+	c.Set("item4", 4, nil) // over maxEntries, evict down to the low water mark
+	exp := []string{"item0", "item1", "item2"}
+	if !reflect.DeepEqual(exp, evicted) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, evicted)
+	}
+	if rcv := c.Len(); rcv != 2 {
+		t.Errorf("expected <%v>, received <%v>", 2, rcv)
+	}
+	c.Set("item5", 5, nil)
+	c.Set("item6", 6, nil)
+	if len(evicted) != 3 {
+		t.Errorf("expected no evictions until over maxEntries, received <%+v>", evicted)
+	}
+}
+
+func TestCacheGetWithRemaining(t *testing.T) {
+	c := NewCache(-1, time.Hour, false, false, nil)
+	c.Set("item1", "value1", nil)
+	if val, rem, ok := c.GetWithRemaining("item1"); !ok || val != "value1" ||
+		rem <= 59*time.Minute || rem > time.Hour {
+		t.Errorf("expected <%+v> expiring in about an hour, received <%+v> in <%v>", "value1", val, rem)
+	}
+	c.SetWithExpiry("item2", "value2", nil, 0)
+	if val, rem, ok := c.GetWithRemaining("item2"); !ok || val != "value2" || rem != NeverExpires {
+		t.Errorf("expected <%+v> never expiring, received <%+v> in <%v>", "value2", val, rem)
+	}
+	if _, _, ok := c.GetWithRemaining("item3"); ok {
+		t.Error("expected missing item")
+	}
+}
+
+func TestCacheSetIfAbsent(t *testing.T) {
+	c := NewCache(-1, 0, false, false, nil)
+	if !c.SetIfAbsent("item1", "value1", []string{"grp1"}) {
+		t.Error("expected item1 to be set")
+	}
+	if c.SetIfAbsent("item1", "value2", nil) {
+		t.Error("expected item1 not to be set again")
+	}
+	if val, has := c.Get("item1"); !has || val != "value1" {
+		t.Errorf("expected <%+v>, received <%+v>", "value1", val)
+	}
+	c.SetWithExpiry("item2", "value1", nil, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if !c.SetIfAbsent("item2", "value2", nil) {
+		t.Error("expected expired item2 to be set")
+	}
+	if val, has := c.Get("item2"); !has || val != "value2" {
+		t.Errorf("expected <%+v>, received <%+v>", "value2", val)
+	}
+	setChan := make(chan bool, 10)
+	for range 10 {
+		go func() { setChan <- c.SetIfAbsent("item3", "value", nil) }()
+	}
+	var set int
+	for range 10 {
+		if <-setChan {
+			set++
+		}
+	}
+	if set != 1 {
+		t.Errorf("expected <%+v>, received <%+v>", 1, set)
+	}
+}
+
+func TestCacheCompareAndSwap(t *testing.T) {
+	c := NewCache(-1, 0, false, false, nil)
+	if c.CompareAndSwap("item1", nil, 1) {
+		t.Error("expected no swap of missing item")
+	}
+	c.Set("item1", []int{1}, []string{"grp1"})
+	if c.CompareAndSwap("item1", []int{2}, []int{3}) {
+		t.Error("expected no swap of different value")
+	}
+	if !c.CompareAndSwap("item1", []int{1}, []int{2}) {
+		t.Error("expected swap")
+	}
+	if val, has := c.Get("item1"); !has || !reflect.DeepEqual(val, []int{2}) {
+		t.Errorf("expected <%+v>, received <%+v>", []int{2}, val)
+	}
+	if exp, rcv := []string{"item1"}, c.GetGroupItemIDs("grp1"); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	swapped := make(chan bool, 10)
+	for range 10 {
+		go func() { swapped <- c.CompareAndSwap("item1", []int{2}, []int{3}) }()
+	}
+	var n int
+	for range 10 {
+		if <-swapped {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("expected <%+v>, received <%+v>", 1, n)
+	}
+}
+
+func TestCacheIncrement(t *testing.T) {
+	c := NewCache(-1, 0, false, false, nil)
+	if val, err := c.Increment("item1", 5); err != nil || val != 5 {
+		t.Errorf("expected <%+v>, received <%+v>, err <%v>", 5, val, err)
+	}
+	if val, err := c.Decrement("item1", 2); err != nil || val != 3 {
+		t.Errorf("expected <%+v>, received <%+v>, err <%v>", 3, val, err)
+	}
+	if val, has := c.Get("item1"); !has || val != int64(3) {
+		t.Errorf("expected <%+v>, received <%+v>", int64(3), val)
+	}
+	c.Set("item2", 1, nil)
+	if _, err := c.Increment("item2", 1); !errors.Is(err, ErrNotInt64) {
+		t.Errorf("expected <%v>, received <%v>", ErrNotInt64, err)
+	}
+	done := make(chan struct{})
+	for range 100 {
+		go func() {
+			c.Increment("item3", 1)
+			done <- struct{}{}
+		}()
+	}
+	for range 100 {
+		<-done
+	}
+	if val, has := c.Get("item3"); !has || val != int64(100) {
+		t.Errorf("expected <%+v>, received <%+v>", int64(100), val)
+	}
+}
+
+func TestCachePeek(t *testing.T) {
+	c := NewCache(2, 0, false, false, nil)
+	c.Set("item1", "value1", nil)
+	c.Set("item2", "value2", nil)
+	if val, has := c.Peek("item1"); !has || val != "value1" {
+		t.Errorf("expected <%+v>, received <%+v>", "value1", val)
+	}
+	c.Set("item3", "value3", nil) // item1 still the least recently used
+	if _, has := c.Peek("item1"); has {
+		t.Error("expected item1 to be evicted")
+	}
+	if _, has := c.Peek("item2"); !has {
+		t.Error("expected item2 to be kept")
+	}
+}
+
+func TestCacheHitMissEvictionStats(t *testing.T) {
+	c := NewCache(2, 0, false, false, nil)
+	c.Set("item1", 1, nil)
+	c.Set("item2", 2, nil)
+	c.Get("item1")
+	c.Get("item3")
+	c.Set("item3", 3, nil) // evicts item2
+	c.Remove("item3")      // not counted as eviction
+	c.SetWithExpiry("item4", 4, nil, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	c.Get("item4") // expired
+	c.Peek("item1")
+	eCs := &CacheStats{Items: 1, Hits: 1, Misses: 2, Evictions: 2, UsedBytes: 21} // item1 and its interface header
+	if cs := c.GetCacheStats(); !reflect.DeepEqual(eCs, cs) {
+		t.Errorf("expected <%+v>, received <%+v>", eCs, cs)
+	}
+	c.ResetStats()
+	if cs := c.GetCacheStats(); !reflect.DeepEqual(&CacheStats{Items: 1, UsedBytes: 21}, cs) {
+		t.Errorf("expected <%+v>, received <%+v>", &CacheStats{Items: 1, UsedBytes: 21}, cs)
+	}
+}
+
+func TestCacheMaxMemory(t *testing.T) {
+	c := NewCache(-1, 0, false, false, nil)
+	c.SetMaxMemory(100, 20)
+	c.Set("item1", strings.Repeat("a", 35), nil) // 40 bytes
+	c.Set("item2", strings.Repeat("b", 35), nil)
+	c.Get("item1")
+	if cs := c.GetCacheStats(); cs.UsedBytes != 80 {
+		t.Errorf("expected <%+v>, received <%+v>", 80, cs.UsedBytes)
+	}
+	c.Set("item3", 3, nil) // 25 bytes, evicts item2
+	if _, has := c.Peek("item2"); has {
+		t.Error("expected item2 to be evicted")
+	}
+	if cs := c.GetCacheStats(); cs.Items != 2 || cs.UsedBytes != 65 {
+		t.Errorf("expected 2 items of 65 bytes, received <%+v>", cs)
+	}
+	c.Set("item3", strings.Repeat("c", 95), nil) // 100 bytes, evicts item1
+	if itmIDs := c.GetItemIDs(""); !reflect.DeepEqual([]string{"item3"}, itmIDs) {
+		t.Errorf("expected <%+v>, received <%+v>", []string{"item3"}, itmIDs)
+	}
+	c.Remove("item3")
+	if cs := c.GetCacheStats(); cs.UsedBytes != 0 {
+		t.Errorf("expected <%+v>, received <%+v>", 0, cs.UsedBytes)
+	}
+	if issues := c.CheckConsistency(); len(issues) != 0 {
+		t.Error(issues)
+	}
+}
+
+func TestCacheLFU(t *testing.T) {
+	c := NewCache(3, 0, false, false, nil)
+	c.SetEvictionPolicy(PolicyLFU)
+	c.Set("hot1", 1, nil)
+	c.Set("hot2", 2, nil)
+	for range 3 {
+		c.Get("hot1")
+		c.Get("hot2")
+	}
+	for i, itmID := range []string{"cold1", "cold2", "cold3"} { // each evicting the previous one
+		c.Set(itmID, i, nil)
+		c.Get(itmID)
+	}
+	itmIDs := c.GetItemIDs("")
+	slices.Sort(itmIDs)
+	if exp := []string{"cold3", "hot1", "hot2"}; !reflect.DeepEqual(exp, itmIDs) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, itmIDs)
+	}
+	c.Remove("hot1")
+	c.Set("cold4", 4, nil)
+	c.Set("cold5", 5, nil) // cold4 evicted as least recently used among the least frequently read
+	if _, has := c.Peek("cold4"); has {
+		t.Error("expected cold4 to be evicted")
+	}
+	if issues := c.CheckConsistency(); len(issues) != 0 {
+		t.Error(issues)
+	}
+	c.SetEvictionPolicy(PolicyLRU)
+	c.Get("cold3")
+	c.Set("cold6", 6, nil) // hot2 least recently used
+	if _, has := c.Peek("hot2"); has {
+		t.Error("expected hot2 to be evicted")
+	}
+}
+
 func TestCacheSetWithOffCollector(t *testing.T) {
 	var logBuf bytes.Buffer
 	c := NewCache(-1, 0, false, false, []func(itmID string, value any){func(itmID string, value interface{}) {}})
@@ -636,10 +1115,11 @@ func TestCacheAsyncDumpEntities(t *testing.T) {
 		maxEntries: -1,
 		cache:      make(map[string]*cachedItem),
 		groups:     make(map[string]map[string]struct{}),
+		ttlIdx:     newTTLHeap(),
 		offCollector: &OfflineCollector{
 			dumpInterval:     100 * time.Millisecond,
-			dumpStopped:      make(chan struct{}),
-			stopDump:         make(chan struct{}),
+			dumpStopped:      make(chan error),
+			stopDump:         make(chan context.Context),
 			file:             tmpFile,
 			collectSetEntity: true,
 			collection:       make(map[string]*CollectionEntity),
@@ -662,10 +1142,56 @@ func TestCacheAsyncDumpEntities(t *testing.T) {
 		}
 	}()
 	time.Sleep(150 * time.Millisecond)
-	cache.offCollector.stopDump <- struct{}{}
+	cache.offCollector.stopDump <- context.Background()
 	time.Sleep(50 * time.Millisecond)
 }
 
+func TestNewCacheFromFolderExpiryTime(t *testing.T) {
+	dir := t.TempDir()
+	oc := &OfflineCollector{
+		fldrPath:      dir,
+		fileSizeLimit: 1000,
+		logger:        nopLogger{},
+	}
+	var err error
+	if oc.file, oc.writer, oc.encoder, err = populateEncoder(dir, "", 0, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, oce := range []*OfflineCacheEntity{
+		{IsSet: true, ItemID: "never", Value: 1},
+		{IsSet: true, ItemID: "expired", Value: 2, ExpiryTime: time.Now().Add(-time.Second)},
+		{IsSet: true, ItemID: "valid", Value: 3, ExpiryTime: time.Now().Add(time.Minute)},
+	} {
+		if err := oc.writeEntity(context.Background(), oce); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oc.file.Close()
+	cache, err := NewCacheFromFolder(&OfflineCollector{
+		fldrPath:      dir,
+		fileSizeLimit: 1000,
+		logger:        nopLogger{},
+		collection:    make(map[string]*CollectionEntity),
+	}, UnlimitedCaching, 0, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.offCollector.file.Close()
+	if exp, has := cache.GetItemExpiryTime("never"); !has {
+		t.Error("item not in cache")
+	} else if !exp.IsZero() {
+		t.Errorf("expected no expiry, received: %v", exp)
+	}
+	if cache.HasItem("expired") {
+		t.Error("expired item should not be recovered")
+	}
+	if exp, has := cache.GetItemExpiryTime("valid"); !has {
+		t.Error("item not in cache")
+	} else if exp.Before(time.Now().Add(59 * time.Second)) {
+		t.Errorf("expected dumped expiry to be kept, received: %v", exp)
+	}
+}
+
 // BenchmarkSetSimpleCache 	10000000	       228 ns/op
 func BenchmarkSetSimpleCache(b *testing.B) {
 	cache := NewCache(UnlimitedCaching, 0, false, false, nil)
@@ -765,3 +1291,197 @@ func BenchmarkGetLRUttl(b *testing.B) {
 		cache.Get(ci.itemID)
 	}
 }
+
+func TestCacheReclaimMemory(t *testing.T) {
+	c := NewCache(3, 0, false, false, nil)
+	c.Set("item1", "value1", nil) // 11 bytes
+	c.Set("item2", []byte("value2"), nil)
+	c.Set("item3", "value3", nil)
+	c.Get("item1") // item2 becomes least recently used
+	if rcv := c.UsedBytes(); rcv != 33 {
+		t.Errorf("expected <33>, received <%d>", rcv)
+	}
+	if rcv := c.ReclaimMemory(12); rcv != 22 {
+		t.Errorf("expected <22>, received <%d>", rcv)
+	}
+	if exp, rcv := []string{"item1"}, c.GetItemIDs(""); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%v>, received <%v>", exp, rcv)
+	}
+	if rcv := c.ReclaimMemory(100); rcv != 11 {
+		t.Errorf("expected <11>, received <%d>", rcv)
+	}
+}
+
+// testClock is a Clock advanced manually by tests
+type testClock struct {
+	mux sync.Mutex
+	now time.Time
+}
+
+func (tc *testClock) Now() time.Time {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	return tc.now
+}
+
+func (tc *testClock) advance(d time.Duration) {
+	tc.mux.Lock()
+	tc.now = tc.now.Add(d)
+	tc.mux.Unlock()
+}
+
+func TestCacheClock(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tc := NewTransCache(map[string]*CacheConfig{
+		"cache1": {MaxItems: -1, TTL: time.Hour, Clock: clock},
+	})
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	if exp, _ := tc.GetItemExpiryTime("cache1", "item1"); !exp.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("expected <%v>, received <%v>", clock.Now().Add(time.Hour), exp)
+	}
+	clock.advance(59 * time.Minute)
+	if _, has := tc.Get("cache1", "item1"); !has { // refreshes the ttl
+		t.Error("expected item1 not expired yet")
+	}
+	clock.advance(59 * time.Minute)
+	if _, has := tc.Get("cache1", "item1"); !has {
+		t.Error("expected item1 not expired after its ttl was refreshed")
+	}
+	clock.advance(time.Hour)
+	if _, has := tc.Get("cache1", "item1"); has {
+		t.Error("expected item1 expired")
+	}
+
+	var evicted []string
+	c := NewCache(-1, 0, false, false, []func(itmID string, value any){
+		func(itmID string, _ any) { evicted = append(evicted, itmID) }})
+	c.SetClock(clock)
+	c.SetWithExpiry("item2", "value2", nil, time.Minute)
+	c.SetWithExpiry("item3", "value3", nil, time.Hour)
+	clock.advance(time.Minute)
+	if removed := c.ExpireNow(); removed != 1 {
+		t.Errorf("expected <1> item removed, received <%d>", removed)
+	}
+	if !reflect.DeepEqual([]string{"item2"}, evicted) {
+		t.Errorf("expected <%+v>, received <%+v>", []string{"item2"}, evicted)
+	}
+	if _, has := c.Get("item2"); has {
+		t.Error("expected item2 expired")
+	}
+	if c.Len() != 1 {
+		t.Errorf("expected <1> item left, received <%d>", c.Len())
+	}
+}
+
+func TestCacheSetLimitsConcurrent(t *testing.T) {
+	c := NewCache(-1, 0, false, false, nil)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := range 100 {
+			c.SetMaxItems(10 + i%5)
+			c.SetTTL(time.Duration(i%3)*time.Minute, i%2 == 0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := range 100 {
+			itmID := strconv.Itoa(i)
+			c.Set(itmID, i, nil)
+			c.SetWithTags(itmID, i, nil, map[string]string{"k": "v"})
+			c.SetIfAbsent("absent"+itmID, i, nil)
+			c.SetMulti(map[string]any{"multi" + itmID: i}, nil)
+			c.GetOrSet("getOrSet"+itmID, i, nil)
+			if err := c.SetCtx(context.Background(), itmID, i, nil); err != nil {
+				t.Error(err)
+			}
+			c.Get(itmID)
+		}
+	}()
+	wg.Wait()
+	if n := len(c.GetItemIDs("")); n > 14 {
+		t.Errorf("expected at most <%d> items, received <%d>", 14, n)
+	}
+}
+
+func TestCacheTTLHeapOrder(t *testing.T) {
+	c := NewCache(-1, time.Hour, false, false, nil)
+	for i, ttl := range []int{5, 3, 9, 1, 7, 2, 8} {
+		c.SetWithExpiry("item"+strconv.Itoa(i), i, nil, time.Duration(ttl)*time.Minute)
+	}
+	c.SetWithExpiry("item2", 2, nil, 30*time.Second) // latest moved first
+	c.SetWithExpiry("item3", 3, nil, 0)              // taken out of the index
+	c.Remove("item5")
+	if rcv := c.CheckConsistency(); len(rcv) != 0 {
+		t.Errorf("expected no violations, received <%+v>", rcv)
+	}
+	var rcv []string
+	c.Lock()
+	for c.ttlIdx.Len() != 0 {
+		rcv = append(rcv, heap.Pop(c.ttlIdx).(*cachedItem).itemID)
+	}
+	c.Unlock()
+	if exp := []string{"item2", "item1", "item0", "item4", "item6"}; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+}
+
+func TestCacheGetItemsByTagExpired(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := NewCache(UnlimitedCaching, time.Minute, true, false, nil)
+	c.SetClock(clock)
+	c.SetWithTags("item1", "value1", nil, map[string]string{"region": "eu"})
+	clock.advance(30 * time.Second)
+	c.SetWithTags("item2", "value2", nil, map[string]string{"region": "eu"})
+	clock.advance(30 * time.Second) // item1 expired but not yet cleaned
+	exp := map[string]any{"item2": "value2"}
+	if rcv := c.GetItemsByTag("region", "eu"); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+}
+
+func TestCacheShutdownStopsCleaner(t *testing.T) {
+	before := runtime.NumGoroutine()
+	caches := make([]*Cache, 10)
+	for i := range caches {
+		caches[i] = NewCache(UnlimitedCaching, 0, false, false, nil)
+		caches[i].SetWithExpiry("item1", "value1", nil, time.Hour) // starts cleaning expiries
+	}
+	if rcv := runtime.NumGoroutine(); rcv < before+len(caches) {
+		t.Fatalf("expected at least <%d> goroutines, received <%d>", before+len(caches), rcv)
+	}
+	for _, c := range caches {
+		c.Shutdown()
+	}
+	c := NewCache(UnlimitedCaching, time.Minute, false, false, nil)
+	c.Shutdown()
+	c.SetWithExpiry("item1", "value1", nil, time.Hour) // not started again once stopped
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("expected <%d> goroutines, received <%d>", before, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheRenameMaxMemory(t *testing.T) {
+	c := NewCache(-1, 0, false, false, nil)
+	c.SetMaxMemory(30, 0)
+	c.Set("a", strings.Repeat("x", 10), nil) // 11 bytes
+	c.Set("b", strings.Repeat("y", 10), nil)
+	// leaves b as the least recently used
+	c.Get("a")
+	if !c.Rename("a", "a"+strings.Repeat("z", 10)) { // 21 bytes, evicts b
+		t.Fatal("expected item renamed")
+	}
+	if _, has := c.Peek("b"); has {
+		t.Error("expected b to be evicted")
+	}
+	if rcv := c.UsedBytes(); rcv != 21 {
+		t.Errorf("expected <21>, received <%d>", rcv)
+	}
+	if issues := c.CheckConsistency(); len(issues) != 0 {
+		t.Error(issues)
+	}
+}
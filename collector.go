@@ -9,17 +9,25 @@ package ltcache
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/exp/mmap"
@@ -32,6 +40,8 @@ const (
 	// process of being rewritten
 	oldRewriteName = "oldRewrite" // prefix of the name of files to be deleted after
 	// renewing rewrite files
+	historyFolderName = "rewriteHistory" // folder inside a Cache instance dump folder keeping
+	// the files replaced by the latest rewrites, never read on recovery
 )
 
 // OfflineCollector used dump cache to files
@@ -48,20 +58,60 @@ type OfflineCollector struct {
 	collectSetEntity bool          // decides weather to collect or write the SET cache command
 	file             *os.File      // holds the file opened
 	writer           *bufio.Writer // holds the buffer writer
-	encoder          *gob.Encoder  // holds encoder
+	encoder          entityEncoder // holds encoder
 	fileSizeLimit    int64         // maximum size in bytes that can be written in a singular dump file
 	logger           logger
-	dumpInterval     time.Duration // holds duration to wait until next dump
-	stopDump         chan struct{} // Used to stop cache dumping inverval
-	dumpStopped      chan struct{} // signal when writing is finished
-	rewriteInterval  time.Duration // holds duration to wait until next rewrite
-	stopRewrite      chan struct{} // Used to stop inverval rewriting
-	rewriteStopped   chan struct{} // signal when rewriting is finished
+	dumpInterval     time.Duration        // holds duration to wait until next dump
+	stopDump         chan context.Context // Used to stop cache dumping inverval, bounding the last dump
+	dumpStopped      chan error           // signal when writing is finished, with its error
+	rewriteInterval  time.Duration        // holds duration to wait until next rewrite
+	stopRewrite      chan struct{}        // Used to stop inverval rewriting
+	rewriteStopped   chan error           // signal when rewriting is finished, with its error
+	renameRetries    int                  // times to retry a failed rename while rewriting
+	renameRetryDelay time.Duration        // delay before first rename retry, doubled on each retry
+	writeBufferSize  int                  // size in bytes of the dump file writer buffer, default if not positive
+
+	status     collectorStatus                   // outcome of the latest dump and rewrite
+	beforeDump func(itmID string, value any) any // transforms the value before being dumped to file
+	afterLoad  func(itmID string, value any) any // transforms the value read from dump file
+
+	validateEncodable  bool              // encode values when set, failing early on the ones which cannot be dumped
+	migrateEntity      MigrateEntityFunc // transforms or drops the entities read from dump files
+	keepRewriteHistory int               // generations of files replaced by rewriting kept, 0 deletes them
+	maxRecoveryBytes   int64             // maximum size of the dump files recovered from, 0 for no limit
+
+	shutdownRewriteThreshold float64 // minimum rewrite savings needed to rewrite on shutdown, 0 always rewrites
+	rejectOversized          bool    // fail setting values encoding to more than fileSizeLimit bytes
+
+	logMux sync.RWMutex // protects logger, which can be replaced at runtime
+
+	streamRecovery bool // read dump files through a buffer instead of mapping them in memory on recovery
+
+	removeBatchSize int      // removes written with one flush by bulk removals when dumping on each change
+	batchingRemoves bool     // a bulk removal is buffering removes, protected by the Cache lock
+	pendingRemoves  []string // removes buffered by the running bulk removal, protected by fileMux
+	batchingSets    bool     // a bulk set is collecting its sets, protected by the Cache lock
+
+	decodeInto func() any // creates the values dumped values are decoded into, nil decodes them as any
+
+	maxWriteFailures  int             // consecutive failed writes after which dumping stops, 0 never stops
+	writeFailures     int             // consecutive failed writes, protected by fileMux
+	degraded          atomic.Bool     // dumping stopped after failed writes, changes are only collected
+	onBackgroundError func(err error) // called when dumping stops after failed writes
+
+	coalesceWindow time.Duration       // duration within which repeated Sets of an item are dumped once
+	coalesced      map[string]struct{} // items dumped during the running window, protected by collMux
+	coalesceTimer  *time.Timer         // dumps the Sets collected during the window, protected by collMux
+
+	recoveryFS fs.FS // filesystem recovered from instead of fldrPath, with the instance folders at its root
+
+	codec    EntityCodec // format of the dump files, nil for gob
+	compress bool        // gzip the dump files
 }
 
 // NewOfflineCollector construct a new OfflineCollector
-func NewOfflineCollector(cacheName string, opts *TransCacheOpts, logger logger) *OfflineCollector {
-	return &OfflineCollector{
+func NewOfflineCollector(cacheName string, opts *TransCacheOpts, logger logger) (oc *OfflineCollector) {
+	oc = &OfflineCollector{
 		collection:       make(map[string]*CollectionEntity),
 		fldrPath:         path.Join(opts.DumpPath, cacheName),
 		backupPath:       opts.BackupPath,
@@ -70,11 +120,67 @@ func NewOfflineCollector(cacheName string, opts *TransCacheOpts, logger logger)
 		logger:           logger,
 		dumpInterval:     opts.DumpInterval,
 		rewriteInterval:  opts.RewriteInterval,
-		stopDump:         make(chan struct{}),
-		dumpStopped:      make(chan struct{}),
+		stopDump:         make(chan context.Context),
+		dumpStopped:      make(chan error, 1), // not blocking the goroutine once ShutdownCtx gave up
 		stopRewrite:      make(chan struct{}),
-		rewriteStopped:   make(chan struct{}),
+		rewriteStopped:   make(chan error, 1),
+		renameRetries:    opts.RenameRetries,
+		renameRetryDelay: opts.RenameRetryDelay,
+		writeBufferSize:  opts.WriteBufferSize,
 	}
+	oc.validateEncodable = opts.ValidateEncodable
+	oc.migrateEntity = opts.MigrateEntity
+	oc.keepRewriteHistory = opts.KeepRewriteHistory
+	oc.maxRecoveryBytes = opts.MaxRecoveryBytes
+	oc.shutdownRewriteThreshold = opts.ShutdownRewriteThreshold
+	oc.rejectOversized = opts.RejectOversizedValues
+	oc.streamRecovery = opts.StreamRecovery
+	oc.removeBatchSize = opts.RemoveBatchSize
+	oc.maxWriteFailures = opts.MaxWriteFailures
+	oc.coalesceWindow = opts.CoalesceWindow
+	oc.recoveryFS = opts.RecoveryFS
+	oc.codec = opts.Codec
+	oc.compress = opts.Compression
+	// hooks take the instance name from the dump folder, following renames of the instance
+	if opts.BeforeDump != nil {
+		oc.beforeDump = func(itmID string, value any) any {
+			return opts.BeforeDump(path.Base(oc.fldrPath), itmID, value)
+		}
+	}
+	if opts.OnBackgroundError != nil {
+		oc.onBackgroundError = func(err error) {
+			opts.OnBackgroundError(path.Base(oc.fldrPath), err)
+		}
+	}
+	if opts.AfterLoad != nil {
+		oc.afterLoad = func(itmID string, value any) any {
+			return opts.AfterLoad(path.Base(oc.fldrPath), itmID, value)
+		}
+	}
+	return
+}
+
+// collectorStatus holds the time and error of the latest dump and rewrite of an OfflineCollector
+type collectorStatus struct {
+	sync.RWMutex
+	lastDump    time.Time
+	dumpErr     error
+	lastRewrite time.Time
+	rewriteErr  error
+}
+
+// dumped records the outcome of a dump
+func (cs *collectorStatus) dumped(err error) {
+	cs.Lock()
+	cs.lastDump, cs.dumpErr = time.Now(), err
+	cs.Unlock()
+}
+
+// rewritten records the outcome of a rewrite
+func (cs *collectorStatus) rewritten(err error) {
+	cs.Lock()
+	cs.lastRewrite, cs.rewriteErr = time.Now(), err
+	cs.Unlock()
 }
 
 // CollectionEntity is used to temporarily collect cache keys of the items to be dumped to file
@@ -90,6 +196,236 @@ type OfflineCacheEntity struct {
 	Value      any       // Value of cache item to be stored in file
 	GroupIDs   []string  // GroupIDs of cache item to be stored in file
 	ExpiryTime time.Time // ExpiryTime of cache item to be stored in file
+
+	Tags map[string]string // Tags of cache item to be stored in file
+
+	EncodedValue []byte // Value encoded on its own, for instances decoding values with CacheConfig.DecodeInto
+}
+
+// EntityCodec writes and reads the OfflineCacheEntities of dump files in a format other than gob
+type EntityCodec interface {
+	Encode(w io.Writer, e OfflineCacheEntity) error
+	Decode(r io.Reader) (OfflineCacheEntity, error) // returns io.EOF once r holds no more entities
+}
+
+// JSONCodec dumps the entities as newline delimited JSON, readable by tools not written in Go.
+// Values are read back as the types encoding/json decodes into any, e.g. float64 for numbers
+type JSONCodec struct{}
+
+// Encode writes e as one line of JSON
+func (JSONCodec) Encode(w io.Writer, e OfflineCacheEntity) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Decode reads the next line of JSON from r. r is read byte by byte unless it is an io.ByteReader,
+// like the buffered readers used on recovery, so no entity is consumed ahead
+func (JSONCodec) Decode(r io.Reader) (e OfflineCacheEntity, err error) {
+	br, isByteReader := r.(io.ByteReader)
+	if !isByteReader {
+		br = oneByteReader{r}
+	}
+	var line []byte
+	var torn bool
+	for {
+		var b byte
+		if b, err = br.ReadByte(); err != nil {
+			if errors.Is(err, io.EOF) && len(line) != 0 { // last line not terminated
+				torn = true
+				break
+			}
+			return
+		}
+		if b == '\n' {
+			break
+		}
+		line = append(line, b)
+	}
+	if err = json.Unmarshal(line, &e); err != nil && torn { // cut while being written
+		err = fmt.Errorf("%w: %w", io.ErrUnexpectedEOF, err)
+	}
+	return
+}
+
+// oneByteReader reads an io.Reader one byte at a time
+type oneByteReader struct{ io.Reader }
+
+func (r oneByteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// entityEncoder writes the entities of one dump file, *gob.Encoder being the default one
+type entityEncoder interface {
+	Encode(e any) error
+}
+
+// codecEncoder writes *OfflineCacheEntity to w with codec
+type codecEncoder struct {
+	codec EntityCodec
+	w     io.Writer
+}
+
+func (ce codecEncoder) Encode(e any) error {
+	return ce.codec.Encode(ce.w, *e.(*OfflineCacheEntity))
+}
+
+// newEntityEncoder returns the encoder writing entities to w with codec, framed gob if nil
+func newEntityEncoder(w io.Writer, codec EntityCodec) entityEncoder {
+	if codec == nil {
+		return newFramedEncoder(w)
+	}
+	return codecEncoder{codec: codec, w: w}
+}
+
+// frameMagic starts the gob dump files made of records framed by framedEncoder, never found at
+// the start of a plain gob stream, a JSON one or a gzip one
+const frameMagic = "\x00LTC"
+
+// errDecodeEntity wraps the errors reading dump files which were opened
+var errDecodeEntity = errors.New("failed to decode OfflineCacheEntity")
+
+var (
+	errTornRecord    = errors.New("torn record")      // record cut by a crash while being written
+	errCorruptRecord = errors.New("corrupted record") // record not matching its checksum
+)
+
+// tornDumpFile returns true if err stopped the reading of a dump file at a record torn by a crash
+// or corrupted, the entities read before being kept. Any other decoding error fails the reading
+func tornDumpFile(err error) bool {
+	return errors.Is(err, errTornRecord) || errors.Is(err, errCorruptRecord) ||
+		errors.Is(err, io.ErrUnexpectedEOF) // unframed files ending in the middle of an entity
+}
+
+// framedEncoder gob encodes each entity in a record prefixed by its length and CRC32, so records
+// torn or corrupted are detected when reading them back
+type framedEncoder struct {
+	w         io.Writer
+	buf       bytes.Buffer
+	enc       *gob.Encoder // encodes into buf, keeping the gob types sent with the first records
+	started   bool         // frameMagic written
+	restarted bool         // enc replaced after a failed record, the next record starting a new gob stream
+}
+
+func newFramedEncoder(w io.Writer) *framedEncoder {
+	fe := &framedEncoder{w: w}
+	fe.enc = gob.NewEncoder(&fe.buf)
+	return fe
+}
+
+func (fe *framedEncoder) Encode(e any) (err error) {
+	fe.buf.Reset()
+	if err = fe.enc.Encode(e); err != nil {
+		// gob considers the types described in buf as sent, so the records after would refer
+		// to types never written. Start over with an encoder describing them again
+		fe.enc = gob.NewEncoder(&fe.buf)
+		fe.restarted = fe.started
+		return
+	}
+	if !fe.started {
+		if _, err = io.WriteString(fe.w, frameMagic); err != nil {
+			return
+		}
+		fe.started = true
+	}
+	var hdr [8]byte
+	if fe.restarted { // an empty record tells the reader to decode the next ones with a new decoder
+		if _, err = fe.w.Write(hdr[:]); err != nil {
+			return
+		}
+		fe.restarted = false
+	}
+	binary.BigEndian.PutUint32(hdr[:4], uint32(fe.buf.Len()))
+	binary.BigEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(fe.buf.Bytes()))
+	if _, err = fe.w.Write(hdr[:]); err != nil {
+		return
+	}
+	_, err = fe.w.Write(fe.buf.Bytes())
+	return
+}
+
+// errGobRestart is returned by frameReader where framedEncoder started a new gob stream
+var errGobRestart = errors.New("gob stream restarted")
+
+// frameReader returns the content of the records written by framedEncoder, failing on the
+// first one torn or not matching its checksum
+type frameReader struct {
+	r       io.Reader
+	content []byte // unread content of the current record
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	if len(fr.content) == 0 {
+		var hdr [8]byte
+		if _, err := io.ReadFull(fr.r, hdr[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, fmt.Errorf("%w header", errTornRecord)
+			}
+			return 0, err // io.EOF after the last record
+		}
+		var buf bytes.Buffer // grows with the data read, not trusting the length of corrupted headers
+		size := binary.BigEndian.Uint32(hdr[:4])
+		if size == 0 { // no gob message is empty
+			return 0, errGobRestart
+		}
+		if n, err := buf.ReadFrom(io.LimitReader(fr.r, int64(size))); err != nil {
+			return 0, err
+		} else if n != int64(size) {
+			return 0, fmt.Errorf("%w of <%d> bytes out of <%d>", errTornRecord, n, size)
+		}
+		if crc32.ChecksumIEEE(buf.Bytes()) != binary.BigEndian.Uint32(hdr[4:]) {
+			return 0, fmt.Errorf("%w, record checksum mismatch", errCorruptRecord)
+		}
+		fr.content = buf.Bytes()
+	}
+	n := copy(p, fr.content)
+	fr.content = fr.content[n:]
+	return n, nil
+}
+
+// unframed returns the reader of the entities in r, checking the records of framed files
+func unframed(r io.Reader) io.Reader {
+	br, isBufio := r.(*bufio.Reader)
+	if !isBufio {
+		br = bufio.NewReader(r)
+	}
+	if magic, err := br.Peek(len(frameMagic)); err != nil || string(magic) != frameMagic { // written before framing
+		return br
+	}
+	br.Discard(len(frameMagic))
+	return &frameReader{r: br}
+}
+
+// fileFormat returns the reader of the entities in r together with the codec of the file,
+// detected from its start so the files dumped before changing the codec are still read: framed
+// gob files start with frameMagic and JSON ones with '{'. Other files are read with codec, gob
+// if nil, except for JSONCodec which did not write them
+func fileFormat(r io.Reader, codec EntityCodec) (io.Reader, EntityCodec) {
+	br, isBufio := r.(*bufio.Reader)
+	if !isBufio {
+		br = bufio.NewReader(r)
+	}
+	start, _ := br.Peek(len(frameMagic)) // shorter for small files
+	_, isJSON := codec.(JSONCodec)
+	switch {
+	case string(start) == frameMagic:
+		return unframed(br), nil
+	case len(start) == 0: // empty file
+	case start[0] == '{':
+		if codec == nil {
+			return br, JSONCodec{}
+		}
+	case isJSON: // gob dumped before framing
+		return br, nil
+	}
+	return br, codec
 }
 
 type logger interface {
@@ -104,6 +440,23 @@ type logger interface {
 	Warning(string) error
 }
 
+// log returns the logger currently used by the collector (thread safe)
+func (coll *OfflineCollector) log() logger {
+	coll.logMux.RLock()
+	defer coll.logMux.RUnlock()
+	return coll.logger
+}
+
+// setLogger replaces the logger of the collector, nil disabling logging (thread safe)
+func (coll *OfflineCollector) setLogger(l logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	coll.logMux.Lock()
+	coll.logger = l
+	coll.logMux.Unlock()
+}
+
 type nopLogger struct{}
 
 func (nopLogger) Alert(string) error   { return nil }
@@ -117,9 +470,9 @@ func (nopLogger) Notice(string) error  { return nil }
 func (nopLogger) Warning(string) error { return nil }
 
 // populateEncoder will create and open a new dump file in the provided fldrPath with
-// prefix filePrefix, create an encoder and writer for it, and return them
-func populateEncoder(fldrPath string, filePrefix string) (file *os.File,
-	writer *bufio.Writer, encoder *gob.Encoder, err error) {
+// prefix filePrefix, create an encoder and writer of bufSize bytes for it, and return them
+func populateEncoder(fldrPath string, filePrefix string, bufSize int, codec EntityCodec, compress bool) (file *os.File,
+	writer *bufio.Writer, encoder entityEncoder, err error) {
 	filePath := filepath.Join(fldrPath, fmt.Sprintf("%s%d", filePrefix,
 		time.Now().UnixNano())) // path of the dump file of current caching
 	// instance, in nanoseconds in case another dump happens within the milisecond of the dump file created
@@ -127,13 +480,70 @@ func populateEncoder(fldrPath string, filePrefix string) (file *os.File,
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	writer = bufio.NewWriter(file)
-	encoder = gob.NewEncoder(writer)
+	writer = newFileWriter(file, bufSize, compress)
+	encoder = newEntityEncoder(writer, codec)
+	return
+}
+
+// newFileWriter returns the writer of bufSize bytes, default if not positive, of a dump file,
+// gzipping what is flushed to file if compress is true
+func newFileWriter(file *os.File, bufSize int, compress bool) *bufio.Writer {
+	if !compress {
+		return bufio.NewWriterSize(file, bufSize)
+	}
+	return bufio.NewWriterSize(gzipSyncWriter{gzip.NewWriter(file)}, bufSize)
+}
+
+// gzipSyncWriter compresses into a dump file, flushing the compressed data on each write so the
+// file can be read up to the last entity flushed. Files are appended until rotated and never get
+// the gzip trailer, whose absence is tolerated when reading them
+type gzipSyncWriter struct {
+	zw *gzip.Writer
+}
+
+func (w gzipSyncWriter) Write(p []byte) (n int, err error) {
+	if n, err = w.zw.Write(p); err != nil {
+		return
+	}
+	return n, w.zw.Flush()
+}
+
+// uncompressed returns the reader of the entities in r, decompressing them if r holds a gzip
+// stream, so compressed and uncompressed dump files can be read alike
+func uncompressed(r io.Reader) (io.Reader, error) {
+	br, isBufio := r.(*bufio.Reader)
+	if !isBufio {
+		br = bufio.NewReader(r)
+	}
+	if magic, err := br.Peek(2); err != nil || magic[0] != 0x1f || magic[1] != 0x8b { // empty or not compressed
+		return br, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	return untrailedGzip{zr}, nil
+}
+
+// untrailedGzip reads a gzip stream written by gzipSyncWriter, ending at the last flushed data
+type untrailedGzip struct {
+	zr *gzip.Reader
+}
+
+func (r untrailedGzip) Read(p []byte) (n int, err error) {
+	if n, err = r.zr.Read(p); errors.Is(err, io.ErrUnexpectedEOF) { // trailer never written
+		err = io.EOF
+	}
 	return
 }
 
 // validateFilePaths makes sure we dont recover from dump files that were stopped mid way rewriting
 func validateFilePaths(paths []string, fileName string) (validPaths []string, err error) {
+	return filterFilePaths(paths, fileName, os.Remove)
+}
+
+// filterFilePaths drops from paths the files left by interrupted rewrites, passing them to remove
+func filterFilePaths(paths []string, fileName string, remove func(string) error) (validPaths []string, err error) {
 	// if there are paths with "oldRewrite" prefix, recover from them instead of 0Rewrite
 	// having an oldRewrite still in the tree means the rewriting process was interupted
 	var removeZeroRewrite bool // true if prefix oldRewrite was found in name of files
@@ -146,14 +556,14 @@ func validateFilePaths(paths []string, fileName string) (validPaths []string, er
 	for _, s := range paths {
 		// dont include "tmpRewrite" paths
 		if strings.HasPrefix(s, path.Join(fileName, tmpRewriteName)) {
-			if err := os.Remove(s); err != nil {
+			if err := remove(s); err != nil {
 				return nil, err
 			}
 			continue
 		}
-		// dont include"0Rewrite" files if any "oldRewrite" found in tree
+		// dont include"0Rewrite"" files if any "oldRewrite" found in tree
 		if removeZeroRewrite && strings.HasPrefix(s, path.Join(fileName, rewriteFileName)) {
-			if err := os.Remove(s); err != nil {
+			if err := remove(s); err != nil {
 				return nil, err
 			}
 			continue
@@ -166,18 +576,102 @@ func validateFilePaths(paths []string, fileName string) (validPaths []string, er
 // getFilePaths gets all file paths from dir directory
 func getFilePaths(dir string) ([]string, error) {
 	var filePaths []string
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() {
+	err := filepath.WalkDir(dir, collectFilePaths(&filePaths))
+	return filePaths, err
+}
+
+// collectFilePaths returns a WalkDirFunc appending to filePaths the files walked, outside history folders
+func collectFilePaths(filePaths *[]string) fs.WalkDirFunc {
+	return func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
 			return err
 		}
-		filePaths = append(filePaths, path)
+		if d.IsDir() {
+			if d.Name() == historyFolderName {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		*filePaths = append(*filePaths, path)
+		return nil
+	}
+}
+
+// recoveryPaths returns the paths of the dump files to recover from, from recoveryFS if set
+func (coll *OfflineCollector) recoveryPaths() (paths []string, err error) {
+	if coll.recoveryFS == nil {
+		if paths, err = getFilePaths(coll.fldrPath); err != nil {
+			return nil, fmt.Errorf("error walking the path: %w", err)
+		}
+		return validateFilePaths(paths, coll.fldrPath)
+	}
+	chID := path.Base(coll.fldrPath)
+	if err = fs.WalkDir(coll.recoveryFS, chID, collectFilePaths(&paths)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) { // nothing dumped for the instance
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error walking the path: %w", err)
+	}
+	return filterFilePaths(paths, chID, func(string) error { return nil })
+}
+
+// recoveryFile reads the dump file at filePath with readFile, or from recoveryFS if set
+func (coll *OfflineCollector) recoveryFile(filePath string, readFile func(string, EntityCodec,
+	func(*OfflineCacheEntity)) error, handleEntity func(oce *OfflineCacheEntity)) (err error) {
+	defer func() {
+		if tornDumpFile(err) { // keep the entities read before the crash
+			coll.log().Warning(fmt.Sprintf("<%v>, recovering only the entities before", err))
+			err = nil
+		}
+	}()
+	if coll.recoveryFS == nil {
+		return readFile(filePath, coll.codec, handleEntity)
+	}
+	f, err := coll.recoveryFS.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening file <%s>: %w", filePath, err)
+	}
+	defer f.Close()
+	return decodeEntities(bufio.NewReader(f), filePath, coll.codec, handleEntity)
+}
+
+// EstimateRecovery walks the dump folder at folderPath without decoding any file and reports
+// the workload of recovering from it: the number of cache instance folders, the number of dump
+// files and their total size in bytes. Files left from interrupted rewrites are not counted
+// since they are ignored on recovery
+func EstimateRecovery(folderPath string) (instances int, files int, totalBytes int64, err error) {
+	err = filepath.WalkDir(folderPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == historyFolderName {
+				return fs.SkipDir
+			}
+			if path != folderPath && filepath.Dir(path) == filepath.Clean(folderPath) {
+				instances++
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), tmpRewriteName) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		totalBytes += info.Size()
 		return nil
 	})
-	return filePaths, err
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("error <%w> walking path <%v>", err, folderPath)
+	}
+	return
 }
 
 // readAndDecodeFile reads dump file and decodes into OfflineCacheEntity to be used by handleEntity function
-func readAndDecodeFile(filepath string, handleEntity func(oce *OfflineCacheEntity)) error {
+func readAndDecodeFile(filepath string, codec EntityCodec, handleEntity func(oce *OfflineCacheEntity)) error {
 	r, err := mmap.Open(filepath) // open mmap reader
 	if err != nil {
 		return fmt.Errorf("error opening file <%s> in memory: %w", filepath, err)
@@ -185,14 +679,51 @@ func readAndDecodeFile(filepath string, handleEntity func(oce *OfflineCacheEntit
 	defer r.Close()
 
 	// Decode directly from the mmap reader
-	dec := gob.NewDecoder(io.NewSectionReader(r, 0, int64(r.Len())))
+	return decodeEntities(io.NewSectionReader(r, 0, int64(r.Len())), filepath, codec, handleEntity)
+}
+
+// readAndDecodeStream decodes the dump file through a buffered reader instead of mapping
+// it in memory, keeping only the buffer resident while reading big files
+func readAndDecodeStream(filepath string, codec EntityCodec, handleEntity func(oce *OfflineCacheEntity)) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("error opening file <%s>: %w", filepath, err)
+	}
+	defer f.Close()
+	return decodeEntities(bufio.NewReader(f), filepath, codec, handleEntity)
+}
+
+// decodeEntities decodes the OfflineCacheEntities read from r with codec, gob if nil, passing
+// them in order to handleEntity. Files dumped in gob or JSON are read as such whatever codec is
+func decodeEntities(r io.Reader, filepath string, codec EntityCodec, handleEntity func(oce *OfflineCacheEntity)) error {
+	r, err := uncompressed(r)
+	if err != nil {
+		return fmt.Errorf("%w at <%s>: %w", errDecodeEntity, filepath, err)
+	}
+	r, codec = fileFormat(r, codec)
+	decode := func(oce *OfflineCacheEntity) (err error) {
+		*oce, err = codec.Decode(r)
+		return
+	}
+	if codec == nil {
+		dec := gob.NewDecoder(r)
+		decode = func(oce *OfflineCacheEntity) (err error) {
+			if err = dec.Decode(oce); errors.Is(err, errGobRestart) {
+				dec = gob.NewDecoder(r) // types described again from the next record
+				err = dec.Decode(oce)
+			}
+			return
+		}
+	} else if _, isByteReader := r.(io.ByteReader); !isByteReader {
+		r = bufio.NewReader(r) // let codecs read ahead without losing the next entities
+	}
 	for {
 		var oce OfflineCacheEntity
-		if err := dec.Decode(&oce); err != nil {
+		if err := decode(&oce); err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			return fmt.Errorf("failed to decode OfflineCacheEntity at <%s>: %w", filepath, err)
+			return fmt.Errorf("%w at <%s>: %w", errDecodeEntity, filepath, err)
 		}
 		// Call the handler function for each decoded entity
 		handleEntity(&oce)
@@ -200,6 +731,144 @@ func readAndDecodeFile(filepath string, handleEntity func(oce *OfflineCacheEntit
 	return nil
 }
 
+// moveFolder moves the dump folder to newPath, continuing to dump in a new file there (not thread safe)
+func (coll *OfflineCollector) moveFolder(newPath string) (err error) {
+	if _, err = os.Stat(newPath); err == nil {
+		return fmt.Errorf("dump folder <%s> already exists", newPath)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err = closeFile(coll.file); err != nil {
+		return
+	}
+	if err = os.Rename(coll.fldrPath, newPath); err == nil {
+		coll.fldrPath = newPath
+	}
+	var popErr error // keep dumping in the old folder if moving failed
+	if coll.file, coll.writer, coll.encoder, popErr = populateEncoder(coll.fldrPath, "",
+		coll.writeBufferSize, coll.codec, coll.compress); err == nil {
+		err = popErr
+	}
+	return
+}
+
+// checkRecoverySize makes sure the dump files at filePaths are within maxRecoveryBytes,
+// before loading any of them in memory
+func (coll *OfflineCollector) checkRecoverySize(filePaths []string) error {
+	if coll.maxRecoveryBytes <= 0 {
+		return nil
+	}
+	stat := os.Stat
+	if coll.recoveryFS != nil {
+		stat = func(name string) (fs.FileInfo, error) { return fs.Stat(coll.recoveryFS, name) }
+	}
+	var totalBytes int64
+	for _, filePath := range filePaths {
+		info, err := stat(filePath)
+		if err != nil {
+			return err
+		}
+		totalBytes += info.Size()
+	}
+	if totalBytes > coll.maxRecoveryBytes {
+		return fmt.Errorf("dump files of <%s> have <%d> bytes, over the recovery limit of <%d> bytes, rewrite or split the dump before recovering",
+			coll.fldrPath, totalBytes, coll.maxRecoveryBytes)
+	}
+	return nil
+}
+
+// readDumpFolder reads the dump folder of an instance the same way as recovering from it,
+// migrating and applying the entities over oceMap. The files left by interrupted rewrites are
+// skipped but not removed, the folder being only read. Returns the streamlined SET entities which
+// did not expire yet at now
+func readDumpFolder(fldrPath string, oceMap map[string]*OfflineCacheEntity,
+	migrate MigrateEntityFunc, codec EntityCodec, now time.Time) (map[string]*OfflineCacheEntity, error) {
+	filePaths, err := getFilePaths(fldrPath)
+	if err != nil {
+		return nil, fmt.Errorf("error walking the path: %w", err)
+	}
+	if filePaths, err = filterFilePaths(filePaths, fldrPath, func(string) error { return nil }); err != nil {
+		return nil, err
+	}
+	if oceMap == nil {
+		oceMap = make(map[string]*OfflineCacheEntity)
+	}
+	handleEntity := func(oce *OfflineCacheEntity) {
+		if migrate != nil {
+			var keep bool
+			if oce, keep = migrate(oce); !keep {
+				return
+			}
+		}
+		if oce.IsSet {
+			oceMap[oce.ItemID] = oce
+		} else {
+			delete(oceMap, oce.ItemID)
+		}
+	}
+	for _, filePath := range filePaths {
+		if err = readAndDecodeFile(filePath, codec, handleEntity); err != nil {
+			return nil, err
+		}
+	}
+	for itmID, oce := range oceMap {
+		if !oce.ExpiryTime.IsZero() && !now.Before(oce.ExpiryTime) { // dropped on recovery
+			delete(oceMap, itmID)
+		}
+	}
+	return oceMap, nil
+}
+
+// MergeDumpFolders merges the dump folders of two cache instances into a single rewrite file
+// in the empty or missing dst folder. Entities of srcB are applied after the ones of srcA, so
+// srcB wins for items found in both. Expired items are left out. The gob and JSON dumps of the
+// folders are merged into a gob one, the default format
+func MergeDumpFolders(dst, srcA, srcB string) (err error) {
+	now := time.Now()
+	oceMap, err := readDumpFolder(srcA, nil, nil, nil, now)
+	if err != nil {
+		return
+	}
+	if oceMap, err = readDumpFolder(srcB, oceMap, nil, nil, now); err != nil {
+		return
+	}
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return
+	}
+	if filePaths, err := getFilePaths(dst); err != nil {
+		return fmt.Errorf("error walking the path: %w", err)
+	} else if len(filePaths) != 0 {
+		return fmt.Errorf("destination folder <%s> is not empty", dst)
+	}
+	tmpRewritePath := path.Join(dst, tmpRewriteName)
+	file, err := os.OpenFile(tmpRewritePath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil { // dont leave behind partial files
+			file.Close()
+			os.Remove(tmpRewritePath)
+		}
+	}()
+	itmIDs := make([]string, 0, len(oceMap))
+	for itmID := range oceMap {
+		itmIDs = append(itmIDs, itmID)
+	}
+	slices.Sort(itmIDs)
+	writer := bufio.NewWriter(file)
+	enc := newEntityEncoder(writer, nil)
+	for _, itmID := range itmIDs {
+		if err = encodeAndDump(oceMap[itmID], enc, writer); err != nil {
+			return fmt.Errorf("error merging item <%s>: %w", itmID, err)
+		}
+	}
+	if err = file.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmpRewritePath, path.Join(dst, rewriteFileName+"0"))
+}
+
 // collect caching items on each set/remove to be dumped to file later on
 func (coll *OfflineCollector) collect(itemID string) {
 	coll.collMux.Lock()
@@ -211,7 +880,7 @@ func (coll *OfflineCollector) collect(itemID string) {
 }
 
 // encodeAndDump OfflineCacheEntity to file
-func encodeAndDump(oce *OfflineCacheEntity, enc *gob.Encoder, w *bufio.Writer) (err error) {
+func encodeAndDump(oce *OfflineCacheEntity, enc entityEncoder, w *bufio.Writer) (err error) {
 	if err = enc.Encode(oce); err != nil {
 		return fmt.Errorf("encode error: <%w>", err)
 	}
@@ -222,8 +891,8 @@ func encodeAndDump(oce *OfflineCacheEntity, enc *gob.Encoder, w *bufio.Writer) (
 }
 
 // rotateFileIfNeeded checks the size of the file and rotates it if it exceeds the limit. (not thread safe)
-func rotateFileIfNeeded(fldrPath string, fileSizeLimit int64, file *os.File) (newFile *os.File,
-	writer *bufio.Writer, encoder *gob.Encoder, err error) {
+func rotateFileIfNeeded(fldrPath string, fileSizeLimit int64, file *os.File, bufSize int,
+	codec EntityCodec, compress bool) (newFile *os.File, writer *bufio.Writer, encoder entityEncoder, err error) {
 	fileStat, err := file.Stat()
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("error getting file stat: %w", err)
@@ -238,34 +907,284 @@ func rotateFileIfNeeded(fldrPath string, fileSizeLimit int64, file *os.File) (ne
 		if err := file.Close(); err != nil {
 			return nil, nil, nil, fmt.Errorf("error closing file: %w", err)
 		}
-		return populateEncoder(fldrPath, prefix)
+		return populateEncoder(fldrPath, prefix, bufSize, codec, compress)
 	}
 	return
 }
 
-// writeEntity writes SET or REMOVE entity on dump file
-func (coll *OfflineCollector) writeEntity(oce *OfflineCacheEntity) error {
-	coll.fileMux.Lock()
+// MigrateEntityFunc transforms an entity read from dump files, returning false to drop it
+type MigrateEntityFunc func(oce *OfflineCacheEntity) (*OfflineCacheEntity, bool)
+
+// migrated passes oce read from dump files through migrateEntity, if set
+func (coll *OfflineCollector) migrated(oce *OfflineCacheEntity) (*OfflineCacheEntity, bool) {
+	if coll.migrateEntity == nil {
+		return oce, true
+	}
+	return coll.migrateEntity(oce)
+}
+
+// loadedValue returns the value of oce as it should be kept in cache
+func (coll *OfflineCollector) loadedValue(oce *OfflineCacheEntity) any {
+	value := oce.Value
+	if oce.EncodedValue != nil {
+		value = coll.decodedValue(oce)
+	}
+	if coll.afterLoad == nil {
+		return value
+	}
+	return coll.afterLoad(oce.ItemID, value)
+}
+
+// decodedValue decodes the EncodedValue of oce into a value created by decodeInto, logging
+// and returning nil if the value cannot be decoded
+func (coll *OfflineCollector) decodedValue(oce *OfflineCacheEntity) (value any) {
+	if coll.decodeInto == nil {
+		coll.log().Err(fmt.Sprintf("cannot decode value of item <%s> without DecodeInto", oce.ItemID))
+		return
+	}
+	value = coll.decodeInto()
+	if err := gob.NewDecoder(bytes.NewReader(oce.EncodedValue)).Decode(value); err != nil {
+		coll.log().Err(fmt.Sprintf("error <%v> decoding value of item <%s>", err, oce.ItemID))
+		return nil
+	}
+	return
+}
+
+// byteCounter is an io.Writer counting the bytes written to it
+type byteCounter int64
+
+func (bc *byteCounter) Write(p []byte) (int, error) {
+	*bc += byteCounter(len(p))
+	return len(p), nil
+}
+
+// checkEncodable makes sure the value of itmID can be encoded in dump files, when
+// validateEncodable is enabled, and fits the file size limit when rejectOversized is
+func (coll *OfflineCollector) checkEncodable(itmID string, value any) (err error) {
+	if !coll.validateEncodable && !coll.rejectOversized {
+		return
+	}
+	if coll.beforeDump != nil {
+		value = coll.beforeDump(itmID, value)
+	}
+	var size byteCounter // includes the gob type information, sent only once per dump file
+	if err = newEntityEncoder(&size, coll.codec).Encode(&OfflineCacheEntity{IsSet: true,
+		ItemID: itmID, Value: value}); err != nil {
+		return fmt.Errorf("item <%s> cannot be dumped, encode error: <%w>", itmID, err)
+	}
+	if coll.rejectOversized && int64(size) > coll.fileSizeLimit {
+		return fmt.Errorf("item <%s> encoded in <%d> bytes: %w", itmID, size, ErrValueTooLarge)
+	}
+	return
+}
+
+// writeEntity writes SET or REMOVE entity on dump file, returning ctx.Err() without writing
+// if ctx is done before encoding it
+func (coll *OfflineCollector) writeEntity(ctx context.Context, oce *OfflineCacheEntity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if oce.IsSet && coll.beforeDump != nil { // dont modify the entity of the caller
+		dumpOce := *oce
+		dumpOce.Value = coll.beforeDump(oce.ItemID, oce.Value)
+		oce = &dumpOce
+	}
+	if oce.IsSet && coll.decodeInto != nil { // encode the concrete value, not needing gob.Register
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(oce.Value); err != nil {
+			return fmt.Errorf("encode error: <%w>", err)
+		}
+		dumpOce := *oce
+		dumpOce.Value, dumpOce.EncodedValue = nil, buf.Bytes()
+		oce = &dumpOce
+	}
+	if err := lockCtx(ctx, coll.fileMux.Lock, coll.fileMux.Unlock); err != nil {
+		return err
+	}
 	defer coll.fileMux.Unlock()
+	if coll.degraded.Load() {
+		return ErrCollectorDegraded
+	}
 	var err error
-	if file, writer, encoder, err := rotateFileIfNeeded(coll.fldrPath,
-		coll.fileSizeLimit, coll.file); err != nil {
+	defer func() { coll.recordWrite(err) }()
+	if err = coll.writePendingRemoves(); err != nil { // keep the order of removes buffered before
+		return err
+	}
+	if err = coll.rotateIfNeeded(); err != nil {
 		return err
-	} else if encoder != nil { // if rotateFileIfNeeded encoder returned nil it means rotating files
-		//  wasnt needed and didnt happen
-		coll.file, coll.writer, coll.encoder = file, writer, encoder
 	}
 	if err = encodeAndDump(oce, coll.encoder, coll.writer); err != nil {
-		coll.logger.Err(fmt.Sprintf("Error <%v>, writing cache item <%#v>", err, oce))
+		coll.log().Err(fmt.Sprintf("Error <%v>, writing cache item <%#v>", err, oce))
 	}
 	return err
 }
 
+// diskSnapshot populates is with the state of the dump folder and collection, blocking
+// dumping and rewriting while reading it
+func (coll *OfflineCollector) diskSnapshot(is *InstanceSnapshot) {
+	coll.collMux.RLock()
+	defer coll.collMux.RUnlock()
+	coll.rewriteMux.RLock()
+	defer coll.rewriteMux.RUnlock()
+	coll.fileMux.RLock()
+	defer coll.fileMux.RUnlock()
+	is.Persistent = true
+	is.PendingEntities = len(coll.collection)
+	if _, files, diskBytes, err := EstimateRecovery(coll.fldrPath); err == nil {
+		is.DiskFiles, is.DiskBytes = files, diskBytes
+	}
+	coll.status.RLock()
+	is.LastDump, is.LastRewrite = coll.status.lastDump, coll.status.lastRewrite
+	coll.status.RUnlock()
+}
+
+// recordWrite counts the consecutive writes failing on disk, stopping dumping once they reach
+// maxWriteFailures. Afterwards changes are only collected, until Flush succeeds (fileMux held)
+func (coll *OfflineCollector) recordWrite(err error) {
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) { // encoding errors are not caused by the disk
+		if err == nil {
+			coll.writeFailures = 0
+		}
+		return
+	}
+	coll.writeFailures++
+	if coll.maxWriteFailures <= 0 || coll.writeFailures < coll.maxWriteFailures {
+		return
+	}
+	coll.degraded.Store(true)
+	coll.log().Crit(fmt.Sprintf("stopped dumping <%s> after <%d> failed writes, last error <%v>",
+		coll.fldrPath, coll.writeFailures, err))
+	if coll.onBackgroundError != nil {
+		coll.onBackgroundError(err)
+	}
+}
+
+// resumeWriting switches to a new dump file, ending the degraded state if the file could be
+// created (fileMux held)
+func (coll *OfflineCollector) resumeWriting() (err error) {
+	file, writer, encoder, err := populateEncoder(coll.fldrPath, "", coll.writeBufferSize, coll.codec, coll.compress)
+	if err != nil {
+		return
+	}
+	closeFile(coll.file) // failed to be written, nothing to flush
+	coll.file, coll.writer, coll.encoder = file, writer, encoder
+	coll.writeFailures = 0
+	coll.degraded.Store(false)
+	return
+}
+
+// rotateIfNeeded switches to a new dump file once the current one is over the size limit (not thread safe)
+func (coll *OfflineCollector) rotateIfNeeded() error {
+	file, writer, encoder, err := rotateFileIfNeeded(coll.fldrPath,
+		coll.fileSizeLimit, coll.file, coll.writeBufferSize, coll.codec, coll.compress)
+	if err != nil {
+		return err
+	}
+	if encoder != nil { // if rotateFileIfNeeded encoder returned nil it means rotating files
+		//  wasnt needed and didnt happen
+		coll.file, coll.writer, coll.encoder = file, writer, encoder
+	}
+	return nil
+}
+
+// writePendingRemoves writes the buffered removes to the dump file with a single flush. A batch
+// is written to one file, which can grow over the size limit by at most one batch (not thread safe)
+func (coll *OfflineCollector) writePendingRemoves() (err error) {
+	if len(coll.pendingRemoves) == 0 {
+		return
+	}
+	defer func() { coll.pendingRemoves = coll.pendingRemoves[:0] }()
+	if err = coll.rotateIfNeeded(); err != nil {
+		return
+	}
+	for _, itemID := range coll.pendingRemoves {
+		if err = coll.encoder.Encode(&OfflineCacheEntity{ItemID: itemID}); err != nil {
+			return fmt.Errorf("encode error: <%w>", err)
+		}
+	}
+	if err = coll.writer.Flush(); err != nil {
+		return fmt.Errorf("write error: <%w>", err)
+	}
+	return
+}
+
+// flushRemoves writes the buffered removes to the dump file (thread safe)
+func (coll *OfflineCollector) flushRemoves() {
+	coll.fileMux.Lock()
+	defer coll.fileMux.Unlock()
+	if err := coll.writePendingRemoves(); err != nil {
+		coll.log().Err(err.Error())
+	}
+}
+
+// endRemoveBatch stops buffering removes, writing the ones buffered so far
+func (coll *OfflineCollector) endRemoveBatch() {
+	coll.batchingRemoves = false
+	coll.flushRemoves()
+}
+
+// coalesce reports if the Set of itemID repeats one dumped within the running window, so it
+// should be collected instead, starting the window with dumpWindow if none is running (collMux held)
+func (coll *OfflineCollector) coalesce(itemID string, dumpWindow func()) bool {
+	if coll.coalesceWindow <= 0 {
+		return false
+	}
+	if _, has := coll.coalesced[itemID]; has {
+		return true
+	}
+	if coll.coalesced == nil {
+		coll.coalesced = make(map[string]struct{})
+		coll.coalesceTimer = time.AfterFunc(coll.coalesceWindow, dumpWindow)
+	}
+	coll.coalesced[itemID] = struct{}{}
+	return false
+}
+
+// replaceCollectedSet replaces the Set of a removed itemID, collected by coalescing, a bulk set or
+// a SetCtx aborted before writing it, with its remove, keeping them in order, and reports if there
+// was one (thread safe)
+func (coll *OfflineCollector) replaceCollectedSet(itemID string) (has bool) {
+	coll.collMux.Lock()
+	defer coll.collMux.Unlock()
+	if _, has = coll.collection[itemID]; has {
+		coll.collection[itemID] = &CollectionEntity{ItemID: itemID}
+	}
+	return
+}
+
+// hasCollected reports if there are changes collected and not dumped yet (thread safe)
+func (coll *OfflineCollector) hasCollected() bool {
+	coll.collMux.RLock()
+	defer coll.collMux.RUnlock()
+	return len(coll.collection) != 0
+}
+
 // storeRemoveEntity dumps the removed Cache itemID on file or collects the entity
 func (coll *OfflineCollector) storeRemoveEntity(itemID string) {
+	if coll.dumpInterval == -1 && coll.degraded.Load() { // collect until writing is resumed
+		coll.collMux.Lock()
+		coll.collection[itemID] = &CollectionEntity{ItemID: itemID}
+		coll.collMux.Unlock()
+		return
+	}
+	if coll.dumpInterval == -1 &&
+		coll.replaceCollectedSet(itemID) { // dumped after the Set collected while coalescing, batching or aborted by SetCtx
+		return
+	}
+	if coll.dumpInterval == -1 && coll.batchingRemoves {
+		coll.fileMux.Lock()
+		coll.pendingRemoves = append(coll.pendingRemoves, itemID)
+		full := len(coll.pendingRemoves) >= coll.removeBatchSize
+		coll.fileMux.Unlock()
+		if full {
+			coll.flushRemoves()
+		}
+		return
+	}
 	if coll.dumpInterval == -1 {
-		if err := coll.writeEntity(&OfflineCacheEntity{ItemID: itemID}); err != nil {
-			coll.logger.Err(err.Error())
+		if err := coll.writeEntity(context.Background(), &OfflineCacheEntity{ItemID: itemID}); err != nil {
+			coll.log().Err(err.Error())
 			return
 		}
 		return
@@ -279,8 +1198,12 @@ func (coll *OfflineCollector) storeRemoveEntity(itemID string) {
 func (coll *OfflineCollector) rewriteFiles() (err error) {
 	coll.rewriteMux.Lock()
 	defer coll.rewriteMux.Unlock()
-	filePaths, oceMap, skip, err := coll.getFilePathsAndOfflineEntities()
-	if skip || err != nil { // make sure rewriting is needed before continuing
+	filePaths, oceMap, _, skip, err := coll.getFilePathsAndOfflineEntities()
+	if skip { // make sure rewriting is needed before continuing
+		return
+	}
+	defer func() { coll.status.rewritten(err) }()
+	if err != nil {
 		return
 	}
 	tmpRewritePath := path.Join(coll.fldrPath, tmpRewriteName)   // temporary path to rewrite file
@@ -299,18 +1222,18 @@ func (coll *OfflineCollector) rewriteFiles() (err error) {
 			file.Close()
 			for i := range tmpFilePaths {
 				if rmvErr := os.Remove(tmpFilePaths[i]); rmvErr != nil {
-					coll.logger.Warning("Failed to remove tmp rewritten file <" + tmpFilePaths[i] + ">, error: " + rmvErr.Error())
+					coll.log().Warning("Failed to remove tmp rewritten file <" + tmpFilePaths[i] + ">, error: " + rmvErr.Error())
 				}
 			}
 		}
 	}()
-	writer := bufio.NewWriter(file)
-	enc := gob.NewEncoder(writer)
+	writer := newFileWriter(file, coll.writeBufferSize, coll.compress)
+	enc := newEntityEncoder(writer, coll.codec)
 	// range over the streamlined cache items read from dump, and write each one in
 	// temporary tmpRewritePath file
 	for _, oce := range oceMap {
 		if newFile, newWriter, newEnc, err := rotateFileIfNeeded(coll.fldrPath, coll.fileSizeLimit,
-			file); err != nil {
+			file, coll.writeBufferSize, coll.codec, coll.compress); err != nil {
 			return fmt.Errorf("error rewriting <%w>", err)
 		} else if newEnc != nil { // if rotateFileIfNeeded encoder returned nil it means rotating
 			// files wasnt needed
@@ -320,15 +1243,26 @@ func (coll *OfflineCollector) rewriteFiles() (err error) {
 			tmpFilePaths = append(tmpFilePaths, newFile.Name())
 		}
 		if err := encodeAndDump(oce, enc, writer); err != nil {
-			coll.logger.Warning(fmt.Sprintf("Rewrite failed. OfflineCacheEntity <%#v> \nError <%v>", oce, err))
+			coll.log().Warning(fmt.Sprintf("Rewrite failed. OfflineCacheEntity <%#v> \nError <%v>", oce, err))
 			return err
 		}
 	}
 	file.Close()
+	// hold writes on the live dump file until files are swapped, so a write-through Set
+	// never races the renaming and always lands in a file kept after rewriting
+	coll.fileMux.Lock()
+	defer coll.fileMux.Unlock()
+	if slices.Contains(filePaths, coll.file.Name()) { // live dump file must never be replaced
+		return fmt.Errorf("current dump file <%s> was collected for rewriting", coll.file.Name())
+	}
+	origNames := make([]string, len(filePaths)) // names before renaming, kept in rewrite history
+	for i := range filePaths {
+		origNames[i] = filepath.Base(filePaths[i])
+	}
 	// Rename old 0Rewrite files to oldRewrite if they exist
 	for i := range filePaths {
 		if strings.Contains(filePaths[i], zeroRewritePath) {
-			if err = os.Rename(filePaths[i], oldRewritePath+strconv.Itoa(i)); err != nil {
+			if err = coll.rename(filePaths[i], oldRewritePath+strconv.Itoa(i)); err != nil {
 				return fmt.Errorf("failed to rename file from <%s>, to <%s>, error <%w>",
 					zeroRewritePath, oldRewritePath+strconv.Itoa(i), err)
 			}
@@ -341,11 +1275,14 @@ func (coll *OfflineCollector) rewriteFiles() (err error) {
 		// account for a maximum of digit number of iterations so we keep the order of the files
 		index := fmt.Sprintf(fmt.Sprintf("%%0%dd", len(strconv.Itoa(len(tmpFilePaths)))), i)
 		zeroRPath := zeroRewritePath + index
-		if err = os.Rename(tmpFilePaths[i], zeroRPath); err != nil {
+		if err = coll.rename(tmpFilePaths[i], zeroRPath); err != nil {
 			return fmt.Errorf("failed to rename file from <%s> to <%s>, error <%w> ",
 				tmpFilePaths[i], zeroRPath, err)
 		}
 	}
+	if coll.keepRewriteHistory > 0 {
+		return coll.archiveRewritten(filePaths, origNames)
+	}
 	for i := range filePaths { // remove old redundant files after everything was successful
 		if err = os.Remove(filePaths[i]); err != nil {
 			return fmt.Errorf("failed to remove file <%s>, error <%w> ", filePaths[i], err)
@@ -354,11 +1291,131 @@ func (coll *OfflineCollector) rewriteFiles() (err error) {
 	return nil
 }
 
+// archiveRewritten moves the files replaced by a rewrite, under their original names, into a
+// new generation folder of the rewrite history, keeping only the latest keepRewriteHistory
+// generations (not thread safe)
+func (coll *OfflineCollector) archiveRewritten(filePaths, origNames []string) (err error) {
+	genPath := path.Join(coll.fldrPath, historyFolderName, strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err = os.MkdirAll(genPath, 0755); err != nil {
+		return
+	}
+	for i := range filePaths {
+		if err = coll.rename(filePaths[i], path.Join(genPath, origNames[i])); err != nil {
+			return fmt.Errorf("failed to archive file <%s>, error <%w> ", filePaths[i], err)
+		}
+	}
+	gens, err := coll.rewriteGenerations()
+	if err != nil {
+		return
+	}
+	for _, gen := range gens[min(len(gens), coll.keepRewriteHistory):] {
+		if err = os.RemoveAll(gen); err != nil {
+			return fmt.Errorf("failed to remove rewrite history <%s>, error <%w> ", gen, err)
+		}
+	}
+	return
+}
+
+// rewriteGenerations returns the paths of the rewrite history folders, the latest first
+func (coll *OfflineCollector) rewriteGenerations() (gens []string, err error) {
+	histPath := path.Join(coll.fldrPath, historyFolderName)
+	entries, err := os.ReadDir(histPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return
+	}
+	for _, entry := range entries { // entries are sorted by the timestamp names
+		if entry.IsDir() {
+			gens = append(gens, path.Join(histPath, entry.Name()))
+		}
+	}
+	slices.Reverse(gens)
+	return
+}
+
+// restoreRewrite puts back in the dump folder the files replaced by the rewrite of generation
+// (0 being the latest), together with the files dumped after it, dropping the files rewritten
+// since then. These are first moved to a new latest generation, deleted only once everything
+// is restored, so no file is lost if restoring fails midway (not thread safe)
+func (coll *OfflineCollector) restoreRewrite(generation int) (err error) {
+	gens, err := coll.rewriteGenerations()
+	if err != nil {
+		return
+	}
+	if generation < 0 || generation >= len(gens) {
+		return fmt.Errorf("rewrite history generation <%d> not found, <%d> available", generation, len(gens))
+	}
+	entries := make([][]os.DirEntry, generation+1) // read before changing anything
+	for i := range entries {
+		if entries[i], err = os.ReadDir(gens[i]); err != nil {
+			return
+		}
+	}
+	filePaths, err := getFilePaths(coll.fldrPath)
+	if err != nil {
+		return fmt.Errorf("error walking the path: %w", err)
+	}
+	supersededPath := path.Join(coll.fldrPath, historyFolderName, strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err = os.MkdirAll(supersededPath, 0755); err != nil {
+		return
+	}
+	for _, filePath := range filePaths { // set aside the results of rewriting
+		if name := filepath.Base(filePath); strings.HasPrefix(name, rewriteFileName) {
+			if err = coll.rename(filePath, path.Join(supersededPath, name)); err != nil {
+				return
+			}
+		}
+	}
+	var rewritten []string // rewrite files of generation, restored last
+	for i := generation; i >= 0; i-- {
+		for _, entry := range entries[i] {
+			if strings.HasPrefix(entry.Name(), rewriteFileName) {
+				if i == generation {
+					rewritten = append(rewritten, entry.Name())
+				}
+				continue // the ones of newer generations rewritten again, replaced by their files
+			}
+			if err = coll.rename(path.Join(gens[i], entry.Name()),
+				path.Join(coll.fldrPath, entry.Name())); err != nil {
+				return
+			}
+		}
+	}
+	for _, name := range rewritten {
+		if err = coll.rename(path.Join(gens[generation], name), path.Join(coll.fldrPath, name)); err != nil {
+			return
+		}
+	}
+	for i := generation; i >= 0; i-- {
+		if err = os.RemoveAll(gens[i]); err != nil {
+			return
+		}
+	}
+	return os.RemoveAll(supersededPath)
+}
+
+// rename renames oldPath to newPath, retrying with backoff up to renameRetries times in
+// case of failure, so transient errors on networked filesystems dont abort the rewrite
+func (coll *OfflineCollector) rename(oldPath, newPath string) (err error) {
+	delay := coll.renameRetryDelay
+	for i := 0; ; i++ {
+		if err = os.Rename(oldPath, newPath); err == nil || i >= coll.renameRetries {
+			return
+		}
+		coll.log().Warning(fmt.Sprintf("Failed to rename file <%s> to <%s>, error <%v>, retrying in <%v>",
+			oldPath, newPath, err, delay))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 // getFilePathsAndOfflineEntities will look into the cache dump folder and return the
 // paths to each file inside it, excluding current opened dump file. Returns also the streamlined cache
-// dump it read from all the files gathered
+// dump it read from all the files gathered, together with the number of entities read
 func (coll *OfflineCollector) getFilePathsAndOfflineEntities() (filePaths []string,
-	oceMap map[string]*OfflineCacheEntity, skip bool, err error) {
+	oceMap map[string]*OfflineCacheEntity, read int, skip bool, err error) {
 	coll.fileMux.RLock() // make sure current opened dump file isnt switched while cache
 	//  dump folder is being read
 	currentDumpFilePath := coll.file.Name() // save path of file which is currently being
@@ -368,6 +1425,9 @@ func (coll *OfflineCollector) getFilePathsAndOfflineEntities() (filePaths []stri
 		if err != nil {
 			return err
 		}
+		if d.IsDir() && d.Name() == historyFolderName {
+			return fs.SkipDir
+		}
 		// Exclude root and current dump file paths from filePaths
 		if !d.IsDir() && !strings.HasSuffix(currentDumpFilePath, d.Name()) {
 			filePaths = append(filePaths, path)
@@ -375,15 +1435,20 @@ func (coll *OfflineCollector) getFilePathsAndOfflineEntities() (filePaths []stri
 		return nil
 	}); err != nil {
 		coll.fileMux.RUnlock()
-		return nil, nil, false, fmt.Errorf("error <%w> walking path <%v>", err, coll.fldrPath)
+		return nil, nil, 0, false, fmt.Errorf("error <%w> walking path <%v>", err, coll.fldrPath)
 	}
 	coll.fileMux.RUnlock()
 
 	if shouldSkipRewrite(filePaths, coll.fldrPath) {
-		return nil, nil, true, nil
+		return nil, nil, 0, true, nil
 	}
 	oceMap = make(map[string]*OfflineCacheEntity)   // momentarily hold only necessary entities of all files of cache dump. Needed so we don’t write something which will be removed on the next coming files.
 	handleEntity := func(oce *OfflineCacheEntity) { // will add/delete OfflineCacheEntity from oceMap
+		read++
+		var keep bool
+		if oce, keep = coll.migrated(oce); !keep { // rewritten files keep the migrated format
+			return
+		}
 		if oce.IsSet {
 			oceMap[oce.ItemID] = oce
 		} else {
@@ -391,13 +1456,27 @@ func (coll *OfflineCollector) getFilePathsAndOfflineEntities() (filePaths []stri
 		}
 	}
 	for i := range filePaths { // populate oceMap from dump files
-		if err := readAndDecodeFile(filePaths[i], handleEntity); err != nil {
-			return nil, nil, false, fmt.Errorf("error <%w> reading file <%v>", err, filePaths[i])
+		if err := readAndDecodeFile(filePaths[i], coll.codec, handleEntity); tornDumpFile(err) {
+			coll.log().Warning(fmt.Sprintf("<%v>, rewriting only the entities before", err))
+		} else if err != nil {
+			return nil, nil, 0, false, fmt.Errorf("error <%w> reading file <%v>", err, filePaths[i])
 		}
 	}
 	return
 }
 
+// rewriteSavings returns the fraction of the entities in the dump files, excluding the current
+// one, which rewriting would drop. Returns 0 if there is nothing to rewrite
+func (coll *OfflineCollector) rewriteSavings() (savings float64, err error) {
+	coll.rewriteMux.RLock() // files should not be replaced while being read
+	defer coll.rewriteMux.RUnlock()
+	_, oceMap, read, skip, err := coll.getFilePathsAndOfflineEntities()
+	if skip || err != nil || read == 0 {
+		return
+	}
+	return 1 - float64(len(oceMap))/float64(read), nil
+}
+
 // shouldSkipRewrite will return true to skip a rewrite if no dumpfiles are found on filePaths.
 // Otherwise means dumpfiles should be rewritten without touching the current open dump file.
 func shouldSkipRewrite(filePaths []string, cacheFldrPath string) bool {
@@ -8,9 +8,12 @@ package ltcache
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -23,7 +26,7 @@ import (
 
 func TestPopulateEncodersErr(t *testing.T) {
 	expErr := "no such file or directory"
-	if _, _, _, err := populateEncoder("/tmp/testOff/*default", ""); err == nil ||
+	if _, _, _, err := populateEncoder("/tmp/testOff/*default", "", 0, nil, false); err == nil ||
 		!strings.Contains(err.Error(), expErr) {
 		t.Errorf("Expected error <%v>, Received <%v>", expErr, err)
 	}
@@ -50,7 +53,7 @@ func TestOfflineCollectorWriteEntity(t *testing.T) {
 		fldrPath:      path + "/*default",
 		file:          tmpFile,
 	}
-	if err := oc.writeEntity(&OfflineCacheEntity{}); err != nil {
+	if err := oc.writeEntity(context.Background(), &OfflineCacheEntity{}); err != nil {
 		t.Error(err)
 	} else if !strings.HasPrefix(oc.file.Name(), "/tmp/internal_db/*default/"+tmpRewriteName) {
 		t.Errorf("expected new file, received <%v>", oc.file.Name())
@@ -69,12 +72,12 @@ func TestOfflineCollectorWriteEntityUniqueFileNames(t *testing.T) {
 		logger:        nopLogger{},
 	}
 	var err error
-	oc.file, oc.writer, oc.encoder, err = populateEncoder(dir, "")
+	oc.file, oc.writer, oc.encoder, err = populateEncoder(dir, "", 0, nil, false)
 	if err != nil {
 		t.Fatal(err)
 	}
 	for i := 0; i < 10; i++ {
-		if err := oc.writeEntity(&OfflineCacheEntity{IsSet: true, ItemID: fmt.Sprintf("item%d", i), Value: i}); err != nil {
+		if err := oc.writeEntity(context.Background(), &OfflineCacheEntity{IsSet: true, ItemID: fmt.Sprintf("item%d", i), Value: i}); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -94,7 +97,7 @@ func TestOfflineCollectorWriteEntityUniqueFileNames(t *testing.T) {
 			t.Fatalf("duplicate filename found: %s", entry.Name())
 		}
 		seen[entry.Name()] = struct{}{}
-		if err := readAndDecodeFile(filepath.Join(dir, entry.Name()), func(oce *OfflineCacheEntity) {}); err != nil {
+		if err := readAndDecodeFile(filepath.Join(dir, entry.Name()), nil, func(oce *OfflineCacheEntity) {}); err != nil {
 			t.Fatalf("failed to decode %s: %v", entry.Name(), err)
 		}
 	}
@@ -182,7 +185,7 @@ func TestReadAndDecodeFileDecodeSet(t *testing.T) {
 		"testID": {IsSet: true, ItemID: "testID", Value: "value",
 			GroupIDs: []string{"gpID"}},
 	}
-	if err := readAndDecodeFile(path+"/file", handleEntity); err != nil {
+	if err := readAndDecodeFile(path+"/file", nil, handleEntity); err != nil {
 		t.Error(err)
 	}
 	if !reflect.DeepEqual(exp, oceMap) {
@@ -225,7 +228,7 @@ func TestReadAndDecodeFileDecodeRemove(t *testing.T) {
 		}
 	}
 	exp := map[string]*OfflineCacheEntity{}
-	if err := readAndDecodeFile(path+"/file", handleEntity); err != nil {
+	if err := readAndDecodeFile(path+"/file", nil, handleEntity); err != nil {
 		t.Error(err)
 	}
 	if !reflect.DeepEqual(exp, oceMap) {
@@ -243,7 +246,7 @@ func TestReadAndDecodeFileErr1(t *testing.T) {
 			delete(oceMap, oce.ItemID)
 		}
 	}
-	if err := readAndDecodeFile("", handleEntity); err == nil ||
+	if err := readAndDecodeFile("", nil, handleEntity); err == nil ||
 		err.Error() != expErr {
 		t.Errorf("Expected error <%v>, Received <%v>", expErr, err)
 	}
@@ -322,7 +325,7 @@ func TestOfflineCollectorCheckAndRotateFile(t *testing.T) {
 		}
 	}()
 	tmpFile.WriteString("writing")
-	if newf, w, e, err := rotateFileIfNeeded(path+"/*default", 0, tmpFile); err != nil {
+	if newf, w, e, err := rotateFileIfNeeded(path+"/*default", 0, tmpFile, 0, nil, false); err != nil {
 		t.Error(err)
 	} else if newf == nil {
 		t.Errorf("expected new file, received nil")
@@ -348,7 +351,7 @@ func TestOfflineCollectorCheckAndRotateFileErr(t *testing.T) {
 		}
 	}()
 	tmpFile.WriteString("writing")
-	if newf, w, e, err := rotateFileIfNeeded(path+"/*default", 0, tmpFile); err != nil {
+	if newf, w, e, err := rotateFileIfNeeded(path+"/*default", 0, tmpFile, 0, nil, false); err != nil {
 		t.Error(err)
 	} else if newf == nil {
 		t.Errorf("expected new file, received nil")
@@ -374,7 +377,7 @@ func TestOfflineCollectorCheckAndRotateFileNoLimit(t *testing.T) {
 		}
 	}()
 	tmpFile.WriteString("writing")
-	if newf, w, e, err := rotateFileIfNeeded(path+"/*default", 1000, tmpFile); err != nil {
+	if newf, w, e, err := rotateFileIfNeeded(path+"/*default", 1000, tmpFile, 0, nil, false); err != nil {
 		t.Error(err)
 	} else if newf != nil {
 		t.Errorf("expected new file, received nil")
@@ -658,7 +661,7 @@ func BenchmarkReadAndDecodeFile1(b *testing.B) {
 	b.ResetTimer()
 	for b.Loop() {
 		count := 0
-		err := readAndDecodeFile(file.Name(), func(oce *OfflineCacheEntity) {
+		err := readAndDecodeFile(file.Name(), nil, func(oce *OfflineCacheEntity) {
 			count++
 		})
 		if err != nil {
@@ -669,3 +672,167 @@ func BenchmarkReadAndDecodeFile1(b *testing.B) {
 		}
 	}
 }
+
+func TestEstimateRecovery(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"cache1/1000":                      "12345",
+		"cache1/" + rewriteFileName + "0":  "123",
+		"cache1/" + tmpRewriteName + "123": "1234567",
+		"cache2/1001":                      "12",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "cache3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	instances, files, totalBytes, err := EstimateRecovery(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instances != 3 || files != 3 || totalBytes != 10 {
+		t.Errorf("expected <3> instances, <3> files, <10> bytes, received <%d>, <%d>, <%d>",
+			instances, files, totalBytes)
+	}
+	if _, _, _, err := EstimateRecovery(filepath.Join(dir, "nonexistent")); err == nil {
+		t.Error("expected error for nonexistent folder")
+	}
+}
+
+func TestOfflineCollectorRenameRetry(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old")
+	if err := os.WriteFile(oldPath, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newPath := filepath.Join(dir, "notyet", "new")
+	var logBuf bytes.Buffer
+	oc := &OfflineCollector{
+		renameRetries:    5,
+		renameRetryDelay: 5 * time.Millisecond,
+		logger:           &testLogger{log.New(&logBuf, "", 0)},
+	}
+	go func() { // make the rename succeed only after a few retries
+		time.Sleep(10 * time.Millisecond)
+		os.MkdirAll(filepath.Dir(newPath), 0755)
+	}()
+	if err := oc.rename(oldPath, newPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(newPath); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(logBuf.String(), "retrying") {
+		t.Errorf("expected retry warning, received <%s>", logBuf.String())
+	}
+	oc.renameRetries = 1
+	if err := oc.rename(oldPath, newPath); err == nil {
+		t.Error("expected error after retries exhausted")
+	}
+}
+
+func TestPopulateEncoderWriteBufferSize(t *testing.T) {
+	dir := t.TempDir()
+	file, writer, _, err := populateEncoder(dir, "", 1<<16, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if writer.Size() != 1<<16 {
+		t.Errorf("expected buffer size <%d>, received <%d>", 1<<16, writer.Size())
+	}
+	file2, writer, _, err := populateEncoder(dir, "", 0, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file2.Close()
+	if writer.Size() != 4096 {
+		t.Errorf("expected default buffer size <4096>, received <%d>", writer.Size())
+	}
+}
+
+func TestMergeDumpFolders(t *testing.T) {
+	dir := t.TempDir()
+	writeDump := func(fldrPath string, oces ...*OfflineCacheEntity) {
+		if err := os.MkdirAll(fldrPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		file, writer, enc, err := populateEncoder(fldrPath, "", 0, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		for _, oce := range oces {
+			if err := encodeAndDump(oce, enc, writer); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	srcA, srcB, dst := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "dst")
+	writeDump(srcA,
+		&OfflineCacheEntity{IsSet: true, ItemID: "item1", Value: "a1"},
+		&OfflineCacheEntity{IsSet: true, ItemID: "item2", Value: "a2"},
+		&OfflineCacheEntity{IsSet: true, ItemID: "item3", Value: "a3"},
+		&OfflineCacheEntity{IsSet: true, ItemID: "expired", Value: "a4",
+			ExpiryTime: time.Now().Add(-time.Minute)})
+	writeDump(srcB,
+		&OfflineCacheEntity{IsSet: true, ItemID: "item1", Value: "b1"},
+		&OfflineCacheEntity{ItemID: "item2"},
+		&OfflineCacheEntity{IsSet: true, ItemID: "item4", Value: "b4", GroupIDs: []string{"grp1"}})
+	tmpRewritePath := filepath.Join(srcA, tmpRewriteName) // left by an interrupted rewrite
+	if err := os.WriteFile(tmpRewritePath, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := MergeDumpFolders(dst, srcA, srcB); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmpRewritePath); err != nil {
+		t.Errorf("expected the source files left untouched, received <%v>", err)
+	}
+	files, err := getFilePaths(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{filepath.Join(dst, rewriteFileName+"0")}; !reflect.DeepEqual(exp, files) {
+		t.Errorf("expected <%v>, received <%v>", exp, files)
+	}
+	rcv, err := readDumpFolder(dst, nil, nil, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]*OfflineCacheEntity{
+		"item1": {IsSet: true, ItemID: "item1", Value: "b1"},
+		"item3": {IsSet: true, ItemID: "item3", Value: "a3"},
+		"item4": {IsSet: true, ItemID: "item4", Value: "b4", GroupIDs: []string{"grp1"}},
+	}
+	if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	if err := MergeDumpFolders(dst, srcA, srcB); err == nil {
+		t.Error("expected error merging into a folder which is not empty")
+	}
+}
+
+func TestJSONCodecDecode(t *testing.T) {
+	var buf bytes.Buffer
+	codec := JSONCodec{}
+	for _, itmID := range []string{"item1", "item2"} {
+		if err := codec.Encode(&buf, OfflineCacheEntity{IsSet: true, ItemID: itmID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := struct{ io.Reader }{&buf} // not an io.ByteReader, read byte by byte
+	for _, itmID := range []string{"item1", "item2"} {
+		if oce, err := codec.Decode(r); err != nil || oce.ItemID != itmID {
+			t.Errorf("expected <%+v>, received <%+v>, err <%v>", itmID, oce.ItemID, err)
+		}
+	}
+	if _, err := codec.Decode(r); !errors.Is(err, io.EOF) {
+		t.Errorf("expected <%+v>, received <%+v>", io.EOF, err)
+	}
+}
@@ -0,0 +1,91 @@
+//go:build ltcache_lockstats
+
+/*
+lockstats.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM GmbH. All Rights Reserved.
+
+Lock wait instrumentation, compiled in only with the ltcache_lockstats build tag
+*/
+
+package ltcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lockStats records the time waited to acquire a lock
+type lockStats struct {
+	count   atomic.Int64 // number of lock acquisitions
+	totalNs atomic.Int64 // total nanoseconds waited
+	maxNs   atomic.Int64 // maximum nanoseconds waited for one acquisition
+}
+
+// newLockStats returns the lockStats of a new lock, kept behind a pointer so the recorded
+// times do not make equal caches differ
+func newLockStats() *lockStats { return new(lockStats) }
+
+// record adds the wait duration of one lock acquisition, nothing for nil ls
+func (ls *lockStats) record(wait time.Duration) {
+	if ls == nil {
+		return
+	}
+	ls.count.Add(1)
+	ls.totalNs.Add(int64(wait))
+	for {
+		maxNs := ls.maxNs.Load()
+		if int64(wait) <= maxNs || ls.maxNs.CompareAndSwap(maxNs, int64(wait)) {
+			return
+		}
+	}
+}
+
+// get returns the LockStats gathered so far
+func (ls *lockStats) get() (s *LockStats) {
+	if ls == nil {
+		return new(LockStats)
+	}
+	s = &LockStats{
+		Count:   ls.count.Load(),
+		MaxWait: time.Duration(ls.maxNs.Load()),
+	}
+	if s.Count != 0 {
+		s.AvgWait = time.Duration(ls.totalNs.Load() / s.Count)
+	}
+	return
+}
+
+// Lock locks c for writing, recording the time waited
+func (c *Cache) Lock() {
+	start := time.Now()
+	c.RWMutex.Lock()
+	c.lockStats.record(time.Since(start))
+}
+
+// RLock locks c for reading, recording the time waited
+func (c *Cache) RLock() {
+	start := time.Now()
+	c.RWMutex.RLock()
+	c.lockStats.record(time.Since(start))
+}
+
+// statsRWMutex is a sync.RWMutex recording the time waited to acquire it in stats, if not nil
+type statsRWMutex struct {
+	sync.RWMutex
+	stats *lockStats
+}
+
+// Lock locks m for writing, recording the time waited
+func (m *statsRWMutex) Lock() {
+	start := time.Now()
+	m.RWMutex.Lock()
+	m.stats.record(time.Since(start))
+}
+
+// RLock locks m for reading, recording the time waited
+func (m *statsRWMutex) RLock() {
+	start := time.Now()
+	m.RWMutex.RLock()
+	m.stats.record(time.Since(start))
+}
@@ -0,0 +1,27 @@
+//go:build !ltcache_lockstats
+
+/*
+lockstats_off.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM GmbH. All Rights Reserved.
+
+No-op lock wait instrumentation, used when the ltcache_lockstats build tag is missing
+*/
+
+package ltcache
+
+import "sync"
+
+// lockStats records nothing unless built with the ltcache_lockstats tag
+type lockStats struct{}
+
+// newLockStats returns nil, nothing being recorded
+func newLockStats() *lockStats { return nil }
+
+// get returns empty LockStats
+func (*lockStats) get() *LockStats { return new(LockStats) }
+
+// statsRWMutex is a plain sync.RWMutex unless built with the ltcache_lockstats tag
+type statsRWMutex struct {
+	sync.RWMutex
+	stats *lockStats
+}
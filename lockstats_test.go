@@ -0,0 +1,55 @@
+//go:build ltcache_lockstats
+
+/*
+lockstats_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM GmbH. All Rights Reserved.
+*/
+
+package ltcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransCacheGetLockStats(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	c := tc.cache[DefaultCacheInstance]
+	c.Lock()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Unlock()
+	}()
+	tc.Set(DefaultCacheInstance, "item1", 1, nil, true, "")
+	tc.Get(DefaultCacheInstance, "item1")
+	ls := tc.GetLockStats(nil)[DefaultCacheInstance]
+	if ls.Count != 3 {
+		t.Errorf("expected <3> lock acquisitions, received <%d>", ls.Count)
+	}
+	if ls.MaxWait < 10*time.Millisecond {
+		t.Errorf("expected max wait over <10ms>, received <%v>", ls.MaxWait)
+	}
+	if ls.AvgWait <= 0 || ls.AvgWait > ls.MaxWait {
+		t.Errorf("unexpected average wait <%v>", ls.AvgWait)
+	}
+}
+
+func TestTransCacheGetTransLockStats(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	tc.cacheMux.Lock()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tc.cacheMux.Unlock()
+	}()
+	tc.Set(DefaultCacheInstance, "item1", 1, nil, true, "")
+	ls := tc.GetTransLockStats()
+	if ls.Count != 2 {
+		t.Errorf("expected <2> lock acquisitions, received <%d>", ls.Count)
+	}
+	if ls.MaxWait < 10*time.Millisecond {
+		t.Errorf("expected max wait over <10ms>, received <%v>", ls.MaxWait)
+	}
+	if cls := tc.GetLockStats(nil)[DefaultCacheInstance]; cls.MaxWait >= 10*time.Millisecond {
+		t.Errorf("expected the cacheMux wait out of the instance stats, received <%v>", cls.MaxWait)
+	}
+}
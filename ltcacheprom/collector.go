@@ -0,0 +1,60 @@
+/*
+collector.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM GmbH. All Rights Reserved.
+
+Prometheus exporter of TransCache statistics, kept in its own module so the Prometheus client
+is needed only by the users importing it
+*/
+
+package ltcacheprom
+
+import (
+	"github.com/cgrates/ltcache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	itemsDesc = prometheus.NewDesc("ltcache_items",
+		"Number of items cached by the instance.", []string{"instance"}, nil)
+	groupsDesc = prometheus.NewDesc("ltcache_groups",
+		"Number of groups of the instance.", []string{"instance"}, nil)
+	hitsDesc = prometheus.NewDesc("ltcache_hits_total",
+		"Lookups finding the item.", []string{"instance"}, nil)
+	missesDesc = prometheus.NewDesc("ltcache_misses_total",
+		"Lookups not finding the item, including the expired ones.", []string{"instance"}, nil)
+	evictionsDesc = prometheus.NewDesc("ltcache_evictions_total",
+		"Items expired or evicted over capacity or idleness.", []string{"instance"}, nil)
+)
+
+// collector exports the CacheStats of the instances of a TransCache
+type collector struct {
+	tc *ltcache.TransCache
+}
+
+// NewPrometheusCollector returns a prometheus.Collector exporting for each instance of tc the
+// items and groups as gauges and the hits, misses and evictions as counters. The statistics are
+// read on each scrape, locking every instance only while copying its counters. Counters restart
+// from 0 after TransCache.ResetStats
+func NewPrometheusCollector(tc *ltcache.TransCache) prometheus.Collector {
+	return &collector{tc: tc}
+}
+
+// Describe implements prometheus.Collector
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- itemsDesc
+	ch <- groupsDesc
+	ch <- hitsDesc
+	ch <- missesDesc
+	ch <- evictionsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	for chID, cs := range c.tc.GetCacheStats(nil) {
+		ch <- prometheus.MustNewConstMetric(itemsDesc, prometheus.GaugeValue, float64(cs.Items), chID)
+		ch <- prometheus.MustNewConstMetric(groupsDesc, prometheus.GaugeValue, float64(cs.Groups), chID)
+		ch <- prometheus.MustNewConstMetric(hitsDesc, prometheus.CounterValue, float64(cs.Hits), chID)
+		ch <- prometheus.MustNewConstMetric(missesDesc, prometheus.CounterValue, float64(cs.Misses), chID)
+		ch <- prometheus.MustNewConstMetric(evictionsDesc, prometheus.CounterValue, float64(cs.Evictions), chID)
+	}
+}
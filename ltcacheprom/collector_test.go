@@ -0,0 +1,44 @@
+/*
+collector_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM GmbH. All Rights Reserved.
+*/
+
+package ltcacheprom
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cgrates/ltcache"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrometheusCollector(t *testing.T) {
+	tc := ltcache.NewTransCache(map[string]*ltcache.CacheConfig{"cache1": {MaxItems: 1}})
+	tc.Set("cache1", "item1", 1, []string{"grp1"}, true, "")
+	tc.Set("cache1", "item2", 2, nil, true, "") // evicts item1
+	tc.Get("cache1", "item1")
+	tc.Get("cache1", "item2")
+	exp := `
+# HELP ltcache_evictions_total Items expired or evicted over capacity or idleness.
+# TYPE ltcache_evictions_total counter
+ltcache_evictions_total{instance="*default"} 0
+ltcache_evictions_total{instance="cache1"} 1
+# HELP ltcache_hits_total Lookups finding the item.
+# TYPE ltcache_hits_total counter
+ltcache_hits_total{instance="*default"} 0
+ltcache_hits_total{instance="cache1"} 1
+# HELP ltcache_items Number of items cached by the instance.
+# TYPE ltcache_items gauge
+ltcache_items{instance="*default"} 0
+ltcache_items{instance="cache1"} 1
+# HELP ltcache_misses_total Lookups not finding the item, including the expired ones.
+# TYPE ltcache_misses_total counter
+ltcache_misses_total{instance="*default"} 0
+ltcache_misses_total{instance="cache1"} 1
+`
+	if err := testutil.CollectAndCompare(NewPrometheusCollector(tc), strings.NewReader(exp),
+		"ltcache_evictions_total", "ltcache_hits_total", "ltcache_items", "ltcache_misses_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -10,15 +10,19 @@ package ltcache
 import (
 	"archive/zip"
 	"bytes"
+	"cmp"
+	"context"
 	"crypto/rand"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -37,6 +41,18 @@ const (
 var (
 	ErrNotFound    = errors.New("not found")
 	ErrNotClonable = errors.New("not clonable")
+
+	ErrReadOnlyTransaction = errors.New("read-only transaction")
+	ErrTooManyTransactions = errors.New("too many open transactions") // see SetMaxOpenTransactions
+
+	ErrInstanceNotPersistent = errors.New("instance is not persistent") // persistence operation on an instance without dump
+	ErrUnknownInstance       = errors.New("unknown cache instance")
+
+	ErrValueTooLarge = errors.New("value over the dump file size limit") // see TransCacheOpts.RejectOversizedValues
+
+	ErrCollectorDegraded = errors.New("dumping stopped after failed writes") // see TransCacheOpts.MaxWriteFailures
+
+	ErrNotInt64 = errors.New("value is not an int64") // see Increment
 )
 
 func GenUUID() string {
@@ -53,6 +69,15 @@ type CacheCloner interface {
 	CacheClone() any
 }
 
+// CacheSizer is implemented by values able to report their memory footprint in bytes,
+// used to estimate the memory of the items
+type CacheSizer interface {
+	CacheSize() int64
+}
+
+// Sizer is an alias of CacheSizer
+type Sizer = CacheSizer
+
 type transactionItem struct {
 	verb     string      // action which will be executed on cache
 	cacheID  string      // cache instance identifier
@@ -61,16 +86,114 @@ type transactionItem struct {
 	groupIDs []string    // attach item to groups
 }
 
+// TransactionOp describes an operation applied on cache when committing a transaction
+type TransactionOp struct {
+	Verb     string   // AddItem, RemoveItem or RemoveGroup
+	CacheID  string   // cache instance identifier
+	ItemID   string   // item identifier
+	Value    any      // item value
+	GroupIDs []string // groups of the item or the group removed
+}
+
+// AppliedOp describes a change applied on cache by CommitTransactionWithResult
+type AppliedOp struct {
+	Verb    string   // AddItem, RemoveItem or RemoveGroup
+	CacheID string   // cache instance identifier
+	ItemID  string   // item set or removed, empty for RemoveGroup
+	GroupID string   // group removed, only for RemoveGroup
+	ItemIDs []string // items removed together with the group, sorted, only for RemoveGroup
+}
+
 type CacheConfig struct {
 	MaxItems  int
 	TTL       time.Duration
 	StaticTTL bool
 	OnEvicted []func(itmID string, value interface{})
 	Clone     bool
+	// OnEvictedReason, if not nil, is called after OnEvicted when an item is removed, together
+	// with the reason of the removal
+	OnEvictedReason func(itmID string, value any, reason EvictionReason)
+	// ClockSkewTolerance keeps items for this long after their expiry time passed, trading a
+	// small staleness window for resilience to expiry times computed on hosts with skewed clocks
+	ClockSkewTolerance time.Duration
+	// MaxAge expires items after this long since they were first set, even if their TTL keeps
+	// being refreshed on get/set (0 disables it)
+	MaxAge time.Duration
+	// Loader populates the items missing from cache on Get (nil disables loading)
+	Loader Loader
+	// GroupAtomicEviction evicts together all the items sharing groups with an item evicted
+	// over MaxItems, so groups are never partially cached. The instance may drop well below
+	// MaxItems when big groups are evicted
+	GroupAtomicEviction bool
+	// TrackAccess records when each item is read, reported by GetLastAccess and used by EvictIdle
+	TrackAccess bool
+	// DecodeInto, if not nil, returns a pointer to a new value of the single type held by the
+	// instance. Values are then dumped as that concrete type and decoded into the value returned
+	// on recovery, without needing gob.Register. Recovered values are the pointers returned
+	DecodeInto func() any
+	// LowWaterMark, if between 0 and MaxItems, evicts the instance down to LowWaterMark items once
+	// it grows over MaxItems, avoiding an eviction on each Set of a saturated instance
+	LowWaterMark int
+	// MaxMemory, if positive, evicts the least recently used items while the estimated bytes of
+	// the items are over it. Values implementing CacheSizer report their own size, strings and
+	// byte slices their length while the others account for DefaultItemSize
+	MaxMemory       int64
+	DefaultItemSize int64
+	// EvictionPolicy selects the items evicted over MaxItems or MaxMemory, PolicyLRU by default
+	EvictionPolicy EvictionPolicy
+	// Clock, if not nil, replaces time.Now in the ttls and expiries of the items, see Cache.SetClock.
+	// Overrides the clock given to the TransCache
+	Clock Clock
+}
+
+// newCache creates a new Cache based on the CacheConfig, with clock if the config sets none
+func (cfg *CacheConfig) newCache(clock Clock) (c *Cache) {
+	c = NewCache(cfg.MaxItems, cfg.TTL, cfg.StaticTTL, cfg.Clone, cfg.OnEvicted)
+	if cfg.ClockSkewTolerance != 0 {
+		c.SetClockSkewTolerance(cfg.ClockSkewTolerance)
+	}
+	if cfg.MaxAge > 0 {
+		c.SetMaxAge(cfg.MaxAge)
+	}
+	if cfg.Loader != nil {
+		c.SetLoader(cfg.Loader)
+	}
+	if cfg.GroupAtomicEviction {
+		c.SetGroupAtomicEviction(true)
+	}
+	if cfg.TrackAccess {
+		c.SetAccessTracking(true)
+	}
+	if cfg.LowWaterMark > 0 {
+		c.SetLowWaterMark(cfg.LowWaterMark)
+	}
+	if cfg.OnEvictedReason != nil {
+		c.SetOnEvictedReason(cfg.OnEvictedReason)
+	}
+	if cfg.MaxMemory > 0 {
+		c.SetMaxMemory(cfg.MaxMemory, cfg.DefaultItemSize)
+	}
+	if cfg.EvictionPolicy != PolicyLRU {
+		c.SetEvictionPolicy(cfg.EvictionPolicy)
+	}
+	if cfg.Clock != nil {
+		clock = cfg.Clock
+	}
+	if clock != nil {
+		c.SetClock(clock)
+	}
+	return
 }
 
 // NewTransCache instantiates a new TransCache
 func NewTransCache(cfg map[string]*CacheConfig) (tc *TransCache) {
+	return NewTransCacheWithClock(cfg, nil)
+}
+
+// NewTransCacheWithClock instantiates a new TransCache whose instances use clock instead of
+// time.Now in the ttls and expiries of their items, unless their CacheConfig sets its own Clock.
+// The transactions are aged on clock too
+func NewTransCacheWithClock(cfg map[string]*CacheConfig, clock Clock) (tc *TransCache) {
 	if _, has := cfg[DefaultCacheInstance]; !has { // Default always created
 		cfg[DefaultCacheInstance] = &CacheConfig{MaxItems: -1}
 	}
@@ -78,9 +201,12 @@ func NewTransCache(cfg map[string]*CacheConfig) (tc *TransCache) {
 		cache:             make(map[string]*Cache),
 		cfg:               cfg,
 		transactionBuffer: make(map[string][]*transactionItem),
+		lazyRecovery:      make(map[string]*lazyRecovery),
+		clock:             clock,
 	}
+	tc.cacheMux.stats = newLockStats()
 	for cacheID, chCfg := range cfg {
-		tc.cache[cacheID] = NewCache(chCfg.MaxItems, chCfg.TTL, chCfg.StaticTTL, chCfg.Clone, chCfg.OnEvicted)
+		tc.cache[cacheID] = chCfg.newCache(clock)
 	}
 	return
 }
@@ -89,101 +215,675 @@ func NewTransCache(cfg map[string]*CacheConfig) (tc *TransCache) {
 type TransCache struct {
 	cache    map[string]*Cache       // map[cacheInstance]cacheStore
 	cfg      map[string]*CacheConfig // map[cacheInstance]*CacheConfig
-	cacheMux sync.RWMutex            // so we can apply the complete transaction buffer in one shoot
+	cacheMux statsRWMutex            // so we can apply the complete transaction buffer in one shoot, wait times recorded only when built with ltcache_lockstats tag
 
 	transactionBuffer map[string][]*transactionItem // Queue tasks based on transactionID
 	transBufMux       sync.Mutex                    // Protects the transactionBuffer
 	transactionMux    sync.Mutex                    // Queue transactions on commit
+
+	lazyRecovery  map[string]*lazyRecovery // map[cacheInstance]*lazyRecovery instances recovered from dump on first access
+	readOnlyTrans map[string]struct{}      // transactions not allowed to buffer changes, protected by transBufMux
+	transBegin    map[string]time.Time     // begin time of the open transactions, protected by transBufMux
+	transReaper   chan struct{}            // stops reapTransactions when closed, protected by transBufMux
+	maxOpenTrans  int                      // open transactions allowed, unlimited if not positive, protected by transBufMux
+
+	dumpConcurrency int                 // maximum number of instances dumped in parallel by DumpAll, GOMAXPROCS if not positive
+	forks           map[string]struct{} // instances created by ForkInstance, kept only in memory
+	adding          map[string]struct{} // instances reserved by AddInstance while recovering from their dump folder
+	offCollOpts     *TransCacheOpts     // options of the offline collectors of the instances added by AddInstance, nil if not persistent
+	offCollLogger   logger              // logger of the offline collectors of the instances added by AddInstance
+	clock           Clock               // time source of the transactions and of the instances not setting CacheConfig.Clock, time.Now if nil
+
+	// OnCommitApplied, if not nil, is called for each buffered operation applied by
+	// CommitTransaction, in order, once the transaction is committed and the cache unlocked.
+	// Should be set before committing any transaction
+	OnCommitApplied func(op TransactionOp)
+}
+
+// lazyRecovery defers recovering a Cache instance from its dump folder until first access
+type lazyRecovery struct {
+	mux       sync.Mutex
+	offColl   *OfflineCollector
+	recovered bool
+}
+
+// recover populates c from the dump folder of the offline collector, only once
+func (lr *lazyRecovery) recover(c *Cache) {
+	lr.mux.Lock()
+	defer lr.mux.Unlock()
+	if lr.recovered {
+		return
+	}
+	lr.recovered = true
+	if err := c.recoverFromFolder(lr.offColl); err != nil {
+		lr.offColl.log().Err(fmt.Sprintf("error <%v> recovering cache from <%s>", err, lr.offColl.fldrPath))
+	}
+}
+
+// isRecovered returns true if the instance was already recovered from its dump folder
+func (lr *lazyRecovery) isRecovered() bool {
+	lr.mux.Lock()
+	defer lr.mux.Unlock()
+	return lr.recovered
 }
 
 // cacheInstance returns a specific cache instance based on ID or default
 func (tc *TransCache) cacheInstance(chID string) (c *Cache) {
 	var ok bool
 	if c, ok = tc.cache[chID]; !ok {
-		c = tc.cache[DefaultCacheInstance]
+		chID = DefaultCacheInstance
+		c = tc.cache[chID]
+	}
+	if lr, has := tc.lazyRecovery[chID]; has {
+		lr.recover(c)
 	}
 	return
 }
 
-// BeginTransaction initializes a new transaction into transactions buffer
+// instancesWhere returns the cache instances for which keep is true, selected under cacheMux so
+// they can be ranged over without blocking the TransCache while instances are added or removed
+func (tc *TransCache) instancesWhere(keep func(chID string, c *Cache) bool) map[string]*Cache {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	chs := make(map[string]*Cache, len(tc.cache))
+	for chID, c := range tc.cache {
+		if keep(chID, c) {
+			chs[chID] = c
+		}
+	}
+	return chs
+}
+
+// dumpedInstances returns the cache instances with a dump folder in use, skipping the ones
+// not recovered yet, whose dump folder is untouched since start, and the forks
+func (tc *TransCache) dumpedInstances() map[string]*Cache {
+	return tc.instancesWhere(func(chID string, _ *Cache) bool {
+		return !tc.pendingRecovery(chID) && !tc.forked(chID)
+	})
+}
+
+// recoverAll recovers from dump all the instances not yet accessed (cacheMux locked)
+func (tc *TransCache) recoverAll() {
+	for chID, lr := range tc.lazyRecovery {
+		lr.recover(tc.cache[chID])
+	}
+}
+
+// pendingRecovery returns true if the chID instance was not yet recovered from its dump folder
+func (tc *TransCache) pendingRecovery(chID string) bool {
+	lr, has := tc.lazyRecovery[chID]
+	return has && !lr.isRecovered()
+}
+
+// BeginTransaction initializes a new transaction into transactions buffer. Returns an empty
+// transID if too many transactions are open, see BeginTransactionErr
 func (tc *TransCache) BeginTransaction() (transID string) {
-	transID = GenUUID()
+	transID, _ = tc.BeginTransactionErr()
+	return
+}
+
+// BeginTransactionErr initializes a new transaction into transactions buffer, failing with
+// ErrTooManyTransactions once SetMaxOpenTransactions transactions are open
+func (tc *TransCache) BeginTransactionErr() (transID string, err error) {
 	tc.transBufMux.Lock()
+	defer tc.transBufMux.Unlock()
+	if tc.maxOpenTrans > 0 && len(tc.transactionBuffer) >= tc.maxOpenTrans {
+		return "", ErrTooManyTransactions
+	}
+	transID = GenUUID()
 	tc.transactionBuffer[transID] = make([]*transactionItem, 0)
+	if tc.transBegin == nil {
+		tc.transBegin = make(map[string]time.Time)
+	}
+	tc.transBegin[transID] = tc.now()
+	return
+}
+
+// now returns the current time of the clock of the TransCache, as seen by its transactions
+func (tc *TransCache) now() time.Time {
+	if tc.clock == nil {
+		return time.Now()
+	}
+	return tc.clock.Now()
+}
+
+// SetMaxOpenTransactions limits the transactions open at once, not committed nor rolled back,
+// protecting the memory from callers never closing them. 0 or lower removes the limit
+func (tc *TransCache) SetMaxOpenTransactions(maxOpen int) {
+	tc.transBufMux.Lock()
+	tc.maxOpenTrans = maxOpen
 	tc.transBufMux.Unlock()
-	return transID
+}
+
+// BeginReadOnlyTransaction initializes a new transaction which rejects any Set, Remove or
+// RemoveGroup with ErrReadOnlyTransaction. Committing it changes nothing
+func (tc *TransCache) BeginReadOnlyTransaction() (transID string) {
+	if transID = tc.BeginTransaction(); transID == "" {
+		return
+	}
+	tc.transBufMux.Lock()
+	if tc.readOnlyTrans == nil {
+		tc.readOnlyTrans = make(map[string]struct{})
+	}
+	tc.readOnlyTrans[transID] = struct{}{}
+	tc.transBufMux.Unlock()
+	return
 }
 
 // RollbackTransaction destroys a transaction from transactions buffer
 func (tc *TransCache) RollbackTransaction(transID string) {
 	tc.transBufMux.Lock()
-	delete(tc.transactionBuffer, transID)
+	tc.dropTransaction(transID)
 	tc.transBufMux.Unlock()
 }
 
+// dropTransaction forgets the transaction transID, with transBufMux held
+func (tc *TransCache) dropTransaction(transID string) {
+	delete(tc.transactionBuffer, transID)
+	delete(tc.readOnlyTrans, transID)
+	delete(tc.transBegin, transID)
+}
+
+// TransactionInfo describes an open transaction
+type TransactionInfo struct {
+	ID  string
+	Age time.Duration // time since BeginTransaction
+	Ops int           // number of operations buffered
+}
+
+// ListTransactions returns the open transactions, oldest first
+func (tc *TransCache) ListTransactions() (transInfos []TransactionInfo) {
+	tc.transBufMux.Lock()
+	defer tc.transBufMux.Unlock()
+	now := tc.now()
+	transInfos = make([]TransactionInfo, 0, len(tc.transactionBuffer))
+	for transID, transItems := range tc.transactionBuffer {
+		transInfos = append(transInfos, TransactionInfo{ID: transID,
+			Age: now.Sub(tc.transBegin[transID]), Ops: len(transItems)})
+	}
+	slices.SortFunc(transInfos, func(a, b TransactionInfo) int {
+		return cmp.Compare(b.Age, a.Age)
+	})
+	return
+}
+
+// SetTransactionTTL rolls back the transactions still open ttl after they began, checking them in
+// background every ttl/2, so the ones abandoned by crashed callers do not hold their buffered
+// values forever. A ttl of 0 or lower stops checking, as does Shutdown
+func (tc *TransCache) SetTransactionTTL(ttl time.Duration) {
+	tc.transBufMux.Lock()
+	defer tc.transBufMux.Unlock()
+	if tc.transReaper != nil {
+		close(tc.transReaper)
+		tc.transReaper = nil
+	}
+	if ttl <= 0 {
+		return
+	}
+	tc.transReaper = make(chan struct{})
+	go tc.reapTransactions(ttl, tc.transReaper)
+}
+
+// reapTransactions rolls back the transactions older than ttl until stop is closed
+func (tc *TransCache) reapTransactions(ttl time.Duration, stop chan struct{}) {
+	tkr := time.NewTicker(max(ttl/2, time.Millisecond))
+	defer tkr.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tkr.C:
+		}
+		tc.transBufMux.Lock()
+		now := tc.now()
+		for transID, begin := range tc.transBegin {
+			if now.Sub(begin) >= ttl {
+				tc.dropTransaction(transID)
+			}
+		}
+		tc.transBufMux.Unlock()
+	}
+}
+
+// bufferItem queues item in the buffer of transaction transID, failing for read-only transactions
+func (tc *TransCache) bufferItem(transID string, item *transactionItem) error {
+	return tc.bufferItems(transID, item)
+}
+
+// bufferItems adds all items to the transaction buffer at once
+func (tc *TransCache) bufferItems(transID string, items ...*transactionItem) error {
+	tc.transBufMux.Lock()
+	defer tc.transBufMux.Unlock()
+	if _, readOnly := tc.readOnlyTrans[transID]; readOnly {
+		return ErrReadOnlyTransaction
+	}
+	tc.transactionBuffer[transID] = append(tc.transactionBuffer[transID], items...)
+	return nil
+}
+
 // CommitTransaction executes the actions in a transaction buffer
 func (tc *TransCache) CommitTransaction(transID string) {
+	tc.CommitTransactionWithResult(transID)
+}
+
+// CommitTransactionWithResult commits a transaction returning the changes applied, in order,
+// with the items removed by group expanded. All the operations are attempted, err being the
+// first one failing, which is not part of applied
+func (tc *TransCache) CommitTransactionWithResult(transID string) (applied []AppliedOp, err error) {
 	tc.transactionMux.Lock()
 	tc.transBufMux.Lock()
 	tc.cacheMux.Lock() // apply all transactioned items in one shot
+	var ops []TransactionOp
 	for _, item := range tc.transactionBuffer[transID] {
 		switch item.verb {
 		case AddItem:
-			tc.Set(item.cacheID, item.itemID, item.value, item.groupIDs, true, transID)
+			if setErr := tc.Set(item.cacheID, item.itemID, item.value, item.groupIDs, true, transID); setErr != nil {
+				if err == nil {
+					err = setErr
+				}
+				continue
+			}
+			applied = append(applied, AppliedOp{Verb: AddItem, CacheID: item.cacheID, ItemID: item.itemID})
 		case RemoveItem:
 			tc.Remove(item.cacheID, item.itemID, true, transID)
+			applied = append(applied, AppliedOp{Verb: RemoveItem, CacheID: item.cacheID, ItemID: item.itemID})
 		case RemoveGroup:
 			if len(item.groupIDs) >= 1 {
+				itmIDs := tc.cacheInstance(item.cacheID).GetGroupItemIDs(item.groupIDs[0])
+				slices.Sort(itmIDs)
 				tc.RemoveGroup(item.cacheID, item.groupIDs[0], true, transID)
+				applied = append(applied, AppliedOp{Verb: RemoveGroup, CacheID: item.cacheID,
+					GroupID: item.groupIDs[0], ItemIDs: itmIDs})
 			}
 		}
+		if tc.OnCommitApplied != nil {
+			ops = append(ops, TransactionOp{Verb: item.verb, CacheID: item.cacheID,
+				ItemID: item.itemID, Value: item.value, GroupIDs: item.groupIDs})
+		}
 	}
 	tc.cacheMux.Unlock()
-	delete(tc.transactionBuffer, transID)
+	tc.dropTransaction(transID)
 	tc.transBufMux.Unlock()
 	tc.transactionMux.Unlock()
+	for _, op := range ops { // the hook can use the TransCache
+		tc.OnCommitApplied(op)
+	}
+	return
+}
+
+// CommitTransactionDurable commits a transaction and dumps the instances it changed right away,
+// instead of on the next dump interval, so the transaction is persisted once it returns
+func (tc *TransCache) CommitTransactionDurable(transID string) (err error) {
+	tc.transBufMux.Lock()
+	chIDs := make(map[string]struct{})
+	for _, item := range tc.transactionBuffer[transID] {
+		chIDs[item.cacheID] = struct{}{}
+	}
+	tc.transBufMux.Unlock()
+	tc.CommitTransaction(transID)
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	for chID := range chIDs {
+		c := tc.cacheInstance(chID)
+		if c.offCollector == nil || c.offCollector.dumpInterval <= 0 { // not dumped or already written through
+			continue
+		}
+		if err = c.DumpToFile(); err != nil {
+			return
+		}
+	}
+	return
 }
 
-// Get returns the value of an Item
+// Get returns the value of an Item, loading it on miss if the instance has a Loader
 func (tc *TransCache) Get(chID, itmID string) (interface{}, bool) {
+	value, ok, _ := tc.GetCtx(context.Background(), chID, itmID)
+	return value, ok
+}
+
+// GetCtx is Get returning ctx.Err() if ctx is done while waiting for the cache instances, and
+// the error returned by the Loader as GetWithError does
+func (tc *TransCache) GetCtx(ctx context.Context, chID, itmID string) (value any, ok bool, err error) {
+	if err = lockCtx(ctx, tc.cacheMux.RLock, tc.cacheMux.RUnlock); err != nil {
+		return
+	}
+	c := tc.cacheInstance(chID)
+	value, result := c.GetDetailed(itmID) // under cacheMux so commits are seen whole
+	tc.cacheMux.RUnlock()                 // do not hold the instances while loading
+	if result == Found {
+		return value, true, nil
+	}
+	return c.loadMissing(itmID)
+}
+
+// GetInTransaction returns the value of an item as seen by the transaction transID, applying its
+// buffered sets and removals over the cache. As Peek, it does not refresh the recency or TTL of
+// the item, the transaction being possibly rolled back
+func (tc *TransCache) GetInTransaction(transID, chID, itmID string) (value any, ok bool) {
+	tc.transBufMux.Lock()
+	transItems := slices.Clone(tc.transactionBuffer[transID])
+	tc.transBufMux.Unlock()
+	tc.cacheMux.RLock() // value and groups of the same commit
+	value, grpIDs, ok := tc.cacheInstance(chID).peekWithGroups(itmID)
+	tc.cacheMux.RUnlock()
+	for _, item := range transItems {
+		if item.cacheID != chID {
+			continue
+		}
+		switch {
+		case item.verb == AddItem && item.itemID == itmID:
+			value, ok, grpIDs = item.value, true, item.groupIDs
+		case item.verb == RemoveItem && item.itemID == itmID:
+			value, ok, grpIDs = nil, false, nil
+		case item.verb == RemoveGroup && len(item.groupIDs) != 0 &&
+			slices.Contains(grpIDs, item.groupIDs[0]):
+			value, ok, grpIDs = nil, false, nil
+		}
+	}
+	return
+}
+
+// Peek returns the value of an item without refreshing its recency, TTL or last access
+func (tc *TransCache) Peek(chID, itmID string) (any, bool) {
 	tc.cacheMux.RLock()
 	defer tc.cacheMux.RUnlock()
-	return tc.cacheInstance(chID).Get(itmID)
+	return tc.cacheInstance(chID).Peek(itmID)
 }
 
-// Set will add/edit an item to the cache
+// GetWithRemaining returns the value of an item together with the time left until it expires,
+// NeverExpires if it has no expiry
+func (tc *TransCache) GetWithRemaining(chID, itmID string) (value any, remaining time.Duration, ok bool) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).GetWithRemaining(itmID)
+}
+
+// ForEach calls fn for each item not expired of a cache instance, under the instance read lock,
+// stopping when fn returns false. fn must not call back into the TransCache, which would deadlock
+func (tc *TransCache) ForEach(chID string, fn func(itmID string, value any) bool) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	tc.cacheInstance(chID).ForEach(fn)
+}
+
+// Watch returns a channel receiving the changes of the itmIDs items of a cache instance, all if
+// none given, together with the function unsubscribing and closing the channel, see Cache.Watch
+func (tc *TransCache) Watch(chID string, itmIDs ...string) (<-chan CacheEvent, func()) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).Watch(itmIDs...)
+}
+
+// GetMulti returns the values of the itmIDs found on a cache instance, missing ones being absent
+// from the map returned
+func (tc *TransCache) GetMulti(chID string, itmIDs []string) map[string]any {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).GetMulti(itmIDs)
+}
+
+// GetLastAccess returns when an item was last read, or last set if not read since. Reads are
+// recorded only for instances with TrackAccess enabled
+func (tc *TransCache) GetLastAccess(chID, itmID string) (time.Time, bool) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).GetLastAccess(itmID)
+}
+
+// EvictIdle removes the items of a cache instance not read within idleFor, returning their number.
+// Items never read are considered accessed when last set. Removes nothing for the instances
+// without TrackAccess
+func (tc *TransCache) EvictIdle(chID string, idleFor time.Duration) int {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).EvictIdle(idleFor)
+}
+
+// GetWithError returns the value of an Item, loading it on miss if the instance has a Loader.
+// The error returned by the Loader is passed to the caller
+func (tc *TransCache) GetWithError(chID, itmID string) (any, bool, error) {
+	tc.cacheMux.RLock()
+	c := tc.cacheInstance(chID)
+	value, result := c.GetDetailed(itmID) // under cacheMux so commits are seen whole
+	tc.cacheMux.RUnlock()                 // do not hold the instances while loading
+	if result == Found {
+		return value, true, nil
+	}
+	return c.loadMissing(itmID)
+}
+
+// GetDetailed returns the value of an Item and if it was found, never set or just expired
+func (tc *TransCache) GetDetailed(chID, itmID string) (any, GetResult) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).GetDetailed(itmID)
+}
+
+// Set will add/edit an item to the cache. Errors if buffered in a read-only transaction or
+// if the value cannot be dumped while ValidateEncodable is enabled
 func (tc *TransCache) Set(chID, itmID string, value interface{},
-	groupIDs []string, commit bool, transID string) {
-	if commit {
-		if transID == "" { // Lock locally
-			tc.cacheMux.Lock()
-			defer tc.cacheMux.Unlock()
+	groupIDs []string, commit bool, transID string) error {
+	return tc.SetCtx(context.Background(), chID, itmID, value, groupIDs, commit, transID)
+}
+
+// SetCtx is Set returning ctx.Err() if ctx is done while waiting for the cache instances or for
+// the lock of the instance, nothing being set then, or while waiting to write the item through to
+// the dump file, the item being set and dumped later then, see Cache.SetCtx
+func (tc *TransCache) SetCtx(ctx context.Context, chID, itmID string, value any,
+	groupIDs []string, commit bool, transID string) error {
+	if !commit {
+		if err := lockCtx(ctx, tc.cacheMux.RLock, tc.cacheMux.RUnlock); err != nil {
+			return err
 		}
-		tc.cacheInstance(chID).Set(itmID, value, groupIDs)
-	} else {
-		tc.transBufMux.Lock()
-		tc.transactionBuffer[transID] = append(tc.transactionBuffer[transID],
-			&transactionItem{cacheID: chID,
-				verb: AddItem, itemID: itmID,
-				value: value, groupIDs: groupIDs})
-		tc.transBufMux.Unlock()
+		c := tc.cacheInstance(chID)
+		tc.cacheMux.RUnlock()
+		if err := c.checkEncodable(itmID, value); err != nil {
+			return err
+		}
+		return tc.bufferItem(transID, &transactionItem{cacheID: chID,
+			verb: AddItem, itemID: itmID,
+			value: value, groupIDs: groupIDs})
 	}
+	if transID == "" { // Lock locally
+		if err := lockCtx(ctx, tc.cacheMux.Lock, tc.cacheMux.Unlock); err != nil {
+			return err
+		}
+		defer tc.cacheMux.Unlock()
+	}
+	c := tc.cacheInstance(chID)
+	if err := c.checkEncodable(itmID, value); err != nil {
+		return err
+	}
+	return c.SetCtx(ctx, itmID, value, groupIDs)
 }
 
-// Remove removes an item from the cache
-func (tc *TransCache) Remove(chID, itmID string, commit bool, transID string) {
-	if commit {
-		if transID == "" { // Lock per operation not transaction
-			tc.cacheMux.Lock()
-			defer tc.cacheMux.Unlock()
+// GetOrSet returns the value of an item if found, with loaded true, otherwise sets it to value
+// and returns value, as one operation. Mirrors sync.Map.LoadOrStore
+func (tc *TransCache) GetOrSet(chID, itmID string, value any, groupIDs []string) (actual any, loaded bool) {
+	tc.cacheMux.Lock()
+	defer tc.cacheMux.Unlock()
+	return tc.cacheInstance(chID).GetOrSet(itmID, value, groupIDs)
+}
+
+// SetIfAbsent sets an item to value only if not found on the cache instance, returning true if
+// it was set
+func (tc *TransCache) SetIfAbsent(chID, itmID string, value any, groupIDs []string) bool {
+	tc.cacheMux.Lock()
+	defer tc.cacheMux.Unlock()
+	return tc.cacheInstance(chID).SetIfAbsent(itmID, value, groupIDs)
+}
+
+// CompareAndSwap replaces the value of an item with newVal only if the current one is deeply
+// equal to oldVal, returning true if swapped
+func (tc *TransCache) CompareAndSwap(chID, itmID string, oldVal, newVal any) bool {
+	tc.cacheMux.Lock()
+	defer tc.cacheMux.Unlock()
+	return tc.cacheInstance(chID).CompareAndSwap(itmID, oldVal, newVal)
+}
+
+// Increment adds delta to the int64 value of an item, starting from 0 if missing, returning
+// the new value
+func (tc *TransCache) Increment(chID, itmID string, delta int64) (int64, error) {
+	tc.cacheMux.Lock()
+	defer tc.cacheMux.Unlock()
+	return tc.cacheInstance(chID).Increment(itmID, delta)
+}
+
+// Decrement subtracts delta from the int64 value of an item, see Increment
+func (tc *TransCache) Decrement(chID, itmID string, delta int64) (int64, error) {
+	return tc.Increment(chID, itmID, -delta)
+}
+
+// SetMulti sets the items attached to groupIDs on a cache instance in one lock acquisition. Fails
+// without setting any if one of the values cannot be dumped. If not committed, all items are
+// buffered at once
+func (tc *TransCache) SetMulti(chID string, items map[string]any, groupIDs []string,
+	commit bool, transID string) error {
+	if !commit {
+		tc.cacheMux.RLock()
+		c := tc.cacheInstance(chID)
+		tc.cacheMux.RUnlock()
+		if err := c.checkEncodableItems(items); err != nil {
+			return err
 		}
-		tc.cacheInstance(chID).Remove(itmID)
-	} else {
-		tc.transBufMux.Lock()
-		tc.transactionBuffer[transID] = append(tc.transactionBuffer[transID],
+		transItems := make([]*transactionItem, 0, len(items))
+		for itmID, value := range items {
+			transItems = append(transItems, &transactionItem{cacheID: chID,
+				verb: AddItem, itemID: itmID, value: value, groupIDs: groupIDs})
+		}
+		return tc.bufferItems(transID, transItems...)
+	}
+	if transID == "" { // Lock locally
+		tc.cacheMux.Lock()
+		defer tc.cacheMux.Unlock()
+	}
+	c := tc.cacheInstance(chID)
+	if err := c.checkEncodableItems(items); err != nil {
+		return err
+	}
+	c.SetMulti(items, groupIDs)
+	return nil
+}
+
+// SetWithTags sets an item labeled with tags on a cache instance, without going through the
+// transaction buffer. Items can be filtered by their tags with GetItemsByTag
+func (tc *TransCache) SetWithTags(chID, itmID string, value any, tags map[string]string) error {
+	tc.cacheMux.Lock()
+	defer tc.cacheMux.Unlock()
+	c := tc.cacheInstance(chID)
+	if err := c.checkEncodable(itmID, value); err != nil {
+		return err
+	}
+	c.SetWithTags(itmID, value, nil, tags)
+	return nil
+}
+
+// GetItemsByTag returns the items of a cache instance tagged with tagKey set to tagValue
+func (tc *TransCache) GetItemsByTag(chID, tagKey, tagValue string) map[string]any {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).GetItemsByTag(tagKey, tagValue)
+}
+
+// CommitBatch applies removes followed by sets on a cache instance at once, without going
+// through the transaction buffer. Items set are attached to groupIDs
+func (tc *TransCache) CommitBatch(chID string, sets map[string]any, removes []string,
+	groupIDs []string) (cr CommitResult) {
+	tc.cacheMux.Lock()
+	cr = tc.cacheInstance(chID).CommitBatch(sets, removes, groupIDs)
+	tc.cacheMux.Unlock()
+	return
+}
+
+// Remove removes an item from the cache. Errors only if buffered in a read-only transaction
+func (tc *TransCache) Remove(chID, itmID string, commit bool, transID string) error {
+	if !commit {
+		return tc.bufferItem(transID,
 			&transactionItem{cacheID: chID, verb: RemoveItem, itemID: itmID})
-		tc.transBufMux.Unlock()
 	}
+	if transID == "" { // Lock per operation not transaction
+		tc.cacheMux.Lock()
+		defer tc.cacheMux.Unlock()
+	}
+	tc.cacheInstance(chID).Remove(itmID)
+	return nil
+}
+
+// RemoveMatching removes the items of a cache instance for which pred returns true, returning
+// their number. pred must not call back into the cache, which would deadlock
+func (tc *TransCache) RemoveMatching(chID string, pred func(itmID string, value any) bool) int {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).RemoveMatching(pred)
+}
+
+// RemoveOlderThan removes the items of a cache instance not set or updated within age, returning
+// their number
+func (tc *TransCache) RemoveOlderThan(chID string, age time.Duration) int {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).RemoveOlderThan(age)
+}
+
+// ExpireNow removes the items of a cache instance expired at the time of its clock, returning
+// their number, see Cache.ExpireNow
+func (tc *TransCache) ExpireNow(chID string) int {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).ExpireNow()
+}
+
+// Rename moves the oldID item of a cache instance to newID, overwriting it, keeping its groups
+// and expiry. Returns false if oldID is not cached
+func (tc *TransCache) Rename(chID, oldID, newID string) bool {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).Rename(oldID, newID)
+}
+
+// GetItemGroups returns the groups of an item of a cache instance, nil if the item is not cached
+func (tc *TransCache) GetItemGroups(chID, itmID string) []string {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).GetItemGroups(itmID)
+}
+
+// AddToGroup adds an item of a cache instance to the grpID group, keeping its value. Returns
+// false if the item is not cached
+func (tc *TransCache) AddToGroup(chID, itmID, grpID string) bool {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).AddToGroup(itmID, grpID)
+}
+
+// RemoveFromGroup removes an item of a cache instance from the grpID group, keeping its value.
+// Returns false if the item is not cached
+func (tc *TransCache) RemoveFromGroup(chID, itmID, grpID string) bool {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).RemoveFromGroup(itmID, grpID)
+}
+
+// SetGroupTTL expires together the items of a group of a cache instance after ttl, including the
+// ones added to the group later. A ttl of 0 or lower removes the group expiry
+func (tc *TransCache) SetGroupTTL(chID, grpID string, ttl time.Duration) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	tc.cacheInstance(chID).SetGroupTTL(grpID, ttl)
+}
+
+// GetGroupStats returns the number of items of each group of a cache instance
+func (tc *TransCache) GetGroupStats(chID string) map[string]int {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).GetGroupStats()
+}
+
+// GetGroupItemCount returns the number of items of a group of a cache instance
+func (tc *TransCache) GetGroupItemCount(chID, grpID string) int {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).GroupLength(grpID)
 }
 
 func (tc *TransCache) HasGroup(chID, grpID string) (has bool) {
@@ -209,65 +909,275 @@ func (tc *TransCache) GetGroupItems(chID, grpID string) (itms []interface{}) {
 	return
 }
 
-// RemoveGroup removes a group of items out of cache
-func (tc *TransCache) RemoveGroup(chID, grpID string, commit bool, transID string) {
-	if commit {
-		if transID == "" { // Lock locally
-			tc.cacheMux.Lock()
-			defer tc.cacheMux.Unlock()
-		}
-		tc.cacheInstance(chID).RemoveGroup(grpID)
-	} else {
-		tc.transBufMux.Lock()
-		tc.transactionBuffer[transID] = append(tc.transactionBuffer[transID],
+// RemoveGroup removes a group of items out of cache. Errors only if buffered in a read-only transaction
+func (tc *TransCache) RemoveGroup(chID, grpID string, commit bool, transID string) error {
+	if !commit {
+		return tc.bufferItem(transID,
 			&transactionItem{cacheID: chID, verb: RemoveGroup, groupIDs: []string{grpID}})
-		tc.transBufMux.Unlock()
 	}
+	if transID == "" { // Lock locally
+		tc.cacheMux.Lock()
+		defer tc.cacheMux.Unlock()
+	}
+	tc.cacheInstance(chID).RemoveGroup(grpID)
+	return nil
+}
+
+// RemoveGroups removes the items of several groups of a cache instance under one lock. Buffered
+// in a transaction as one RemoveGroup per group. Errors only if buffered in a read-only transaction
+func (tc *TransCache) RemoveGroups(chID string, grpIDs []string, commit bool, transID string) error {
+	if !commit {
+		transItems := make([]*transactionItem, len(grpIDs))
+		for i, grpID := range grpIDs {
+			transItems[i] = &transactionItem{cacheID: chID, verb: RemoveGroup, groupIDs: []string{grpID}}
+		}
+		return tc.bufferItems(transID, transItems...)
+	}
+	if transID == "" { // Lock locally
+		tc.cacheMux.Lock()
+		defer tc.cacheMux.Unlock()
+	}
+	tc.cacheInstance(chID).RemoveGroups(grpIDs...)
+	return nil
+}
+
+// ExportInstance streams the items of a cache instance to w, see Cache.Export
+func (tc *TransCache) ExportInstance(chID string, w io.Writer) error {
+	tc.cacheMux.RLock()
+	c := tc.cacheInstance(chID)
+	tc.cacheMux.RUnlock()
+	return c.Export(w)
+}
+
+// ImportInstance sets on a cache instance the items exported to r by ExportInstance
+func (tc *TransCache) ImportInstance(chID string, r io.Reader) error {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).Import(r)
+}
+
+// SetOnEvicted replaces the OnEvicted functions of a cache instance with fn, affecting only
+// future evictions. A nil fn removes them
+func (tc *TransCache) SetOnEvicted(chID string, fn func(itmID string, value any)) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	if fn == nil {
+		tc.cacheInstance(chID).SetOnEvicted()
+		return
+	}
+	tc.cacheInstance(chID).SetOnEvicted(fn)
+}
+
+// UpdateGroup replaces atomically the values of the items in a group of a cache instance with the
+// ones returned by fn, skipping the items for which fn returns false. See Cache.UpdateGroup
+func (tc *TransCache) UpdateGroup(chID, grpID string,
+	fn func(itmID string, old any) (value any, ok bool)) (updated int, err error) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).UpdateGroup(grpID, fn)
+}
+
+// CompactGroups removes empty groups and shrinks the groups index of a cache instance
+func (tc *TransCache) CompactGroups(chID string) {
+	tc.cacheMux.RLock()
+	tc.cacheInstance(chID).CompactGroups()
+	tc.cacheMux.RUnlock()
+}
+
+// Remove all items in one or more cache instances
+func (tc *TransCache) Clear(chIDs []string) {
+	tc.cacheMux.Lock()
+	if chIDs == nil {
+		chIDs = make([]string, len(tc.cache))
+		i := 0
+		for chID := range tc.cache {
+			chIDs[i] = chID
+			i += 1
+		}
+	}
+	for _, chID := range chIDs {
+		tc.cacheInstance(chID).Clear()
+	}
+	tc.cacheMux.Unlock()
+}
+
+// Drain returns the items not expired of a cache instance, cloned as on Get, and removes all
+// the items in one step, so no item set meanwhile is lost
+func (tc *TransCache) Drain(chID string) (items map[string]any) {
+	tc.cacheMux.Lock()
+	items = tc.cacheInstance(chID).Drain()
+	tc.cacheMux.Unlock()
+	return
+}
+
+// GetItemIDs returns a list of item IDs matching prefix
+func (tc *TransCache) GetItemIDs(chID, prfx string) (itmIDs []string) {
+	tc.cacheMux.RLock()
+	itmIDs = tc.cacheInstance(chID).GetItemIDs(prfx)
+	tc.cacheMux.RUnlock()
+	return
+}
+
+// RangeAll calls fn for every item not expired of every cache instance, with the values cloned
+// as on Get, stopping when fn returns false. Instances are iterated sorted by ID while adding or
+// removing instances is blocked, so fn must not modify the TransCache
+func (tc *TransCache) RangeAll(fn func(chID, itmID string, value any) bool) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	chIDs := make([]string, 0, len(tc.cache))
+	for chID := range tc.cache {
+		chIDs = append(chIDs, chID)
+	}
+	slices.Sort(chIDs)
+	for _, chID := range chIDs {
+		if !tc.cacheInstance(chID).rangeItems(func(itmID string, value any) bool {
+			return fn(chID, itmID, value)
+		}) {
+			return
+		}
+	}
+}
+
+// GetItemIDsPage returns a sorted page of item IDs matching prefix and the total number of matches
+func (tc *TransCache) GetItemIDsPage(chID, prfx string, offset, limit int) (itmIDs []string, total int) {
+	tc.cacheMux.RLock()
+	itmIDs, total = tc.cacheInstance(chID).GetItemIDsPage(prfx, offset, limit)
+	tc.cacheMux.RUnlock()
+	return
+}
+
+// GetCloneable returns the value of an item and if it is a CacheCloner from a single lookup, ok is false if not found
+func (tc *TransCache) GetCloneable(chID, itmID string) (value any, cloneable bool, ok bool) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).GetCloneable(itmID)
+}
+
+// GetItemExpiryTime returns the expiry time of an item, ok is false if not found
+func (tc *TransCache) GetItemExpiryTime(chID, itmID string) (exp time.Time, ok bool) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).GetItemExpiryTime(itmID)
+}
+
+// GetItemTTLInfo returns the expiry time of an item and if it stays fixed on reads, ok is false if not found
+func (tc *TransCache) GetItemTTLInfo(chID, itmID string) (exp time.Time, static bool, ok bool) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).GetItemTTLInfo(itmID)
+}
+
+// HasItem verifies if Item is in the cache
+func (tc *TransCache) HasItem(chID, itmID string) (has bool) {
+	tc.cacheMux.RLock()
+	has = tc.cacheInstance(chID).HasItem(itmID)
+	tc.cacheMux.RUnlock()
+	return
+}
+
+// EvictionChannel returns a channel with buffer size receiving the items removed from the
+// cache instance. Events are dropped and counted in CacheStats if the buffer is full.
+// The channel is closed on Shutdown
+func (tc *TransCache) EvictionChannel(chID string, buffer int) <-chan EvictionEvent {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).EvictionChannel(buffer)
+}
+
+// ReclaimMemory evicts the least recently used items, instance by instance, until at least
+// targetBytes are released. Returns the estimated number of bytes reclaimed
+func (tc *TransCache) ReclaimMemory(targetBytes int64) (reclaimed int64) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	chIDs := make([]string, 0, len(tc.cache))
+	for chID := range tc.cache {
+		if !tc.pendingRecovery(chID) { // nothing in memory yet
+			chIDs = append(chIDs, chID)
+		}
+	}
+	slices.Sort(chIDs)
+	for _, chID := range chIDs {
+		if reclaimed >= targetBytes {
+			break
+		}
+		reclaimed += tc.cache[chID].ReclaimMemory(targetBytes - reclaimed)
+	}
+	return
+}
+
+// SuspendEviction allows a cache instance to grow over its MaxItems during bulk loads
+func (tc *TransCache) SuspendEviction(chID string) {
+	tc.cacheMux.RLock()
+	tc.cacheInstance(chID).SuspendEviction()
+	tc.cacheMux.RUnlock()
+}
+
+// ResumeEviction restores the MaxItems limit of a cache instance, trimming it at once
+func (tc *TransCache) ResumeEviction(chID string) {
+	tc.cacheMux.RLock()
+	tc.cacheInstance(chID).ResumeEviction()
+	tc.cacheMux.RUnlock()
+}
+
+// GetCacheStats returns on overview of full cache
+func (tc *TransCache) GetCacheStats(chIDs []string) (cs map[string]*CacheStats) {
+	cs = make(map[string]*CacheStats)
+	tc.cacheMux.RLock()
+	if len(chIDs) == 0 {
+		for chID := range tc.cache {
+			chIDs = append(chIDs, chID)
+		}
+	}
+	for _, chID := range chIDs {
+		cs[chID] = tc.cacheInstance(chID).GetCacheStats()
+	}
+	tc.cacheMux.RUnlock()
+	return
 }
 
-// Remove all items in one or more cache instances
-func (tc *TransCache) Clear(chIDs []string) {
-	tc.cacheMux.Lock()
-	if chIDs == nil {
-		chIDs = make([]string, len(tc.cache))
-		i := 0
+// StatsSnapshot returns the statistics of the cache instances, all if chIDs is empty, each
+// gathered at one moment so memory, disk and pending numbers are consistent. Instances not
+// yet recovered from their dump folder are reported without recovering them
+func (tc *TransCache) StatsSnapshot(chIDs []string) (ss map[string]InstanceSnapshot) {
+	tc.cacheMux.Lock() // no transactions applied while gathering
+	defer tc.cacheMux.Unlock()
+	if len(chIDs) == 0 {
 		for chID := range tc.cache {
-			chIDs[i] = chID
-			i += 1
+			chIDs = append(chIDs, chID)
 		}
 	}
+	ss = make(map[string]InstanceSnapshot, len(chIDs))
 	for _, chID := range chIDs {
-		tc.cacheInstance(chID).Clear()
+		if tc.pendingRecovery(chID) {
+			var is InstanceSnapshot
+			tc.lazyRecovery[chID].offColl.diskSnapshot(&is)
+			ss[chID] = is
+			continue
+		}
+		ss[chID] = tc.cacheInstance(chID).StatsSnapshot()
 	}
-	tc.cacheMux.Unlock()
-}
-
-// GetItemIDs returns a list of item IDs matching prefix
-func (tc *TransCache) GetItemIDs(chID, prfx string) (itmIDs []string) {
-	tc.cacheMux.RLock()
-	itmIDs = tc.cacheInstance(chID).GetItemIDs(prfx)
-	tc.cacheMux.RUnlock()
 	return
 }
 
-// GetItemExpiryTime returns the expiry time of an item, ok is false if not found
-func (tc *TransCache) GetItemExpiryTime(chID, itmID string) (exp time.Time, ok bool) {
+// ResetStats zeroes the counters reported in the CacheStats of a cache instance
+func (tc *TransCache) ResetStats(chID string) {
 	tc.cacheMux.RLock()
 	defer tc.cacheMux.RUnlock()
-	return tc.cacheInstance(chID).GetItemExpiryTime(itmID)
+	tc.cacheInstance(chID).ResetStats()
 }
 
-// HasItem verifies if Item is in the cache
-func (tc *TransCache) HasItem(chID, itmID string) (has bool) {
-	tc.cacheMux.RLock()
-	has = tc.cacheInstance(chID).HasItem(itmID)
-	tc.cacheMux.RUnlock()
+// GetCacheStatsExcludingDefault returns the overview of all cache instances except the default
+// one, which is created even if not configured
+func (tc *TransCache) GetCacheStatsExcludingDefault() (cs map[string]*CacheStats) {
+	cs = tc.GetCacheStats(nil)
+	delete(cs, DefaultCacheInstance)
 	return
 }
 
-// GetCacheStats returns on overview of full cache
-func (tc *TransCache) GetCacheStats(chIDs []string) (cs map[string]*CacheStats) {
-	cs = make(map[string]*CacheStats)
+// GetLockStats returns the lock wait statistics of the cache instances, all if chIDs is empty.
+// Statistics are recorded only when built with the ltcache_lockstats tag
+func (tc *TransCache) GetLockStats(chIDs []string) (ls map[string]*LockStats) {
+	ls = make(map[string]*LockStats)
 	tc.cacheMux.RLock()
 	if len(chIDs) == 0 {
 		for chID := range tc.cache {
@@ -275,12 +1185,90 @@ func (tc *TransCache) GetCacheStats(chIDs []string) (cs map[string]*CacheStats)
 		}
 	}
 	for _, chID := range chIDs {
-		cs[chID] = tc.cacheInstance(chID).GetCacheStats()
+		ls[chID] = tc.cacheInstance(chID).GetLockStats()
 	}
 	tc.cacheMux.RUnlock()
 	return
 }
 
+// GetTransLockStats returns the wait statistics of the TransCache lock guarding the instances and transactions.
+// Statistics are recorded only when built with the ltcache_lockstats tag
+func (tc *TransCache) GetTransLockStats() *LockStats {
+	return tc.cacheMux.stats.get()
+}
+
+// GetLoadReport returns the statistics of recovering each cache instance from its dump files.
+// Instances not recovered yet are missing
+func (tc *TransCache) GetLoadReport() (lr map[string]*LoadReport) {
+	lr = make(map[string]*LoadReport)
+	tc.cacheMux.RLock()
+	for chID, c := range tc.cache {
+		if rpt := c.GetLoadReport(); rpt != nil {
+			lr[chID] = rpt
+		}
+	}
+	tc.cacheMux.RUnlock()
+	return
+}
+
+// CacheReport is an overview of the TransCache state, taken in one consistent snapshot
+type CacheReport struct {
+	Instances map[string]*InstanceReport // map[cacheInstance]*InstanceReport
+}
+
+// InstanceReport is an overview of a cache instance state
+type InstanceReport struct {
+	Items            int       // number of items in cache
+	Groups           int       // number of groups in cache
+	Persistent       bool      // true if the instance is dumped to files
+	PendingRecovery  bool      // true if the instance was not yet recovered from its dump files
+	DiskBytes        int64     // size of the instance dump files
+	PendingEntities  int       // number of collected items waiting to be dumped
+	LastDump         time.Time // time of the latest dump
+	LastDumpError    string    // error of the latest dump, empty if successful
+	LastRewrite      time.Time // time of the latest rewrite of dump files
+	LastRewriteError string    // error of the latest rewrite, empty if successful
+}
+
+// Inspect returns the state of all cache instances, blocking any change to the TransCache
+// until the report is built
+func (tc *TransCache) Inspect() (cr CacheReport) {
+	tc.cacheMux.Lock()
+	defer tc.cacheMux.Unlock()
+	cr.Instances = make(map[string]*InstanceReport, len(tc.cache))
+	for chID, c := range tc.cache {
+		ir := &InstanceReport{PendingRecovery: tc.pendingRecovery(chID)}
+		offColl := c.offCollector
+		if ir.PendingRecovery {
+			offColl = tc.lazyRecovery[chID].offColl
+		} else {
+			c.RLock()
+			ir.Items, ir.Groups = len(c.cache), len(c.groups)
+			c.RUnlock()
+		}
+		if offColl != nil {
+			ir.Persistent = true
+			if _, _, diskBytes, err := EstimateRecovery(offColl.fldrPath); err == nil {
+				ir.DiskBytes = diskBytes
+			}
+			offColl.collMux.RLock()
+			ir.PendingEntities = len(offColl.collection)
+			offColl.collMux.RUnlock()
+			offColl.status.RLock()
+			ir.LastDump, ir.LastRewrite = offColl.status.lastDump, offColl.status.lastRewrite
+			if offColl.status.dumpErr != nil {
+				ir.LastDumpError = offColl.status.dumpErr.Error()
+			}
+			if offColl.status.rewriteErr != nil {
+				ir.LastRewriteError = offColl.status.rewriteErr.Error()
+			}
+			offColl.status.RUnlock()
+		}
+		cr.Instances[chID] = ir
+	}
+	return
+}
+
 // TransCacheOpts holds the options needed to create a TransCache with OfflineCollector
 type TransCacheOpts struct {
 	DumpPath        string        // path where TransCache will be dumped
@@ -289,11 +1277,94 @@ type TransCacheOpts struct {
 	DumpInterval    time.Duration // dump frequency interval at which cache will be dumped to file (-1 dumps cache as soon as a set/remove is done; 0 disables it)
 	RewriteInterval time.Duration // rewrite the dump files to streamline them, using RewriteInterval. (-2 rewrites on shutdown, -1 rewrites before start of dumping, 0 disables it).
 	FileSizeLimit   int64         // File size limit in bytes. When limit is passed, it creates a new file where cache will be dumped. (only bigger than 0 allowed)
+	RecoverCaches   []string      // cache instances recovered from dump on start, the rest will be recovered on first access (nil recovers all)
+
+	RenameRetries    int           // times to retry renaming files on rewrite in case of failure (0 disables retrying)
+	RenameRetryDelay time.Duration // delay before the first rename retry, doubled on each retry
+	WriteBufferSize  int           // size in bytes of the buffer used when writing dump files (0 uses the default of 4096)
+
+	// ValidateEncodable encodes the values on Set, returning the error to the caller instead of
+	// losing the item when dumping it fails later on
+	ValidateEncodable bool
+	// MigrateEntity, if not nil, is called for each entity read from dump files or backups, allowing
+	// to transform entities dumped in an older format. Returning false drops the entity
+	MigrateEntity MigrateEntityFunc
+	// KeepRewriteHistory keeps the files replaced by the latest KeepRewriteHistory rewrites of each
+	// instance, allowing RestoreRewrite to roll back a rewrite (0 deletes them)
+	KeepRewriteHistory int
+	// MaxRecoveryBytes fails recovering an instance whose dump files are bigger than this, instead
+	// of running out of memory while loading them (0 for no limit)
+	MaxRecoveryBytes int64
+	// DumpConcurrency limits the number of instances dumped in parallel by DumpAll, smoothing
+	// the disk load with many instances (0 uses GOMAXPROCS)
+	DumpConcurrency int
+	// ShutdownRewriteThreshold, when RewriteInterval is -2, rewrites an instance on shutdown only if
+	// the fraction of dumped entities dropped by rewriting (see RewriteSavings) reaches it (0 always rewrites)
+	ShutdownRewriteThreshold float64
+	// RejectOversizedValues fails setting values which encode to more than FileSizeLimit bytes with
+	// ErrValueTooLarge, instead of dumping each of them in a single file over the limit
+	RejectOversizedValues bool
+	// StreamRecovery reads the dump files through a small buffer when recovering, instead of mapping
+	// each file in memory. Entities are applied to the cache in file order either way, so memory is
+	// bounded by MaxItems and TTL rather than by the size of the files, at the cost of slower reads.
+	// Sets later overwritten or removed are still applied, possibly evicting items which would have
+	// been kept if the files were de-duplicated first by a rewrite
+	StreamRecovery bool
+	// RemoveBatchSize, when dumping on each change (DumpInterval -1), writes the removes of bulk
+	// operations like RemoveGroup or Clear in batches of up to RemoveBatchSize entities per flush,
+	// instead of flushing each of them (0 or 1 flushes each remove)
+	RemoveBatchSize int
+	// MaxWriteFailures stops dumping an instance after this many consecutive writes failed on disk,
+	// avoiding an error on each change while the dump folder is not writable. Changes are then
+	// collected in memory until a Flush of the instance succeeds (0 never stops dumping)
+	MaxWriteFailures int
+	// OnBackgroundError, if not nil, is called when an instance stops dumping after MaxWriteFailures
+	OnBackgroundError func(chID string, err error)
+	// CoalesceWindow, when dumping on each change (DumpInterval -1), delays dumping the Sets of an
+	// item repeated within this duration of its dumped Set, dumping only its latest value at the
+	// end of the window (0 dumps every Set)
+	CoalesceWindow time.Duration
+	// RecoveryFS, if not nil, is the filesystem the dump files are recovered from instead of DumpPath,
+	// holding the instance folders at its root, e.g. an fstest.MapFS when testing. Files left by
+	// interrupted rewrites are skipped instead of removed. Changes are still dumped under DumpPath
+	RecoveryFS fs.FS
+	// Codec, if not nil, writes and reads the dump files in its own format instead of gob, e.g.
+	// JSONCodec for dumps inspected by other tools. The gob and JSON files dumped before changing
+	// it are still recovered, being rewritten with Codec. MergeDumpFolders always writes gob dumps
+	Codec EntityCodec
+	// Compression gzips the dump files written from now on, including the rewritten ones. Files
+	// are read alike whether compressed or not, so existing dumps are recovered while migrating
+	Compression bool
+	// Clock, if not nil, replaces time.Now in the ttls and expiries of the items of the instances
+	// not setting their own CacheConfig.Clock and in the age of the transactions, see
+	// NewTransCacheWithClock
+	Clock Clock
+
+	BeforeDump func(chID, itmID string, value any) any // if not nil, transforms the value of an item before being dumped to file
+	AfterLoad  func(chID, itmID string, value any) any // if not nil, transforms the value of an item read from dump files before being cached
+}
+
+// EnsureInstanceFolders creates under rootPath the dump folders of the chID cache instances and
+// of the default instance, so they can be provisioned before NewTransCacheWithOfflineCollector
+// runs, possibly under a user not allowed to create them
+func EnsureInstanceFolders(rootPath string, chIDs []string) (err error) {
+	for _, chID := range append([]string{DefaultCacheInstance}, chIDs...) {
+		if err = ensureDir(path.Join(rootPath, chID)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ensureDir creates the fldrPath folder together with its parents, if missing
+func ensureDir(fldrPath string) error {
+	return os.MkdirAll(fldrPath, 0755)
 }
 
 // NewTransCacheWithOfflineCollector constructs a new TransCache with OfflineCollector if opts are
 // provided. If not it runs NewTransCache constructor. Cache configuration is taken from cfg and logs
-// will be sent to l logger.
+// will be sent to l logger. On a recovery error, the instances already recovered are shut down
+// before returning.
 func NewTransCacheWithOfflineCollector(opts *TransCacheOpts, cfg map[string]*CacheConfig, l logger) (tc *TransCache, err error) {
 	if opts == nil { // if no opts are provided, create a TransCache without offline collector
 		return NewTransCache(cfg), nil
@@ -311,27 +1382,50 @@ func NewTransCacheWithOfflineCollector(opts *TransCacheOpts, cfg map[string]*Cac
 		cache:             make(map[string]*Cache),
 		cfg:               cfg,
 		transactionBuffer: make(map[string][]*transactionItem),
+		lazyRecovery:      make(map[string]*lazyRecovery),
+		dumpConcurrency:   opts.DumpConcurrency,
+		offCollOpts:       opts,
+		offCollLogger:     l,
+		clock:             opts.Clock,
 	}
+	tc.cacheMux.stats = newLockStats()
 	var wg sync.WaitGroup                   // wait for all goroutines to finish reading dump
 	errChan := make(chan error, 1)          // signal error from newCacheFromFolder
 	constructed := make(chan struct{})      // signal transCache constructed
+	newTC := tc                             // kept by goroutines still recovering after returning on error
 	for cacheName, config := range tc.cfg { // range over cfg to create each cache and populate TransCache.cache with them
 		// Create folder if it doesnt exist
-		if err := os.MkdirAll(path.Join(opts.DumpPath, cacheName), 0755); err != nil {
+		if err := ensureDir(path.Join(opts.DumpPath, cacheName)); err != nil {
+			wg.Wait() // no recovery left running on opts once returned
+			tc.Shutdown()
 			return nil, err
 		}
+		if opts.RecoverCaches != nil && !slices.Contains(opts.RecoverCaches, cacheName) {
+			// recover the instance only when accessed for the first time
+			tc.cacheMux.Lock()
+			tc.cache[cacheName] = config.newCache(tc.clock)
+			tc.cacheMux.Unlock()
+			offColl := NewOfflineCollector(cacheName, opts, l)
+			offColl.decodeInto = config.DecodeInto
+			tc.lazyRecovery[cacheName] = &lazyRecovery{offColl: offColl}
+			continue
+		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			offColl := NewOfflineCollector(cacheName, opts, l)
-			cache, err := NewCacheFromFolder(offColl, config.MaxItems, config.TTL, config.StaticTTL, config.Clone, config.OnEvicted)
-			if err != nil {
-				errChan <- err
+			offColl.decodeInto = config.DecodeInto
+			cache := config.newCache(newTC.clock)
+			if err := cache.recoverFromFolder(offColl); err != nil {
+				select {
+				case errChan <- err:
+				default: // only the first error is returned
+				}
 				return
 			}
-			tc.cacheMux.Lock()
-			tc.cache[cacheName] = cache
-			tc.cacheMux.Unlock()
+			newTC.cacheMux.Lock()
+			newTC.cache[cacheName] = cache
+			newTC.cacheMux.Unlock()
 		}()
 	}
 	go func() { // wait in goroutine for reading from dump to be finished. In cases when an error is returned from newCacheFromFolder, instantly return the error and stop proccessing
@@ -343,6 +1437,8 @@ func NewTransCacheWithOfflineCollector(opts *TransCacheOpts, cfg map[string]*Cac
 	case <-time.After(opts.StartTimeout):
 		return nil, fmt.Errorf("building TransCache from <%s> timed out after <%v>", opts.DumpPath, opts.StartTimeout)
 	case err := <-errChan:
+		<-constructed // no recovery left running on opts once returned
+		newTC.Shutdown()
 		return nil, err
 	case <-constructed:
 		return
@@ -352,16 +1448,28 @@ func NewTransCacheWithOfflineCollector(opts *TransCacheOpts, cfg map[string]*Cac
 // DumpAll collected cache in files
 func (tc *TransCache) DumpAll() (err error) {
 	var wg sync.WaitGroup
-	errChan := make(chan error, len(tc.cache)) // Channel to collect errors
-	for cacheKey, cache := range tc.cache {
+	chs := tc.dumpedInstances()
+	errChan := make(chan error, len(chs)) // Channel to collect errors
+	concurrency := tc.dumpConcurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	for cacheKey, cache := range chs { // check all before dumping any
 		if cache.offCollector == nil {
-			return fmt.Errorf("couldn't dump cache to file, %s offCollector is nil", cacheKey)
+			return fmt.Errorf("couldn't dump cache to file, %s %w", cacheKey, ErrInstanceNotPersistent)
 		}
+	}
+	sem := make(chan struct{}, concurrency) // limit the instances dumping at once
+	for _, cache := range chs {
 		wg.Add(1)
+		sem <- struct{}{}
 		go func() {
-			defer wg.Done()
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
 			if err := cache.DumpToFile(); err != nil {
-				cache.offCollector.logger.Err(err.Error()) // dont stop other caches from dumping if previous DumpToFile errors
+				cache.offCollector.log().Err(err.Error()) // dont stop other caches from dumping if previous DumpToFile errors
 				errChan <- err
 			}
 		}()
@@ -377,11 +1485,377 @@ func (tc *TransCache) DumpAll() (err error) {
 	return
 }
 
+// VerifyPersistence compares the items of a cache instance with the ones recovered from its
+// dump folder, returning the discrepancies found
+func (tc *TransCache) VerifyPersistence(chID string) (matches bool, diffs []string, err error) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	c, err := tc.persistentInstance(chID)
+	if err != nil {
+		return
+	}
+	return c.VerifyPersistence()
+}
+
+// RewriteSavings returns the fraction of the dumped entities of a cache instance, from 0 to 1,
+// which rewriting its dump files would drop
+func (tc *TransCache) RewriteSavings(chID string) (savings float64, err error) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	c, err := tc.persistentInstance(chID)
+	if err != nil {
+		return
+	}
+	return c.RewriteSavings()
+}
+
+// InstanceIDs returns the sorted IDs of the cache instances
+func (tc *TransCache) InstanceIDs() (chIDs []string) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	chIDs = slices.Collect(maps.Keys(tc.cache))
+	slices.Sort(chIDs)
+	return
+}
+
+// GetInstanceConfig returns a copy of the configuration of a cache instance, ok is false if
+// the instance is not configured
+func (tc *TransCache) GetInstanceConfig(chID string) (*CacheConfig, bool) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	chCfg, has := tc.cfg[chID]
+	if !has {
+		return nil, false
+	}
+	cfgCopy := *chCfg
+	cfgCopy.OnEvicted = slices.Clone(chCfg.OnEvicted)
+	return &cfgCopy, true
+}
+
+// UpdateInstanceConfig applies at runtime the MaxItems, TTL and StaticTTL of cfg to an existing
+// cache instance, see Cache.SetMaxItems and Cache.SetTTL. The other fields of cfg are ignored,
+// being applied only when creating the instance. Caching cannot be disabled or enabled live
+func (tc *TransCache) UpdateInstanceConfig(chID string, cfg *CacheConfig) error {
+	if cfg == nil {
+		return fmt.Errorf("no config for cache instance <%s>", chID)
+	}
+	tc.cacheMux.Lock()
+	defer tc.cacheMux.Unlock()
+	if _, has := tc.cache[chID]; !has {
+		return fmt.Errorf("<%s> %w", chID, ErrUnknownInstance)
+	}
+	chCfg := *tc.cfg[chID]
+	if (chCfg.MaxItems == DisabledCaching) != (cfg.MaxItems == DisabledCaching) {
+		return fmt.Errorf("cannot change caching of <%s> between disabled and enabled", chID)
+	}
+	c := tc.cacheInstance(chID)
+	c.SetMaxItems(cfg.MaxItems)
+	c.SetTTL(cfg.TTL, cfg.StaticTTL)
+	chCfg.MaxItems, chCfg.TTL, chCfg.StaticTTL = cfg.MaxItems, cfg.TTL, cfg.StaticTTL
+	chCfgs := maps.Clone(tc.cfg) // dont modify the configuration of the caller
+	chCfgs[chID] = &chCfg
+	tc.cfg = chCfgs
+	return nil
+}
+
+// CollectorConfig returns the settings of the offline collector of a cache instance, ok is false
+// if the instance is not dumped
+func (tc *TransCache) CollectorConfig(chID string) (CollectorInfo, bool) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).CollectorConfig()
+}
+
+// SetLogger replaces the logger used by the offline collectors of all cache instances, including
+// their background dumping and rewriting. A nil l disables logging
+func (tc *TransCache) SetLogger(l logger) {
+	tc.cacheMux.Lock()
+	defer tc.cacheMux.Unlock()
+	tc.offCollLogger = l
+	for chID, c := range tc.cache {
+		if lr, has := tc.lazyRecovery[chID]; has { // collector attached to c only once recovered
+			lr.offColl.setLogger(l)
+			continue
+		}
+		if c.offCollector != nil {
+			c.offCollector.setLogger(l)
+		}
+	}
+}
+
+// Healthy returns false if any cache instance stopped dumping after failed writes, see MaxWriteFailures
+func (tc *TransCache) Healthy() bool {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	for chID, c := range tc.cache {
+		if !tc.pendingRecovery(chID) && !c.Healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush dumps right away the changes collected by all the cache instances, as on each dump
+// interval. Instances without offline collector are skipped, so it is a no-op when persistence
+// is disabled. Errors are joined, not stopping the other instances from flushing
+func (tc *TransCache) Flush() error {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	var errs []error
+	for chID, c := range tc.cache {
+		if c.offCollector == nil || tc.pendingRecovery(chID) || tc.forked(chID) { // nothing collected
+			continue
+		}
+		if err := c.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("cache <%s>: %w", chID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FlushInstance dumps the changes collected by a cache instance, resuming dumping if it was
+// stopped after failed writes
+func (tc *TransCache) FlushInstance(chID string) (err error) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	c, err := tc.persistentInstance(chID)
+	if err != nil {
+		return
+	}
+	return c.Flush()
+}
+
+// CheckConsistency verifies the internal indexes of a cache instance, returning the violations
+// found, empty if the instance is healthy
+func (tc *TransCache) CheckConsistency(chID string) []string {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.cacheInstance(chID).CheckConsistency()
+}
+
+// AddInstance creates the chID cache instance with a copy of cfg at runtime. With the offline
+// collector active, the instance is dumped in its own folder, recovering first the items found
+// there without blocking the other instances
+func (tc *TransCache) AddInstance(chID string, cfg *CacheConfig) (err error) {
+	if cfg == nil {
+		return fmt.Errorf("no config for cache instance <%s>", chID)
+	}
+	chCfg := *cfg // not changed by the caller after
+	tc.cacheMux.Lock()
+	if tc.instanceTaken(chID) {
+		tc.cacheMux.Unlock()
+		return fmt.Errorf("cache instance <%s> already exists", chID)
+	}
+	if tc.adding == nil {
+		tc.adding = make(map[string]struct{})
+	}
+	tc.adding[chID] = struct{}{} // reserved until recovered, the folder being ours
+	opts, l := tc.offCollOpts, tc.offCollLogger
+	tc.cacheMux.Unlock()
+	c := chCfg.newCache(tc.clock)
+	if opts != nil {
+		if err = ensureDir(path.Join(opts.DumpPath, chID)); err == nil {
+			offColl := NewOfflineCollector(chID, opts, l)
+			offColl.decodeInto = chCfg.DecodeInto
+			err = c.recoverFromFolder(offColl)
+		}
+	}
+	tc.cacheMux.Lock()
+	defer tc.cacheMux.Unlock()
+	delete(tc.adding, chID)
+	if err != nil {
+		return
+	}
+	tc.cache[chID] = c
+	chCfgs := maps.Clone(tc.cfg) // dont modify the configuration of the caller
+	chCfgs[chID] = &chCfg
+	tc.cfg = chCfgs
+	return
+}
+
+// instanceTaken returns true if chID is an instance or is being added by AddInstance (cacheMux locked)
+func (tc *TransCache) instanceTaken(chID string) bool {
+	if _, has := tc.cache[chID]; has {
+		return true
+	}
+	_, has := tc.adding[chID]
+	return has
+}
+
+// RemoveInstance drops the chID cache instance together with its configuration and dump folder,
+// the default instance being used for chID from then on, as for any unknown instance. Its items
+// are evicted as on Clear. With archivePath not empty, the dump folder is moved inside it, named
+// after chID and the time of the removal, instead of being deleted
+func (tc *TransCache) RemoveInstance(chID, archivePath string) (err error) {
+	if chID == DefaultCacheInstance {
+		return fmt.Errorf("cannot remove <%s>", DefaultCacheInstance)
+	}
+	tc.cacheMux.Lock()
+	c, has := tc.cache[chID]
+	if !has {
+		tc.cacheMux.Unlock()
+		return fmt.Errorf("<%s> %w", chID, ErrUnknownInstance)
+	}
+	var fldrPath string
+	pending := tc.pendingRecovery(chID) // nothing opened in the dump folder
+	if pending {
+		fldrPath = tc.lazyRecovery[chID].offColl.fldrPath
+	} else if c.offCollector != nil {
+		fldrPath = c.offCollector.fldrPath
+	}
+	delete(tc.cache, chID)
+	chCfgs := maps.Clone(tc.cfg) // dont modify the configuration of the caller
+	delete(chCfgs, chID)
+	tc.cfg = chCfgs
+	delete(tc.lazyRecovery, chID)
+	delete(tc.forks, chID)
+	tc.cacheMux.Unlock()
+
+	if !pending && c.offCollector != nil {
+		if archivePath != "" { // archive the changes still collected as well
+			if err := c.Flush(); err != nil {
+				c.offCollector.log().Warning(fmt.Sprintf("archiving cache instance <%s>: %v", chID, err))
+			}
+		}
+		c.clearUndumped()
+		if err := c.Shutdown(); err != nil { // the dump folder is removed anyway
+			c.offCollector.log().Warning(fmt.Sprintf("removing cache instance <%s>: %v", chID, err))
+		}
+	} else {
+		c.Clear()
+		c.stopCleaner()
+		c.closeEvictionChannels()
+	}
+	if fldrPath == "" {
+		return
+	}
+	if archivePath == "" {
+		return os.RemoveAll(fldrPath)
+	}
+	if err = ensureDir(archivePath); err != nil {
+		return
+	}
+	return os.Rename(fldrPath, filepath.Join(archivePath,
+		chID+"_"+strconv.FormatInt(time.Now().UnixMilli(), 10)))
+}
+
+// ForkInstance creates the dstID cache instance with the configuration and items of srcID,
+// after which each of them can be changed without affecting the other. The values are shared,
+// not cloned, so they must not be modified in place. The fork is kept only in memory, being
+// skipped when dumping, backing up or restoring the TransCache
+func (tc *TransCache) ForkInstance(srcID, dstID string) (err error) {
+	tc.cacheMux.Lock()
+	defer tc.cacheMux.Unlock()
+	if _, has := tc.cache[srcID]; !has {
+		return fmt.Errorf("<%s> %w", srcID, ErrUnknownInstance)
+	}
+	if tc.instanceTaken(dstID) {
+		return fmt.Errorf("cache instance <%s> already exists", dstID)
+	}
+	src := tc.cacheInstance(srcID)
+	chCfg, has := tc.cfg[srcID]
+	if !has {
+		chCfg = tc.cfg[DefaultCacheInstance]
+	}
+	dst := chCfg.newCache(tc.clock)
+	src.copyItemsTo(dst)
+	tc.cache[dstID] = dst
+	cfg := maps.Clone(tc.cfg) // dont modify the configuration of the caller
+	cfg[dstID] = chCfg
+	tc.cfg = cfg
+	if tc.forks == nil {
+		tc.forks = make(map[string]struct{})
+	}
+	tc.forks[dstID] = struct{}{}
+	return
+}
+
+// forked returns true if chID was created by ForkInstance (not thread safe)
+func (tc *TransCache) forked(chID string) bool {
+	_, has := tc.forks[chID]
+	return has
+}
+
+// persistentInstance returns the chID cache instance, failing with ErrUnknownInstance instead
+// of falling back to the default instance, or with ErrInstanceNotPersistent if it is not dumped
+func (tc *TransCache) persistentInstance(chID string) (c *Cache, err error) {
+	if _, has := tc.cache[chID]; !has {
+		return nil, fmt.Errorf("<%s> %w", chID, ErrUnknownInstance)
+	}
+	if c = tc.cacheInstance(chID); c.offCollector == nil {
+		return nil, fmt.Errorf("<%s> %w", chID, ErrInstanceNotPersistent)
+	}
+	return
+}
+
+// RenameCacheInstance moves the cache instance oldID, together with its configuration and dump
+// folder, to newID. Transactions buffered for oldID will apply on the default instance
+func (tc *TransCache) RenameCacheInstance(oldID, newID string) (err error) {
+	if oldID == DefaultCacheInstance || newID == DefaultCacheInstance {
+		return fmt.Errorf("cannot rename from or to <%s>", DefaultCacheInstance)
+	}
+	tc.cacheMux.Lock()
+	defer tc.cacheMux.Unlock()
+	c, has := tc.cache[oldID]
+	if !has {
+		return fmt.Errorf("<%s> %w", oldID, ErrUnknownInstance)
+	}
+	if tc.instanceTaken(newID) {
+		return fmt.Errorf("cache instance <%s> already exists", newID)
+	}
+	c = tc.cacheInstance(oldID) // recover before moving the dump folder
+	if c.offCollector != nil {
+		c.Lock() // stop dumping and rewriting until the folder is moved
+		c.offCollector.collMux.Lock()
+		c.offCollector.rewriteMux.Lock()
+		c.offCollector.fileMux.Lock()
+		err = c.offCollector.moveFolder(path.Join(path.Dir(c.offCollector.fldrPath), newID))
+		c.offCollector.fileMux.Unlock()
+		c.offCollector.rewriteMux.Unlock()
+		c.offCollector.collMux.Unlock()
+		c.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	tc.cache[newID] = c
+	delete(tc.cache, oldID)
+	cfg := maps.Clone(tc.cfg) // dont modify the configuration of the caller
+	if chCfg, has := cfg[oldID]; has {
+		cfg[newID] = chCfg
+		delete(cfg, oldID)
+	}
+	tc.cfg = cfg
+	if lr, has := tc.lazyRecovery[oldID]; has {
+		tc.lazyRecovery[newID] = lr
+		delete(tc.lazyRecovery, oldID)
+	}
+	if tc.forked(oldID) {
+		tc.forks[newID] = struct{}{}
+		delete(tc.forks, oldID)
+	}
+	return
+}
+
+// RestoreRewrite rolls back the dump files of a cache instance to the state before the rewrite
+// of the given generation (0 being the latest) kept in history. The cache is not changed, the
+// restored files are used on the next recovery
+func (tc *TransCache) RestoreRewrite(chID string, generation int) error {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	c, err := tc.persistentInstance(chID)
+	if err != nil {
+		return err
+	}
+	return c.RestoreRewrite(generation)
+}
+
 // RewriteAll will gather all sets and removes from dump files and rewrite a new streamlined file
 func (tc *TransCache) RewriteAll() (err error) {
 	var wg sync.WaitGroup
-	errChan := make(chan error, len(tc.cache)) // Channel to collect errors
-	for _, cache := range tc.cache {
+	chs := tc.dumpedInstances()
+	errChan := make(chan error, len(chs)) // Channel to collect errors
+	for _, cache := range chs {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -403,31 +1877,70 @@ func (tc *TransCache) RewriteAll() (err error) {
 }
 
 // Shutdown depending on dump and rewrite intervals, will dump all thats left in
-// cache collector to file and/or rewrite files, and close all files
-func (tc *TransCache) Shutdown() {
-	for _, c := range tc.cache {
-		if c.offCollector == nil {
-			return // dont return any error on shutdown where collector was disabled
+// cache collector to file and/or rewrite files, and close all files. The errors of
+// the caches are logged and returned joined, telling if all were flushed cleanly
+func (tc *TransCache) Shutdown() error {
+	return tc.ShutdownCtx(context.Background())
+}
+
+// ShutdownCtx is Shutdown returning ctx.Err() once ctx is done, without waiting for the dumps
+// and rewrites left. The entities dumped until then stay valid in the dump files
+func (tc *TransCache) ShutdownCtx(ctx context.Context) error {
+	tc.SetTransactionTTL(0)
+	var errs []error
+	for _, c := range tc.instancesWhere(func(chID string, _ *Cache) bool {
+		return tc.pendingRecovery(chID)
+	}) {
+		c.stopCleaner()
+	}
+	for chID, c := range tc.instancesWhere(func(chID string, _ *Cache) bool {
+		return !tc.pendingRecovery(chID) // nothing opened for instances never accessed
+	}) {
+		if c.offCollector == nil { // dont return any error on shutdown where collector was disabled
+			c.stopCleaner()
+			c.closeEvictionChannels()
+			continue
 		}
-		if err := c.Shutdown(); err != nil { // only log errors to make sure we dont stop other caches from shutting down
-			c.offCollector.logger.Err(err.Error())
+		if err := c.ShutdownCtx(ctx); err != nil { // dont stop other caches from shutting down
+			c.offCollector.log().Err(err.Error())
+			errs = append(errs, fmt.Errorf("cache <%s>: %w", chID, err))
+		}
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 	}
+	return errors.Join(errs...)
 }
 
 // BackupDumpFolder will momentarely stop any dumping and rewriting per Cache until their
 // dump folder is backed up in folder path backupFolderPath, making zip true will create
 // a zip file from the dump folder in the backupFolderPath instead and add ".zip" suffix at the end of the created zip file.
 func (tc *TransCache) BackupDumpFolder(backupFolderPath string, zip bool) (err error) {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	return tc.backupDumpFolder(backupFolderPath, zip)
+}
+
+// backupDumpFolder implements BackupDumpFolder (cacheMux locked)
+func (tc *TransCache) backupDumpFolder(backupFolderPath string, zip bool) (err error) {
 	newBackupFldrName := "backup_" +
 		strconv.FormatInt(time.Now().UnixMilli(), 10) // the name that will be used to
 	// create a new backup folder
 	var newBackupFldrPath string // create new backup folder in newBackupFldrPath path
 	// where each Cache dump will be pasted
-	var dumpFolderPath string        // path to the main dump folder
-	for _, cache := range tc.cache { // lock all dumping or rewriting until function returns
+	var dumpFolderPath string           // path to the main dump folder
+	for chID, cache := range tc.cache { // lock all dumping or rewriting until function returns
+		if tc.forked(chID) { // no dump folder to back up
+			continue
+		}
+		if tc.pendingRecovery(chID) { // dump folder untouched since start, no need to lock
+			if dumpFolderPath == "" {
+				dumpFolderPath = filepath.Dir(tc.lazyRecovery[chID].offColl.fldrPath)
+			}
+			continue
+		}
 		if cache.offCollector == nil {
-			return fmt.Errorf("cache offCollector is nil")
+			return fmt.Errorf("cache %w", ErrInstanceNotPersistent)
 		}
 		// wait for any live file writting to be finished using fileMux locker
 		cache.offCollector.fileMux.Lock()
@@ -460,9 +1973,15 @@ func (tc *TransCache) BackupDumpFolder(backupFolderPath string, zip bool) (err e
 	return zipFolder(dumpFolderPath, newBackupFldrPath+".zip")
 }
 
-// backupPath returns the backupPath string from TransCache
+// backupPath returns the backupPath string from TransCache (cacheMux locked)
 func (tc *TransCache) backupPath() (string, error) {
-	for _, cache := range tc.cache {
+	for chID, cache := range tc.cache {
+		if tc.forked(chID) {
+			continue
+		}
+		if lr, has := tc.lazyRecovery[chID]; has { // offCollector might not be populated yet
+			return lr.offColl.backupPath, nil
+		}
 		return cache.offCollector.backupPath, nil
 	}
 	return "", errors.New("empty BackupPath")
@@ -473,9 +1992,15 @@ func (tc *TransCache) backupPath() (string, error) {
 // from the cache backup path. Any data that was dumped from internal DB will be cleared
 // before restoring from backup
 func (tc *TransCache) Restore(backupPath string) (err error) {
-	for _, chI := range tc.cache {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	tc.recoverAll() // make sure all instances have their offline collector populated
+	for chID, chI := range tc.cache {
+		if tc.forked(chID) {
+			continue
+		}
 		if chI.offCollector == nil {
-			return fmt.Errorf("couldn't restore cache from backup, offline collector is nil")
+			return fmt.Errorf("couldn't restore cache from backup, %w", ErrInstanceNotPersistent)
 		}
 		break
 	}
@@ -552,10 +2077,10 @@ func (tc *TransCache) Restore(backupPath string) (err error) {
 
 		// Iterate through each file in the zip and decode its contents into the cache
 		for _, f := range zr.File {
-			if f.FileInfo().IsDir() {
+			if f.FileInfo().IsDir() || slices.Contains(strings.Split(f.Name, "/"), historyFolderName) {
 				continue
 			}
-			chInstanceName := path.Base(path.Dir(f.Name)) // the name of the base folder of the file
+			c := tc.cache[path.Base(path.Dir(f.Name))] // the instance named as the base folder of the file
 			rc, err := f.Open()
 			if err != nil {
 				return fmt.Errorf("failed to open file %s inside zip: %w", f.Name, err)
@@ -570,21 +2095,8 @@ func (tc *TransCache) Restore(backupPath string) (err error) {
 					errChan <- fmt.Errorf("failed to read file %s: %w", f.Name, err)
 					return
 				}
-				dec := gob.NewDecoder(bytes.NewReader(fileInBytes))
-				for {
-					var oce OfflineCacheEntity
-					if err := dec.Decode(&oce); err != nil {
-						if err == io.EOF {
-							break
-						}
-						errChan <- fmt.Errorf("failed to decode OfflineCacheEntity at <%s>: %w", f.Name, err)
-						return
-					}
-					if oce.IsSet {
-						tc.cache[chInstanceName].Set(oce.ItemID, oce.Value, oce.GroupIDs)
-					} else {
-						tc.cache[chInstanceName].Remove(oce.ItemID)
-					}
+				if err := restoreEntities(c, bytes.NewReader(fileInBytes), f.Name); err != nil {
+					errChan <- err
 				}
 			}()
 		}
@@ -594,8 +2106,12 @@ func (tc *TransCache) Restore(backupPath string) (err error) {
 				return err
 			}
 			if d.IsDir() {
+				if d.Name() == historyFolderName { // rewrite history is not part of the cache
+					return fs.SkipDir
+				}
 				return nil
 			}
+			c := tc.cache[filepath.Base(filepath.Dir(path))] // the instance named as the base folder of the file
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
@@ -605,22 +2121,8 @@ func (tc *TransCache) Restore(backupPath string) (err error) {
 					return
 				}
 				defer r.Close()
-				chInstanceName := filepath.Base(filepath.Dir(path)) // the name of the base folder of the file
-				dec := gob.NewDecoder(io.NewSectionReader(r, 0, int64(r.Len())))
-				for {
-					var oce OfflineCacheEntity
-					if err := dec.Decode(&oce); err != nil {
-						if errors.Is(err, io.EOF) {
-							break
-						}
-						errChan <- fmt.Errorf("failed to decode OfflineCacheEntity at <%s>: %w", path, err)
-						return
-					}
-					if oce.IsSet {
-						tc.cache[chInstanceName].Set(oce.ItemID, oce.Value, oce.GroupIDs)
-					} else {
-						tc.cache[chInstanceName].Remove(oce.ItemID)
-					}
+				if err := restoreEntities(c, io.NewSectionReader(r, 0, int64(r.Len())), path); err != nil {
+					errChan <- err
 				}
 			}()
 			return nil
@@ -641,13 +2143,32 @@ func (tc *TransCache) Restore(backupPath string) (err error) {
 	}
 }
 
+// restoreEntities applies to the c instance the entities of the backed up dump file read from
+// r, decoded in the format of its offline collector
+func restoreEntities(c *Cache, r io.Reader, filePath string) error {
+	return decodeEntities(r, filePath, c.offCollector.codec, func(oce *OfflineCacheEntity) {
+		migrated, keep := c.offCollector.migrated(oce)
+		if !keep {
+			return
+		}
+		if migrated.IsSet {
+			c.SetWithTags(migrated.ItemID, c.offCollector.loadedValue(migrated), migrated.GroupIDs, migrated.Tags)
+		} else {
+			c.Remove(migrated.ItemID)
+		}
+	})
+}
+
 // clearCacheAndDumpFiles will delete all dump files and create new empty ones for each cache instance.
-// If clearCache is true, it will also clear the cache instance
+// If clearCache is true, it will also clear the cache instance (cacheMux locked)
 func (tc *TransCache) clearCacheAndDumpFiles(clearCache bool) (err error) {
 	var wg sync.WaitGroup          // wait for all goroutines to finish
 	errChan := make(chan error, 1) // signal error from goroutines
 	cleared := make(chan struct{}) // signal dump cleared
-	for _, cacheInstance := range tc.cache {
+	for chID, cacheInstance := range tc.cache {
+		if tc.forked(chID) {
+			continue
+		}
 		if clearCache {
 			cacheInstance.Clear()
 		}
@@ -688,7 +2209,8 @@ func (tc *TransCache) clearCacheAndDumpFiles(clearCache bool) (err error) {
 			// create new live file
 			if cacheInstance.offCollector.file, cacheInstance.offCollector.writer,
 				cacheInstance.offCollector.encoder, goErr = populateEncoder(cacheInstance.
-				offCollector.fldrPath, ""); goErr != nil {
+				offCollector.fldrPath, "", cacheInstance.offCollector.writeBufferSize,
+				cacheInstance.offCollector.codec, cacheInstance.offCollector.compress); goErr != nil {
 				errChan <- goErr
 			}
 		}()
@@ -707,7 +2229,10 @@ func (tc *TransCache) clearCacheAndDumpFiles(clearCache bool) (err error) {
 
 // Snapshot will lock all chache instances, backup the live dump folder taking zip as parameter to zip the backup or not, after which it cleares the live dump folder and creates new dump files out of the live cache entities inside TransCache, and finaly unlock all cache instances
 func (tc *TransCache) Snapshot(backupFolderPath string, zip bool) (err error) {
-	if err := tc.BackupDumpFolder(backupFolderPath, zip); err != nil {
+	tc.cacheMux.RLock()
+	defer tc.cacheMux.RUnlock()
+	tc.recoverAll() // dump files are recreated from memory, so all instances need to be recovered first
+	if err := tc.backupDumpFolder(backupFolderPath, zip); err != nil {
 		return err
 	}
 	if err := tc.clearCacheAndDumpFiles(false); err != nil {
@@ -717,20 +2242,23 @@ func (tc *TransCache) Snapshot(backupFolderPath string, zip bool) (err error) {
 	var wg sync.WaitGroup           // wait for all goroutines to finish
 	errChan := make(chan error, 1)  // signal error from goroutines
 	finished := make(chan struct{}) // signal snapshot finished
-	tc.cacheMux.RLock()
-	for _, chacheInstance := range tc.cache {
+	for chID, chacheInstance := range tc.cache {
+		if tc.forked(chID) {
+			continue
+		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			chacheInstance.Lock()
 			defer chacheInstance.Unlock()
 			for _, cache := range chacheInstance.cache {
-				if writeErr := chacheInstance.offCollector.writeEntity(&OfflineCacheEntity{
+				if writeErr := chacheInstance.offCollector.writeEntity(context.Background(), &OfflineCacheEntity{
 					IsSet:      true,
 					ItemID:     cache.itemID,
 					Value:      cache.value,
 					ExpiryTime: cache.expiryTime,
 					GroupIDs:   cache.groupIDs,
+					Tags:       cache.tags,
 				}); writeErr != nil {
 					errChan <- writeErr
 					return
@@ -738,7 +2266,6 @@ func (tc *TransCache) Snapshot(backupFolderPath string, zip bool) (err error) {
 			}
 		}()
 	}
-	tc.cacheMux.RUnlock()
 	go func() {
 		wg.Wait() // wait for all goroutines to finish
 		close(finished)
@@ -750,3 +2277,39 @@ func (tc *TransCache) Snapshot(backupFolderPath string, zip bool) (err error) {
 		return
 	}
 }
+
+// TypedCache wraps a TransCache storing values of type T, sparing the type assertions on reads.
+// Transactions and dumping are handled by the TransCache underneath
+type TypedCache[T any] struct {
+	tc *TransCache
+}
+
+// NewTypedCache returns a TypedCache over tc
+func NewTypedCache[T any](tc *TransCache) *TypedCache[T] {
+	return &TypedCache[T]{tc: tc}
+}
+
+// Get returns the value of an item, the zero value and false if missing or not of type T
+func (tyc *TypedCache[T]) Get(chID, itmID string) (v T, ok bool) {
+	value, has := tyc.tc.Get(chID, itmID)
+	if !has {
+		return
+	}
+	v, ok = value.(T)
+	return
+}
+
+// Set sets the value of an item, committed right away
+func (tyc *TypedCache[T]) Set(chID, itmID string, v T, groupIDs []string) error {
+	return tyc.tc.Set(chID, itmID, v, groupIDs, true, "")
+}
+
+// GetGroupItems returns the values of a group, skipping the ones not of type T
+func (tyc *TypedCache[T]) GetGroupItems(chID, grpID string) (vs []T) {
+	for _, value := range tyc.tc.GetGroupItems(chID, grpID) {
+		if v, ok := value.(T); ok {
+			vs = append(vs, v)
+		}
+	}
+	return
+}
@@ -9,17 +9,26 @@ import (
 	"bufio"
 	"bytes"
 	"container/list"
+	"context"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"log"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -141,863 +150,4129 @@ func TestTransactionRemBefore(t *testing.T) {
 	}
 }
 
-func TestTCGetGroupItems(t *testing.T) {
+func TestTransactionOnCommitApplied(t *testing.T) {
 	tc := NewTransCache(map[string]*CacheConfig{})
-	tc.Set("xxx_", "t1", "test", []string{"grp1"}, true, "")
-	tc.Set("xxx_", "t2", "test", []string{"grp1"}, true, "")
-	if grpItms := tc.GetGroupItems("xxx_", "grp1"); len(grpItms) != 2 {
-		t.Errorf("Received group items: %+v", grpItms)
+	var ops []TransactionOp
+	tc.OnCommitApplied = func(op TransactionOp) {
+		ops = append(ops, op)
+		tc.HasItem(op.CacheID, op.ItemID) // not deadlocking on the commit locks
 	}
-	if grpItms := tc.GetGroupItems("xxx_", "nonexsitent"); grpItms != nil {
-		t.Errorf("Received group items: %+v", grpItms)
+	transID := tc.BeginTransaction()
+	tc.Remove("t41_", "mm", false, transID)
+	tc.Set("t41_", "mm", "test", []string{"grp1"}, false, transID)
+	tc.RemoveGroup("t41_", "grp2", false, transID)
+	tc.CommitTransaction(transID)
+	exp := []TransactionOp{
+		{Verb: RemoveItem, CacheID: "t41_", ItemID: "mm"},
+		{Verb: AddItem, CacheID: "t41_", ItemID: "mm", Value: "test", GroupIDs: []string{"grp1"}},
+		{Verb: RemoveGroup, CacheID: "t41_", GroupIDs: []string{"grp2"}},
+	}
+	if !reflect.DeepEqual(exp, ops) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, ops)
 	}
 }
 
-func TestRemGroup(t *testing.T) {
+func TestTransCacheCommitBatch(t *testing.T) {
 	tc := NewTransCache(map[string]*CacheConfig{})
-	tc.Set("xxx_", "t1", "test", []string{"grp1"}, true, "")
-	tc.Set("xxx_", "t2", "test", []string{"grp1"}, true, "")
-	tc.RemoveGroup("xxx_", "grp1", true, "")
-	_, okt1 := tc.Get("xxx_", "t1")
-	_, okt2 := tc.Get("xxx_", "t2")
-	if okt1 || okt2 {
-		t.Error("Error removing prefix: ", okt1, okt2)
+	tc.Set("", "item1", 1, nil, true, "")
+	tc.Set("", "item2", 2, nil, true, "")
+	exp := CommitResult{Set: 2, Removed: 2}
+	if rcv := tc.CommitBatch("", map[string]any{"item2": 22, "item3": 3},
+		[]string{"item1", "item2", "item4"}, []string{"grp1"}); rcv != exp {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
 	}
-}
-
-func TestCacheCount(t *testing.T) {
-	tc := NewTransCache(map[string]*CacheConfig{
-		"dst_": {MaxItems: -1},
-		"rpf_": {MaxItems: -1}})
-	tc.Set("dst_", "A1", "1", nil, true, "")
-	tc.Set("dst_", "A2", "2", nil, true, "")
-	tc.Set("rpf_", "A3", "3", nil, true, "")
-	tc.Set("dst_", "A4", "4", nil, true, "")
-	tc.Set("dst_", "A5", "5", nil, true, "")
-	if itms := tc.GetItemIDs("dst_", ""); len(itms) != 4 {
-		t.Errorf("Error getting item ids: %+v", itms)
+	if tc.HasItem("", "item1") {
+		t.Error("item1 should have been removed")
 	}
-}
-
-func TestTransCacheNilOptsCacheCount(t *testing.T) {
-	tc, err := NewTransCacheWithOfflineCollector(nil, map[string]*CacheConfig{
-		"dst_": {MaxItems: -1},
-		"rpf_": {MaxItems: -1}}, nil)
-	if err != nil {
-		t.Fatal(err)
+	if val, _ := tc.Get("", "item2"); val != 22 {
+		t.Errorf("expected <22>, received <%v>", val)
 	}
-	tc.Set("dst_", "A1", "1", nil, true, "")
-	tc.Set("dst_", "A2", "2", nil, true, "")
-	tc.Set("rpf_", "A3", "3", nil, true, "")
-	tc.Set("dst_", "A4", "4", nil, true, "")
-	tc.Set("dst_", "A5", "5", nil, true, "")
-	if itms := tc.GetItemIDs("dst_", ""); len(itms) != 4 {
-		t.Errorf("Error getting item ids: %+v", itms)
+	rcv := tc.GetGroupItemIDs("", "grp1")
+	slices.Sort(rcv)
+	if exp := []string{"item2", "item3"}; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%v>, received <%v>", exp, rcv)
 	}
 }
 
-func TestCacheGetStats(t *testing.T) {
+func TestTransCacheEvictionChannel(t *testing.T) {
 	tc := NewTransCache(map[string]*CacheConfig{
-		"part1": {MaxItems: -1},
-		"part2": {MaxItems: -1}})
-	testCIs := []*cachedItem{
-		{itemID: "_1_", value: "one"},
-		{itemID: "_2_", value: "two", groupIDs: []string{"grp1"}},
-		{itemID: "_3_", value: "three", groupIDs: []string{"grp1", "grp2"}},
-		{itemID: "_4_", value: "four", groupIDs: []string{"grp1", "grp2", "grp3"}},
-		{itemID: "_5_", value: "five", groupIDs: []string{"grp4"}},
-	}
-	for _, ci := range testCIs {
-		tc.Set("part1", ci.itemID, ci.value, ci.groupIDs, true, "")
-	}
-	for _, ci := range testCIs[:4] {
-		tc.Set("part2", ci.itemID, ci.value, ci.groupIDs, true, "")
+		"cache1": {MaxItems: 1},
+	})
+	evCh := tc.EvictionChannel("cache1", 1)
+	tc.Set("cache1", "item1", 1, nil, true, "")
+	tc.Set("cache1", "item2", 2, nil, true, "") // evicts item1 on capacity
+	tc.Remove("cache1", "item2", true, "")      // dropped, buffer full
+	exp := EvictionEvent{ItemID: "item1", Value: 1, Reason: EvictionCapacity}
+	if rcv := <-evCh; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
 	}
-	eCs := map[string]*CacheStats{
-		"part1": {Items: 5, Groups: 4},
-		"part2": {Items: 4, Groups: 3},
+	if rcv := tc.GetCacheStats([]string{"cache1"})["cache1"].EvictionsDropped; rcv != 1 {
+		t.Errorf("expected <1>, received <%d>", rcv)
 	}
-	if cs := tc.GetCacheStats(nil); reflect.DeepEqual(eCs, cs) {
-		t.Errorf("expecting: %+v, received: %+v", eCs, cs)
+	tc.Shutdown()
+	if _, open := <-evCh; open {
+		t.Error("expected eviction channel to be closed on Shutdown")
 	}
 }
 
-// Try concurrent read/write of the cache
-func TestCacheConcurrent(t *testing.T) {
+func TestTransCacheLoader(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
 	tc := NewTransCache(map[string]*CacheConfig{
-		"dst_": {MaxItems: -1},
-		"rpf_": {MaxItems: -1}})
-	s := &struct{ Prefix string }{Prefix: "+49"}
-	tc.Set("dst_", "DE", s, nil, true, "")
-	wg := new(sync.WaitGroup)
-	for i := 0; i < 1000; i++ {
+		"cache1": {
+			MaxItems: -1,
+			Loader: func(itmID string) (any, []string, time.Duration, error) {
+				calls.Add(1)
+				if itmID == "missing" {
+					return nil, nil, 0, ErrNotFound
+				}
+				<-release
+				return itmID + "_val", []string{"grp1"}, 0, nil
+			},
+		},
+	})
+	var wg sync.WaitGroup
+	for range 5 {
 		wg.Add(1)
 		go func() {
-			tc.Get("dst_", "DE")
-			wg.Done()
+			defer wg.Done()
+			if val, has := tc.Get("cache1", "item1"); !has || val != "item1_val" {
+				t.Errorf("expected <item1_val>, received <%v>", val)
+			}
 		}()
 	}
-	s.Prefix = "+491"
+	time.Sleep(10 * time.Millisecond)
+	close(release)
 	wg.Wait()
+	if rcv := calls.Load(); rcv != 1 {
+		t.Errorf("expected <1> loader call, received <%d>", rcv)
+	}
+	if rcv := tc.GetGroupItemIDs("cache1", "grp1"); !reflect.DeepEqual([]string{"item1"}, rcv) {
+		t.Errorf("expected <[item1]>, received <%v>", rcv)
+	}
+	if _, has, err := tc.GetWithError("cache1", "missing"); has || err != ErrNotFound {
+		t.Errorf("expected <%v>, received <%v>", ErrNotFound, err)
+	}
+	if _, has := tc.Get(DefaultCacheInstance, "item1"); has { // no loader on default instance
+		t.Error("item1 should not be loaded")
+	}
 }
 
-type TenantID struct {
-	Tenant string
-	ID     string
+func TestTransCacheSuspendEviction(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"cache1": {MaxItems: 2}})
+	tc.SuspendEviction("cache1")
+	for i := range 5 {
+		tc.Set("cache1", fmt.Sprintf("item%d", i), i, nil, true, "")
+	}
+	if rcv := tc.cache["cache1"].Len(); rcv != 5 {
+		t.Errorf("expected <5> items while eviction is suspended, received <%d>", rcv)
+	}
+	tc.ResumeEviction("cache1")
+	rcv := tc.GetItemIDs("cache1", "")
+	slices.Sort(rcv)
+	if exp := []string{"item3", "item4"}; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%v>, received <%v>", exp, rcv)
+	}
+	tc.Set("cache1", "item5", 5, nil, true, "")
+	if rcv := tc.cache["cache1"].Len(); rcv != 2 {
+		t.Errorf("expected <2> items after resuming eviction, received <%d>", rcv)
+	}
 }
 
-func (tID *TenantID) CacheClone() any {
-	tClone := new(TenantID)
-	*tClone = *tID
-	return tClone
+func TestTransCacheReadOnlyTransaction(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	tc.Set("", "item1", 1, []string{"grp1"}, true, "")
+	transID := tc.BeginReadOnlyTransaction()
+	if err := tc.Set("", "item2", 2, nil, false, transID); err != ErrReadOnlyTransaction {
+		t.Errorf("expected <%v>, received <%v>", ErrReadOnlyTransaction, err)
+	}
+	if err := tc.Remove("", "item1", false, transID); err != ErrReadOnlyTransaction {
+		t.Errorf("expected <%v>, received <%v>", ErrReadOnlyTransaction, err)
+	}
+	if err := tc.RemoveGroup("", "grp1", false, transID); err != ErrReadOnlyTransaction {
+		t.Errorf("expected <%v>, received <%v>", ErrReadOnlyTransaction, err)
+	}
+	if val, has := tc.Get("", "item1"); !has || val != 1 {
+		t.Errorf("expected <1>, received <%v>", val)
+	}
+	tc.CommitTransaction(transID)
+	if !tc.HasItem("", "item1") || tc.HasItem("", "item2") {
+		t.Error("expected read-only transaction commit to change nothing")
+	}
+	if len(tc.readOnlyTrans) != 0 || len(tc.transactionBuffer) != 0 {
+		t.Error("expected transaction to be cleaned after commit")
+	}
+	transID = tc.BeginTransaction()
+	if err := tc.Remove("", "item1", false, transID); err != nil {
+		t.Error(err)
+	}
+	tc.CommitTransaction(transID)
+	if tc.HasItem("", "item1") {
+		t.Error("item1 should have been removed")
+	}
 }
 
-func TestGetClone(t *testing.T) {
+func TestTransCacheGroupAtomicEviction(t *testing.T) {
 	tc := NewTransCache(map[string]*CacheConfig{
-		"t11_": {
-			MaxItems: -1,
-			Clone:    true,
-		},
+		"cache1": {MaxItems: 4, GroupAtomicEviction: true},
 	})
-	a := &TenantID{Tenant: "cgrates.org", ID: "ID#1"}
-	tc.Set("t11_", "mm", a, nil, true, "")
-	if t1, ok := tc.Get("t11_", "mm"); !ok {
-		t.Error("Error setting cache: ", ok, t1)
-	} else {
-		tcCloned := t1.(*TenantID)
-		if !reflect.DeepEqual(tcCloned, a) {
-			t.Errorf("Expecting: %+v, received: %+v", a, tcCloned)
-		}
-		a.ID = "ID#2"
-		if reflect.DeepEqual(tcCloned, a) {
-			t.Errorf("Expecting: %+v, received: %+v", a, tcCloned)
+	tc.Set("cache1", "item1", 1, []string{"grp1"}, true, "")
+	tc.Set("cache1", "item2", 2, []string{"grp1", "grp2"}, true, "")
+	tc.Set("cache1", "item3", 3, []string{"grp2"}, true, "")
+	tc.Set("cache1", "item4", 4, []string{"grp3"}, true, "")
+	tc.Set("cache1", "item5", 5, []string{"grp3"}, true, "") // evicts item1 with grp1 and grp2
+	rcv := tc.GetItemIDs("cache1", "")
+	slices.Sort(rcv)
+	if exp := []string{"item4", "item5"}; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%v>, received <%v>", exp, rcv)
+	}
+	// pressure with groups of 3 items, counting the items set in each group
+	grpSize := map[string]int{"grp3": 2}
+	for i := 6; i < 50; i++ {
+		grpID := fmt.Sprintf("grp%d", 4+i/3)
+		tc.Set("cache1", fmt.Sprintf("item%d", i), i, []string{grpID}, true, "")
+		grpSize[grpID]++
+		for grpID := range tc.cache["cache1"].groups {
+			if n := len(tc.GetGroupItemIDs("cache1", grpID)); n != grpSize[grpID] {
+				t.Fatalf("group <%s> partially evicted, <%d> out of <%d> items left",
+					grpID, n, grpSize[grpID])
+			}
 		}
 	}
 }
 
-func TestGetClone2(t *testing.T) {
+func TestTransCacheGetLastAccess(t *testing.T) {
 	tc := NewTransCache(map[string]*CacheConfig{
-		"t11_": {
-			MaxItems: -1,
-			Clone:    true,
-		},
+		"cache1": {MaxItems: -1, TrackAccess: true},
+		"cache2": {MaxItems: -1},
 	})
-	tc.Set("t11_", "mm", nil, nil, true, "")
-	if x, ok := tc.Get("t11_", "mm"); !ok {
-		t.Error("Couldnt get cache value, ok: ", ok)
-	} else if x != nil {
-		t.Errorf("Expecting: nil, received: %+v", x)
+	if _, has := tc.GetLastAccess("cache1", "item1"); has {
+		t.Error("expected item1 not to be found")
+	}
+	tc.Set("cache1", "item1", 1, nil, true, "")
+	tc.Set("cache2", "item1", 1, nil, true, "")
+	setTime, has := tc.GetLastAccess("cache1", "item1")
+	if !has || setTime.IsZero() {
+		t.Errorf("expected set time as last access, received <%v>", setTime)
+	}
+	time.Sleep(time.Millisecond)
+	tc.Get("cache1", "item1")
+	tc.Get("cache2", "item1")
+	if rcv, _ := tc.GetLastAccess("cache1", "item1"); !rcv.After(setTime) {
+		t.Errorf("expected last access after <%v>, received <%v>", setTime, rcv)
+	}
+	if rcv := tc.cache["cache2"].cache["item1"].lastAccess; !rcv.IsZero() {
+		t.Errorf("expected access not tracked, received <%v>", rcv)
 	}
 }
 
-func TestTranscacheHasGroup(t *testing.T) {
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			"testChID": {},
+func TestTransCacheGetLastAccessReSet(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tc := NewTransCacheWithClock(map[string]*CacheConfig{
+		"cache1": {MaxItems: -1, TrackAccess: true},
+	}, clock)
+	tc.Set("cache1", "item1", 1, nil, true, "")
+	clock.advance(time.Hour)
+	tc.Set("cache1", "item1", 2, nil, true, "")
+	if rcv, _ := tc.GetLastAccess("cache1", "item1"); !rcv.Equal(clock.Now()) {
+		t.Errorf("expected last set <%v> as last access, received <%v>", clock.Now(), rcv)
+	}
+}
+
+func TestTransCacheEvictIdle(t *testing.T) {
+	var evicted []string
+	tc := NewTransCache(map[string]*CacheConfig{
+		"cache1": {
+			MaxItems:    -1,
+			TrackAccess: true,
+			OnEvicted: []func(itmID string, value any){
+				func(itmID string, _ any) { evicted = append(evicted, itmID) },
+			},
 		},
+	})
+	tc.Set("cache1", "item1", 1, nil, true, "")
+	tc.Set("cache1", "item2", 2, nil, true, "")
+	time.Sleep(20 * time.Millisecond)
+	tc.Get("cache1", "item1")
+	if rcv := tc.EvictIdle("cache1", 10*time.Millisecond); rcv != 1 {
+		t.Errorf("expected <1>, received <%d>", rcv)
 	}
-	chID := "testChID"
-	grpID := "testGroupID"
+	if !reflect.DeepEqual([]string{"item2"}, evicted) {
+		t.Errorf("expected <[item2]>, received <%v>", evicted)
+	}
+	if !tc.HasItem("cache1", "item1") {
+		t.Error("expected item1 to be kept")
+	}
+}
 
-	exp := false
-	rcv := tc.HasGroup(chID, grpID)
+func TestTransCacheEvictIdleReSetUntracked(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tc := NewTransCacheWithClock(map[string]*CacheConfig{
+		"cache1": {MaxItems: -1, TrackAccess: true},
+		"cache2": {MaxItems: -1},
+	}, clock)
+	for _, chID := range []string{"cache1", "cache2"} {
+		tc.Set(chID, "item1", 1, nil, true, "")
+	}
+	clock.advance(time.Hour)
+	tc.Set("cache1", "item1", 2, nil, true, "")
+	tc.Get("cache2", "item1")
+	if rcv := tc.EvictIdle("cache1", time.Minute); rcv != 0 {
+		t.Errorf("expected the item set again to be kept, received <%d> evicted", rcv)
+	}
+	if rcv := tc.EvictIdle("cache2", time.Minute); rcv != 0 {
+		t.Errorf("expected no eviction without access tracking, received <%d>", rcv)
+	}
+	if !tc.HasItem("cache2", "item1") {
+		t.Error("expected item1 to be kept")
+	}
+}
 
-	if rcv != exp {
-		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+func TestTransCacheGetCloneable(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"t11_": {MaxItems: -1, Clone: true}})
+	a := &TenantID{Tenant: "cgrates.org", ID: "ID#1"}
+	tc.Set("t11_", "cloner", a, nil, true, "")
+	tc.Set("t11_", "plain", "value", nil, true, "")
+	if val, cloneable, ok := tc.GetCloneable("t11_", "cloner"); !ok || !cloneable {
+		t.Errorf("expected cloneable item, received <%v> <%v>", cloneable, ok)
+	} else if val == a || !reflect.DeepEqual(val, a) {
+		t.Errorf("expected a clone of <%+v>, received <%+v>", a, val)
+	}
+	if val, cloneable, ok := tc.GetCloneable("t11_", "plain"); !ok || cloneable || val != "value" {
+		t.Errorf("expected plain item, received <%v> <%v> <%v>", val, cloneable, ok)
+	}
+	if _, _, ok := tc.GetCloneable("t11_", "missing"); ok {
+		t.Error("expected missing item not to be found")
 	}
+}
 
-	tc.cache[chID].groups = map[string]map[string]struct{}{
-		"testGroupID": make(map[string]struct{}),
+func TestTransCacheForkInstance(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"cache1": {MaxItems: 3, TTL: time.Hour}})
+	tc.Set("cache1", "item1", "value1", []string{"grp1"}, true, "")
+	tc.Set("cache1", "item2", "value2", []string{"grp1"}, true, "")
+	tc.Set("cache1", "item3", "value3", nil, true, "")
+	tc.Get("cache1", "item1") // item2 least recently used
+	if err := tc.ForkInstance("missing", "fork"); !errors.Is(err, ErrUnknownInstance) {
+		t.Errorf("expected <%v>, received <%v>", ErrUnknownInstance, err)
+	}
+	if err := tc.ForkInstance("cache1", "cache1"); err == nil {
+		t.Error("expected error forking into an existing instance")
 	}
+	if err := tc.ForkInstance("cache1", "fork"); err != nil {
+		t.Fatal(err)
+	}
+	if rcv := tc.CheckConsistency("fork"); len(rcv) != 0 {
+		t.Errorf("expected no violations, received <%+v>", rcv)
+	}
+	tc.Remove("fork", "item3", true, "")
+	tc.Set("fork", "item4", "value4", nil, true, "")
+	tc.Set("fork", "item5", "value5", nil, true, "") // evicts item2, same recency as cache1
+	exp := []string{"item1", "item2", "item3"}
+	rcv := tc.GetItemIDs("cache1", "")
+	slices.Sort(rcv)
+	if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	exp = []string{"item1", "item4", "item5"}
+	rcv = tc.GetItemIDs("fork", "")
+	slices.Sort(rcv)
+	if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	exp = []string{"item1"}
+	if rcv = tc.GetGroupItemIDs("fork", "grp1"); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	if _, has := tc.cfg["fork"]; !has {
+		t.Error("expected the fork to share the configuration of cache1")
+	}
+}
 
-	exp = true
-	rcv = tc.HasGroup(chID, grpID)
+func TestTransCacheForkInstanceGroupTTL(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"cache1": {MaxItems: -1}})
+	tc.Set("cache1", "item1", "value1", []string{"grp1"}, true, "")
+	tc.SetGroupTTL("cache1", "grp1", time.Hour)
+	tc.SetGroupTTL("cache1", "grp2", time.Millisecond)
+	time.Sleep(5 * time.Millisecond) // grp2 expired
+	if err := tc.ForkInstance("cache1", "fork"); err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]time.Time{"grp1": tc.cache["cache1"].grpTTLs["grp1"]}
+	if rcv := tc.cache["fork"].grpTTLs; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	tc.Set("fork", "item2", "value2", []string{"grp1"}, true, "") // inherits the group expiry
+	if rcv, _ := tc.GetItemExpiryTime("fork", "item2"); !rcv.Equal(exp["grp1"]) {
+		t.Errorf("expected <%+v>, received <%+v>", exp["grp1"], rcv)
+	}
+}
 
-	if rcv != exp {
-		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+func TestTransCacheGetCacheStatsExcludingDefault(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"cache1": {MaxItems: -1}, "cache2": {MaxItems: -1}})
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	tc.Set("unknown", "item2", "value2", nil, true, "") // stored on the default instance
+	cs := tc.GetCacheStatsExcludingDefault()
+	if _, has := cs[DefaultCacheInstance]; has {
+		t.Errorf("expected no stats for <%s>", DefaultCacheInstance)
+	}
+	if len(cs) != 2 || cs["cache1"].Items != 1 || cs["cache2"].Items != 0 {
+		t.Errorf("expected stats of cache1 and cache2, received <%+v>", cs)
 	}
 }
 
-func TestTranscacheGetGroupItemIDs(t *testing.T) {
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			"testChID": {
-				groups: map[string]map[string]struct{}{
-					"testGroupID": {
-						"testField1": struct{}{},
-						"testField2": struct{}{},
-					},
-				},
+func TestTransCacheSetCtx(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"cache1": {MaxItems: -1}})
+	tc.cacheMux.Lock() // instances busy
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tc.SetCtx(ctx, "cache1", "item1", "value1", nil, true, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected <%v>, received <%v>", context.DeadlineExceeded, err)
+	}
+	if _, _, err := tc.GetCtx(ctx, "cache1", "item1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected <%v>, received <%v>", context.DeadlineExceeded, err)
+	}
+	tc.cacheMux.Unlock()
+	if _, has := tc.Get("cache1", "item1"); has {
+		t.Error("expected the canceled set not to be applied")
+	}
+	c := tc.cache["cache1"]
+	c.Lock() // instance busy
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errChan := make(chan error)
+	go func() {
+		errChan <- tc.SetCtx(ctx2, "cache1", "item1", "value1", nil, true, "")
+	}()
+	cancel2()
+	if err := <-errChan; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected <%v>, received <%v>", context.Canceled, err)
+	}
+	c.Unlock()
+	if err := tc.SetCtx(context.Background(), "cache1", "item1", "value2", nil, true, ""); err != nil {
+		t.Error(err)
+	}
+	if val, has, err := tc.GetCtx(context.Background(), "cache1", "item1"); err != nil || !has || val != "value2" {
+		t.Errorf("expected <%+v>, received <%+v>, err <%v>", "value2", val, err)
+	}
+}
+
+func TestTransCacheGetCtxLoaderError(t *testing.T) {
+	errLoad := errors.New("load failed")
+	tc := NewTransCache(map[string]*CacheConfig{
+		"cache1": {
+			MaxItems: -1,
+			Loader: func(itmID string) (any, []string, time.Duration, error) {
+				return nil, nil, 0, errLoad
 			},
 		},
+	})
+	if val, has, err := tc.GetCtx(context.Background(), "cache1", "item1"); has || !errors.Is(err, errLoad) {
+		t.Errorf("expected <%v>, received <%+v>, <%v>, err <%v>", errLoad, val, has, err)
 	}
-	chID := "testChID"
-	grpID := "testGroupID"
+}
 
-	exp := []string{"testField1", "testField2"}
-	rcv := tc.GetGroupItemIDs(chID, grpID)
+func TestTypedCache(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"cache1": {MaxItems: -1}})
+	tyc := NewTypedCache[int](tc)
+	if err := tyc.Set("cache1", "item1", 1, []string{"grp1"}); err != nil {
+		t.Error(err)
+	}
+	tc.Set("cache1", "item2", "value2", []string{"grp1"}, true, "")
+	if v, ok := tyc.Get("cache1", "item1"); !ok || v != 1 {
+		t.Errorf("expected <%+v>, received <%+v>", 1, v)
+	}
+	if v, ok := tyc.Get("cache1", "item2"); ok || v != 0 {
+		t.Errorf("expected zero value on type mismatch, received <%+v>", v)
+	}
+	if _, ok := tyc.Get("cache1", "item3"); ok {
+		t.Error("expected missing item")
+	}
+	if exp, rcv := []int{1}, tyc.GetGroupItems("cache1", "grp1"); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+}
 
-	if len(exp) != len(rcv) {
-		t.Fatalf("\nexpected slice length: <%+v>, \nreceived slice length: <%+v>",
-			len(exp), len(rcv))
+func TestTransCacheGetMulti(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"cache1": {MaxItems: -1}})
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	tc.Set("cache1", "item2", nil, nil, true, "")
+	exp := map[string]any{"item1": "value1", "item2": nil}
+	if rcv := tc.GetMulti("cache1", []string{"item1", "item2", "item3"}); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
 	}
+	if rcv := tc.GetMulti("cache1", nil); len(rcv) != 0 {
+		t.Errorf("expected empty map, received <%+v>", rcv)
+	}
+}
 
-	diff := make(map[string]int, len(exp))
+func TestTransCacheOnEvictedReason(t *testing.T) {
+	reasons := make(map[string]EvictionReason)
+	var evicted []string
+	tc := NewTransCache(map[string]*CacheConfig{"cache1": {
+		MaxItems:  2,
+		OnEvicted: []func(string, any){func(itmID string, _ any) { evicted = append(evicted, itmID) }},
+		OnEvictedReason: func(itmID string, _ any, reason EvictionReason) {
+			reasons[itmID] = reason
+		},
+	}})
+	tc.Set("cache1", "item1", 1, nil, true, "")
+	tc.Set("cache1", "item2", 2, []string{"grp1"}, true, "")
+	tc.Set("cache1", "item3", 3, nil, true, "") // evicts item1
+	tc.RemoveGroup("cache1", "grp1", true, "")
+	tc.Remove("cache1", "item3", true, "")
+	exp := map[string]EvictionReason{"item1": EvictionCapacity, "item2": EvictionGroup, "item3": EvictionRemoved}
+	if !reflect.DeepEqual(exp, reasons) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, reasons)
+	}
+	if exp := []string{"item1", "item2", "item3"}; !reflect.DeepEqual(exp, evicted) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, evicted)
+	}
+}
 
-	for _, valRcv := range rcv {
-		diff[valRcv]++
+func TestTransCacheForEach(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"cache1": {MaxItems: -1}})
+	tc.Set("cache1", "item1", 1, nil, true, "")
+	tc.Set("cache1", "item2", 2, nil, true, "")
+	tc.cache["cache1"].SetWithExpiry("item3", 3, nil, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	items := make(map[string]any)
+	tc.ForEach("cache1", func(itmID string, value any) bool {
+		items[itmID] = value
+		return true
+	})
+	if exp := map[string]any{"item1": 1, "item2": 2}; !reflect.DeepEqual(exp, items) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, items)
 	}
-	for _, valExp := range exp {
-		if _, ok := diff[valExp]; !ok {
-			t.Fatalf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
-		}
-		diff[valExp] -= 1
-		if diff[valExp] == 0 {
-			delete(diff, valExp)
+	var calls int
+	tc.ForEach("cache1", func(string, any) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("expected <%+v>, received <%+v>", 1, calls)
+	}
+}
+
+func TestTCWatch(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"cache1": {MaxItems: 1}})
+	evCh, unsubscribe := tc.Watch("cache1", "item1")
+	tc.Set("cache1", "item1", 1, nil, true, "")
+	tc.Set("cache1", "item2", 2, nil, true, "") // evicts item1, other items not watched
+	tc.Set("cache1", "item1", 3, nil, true, "") // evicts item2, not watched
+	tc.Remove("cache1", "item1", true, "")
+	exp := []CacheEvent{
+		{ItemID: "item1", Kind: EventSet, Value: 1},
+		{ItemID: "item1", Kind: EventEvict, Value: 1},
+		{ItemID: "item1", Kind: EventSet, Value: 3},
+		{ItemID: "item1", Kind: EventRemove, Value: 3},
+	}
+	for _, expEv := range exp {
+		if ev := <-evCh; !reflect.DeepEqual(expEv, ev) {
+			t.Errorf("expected <%+v>, received <%+v>", expEv, ev)
 		}
 	}
-	if len(diff) != 0 {
-		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+	unsubscribe()
+	if _, open := <-evCh; open {
+		t.Error("expected channel closed after unsubscribe")
 	}
+	unsubscribe() // no double close
 }
 
-func TestTranscacheClearSpecific(t *testing.T) {
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			"testChID1": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache: map[string]*cachedItem{
-					"item1": {},
-					"item2": {},
-				},
-			},
-			"testChID2": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache: map[string]*cachedItem{
-					"item1": {},
-					"item2": {},
-					"item3": {},
-				},
-			},
-		},
+func TestTCWatchDropped(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	evCh, unsubscribe := tc.Watch(DefaultCacheInstance)
+	defer unsubscribe()
+	for i := 0; i < watchBufferSize+2; i++ {
+		tc.Set(DefaultCacheInstance, fmt.Sprintf("item%d", i), i, nil, true, "")
 	}
-	chIDs := []string{"testChID2"}
-
-	exp := &TransCache{
-		cache: map[string]*Cache{
-			"testChID1": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache: map[string]*cachedItem{
-					"item1": {},
-					"item2": {},
-				},
-			},
-			"testChID2": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache:  map[string]*cachedItem{},
-			},
-		},
+	if len(evCh) != watchBufferSize {
+		t.Errorf("expected <%+v>, received <%+v>", watchBufferSize, len(evCh))
 	}
-
-	tc.Clear(chIDs)
-
-	for key, value := range tc.cache {
-		if len(value.cache) != len(exp.cache[key].cache) {
-			t.Errorf("\nKey: <%+v>\nexpected nr of items: <%+v>, \nreceived nr of items: <%+v>",
-				key, len(exp.cache[key].cache), len(value.cache))
-		}
+	if dropped := tc.GetCacheStats(nil)[DefaultCacheInstance].WatchEventsDropped; dropped != 2 {
+		t.Errorf("expected <%+v>, received <%+v>", 2, dropped)
 	}
 }
 
-func TestTranscacheClearAll(t *testing.T) {
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			"testChID1": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache: map[string]*cachedItem{
-					"item1": {},
-					"item2": {},
-				},
-			},
-			"testChID2": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache: map[string]*cachedItem{
-					"item1": {},
-					"item2": {},
-					"item3": {},
-				},
-			},
-		},
+func TestTCRemoveMatching(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	var evicted []string
+	tc.SetOnEvicted(DefaultCacheInstance, func(itmID string, _ any) { evicted = append(evicted, itmID) })
+	for i := 0; i < 6; i++ {
+		tc.Set(DefaultCacheInstance, fmt.Sprintf("item%d", i), i, nil, true, "")
 	}
-	var chIDs []string
-
-	exp := &TransCache{
-		cache: map[string]*Cache{
-			"testChID1": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache:  map[string]*cachedItem{},
-			},
-			"testChID2": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache:  map[string]*cachedItem{},
-			},
-		},
+	if removed := tc.RemoveMatching(DefaultCacheInstance, func(_ string, value any) bool {
+		return value.(int)%2 == 0
+	}); removed != 3 {
+		t.Errorf("expected <%+v>, received <%+v>", 3, removed)
 	}
-
-	tc.Clear(chIDs)
-
-	for key, value := range tc.cache {
-		if len(value.cache) != len(exp.cache[key].cache) {
-			t.Errorf("\nKey: <%+v>\nexpected nr of items: <%+v>, \nreceived nr of items: <%+v>",
-				key, len(exp.cache[key].cache), len(value.cache))
-		}
+	slices.Sort(evicted)
+	if exp := []string{"item0", "item2", "item4"}; !reflect.DeepEqual(exp, evicted) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, evicted)
+	}
+	itmIDs := tc.GetItemIDs(DefaultCacheInstance, "")
+	slices.Sort(itmIDs)
+	if exp := []string{"item1", "item3", "item5"}; !reflect.DeepEqual(exp, itmIDs) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, itmIDs)
 	}
 }
 
-func TestTranscacheClearWithOfflineCollector(t *testing.T) {
-	var logBuf bytes.Buffer
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			"testChID1": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache: map[string]*cachedItem{
-					"item1": {itemID: "item1"},
-					"item2": {itemID: "item2"},
-				},
-				offCollector: &OfflineCollector{
-					dumpInterval: 1,
-					logger:       &testLogger{log.New(&logBuf, "", 0)},
-					collection: map[string]*CollectionEntity{
-						"item1": {IsSet: true, ItemID: "item1"},
-						"item2": {IsSet: true, ItemID: "item2"},
-						"item3": {IsSet: false, ItemID: "item3"},
-					},
-				},
-			},
-			"testChID2": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache: map[string]*cachedItem{
-					"item1": {itemID: "item1"},
-					"item2": {itemID: "item2"},
-					"item3": {itemID: "item3"},
-				},
-				offCollector: &OfflineCollector{
-					dumpInterval: 1,
-					logger:       &testLogger{log.New(&logBuf, "", 0)},
-					collection: map[string]*CollectionEntity{
-						"item1": {IsSet: true, ItemID: "item1"},
-						"item2": {IsSet: true, ItemID: "item2"},
-					},
-				},
-			},
-		},
+func TestTCRemoveOlderThan(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	var evicted []string
+	tc.SetOnEvicted(DefaultCacheInstance, func(itmID string, _ any) { evicted = append(evicted, itmID) })
+	tc.Set(DefaultCacheInstance, "item1", 1, nil, true, "")
+	tc.Set(DefaultCacheInstance, "item2", 2, nil, true, "")
+	time.Sleep(20 * time.Millisecond)
+	tc.Set(DefaultCacheInstance, "item2", 3, nil, true, "") // updated, not stale anymore
+	tc.Set(DefaultCacheInstance, "item3", 3, nil, true, "")
+	if removed := tc.RemoveOlderThan(DefaultCacheInstance, 10*time.Millisecond); removed != 1 {
+		t.Errorf("expected <%+v>, received <%+v>", 1, removed)
 	}
-
-	for i := range tc.cache {
-		tc.cache[i].onEvicted = append(tc.cache[i].onEvicted, func(itemID string, _ any) {
-			tc.cache[i].offCollector.storeRemoveEntity(itemID)
-		})
+	if exp := []string{"item1"}; !reflect.DeepEqual(exp, evicted) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, evicted)
 	}
-
-	exp := &TransCache{
-		cache: map[string]*Cache{
-			"testChID1": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache:  map[string]*cachedItem{},
-				offCollector: &OfflineCollector{
-					dumpInterval: 1,
-					logger:       &testLogger{log.New(&logBuf, "", 0)},
-					collection: map[string]*CollectionEntity{
-						"item1": {IsSet: false, ItemID: "item1"},
-						"item2": {IsSet: false, ItemID: "item2"},
-						"item3": {IsSet: false, ItemID: "item3"},
-					},
-				},
-			},
-			"testChID2": {
-				lruIdx: list.New(),
-				ttlIdx: list.New(),
-				cache:  map[string]*cachedItem{},
-				offCollector: &OfflineCollector{
-					dumpInterval: 1,
-					logger:       &testLogger{log.New(&logBuf, "", 0)},
-					collection: map[string]*CollectionEntity{
-						"item1": {IsSet: false, ItemID: "item1"},
-						"item2": {IsSet: false, ItemID: "item2"},
-						"item3": {IsSet: false, ItemID: "item3"},
-					},
-				},
-			},
-		},
+	if _, has := tc.Get(DefaultCacheInstance, "item2"); !has {
+		t.Error("expected item2 kept after update")
 	}
+}
 
-	tc.Clear(nil)
+func TestTCGetItemGroups(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	tc.Set(DefaultCacheInstance, "item1", 1, []string{"grp1", "grp2"}, true, "")
+	grpIDs := tc.GetItemGroups(DefaultCacheInstance, "item1")
+	if exp := []string{"grp1", "grp2"}; !reflect.DeepEqual(exp, grpIDs) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, grpIDs)
+	}
+	grpIDs[0] = "grp3" // copy, cache not affected
+	if rcv := tc.GetItemGroups(DefaultCacheInstance, "item1"); rcv[0] != "grp1" {
+		t.Errorf("expected <%+v>, received <%+v>", "grp1", rcv[0])
+	}
+	if rcv := tc.GetItemGroups(DefaultCacheInstance, "item2"); rcv != nil {
+		t.Errorf("expected nil, received <%+v>", rcv)
+	}
+}
 
-	for key, value := range tc.cache {
-		if len(value.cache) != len(exp.cache[key].cache) {
-			t.Errorf("\nKey: <%+v>\nexpected nr of items: <%+v>, \nreceived nr of items: <%+v>",
-				key, len(exp.cache[key].cache), len(value.cache))
+func TestTCSetGroupTTL(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	var evicted []string
+	evCh := make(chan struct{}, 3)
+	tc.SetOnEvicted(DefaultCacheInstance, func(itmID string, _ any) {
+		evicted = append(evicted, itmID)
+		evCh <- struct{}{}
+	})
+	tc.Set(DefaultCacheInstance, "item1", 1, []string{"grp1"}, true, "")
+	tc.Set(DefaultCacheInstance, "item2", 2, []string{"grp2"}, true, "")
+	tc.SetGroupTTL(DefaultCacheInstance, "grp1", 20*time.Millisecond)
+	tc.Set(DefaultCacheInstance, "item3", 3, []string{"grp1"}, true, "") // inherits the group expiry
+	tc.AddToGroup(DefaultCacheInstance, "item2", "grp1")
+	exp, _ := tc.GetItemExpiryTime(DefaultCacheInstance, "item1")
+	for _, itmID := range []string{"item2", "item3"} {
+		if rcv, _ := tc.GetItemExpiryTime(DefaultCacheInstance, itmID); !rcv.Equal(exp) {
+			t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
 		}
 	}
-	for key, c := range tc.cache {
-		for collKey, coll := range c.offCollector.collection {
-			if !reflect.DeepEqual(exp.cache[key].offCollector.collection[collKey], coll) {
-				t.Errorf("Instance <%s>. Expected <%+v>, \nReceived <%+v>", key, exp.cache[key].offCollector.collection[collKey], coll)
-			} else if rcv := logBuf.String(); rcv != "" {
-				t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
-			}
+	for range 3 {
+		select {
+		case <-evCh:
+		case <-time.After(time.Second):
+			t.Fatalf("expected group expired, evicted <%+v>", evicted)
 		}
 	}
+	tc.Set(DefaultCacheInstance, "item4", 4, []string{"grp1"}, true, "") // group expiry passed
+	if rcv, _ := tc.GetItemExpiryTime(DefaultCacheInstance, "item4"); !rcv.IsZero() {
+		t.Errorf("expected no expiry, received <%+v>", rcv)
+	}
 }
 
-func TestTranscacheGetItemExpiryTime(t *testing.T) {
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			"testChID": {
-				cache: map[string]*cachedItem{
-					"testItemID": {
-						expiryTime: time.Time{},
-					},
-				},
-			},
-		},
+func TestTCGetGroupStats(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	tc.Set(DefaultCacheInstance, "item1", 1, []string{"grp1", "grp2"}, true, "")
+	tc.Set(DefaultCacheInstance, "item2", 2, []string{"grp1"}, true, "")
+	tc.Set(DefaultCacheInstance, "item3", 3, nil, true, "")
+	if exp, rcv := map[string]int{"grp1": 2, "grp2": 1},
+		tc.GetGroupStats(DefaultCacheInstance); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
 	}
-	chID := "testChID"
-	itmID := "testItemID"
-
-	var exp time.Time
-	expok := true
-	rcv, ok := tc.GetItemExpiryTime(chID, itmID)
-
-	if ok != expok {
-		t.Fatalf("\nexpected: <%+v>, \nreceived: <%+v>", expok, ok)
+	if rcv := tc.GetGroupItemCount(DefaultCacheInstance, "grp1"); rcv != 2 {
+		t.Errorf("expected <%+v>, received <%+v>", 2, rcv)
 	}
-
-	if rcv != exp {
-		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+	if rcv := tc.GetGroupItemCount(DefaultCacheInstance, "grp3"); rcv != 0 {
+		t.Errorf("expected <%+v>, received <%+v>", 0, rcv)
 	}
 }
 
-func TestTranscacheHasItem(t *testing.T) {
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			"testChID": {
-				cache: map[string]*cachedItem{
-					"testItemID": {},
-				},
-			},
-		},
+func TestTCRemoveGroups(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	tc.Set(DefaultCacheInstance, "item1", 1, []string{"grp1"}, true, "")
+	tc.Set(DefaultCacheInstance, "item2", 2, []string{"grp2"}, true, "")
+	tc.Set(DefaultCacheInstance, "item3", 3, []string{"grp3"}, true, "")
+	transID := tc.BeginTransaction()
+	if err := tc.RemoveGroups(DefaultCacheInstance, []string{"grp1", "grp2"}, false, transID); err != nil {
+		t.Fatal(err)
 	}
-	chID := "testChID"
-	itmID := "testItemID"
-
-	exp := true
-	rcv := tc.HasItem(chID, itmID)
-
-	if rcv != exp {
-		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+	if n := len(tc.transactionBuffer[transID]); n != 2 {
+		t.Errorf("expected <%+v>, received <%+v>", 2, n)
+	}
+	if rcv := tc.GetItemIDs(DefaultCacheInstance, ""); len(rcv) != 3 {
+		t.Errorf("expected items kept before commit, received <%+v>", rcv)
+	}
+	tc.CommitTransaction(transID)
+	if rcv := tc.GetItemIDs(DefaultCacheInstance, ""); !reflect.DeepEqual([]string{"item3"}, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", []string{"item3"}, rcv)
+	}
+	if err := tc.RemoveGroups(DefaultCacheInstance, []string{"grp3", "grp4"}, true, ""); err != nil {
+		t.Fatal(err)
+	}
+	if rcv := tc.GetItemIDs(DefaultCacheInstance, ""); len(rcv) != 0 {
+		t.Errorf("expected no items, received <%+v>", rcv)
 	}
 }
 
-func TestTranscacheNoItem(t *testing.T) {
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			"testChID": {
-				cache: map[string]*cachedItem{
-					"otherItem": {},
-				},
-			},
-		},
+func TestTCCommitTransactionWithResult(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	tc.Set(DefaultCacheInstance, "item1", 1, []string{"grp1"}, true, "")
+	tc.Set(DefaultCacheInstance, "item2", 2, []string{"grp1"}, true, "")
+	transID := tc.BeginTransaction()
+	tc.Set(DefaultCacheInstance, "item3", 3, nil, false, transID)
+	tc.RemoveGroup(DefaultCacheInstance, "grp1", false, transID)
+	tc.Remove(DefaultCacheInstance, "item3", false, transID)
+	applied, err := tc.CommitTransactionWithResult(transID)
+	if err != nil {
+		t.Fatal(err)
 	}
-	chID := "testChID"
-	itmID := "testItemID"
-
-	exp := false
-	rcv := tc.HasItem(chID, itmID)
-
-	if rcv != exp {
-		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+	exp := []AppliedOp{
+		{Verb: AddItem, CacheID: DefaultCacheInstance, ItemID: "item3"},
+		{Verb: RemoveGroup, CacheID: DefaultCacheInstance, GroupID: "grp1", ItemIDs: []string{"item1", "item2"}},
+		{Verb: RemoveItem, CacheID: DefaultCacheInstance, ItemID: "item3"},
+	}
+	if !reflect.DeepEqual(exp, applied) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, applied)
+	}
+	if rcv := tc.GetItemIDs(DefaultCacheInstance, ""); len(rcv) != 0 {
+		t.Errorf("expected no items, received <%+v>", rcv)
 	}
 }
 
-func TestTranscacheGetClonedNotFound(t *testing.T) {
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			"testChID": {
+func TestTCGetInTransaction(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	tc.Set(DefaultCacheInstance, "item1", 1, []string{"grp1"}, true, "")
+	tc.Set(DefaultCacheInstance, "item2", 2, nil, true, "")
+	transID := tc.BeginTransaction()
+	tc.Set(DefaultCacheInstance, "item2", 3, []string{"grp1"}, false, transID)
+	tc.Set(DefaultCacheInstance, "item3", 4, nil, false, transID)
+	tc.RemoveGroup(DefaultCacheInstance, "grp1", false, transID)
+	tc.Set(DefaultCacheInstance, "item3", 5, nil, false, transID)
+	for itmID, exp := range map[string]any{"item1": nil, "item2": nil, "item3": 5} {
+		if val, _ := tc.GetInTransaction(transID, DefaultCacheInstance, itmID); val != exp {
+			t.Errorf("expected <%+v> for <%s>, received <%+v>", exp, itmID, val)
+		}
+	}
+	if val, ok := tc.Get(DefaultCacheInstance, "item1"); !ok || val != 1 {
+		t.Errorf("expected <%+v> outside the transaction, received <%+v>", 1, val)
+	}
+	if val, ok := tc.GetInTransaction("", DefaultCacheInstance, "item1"); !ok || val != 1 {
+		t.Errorf("expected <%+v> without transaction, received <%+v>", 1, val)
+	}
+	tc.RollbackTransaction(transID)
+}
+
+func TestTCGetInTransactionNoRefresh(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{DefaultCacheInstance: {MaxItems: 2}})
+	tc.Set(DefaultCacheInstance, "item1", 1, nil, true, "")
+	tc.Set(DefaultCacheInstance, "item2", 2, nil, true, "")
+	transID := tc.BeginTransaction()
+	defer tc.RollbackTransaction(transID)
+	tc.Set(DefaultCacheInstance, "item2", 3, nil, false, transID)
+	for itmID, exp := range map[string]any{"item1": 1, "item2": 3} { // live and buffered values
+		if val, ok := tc.GetInTransaction(transID, DefaultCacheInstance, itmID); !ok || val != exp {
+			t.Errorf("expected <%+v> for <%s>, received <%+v>", exp, itmID, val)
+		}
+	}
+	tc.Set(DefaultCacheInstance, "item3", 3, nil, true, "") // item1 still the least recently used
+	if tc.HasItem(DefaultCacheInstance, "item1") {
+		t.Error("expected item1 evicted")
+	}
+}
+
+func TestTCTransactionTTL(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	defer tc.Shutdown()
+	oldID := tc.BeginTransaction()
+	tc.Set(DefaultCacheInstance, "item1", 1, nil, false, oldID)
+	time.Sleep(10 * time.Millisecond)
+	newID := tc.BeginTransaction()
+	transInfos := tc.ListTransactions()
+	if len(transInfos) != 2 || transInfos[0].ID != oldID || transInfos[0].Ops != 1 ||
+		transInfos[1].ID != newID || transInfos[1].Ops != 0 || transInfos[0].Age < 10*time.Millisecond {
+		t.Errorf("unexpected transactions <%+v>", transInfos)
+	}
+	tc.SetTransactionTTL(50 * time.Millisecond)
+	for i := 0; i < 100 && len(tc.ListTransactions()) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if transInfos = tc.ListTransactions(); len(transInfos) != 0 {
+		t.Errorf("expected stale transactions rolled back, received <%+v>", transInfos)
+	}
+	tc.CommitTransaction(oldID) // rolled back, nothing applied
+	if _, has := tc.Get(DefaultCacheInstance, "item1"); has {
+		t.Error("expected item1 not set by the rolled back transaction")
+	}
+}
+
+func TestTCTransactionTTLClock(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tc := NewTransCacheWithClock(map[string]*CacheConfig{}, clock)
+	defer tc.Shutdown()
+	oldID := tc.BeginTransaction()
+	clock.advance(time.Minute)
+	if transInfos := tc.ListTransactions(); len(transInfos) != 1 || transInfos[0].Age != time.Minute {
+		t.Errorf("expected an age of <%v>, received <%+v>", time.Minute, transInfos)
+	}
+	newID := tc.BeginTransaction()
+	tc.SetTransactionTTL(10 * time.Millisecond)
+	for i := 0; i < 100 && len(tc.ListTransactions()) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(30 * time.Millisecond) // newID did not reach the ttl on the clock
+	if transInfos := tc.ListTransactions(); len(transInfos) != 1 || transInfos[0].ID != newID {
+		t.Errorf("expected only <%s> kept instead of <%s>, received <%+v>", newID, oldID, transInfos)
+	}
+	clock.advance(time.Minute)
+	for i := 0; i < 100 && len(tc.ListTransactions()) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if transInfos := tc.ListTransactions(); len(transInfos) != 0 {
+		t.Errorf("expected the stale transactions rolled back, received <%+v>", transInfos)
+	}
+}
+
+func TestTCMaxOpenTransactions(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	tc.SetMaxOpenTransactions(2)
+	transID, err := tc.BeginTransactionErr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.BeginReadOnlyTransaction()
+	if _, err = tc.BeginTransactionErr(); !errors.Is(err, ErrTooManyTransactions) {
+		t.Errorf("expected <%+v>, received <%+v>", ErrTooManyTransactions, err)
+	}
+	if rcv := tc.BeginTransaction(); rcv != "" {
+		t.Errorf("expected empty transID, received <%+v>", rcv)
+	}
+	tc.RollbackTransaction(transID)
+	if _, err = tc.BeginTransactionErr(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTCExportImportInstance(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"cache1": {MaxItems: -1}, "cache2": {MaxItems: -1}})
+	expiry := time.Now().Add(time.Hour).Round(0)
+	tc.Set("cache1", "item1", 1, []string{"grp1"}, true, "")
+	tc.cacheInstance("cache1").SetWithExpiryTime("item2", "two", nil, expiry)
+	tc.SetWithTags("cache1", "item3", 3, map[string]string{"tag1": "val1"})
+	var buf bytes.Buffer
+	if err := tc.ExportInstance("cache1", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.ImportInstance("cache2", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if rcv := tc.GetGroupItemIDs("cache2", "grp1"); !reflect.DeepEqual([]string{"item1"}, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", []string{"item1"}, rcv)
+	}
+	if val, _ := tc.Get("cache2", "item2"); val != "two" {
+		t.Errorf("expected <%+v>, received <%+v>", "two", val)
+	}
+	if exp, _ := tc.GetItemExpiryTime("cache2", "item2"); !exp.Equal(expiry) {
+		t.Errorf("expected <%+v>, received <%+v>", expiry, exp)
+	}
+	if rcv := tc.GetItemsByTag("cache2", "tag1", "val1"); !reflect.DeepEqual(map[string]any{"item3": 3}, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", map[string]any{"item3": 3}, rcv)
+	}
+	if err := tc.ImportInstance("cache2", strings.NewReader("not gob")); err == nil {
+		t.Error("expected error importing an invalid stream")
+	}
+}
+
+func TestTransCacheInstanceConfig(t *testing.T) {
+	cfg := map[string]*CacheConfig{
+		"cache1": {MaxItems: 10, TTL: time.Minute, OnEvicted: []func(string, any){func(string, any) {}}},
+		"cache2": {MaxItems: -1},
+	}
+	tc := NewTransCache(cfg)
+	if exp, rcv := []string{DefaultCacheInstance, "cache1", "cache2"}, tc.InstanceIDs(); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	chCfg, has := tc.GetInstanceConfig("cache1")
+	if !has {
+		t.Fatal("expected cache1 configured")
+	} else if chCfg.MaxItems != 10 || chCfg.TTL != time.Minute || len(chCfg.OnEvicted) != 1 {
+		t.Errorf("unexpected config <%+v>", chCfg)
+	}
+	chCfg.MaxItems = 20
+	chCfg.OnEvicted[0] = nil
+	if cfg["cache1"].MaxItems != 10 || cfg["cache1"].OnEvicted[0] == nil {
+		t.Error("expected the configuration of the instance unchanged")
+	}
+	if _, has = tc.GetInstanceConfig("cache3"); has {
+		t.Error("expected cache3 not configured")
+	}
+}
+
+func TestTransCacheUpdateInstanceConfig(t *testing.T) {
+	var evicted []string
+	cfg := map[string]*CacheConfig{
+		"cache1": {MaxItems: -1, OnEvicted: []func(string, any){func(itmID string, _ any) {
+			evicted = append(evicted, itmID)
+		}}},
+		"cache2": {},
+	}
+	tc := NewTransCache(cfg)
+	for _, itmID := range []string{"item1", "item2", "item3", "item4"} {
+		tc.Set("cache1", itmID, itmID, nil, true, "")
+	}
+	if err := tc.UpdateInstanceConfig("cache1", &CacheConfig{MaxItems: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tc.GetItemIDs("cache1", "")); n != 2 || len(evicted) != 2 {
+		t.Errorf("expected 2 items left and 2 evicted, received <%d> and <%+v>", n, evicted)
+	}
+	tc.Set("cache1", "item5", "item5", nil, true, "")
+	if n := len(tc.GetItemIDs("cache1", "")); n != 2 {
+		t.Errorf("expected <%d>, received <%d>", 2, n)
+	}
+	if chCfg, _ := tc.GetInstanceConfig("cache1"); chCfg.MaxItems != 2 || len(chCfg.OnEvicted) != 1 {
+		t.Errorf("unexpected config <%+v>", chCfg)
+	} else if cfg["cache1"].MaxItems != -1 {
+		t.Error("expected the configuration of the caller unchanged")
+	}
+
+	if err := tc.UpdateInstanceConfig("cache1", &CacheConfig{MaxItems: -1, TTL: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item6", "item6", nil, true, "")
+	if exp, has := tc.GetItemExpiryTime("cache1", "item6"); !has || exp.IsZero() {
+		t.Errorf("expected item6 to expire, received <%v>", exp)
+	}
+	if exp, has := tc.GetItemExpiryTime("cache1", "item5"); !has || !exp.IsZero() {
+		t.Errorf("expected item5 expiry unchanged until accessed, received <%v>", exp)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, has := tc.Get("cache1", "item6"); has {
+		t.Error("expected item6 expired")
+	}
+
+	expErr := "cannot change caching of <cache2> between disabled and enabled"
+	if err := tc.UpdateInstanceConfig("cache2", &CacheConfig{MaxItems: -1}); err == nil || err.Error() != expErr {
+		t.Errorf("expected error <%v>, received <%v>", expErr, err)
+	}
+	if err := tc.UpdateInstanceConfig("cache3", &CacheConfig{}); !errors.Is(err, ErrUnknownInstance) {
+		t.Errorf("expected <%v>, received <%v>", ErrUnknownInstance, err)
+	}
+}
+
+func TestTransCacheGetDuringCommit(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{
+		"cache1": {MaxItems: -1},
+		"cache2": {MaxItems: -1, OnEvicted: []func(itmID string, value any){
+			func(string, any) { time.Sleep(time.Millisecond) }}}, // widen the commit
+	})
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			tc.Set("cache2", "item2", "value2", nil, true, "")
+			transID := tc.BeginTransaction()
+			tc.Remove("cache1", "item1", false, transID)
+			tc.Remove("cache2", "item2", false, transID)
+			tc.Set("cache1", "item1", "value1", nil, false, transID)
+			tc.CommitTransaction(transID)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if val, has := tc.Get("cache1", "item1"); !has {
+			t.Fatalf("expected <%+v>, received <%+v>", "value1", val)
+		}
+		if val, has, _ := tc.GetWithError("cache1", "item1"); !has {
+			t.Fatalf("expected <%+v>, received <%+v>", "value1", val)
+		}
+		if items := tc.GetMulti("cache1", []string{"item1"}); len(items) != 1 {
+			t.Fatalf("expected <%+v>, received <%+v>", 1, len(items))
+		}
+		var cnt int
+		tc.ForEach("cache1", func(string, any) bool { cnt++; return true })
+		if cnt != 1 {
+			t.Fatalf("expected <%+v>, received <%+v>", 1, cnt)
+		}
+	}
+}
+
+func TestTCGetGroupItems(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	tc.Set("xxx_", "t1", "test", []string{"grp1"}, true, "")
+	tc.Set("xxx_", "t2", "test", []string{"grp1"}, true, "")
+	if grpItms := tc.GetGroupItems("xxx_", "grp1"); len(grpItms) != 2 {
+		t.Errorf("Received group items: %+v", grpItms)
+	}
+	if grpItms := tc.GetGroupItems("xxx_", "nonexsitent"); grpItms != nil {
+		t.Errorf("Received group items: %+v", grpItms)
+	}
+}
+
+func TestRemGroup(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	tc.Set("xxx_", "t1", "test", []string{"grp1"}, true, "")
+	tc.Set("xxx_", "t2", "test", []string{"grp1"}, true, "")
+	tc.RemoveGroup("xxx_", "grp1", true, "")
+	_, okt1 := tc.Get("xxx_", "t1")
+	_, okt2 := tc.Get("xxx_", "t2")
+	if okt1 || okt2 {
+		t.Error("Error removing prefix: ", okt1, okt2)
+	}
+}
+
+func TestTransCacheCompactGroups(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	for i := 0; i < 100; i++ {
+		tc.Set("", fmt.Sprintf("item%d", i), i, []string{"grp1"}, true, "")
+	}
+	tc.Set("", "item100", 100, []string{"grp2"}, true, "")
+	for i := 1; i < 100; i++ {
+		tc.Remove("", fmt.Sprintf("item%d", i), true, "")
+	}
+	c := tc.cache[DefaultCacheInstance]
+	c.groups["empty"] = make(map[string]struct{}) // leftover entry
+	tc.CompactGroups("")
+	exp := map[string]map[string]struct{}{
+		"grp1": {"item0": {}},
+		"grp2": {"item100": {}},
+	}
+	if !reflect.DeepEqual(exp, c.groups) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, c.groups)
+	}
+	if rcv := tc.GetGroupItemIDs("", "grp1"); !reflect.DeepEqual([]string{"item0"}, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", []string{"item0"}, rcv)
+	}
+}
+
+func TestTransCacheSetOnEvicted(t *testing.T) {
+	path := t.TempDir()
+	var evicted []string
+	tc, err := NewTransCacheWithOfflineCollector(&TransCacheOpts{
+		DumpPath:      path,
+		StartTimeout:  1 * time.Minute,
+		DumpInterval:  1 * time.Hour,
+		FileSizeLimit: 1000,
+	}, map[string]*CacheConfig{
+		DefaultCacheInstance: {MaxItems: -1, OnEvicted: []func(itmID string, value any){
+			func(itmID string, _ any) { evicted = append(evicted, "old_"+itmID) }}},
+	}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	tc.Set("", "item1", 1, nil, true, "")
+	tc.Set("", "item2", 2, nil, true, "")
+	tc.Remove("", "item1", true, "")
+	tc.SetOnEvicted("", func(itmID string, _ any) { evicted = append(evicted, "new_"+itmID) })
+	tc.Remove("", "item2", true, "")
+	if exp := []string{"old_item1", "new_item2"}; !reflect.DeepEqual(exp, evicted) {
+		t.Errorf("expected <%v>, received <%v>", exp, evicted)
+	}
+	exp := map[string]*CollectionEntity{
+		"item1": {ItemID: "item1"},
+		"item2": {ItemID: "item2"},
+	}
+	if rcv := tc.cache[DefaultCacheInstance].offCollector.collection; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	tc.SetOnEvicted("", nil)
+	tc.Set("", "item3", 3, nil, true, "")
+	tc.Remove("", "item3", true, "")
+	if len(evicted) != 2 {
+		t.Errorf("expected no new evictions, received <%v>", evicted)
+	}
+}
+
+func TestTransCacheRangeAll(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{
+		"cache1": {MaxItems: -1},
+		"cache2": {MaxItems: -1},
+	})
+	tc.Set("cache1", "item1", 1, nil, true, "")
+	tc.Set("cache1", "item2", 2, nil, true, "")
+	tc.Set("cache2", "item3", 3, nil, true, "")
+	rcv := make(map[string]any)
+	tc.RangeAll(func(chID, itmID string, value any) bool {
+		rcv[chID+"/"+itmID] = value
+		return true
+	})
+	exp := map[string]any{"cache1/item1": 1, "cache1/item2": 2, "cache2/item3": 3}
+	if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	var count int
+	tc.RangeAll(func(chID, itmID string, value any) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Errorf("expected iteration to stop after <1> item, received <%d>", count)
+	}
+}
+
+func TestTransCacheRangeAllExpiredCloned(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tc := NewTransCacheWithClock(map[string]*CacheConfig{
+		"cache1": {MaxItems: -1, Clone: true},
+	}, clock)
+	a := &TenantID{Tenant: "cgrates.org", ID: "ID#1"}
+	tc.Set("cache1", "item1", a, nil, true, "")
+	tc.cache["cache1"].SetWithExpiry("item2", "value2", nil, time.Minute)
+	clock.advance(time.Hour) // item2 expired, not yet cleaned
+	rcv := make(map[string]any)
+	tc.RangeAll(func(chID, itmID string, value any) bool {
+		rcv[itmID] = value
+		return true
+	})
+	if len(rcv) != 1 {
+		t.Fatalf("expected only item1, received <%+v>", rcv)
+	}
+	if val := rcv["item1"]; val == a || !reflect.DeepEqual(val, a) {
+		t.Errorf("expected a clone of <%+v>, received <%+v>", a, val)
+	}
+}
+
+func TestTransCacheDrain(t *testing.T) {
+	path := t.TempDir()
+	var evicted []string
+	tc, err := NewTransCacheWithOfflineCollector(&TransCacheOpts{
+		DumpPath:      path,
+		StartTimeout:  1 * time.Minute,
+		DumpInterval:  1 * time.Hour,
+		FileSizeLimit: 1000,
+	}, map[string]*CacheConfig{
+		DefaultCacheInstance: {MaxItems: -1, OnEvicted: []func(itmID string, value any){
+			func(itmID string, _ any) { evicted = append(evicted, itmID) }}},
+	}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	tc.Set("", "item1", 1, []string{"grp1"}, true, "")
+	tc.Set("", "item2", 2, nil, true, "")
+	if rcv := tc.Drain(""); !reflect.DeepEqual(map[string]any{"item1": 1, "item2": 2}, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", map[string]any{"item1": 1, "item2": 2}, rcv)
+	}
+	if rcv := tc.GetItemIDs("", ""); len(rcv) != 0 {
+		t.Errorf("expected empty cache, received <%v>", rcv)
+	}
+	if tc.HasGroup("", "grp1") {
+		t.Error("expected groups to be cleared")
+	}
+	slices.Sort(evicted)
+	if exp := []string{"item1", "item2"}; !reflect.DeepEqual(exp, evicted) {
+		t.Errorf("expected <%v>, received <%v>", exp, evicted)
+	}
+	exp := map[string]*CollectionEntity{
+		"item1": {ItemID: "item1"},
+		"item2": {ItemID: "item2"},
+	}
+	if rcv := tc.cache[DefaultCacheInstance].offCollector.collection; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+}
+
+func TestTransCacheDrainExpiredCloned(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tc := NewTransCacheWithClock(map[string]*CacheConfig{
+		"cache1": {MaxItems: -1, TTL: time.Minute, Clone: true},
+	}, clock)
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	clock.advance(time.Hour) // item1 expired, not yet cleaned
+	a := &TenantID{Tenant: "cgrates.org", ID: "ID#1"}
+	tc.Set("cache1", "item2", a, nil, true, "")
+	items := tc.Drain("cache1")
+	if len(items) != 1 {
+		t.Fatalf("expected only item2, received <%+v>", items)
+	}
+	if val := items["item2"]; val == a || !reflect.DeepEqual(val, a) {
+		t.Errorf("expected a clone of <%+v>, received <%+v>", a, val)
+	}
+	if rcv := tc.GetItemIDs("cache1", ""); len(rcv) != 0 {
+		t.Errorf("expected all the items purged, received <%v>", rcv)
+	}
+}
+
+func TestCacheCount(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{
+		"dst_": {MaxItems: -1},
+		"rpf_": {MaxItems: -1}})
+	tc.Set("dst_", "A1", "1", nil, true, "")
+	tc.Set("dst_", "A2", "2", nil, true, "")
+	tc.Set("rpf_", "A3", "3", nil, true, "")
+	tc.Set("dst_", "A4", "4", nil, true, "")
+	tc.Set("dst_", "A5", "5", nil, true, "")
+	if itms := tc.GetItemIDs("dst_", ""); len(itms) != 4 {
+		t.Errorf("Error getting item ids: %+v", itms)
+	}
+}
+
+func TestTransCacheNilOptsCacheCount(t *testing.T) {
+	tc, err := NewTransCacheWithOfflineCollector(nil, map[string]*CacheConfig{
+		"dst_": {MaxItems: -1},
+		"rpf_": {MaxItems: -1}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("dst_", "A1", "1", nil, true, "")
+	tc.Set("dst_", "A2", "2", nil, true, "")
+	tc.Set("rpf_", "A3", "3", nil, true, "")
+	tc.Set("dst_", "A4", "4", nil, true, "")
+	tc.Set("dst_", "A5", "5", nil, true, "")
+	if itms := tc.GetItemIDs("dst_", ""); len(itms) != 4 {
+		t.Errorf("Error getting item ids: %+v", itms)
+	}
+}
+
+func TestCacheGetStats(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{
+		"part1": {MaxItems: -1},
+		"part2": {MaxItems: -1}})
+	testCIs := []*cachedItem{
+		{itemID: "_1_", value: "one"},
+		{itemID: "_2_", value: "two", groupIDs: []string{"grp1"}},
+		{itemID: "_3_", value: "three", groupIDs: []string{"grp1", "grp2"}},
+		{itemID: "_4_", value: "four", groupIDs: []string{"grp1", "grp2", "grp3"}},
+		{itemID: "_5_", value: "five", groupIDs: []string{"grp4"}},
+	}
+	for _, ci := range testCIs {
+		tc.Set("part1", ci.itemID, ci.value, ci.groupIDs, true, "")
+	}
+	for _, ci := range testCIs[:4] {
+		tc.Set("part2", ci.itemID, ci.value, ci.groupIDs, true, "")
+	}
+	eCs := map[string]*CacheStats{
+		"part1": {Items: 5, Groups: 4},
+		"part2": {Items: 4, Groups: 3},
+	}
+	if cs := tc.GetCacheStats(nil); reflect.DeepEqual(eCs, cs) {
+		t.Errorf("expecting: %+v, received: %+v", eCs, cs)
+	}
+}
+
+// Try concurrent read/write of the cache
+func TestCacheConcurrent(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{
+		"dst_": {MaxItems: -1},
+		"rpf_": {MaxItems: -1}})
+	s := &struct{ Prefix string }{Prefix: "+49"}
+	tc.Set("dst_", "DE", s, nil, true, "")
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func() {
+			tc.Get("dst_", "DE")
+			wg.Done()
+		}()
+	}
+	s.Prefix = "+491"
+	wg.Wait()
+}
+
+type TenantID struct {
+	Tenant string
+	ID     string
+}
+
+func (tID *TenantID) CacheClone() any {
+	tClone := new(TenantID)
+	*tClone = *tID
+	return tClone
+}
+
+func TestGetClone(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{
+		"t11_": {
+			MaxItems: -1,
+			Clone:    true,
+		},
+	})
+	a := &TenantID{Tenant: "cgrates.org", ID: "ID#1"}
+	tc.Set("t11_", "mm", a, nil, true, "")
+	if t1, ok := tc.Get("t11_", "mm"); !ok {
+		t.Error("Error setting cache: ", ok, t1)
+	} else {
+		tcCloned := t1.(*TenantID)
+		if !reflect.DeepEqual(tcCloned, a) {
+			t.Errorf("Expecting: %+v, received: %+v", a, tcCloned)
+		}
+		a.ID = "ID#2"
+		if reflect.DeepEqual(tcCloned, a) {
+			t.Errorf("Expecting: %+v, received: %+v", a, tcCloned)
+		}
+	}
+}
+
+func TestGetClone2(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{
+		"t11_": {
+			MaxItems: -1,
+			Clone:    true,
+		},
+	})
+	tc.Set("t11_", "mm", nil, nil, true, "")
+	if x, ok := tc.Get("t11_", "mm"); !ok {
+		t.Error("Couldnt get cache value, ok: ", ok)
+	} else if x != nil {
+		t.Errorf("Expecting: nil, received: %+v", x)
+	}
+}
+
+func TestTranscacheHasGroup(t *testing.T) {
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			"testChID": {},
+		},
+	}
+	chID := "testChID"
+	grpID := "testGroupID"
+
+	exp := false
+	rcv := tc.HasGroup(chID, grpID)
+
+	if rcv != exp {
+		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+	}
+
+	tc.cache[chID].groups = map[string]map[string]struct{}{
+		"testGroupID": make(map[string]struct{}),
+	}
+
+	exp = true
+	rcv = tc.HasGroup(chID, grpID)
+
+	if rcv != exp {
+		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestTranscacheGetGroupItemIDs(t *testing.T) {
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			"testChID": {
+				groups: map[string]map[string]struct{}{
+					"testGroupID": {
+						"testField1": struct{}{},
+						"testField2": struct{}{},
+					},
+				},
+			},
+		},
+	}
+	chID := "testChID"
+	grpID := "testGroupID"
+
+	exp := []string{"testField1", "testField2"}
+	rcv := tc.GetGroupItemIDs(chID, grpID)
+
+	if len(exp) != len(rcv) {
+		t.Fatalf("\nexpected slice length: <%+v>, \nreceived slice length: <%+v>",
+			len(exp), len(rcv))
+	}
+
+	diff := make(map[string]int, len(exp))
+
+	for _, valRcv := range rcv {
+		diff[valRcv]++
+	}
+	for _, valExp := range exp {
+		if _, ok := diff[valExp]; !ok {
+			t.Fatalf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+		}
+		diff[valExp] -= 1
+		if diff[valExp] == 0 {
+			delete(diff, valExp)
+		}
+	}
+	if len(diff) != 0 {
+		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestTranscacheClearSpecific(t *testing.T) {
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			"testChID1": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache: map[string]*cachedItem{
+					"item1": {},
+					"item2": {},
+				},
+			},
+			"testChID2": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache: map[string]*cachedItem{
+					"item1": {},
+					"item2": {},
+					"item3": {},
+				},
+			},
+		},
+	}
+	chIDs := []string{"testChID2"}
+
+	exp := &TransCache{
+		cache: map[string]*Cache{
+			"testChID1": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache: map[string]*cachedItem{
+					"item1": {},
+					"item2": {},
+				},
+			},
+			"testChID2": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache:  map[string]*cachedItem{},
+			},
+		},
+	}
+
+	tc.Clear(chIDs)
+
+	for key, value := range tc.cache {
+		if len(value.cache) != len(exp.cache[key].cache) {
+			t.Errorf("\nKey: <%+v>\nexpected nr of items: <%+v>, \nreceived nr of items: <%+v>",
+				key, len(exp.cache[key].cache), len(value.cache))
+		}
+	}
+}
+
+func TestTranscacheClearAll(t *testing.T) {
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			"testChID1": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache: map[string]*cachedItem{
+					"item1": {},
+					"item2": {},
+				},
+			},
+			"testChID2": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache: map[string]*cachedItem{
+					"item1": {},
+					"item2": {},
+					"item3": {},
+				},
+			},
+		},
+	}
+	var chIDs []string
+
+	exp := &TransCache{
+		cache: map[string]*Cache{
+			"testChID1": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache:  map[string]*cachedItem{},
+			},
+			"testChID2": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache:  map[string]*cachedItem{},
+			},
+		},
+	}
+
+	tc.Clear(chIDs)
+
+	for key, value := range tc.cache {
+		if len(value.cache) != len(exp.cache[key].cache) {
+			t.Errorf("\nKey: <%+v>\nexpected nr of items: <%+v>, \nreceived nr of items: <%+v>",
+				key, len(exp.cache[key].cache), len(value.cache))
+		}
+	}
+}
+
+func TestTranscacheClearWithOfflineCollector(t *testing.T) {
+	var logBuf bytes.Buffer
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			"testChID1": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache: map[string]*cachedItem{
+					"item1": {itemID: "item1"},
+					"item2": {itemID: "item2"},
+				},
+				offCollector: &OfflineCollector{
+					dumpInterval: 1,
+					logger:       &testLogger{log.New(&logBuf, "", 0)},
+					collection: map[string]*CollectionEntity{
+						"item1": {IsSet: true, ItemID: "item1"},
+						"item2": {IsSet: true, ItemID: "item2"},
+						"item3": {IsSet: false, ItemID: "item3"},
+					},
+				},
+			},
+			"testChID2": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache: map[string]*cachedItem{
+					"item1": {itemID: "item1"},
+					"item2": {itemID: "item2"},
+					"item3": {itemID: "item3"},
+				},
+				offCollector: &OfflineCollector{
+					dumpInterval: 1,
+					logger:       &testLogger{log.New(&logBuf, "", 0)},
+					collection: map[string]*CollectionEntity{
+						"item1": {IsSet: true, ItemID: "item1"},
+						"item2": {IsSet: true, ItemID: "item2"},
+					},
+				},
+			},
+		},
+	}
+
+	for i := range tc.cache {
+		tc.cache[i].onEvicted = append(tc.cache[i].onEvicted, func(itemID string, _ any) {
+			tc.cache[i].offCollector.storeRemoveEntity(itemID)
+		})
+	}
+
+	exp := &TransCache{
+		cache: map[string]*Cache{
+			"testChID1": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache:  map[string]*cachedItem{},
+				offCollector: &OfflineCollector{
+					dumpInterval: 1,
+					logger:       &testLogger{log.New(&logBuf, "", 0)},
+					collection: map[string]*CollectionEntity{
+						"item1": {IsSet: false, ItemID: "item1"},
+						"item2": {IsSet: false, ItemID: "item2"},
+						"item3": {IsSet: false, ItemID: "item3"},
+					},
+				},
+			},
+			"testChID2": {
+				lruIdx: list.New(),
+				ttlIdx: newTTLHeap(),
+				cache:  map[string]*cachedItem{},
+				offCollector: &OfflineCollector{
+					dumpInterval: 1,
+					logger:       &testLogger{log.New(&logBuf, "", 0)},
+					collection: map[string]*CollectionEntity{
+						"item1": {IsSet: false, ItemID: "item1"},
+						"item2": {IsSet: false, ItemID: "item2"},
+						"item3": {IsSet: false, ItemID: "item3"},
+					},
+				},
+			},
+		},
+	}
+
+	tc.Clear(nil)
+
+	for key, value := range tc.cache {
+		if len(value.cache) != len(exp.cache[key].cache) {
+			t.Errorf("\nKey: <%+v>\nexpected nr of items: <%+v>, \nreceived nr of items: <%+v>",
+				key, len(exp.cache[key].cache), len(value.cache))
+		}
+	}
+	for key, c := range tc.cache {
+		for collKey, coll := range c.offCollector.collection {
+			if !reflect.DeepEqual(exp.cache[key].offCollector.collection[collKey], coll) {
+				t.Errorf("Instance <%s>. Expected <%+v>, \nReceived <%+v>", key, exp.cache[key].offCollector.collection[collKey], coll)
+			} else if rcv := logBuf.String(); rcv != "" {
+				t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
+			}
+		}
+	}
+}
+
+func TestTranscacheGetItemExpiryTime(t *testing.T) {
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			"testChID": {
+				cache: map[string]*cachedItem{
+					"testItemID": {
+						expiryTime: time.Time{},
+					},
+				},
+			},
+		},
+	}
+	chID := "testChID"
+	itmID := "testItemID"
+
+	var exp time.Time
+	expok := true
+	rcv, ok := tc.GetItemExpiryTime(chID, itmID)
+
+	if ok != expok {
+		t.Fatalf("\nexpected: <%+v>, \nreceived: <%+v>", expok, ok)
+	}
+
+	if rcv != exp {
+		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestTranscacheHasItem(t *testing.T) {
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			"testChID": {
+				cache: map[string]*cachedItem{
+					"testItemID": {},
+				},
+			},
+		},
+	}
+	chID := "testChID"
+	itmID := "testItemID"
+
+	exp := true
+	rcv := tc.HasItem(chID, itmID)
+
+	if rcv != exp {
+		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestTranscacheNoItem(t *testing.T) {
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			"testChID": {
 				cache: map[string]*cachedItem{
 					"otherItem": {},
 				},
+			},
+		},
+	}
+	chID := "testChID"
+	itmID := "testItemID"
+
+	exp := false
+	rcv := tc.HasItem(chID, itmID)
+
+	if rcv != exp {
+		t.Errorf("\nexpected: <%+v>, \nreceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestTranscacheGetClonedNotFound(t *testing.T) {
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			"testChID": {
+				cache: map[string]*cachedItem{
+					"otherItem": {},
+				},
+				clone: true,
+			},
+		},
+	}
+	chID := "testChID"
+	itmID := "testItemID"
+
+	if rcv, ok := tc.Get(chID, itmID); ok {
+		t.Errorf("\nexpected to not find item, ok: %v", ok)
+	} else if rcv != nil {
+		t.Fatalf("\nexpected nil, \nreceived: <%+v>", rcv)
+	}
+
+}
+
+func TestTranscacheGetClonedNotClonable(t *testing.T) {
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			"testChID": {
+				lruIdx: list.New(),
+				lruRefs: map[string]*list.Element{
+					"testItemID": {},
+				},
+				cache: map[string]*cachedItem{
+					"testItemID": {
+						value: 3,
+					},
+				},
 				clone: true,
 			},
 		},
 	}
-	chID := "testChID"
-	itmID := "testItemID"
+	chID := "testChID"
+	itmID := "testItemID"
+
+	if rcv, ok := tc.Get(chID, itmID); !ok {
+		t.Error("Couldnt get cache value, ok: ", ok)
+	} else if rcv != 3 {
+		t.Fatalf("\nexpected <%+v>, \nreceived: <%+v>", 3, rcv)
+	}
+}
+
+func TestTranscacheRewriteAllErr1(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	tc := TransCache{
+		cache: map[string]*Cache{
+			"testChID1": {
+				offCollector: &OfflineCollector{
+					fileSizeLimit:   1000,
+					file:            tmpFile,
+					dumpInterval:    -1,
+					rewriteInterval: -1,
+					fldrPath:        "/tmp/notexistent",
+				},
+			},
+		},
+	}
+	expErr := "error <lstat /tmp/notexistent: no such file or directory> walking path </tmp/notexistent>"
+	if err := tc.RewriteAll(); err == nil || err.Error() != expErr {
+		t.Errorf("Expected error <%+v>, \nReceived error <%+v>", expErr, err)
+	}
+}
+
+func TestTranscacheShutdownNil(t *testing.T) {
+	tc := &TransCache{}
+	exp := &TransCache{}
+	tc.Shutdown()
+	if !reflect.DeepEqual(exp, tc) {
+		t.Errorf("Expected TransCache to not change, received <%+v>", tc)
+	}
+}
+
+func TestTranscacheShutdownNoIntervalErr(t *testing.T) {
+	path := "/tmp/*default"
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(path); err != nil {
+			t.Errorf("Failed to delete temporary dir: %v", err)
+		}
+	}()
+	f, err := os.OpenFile(path+"/file", os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0644)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer f.Close()
+	}
+	f.Close()
+	var logBuf bytes.Buffer
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			DefaultCacheInstance: {
+				offCollector: &OfflineCollector{
+					fileSizeLimit:   1000,
+					dumpInterval:    -1,
+					rewriteInterval: -1,
+					logger:          &testLogger{log.New(&logBuf, "", 0)},
+					file:            f,
+				},
+			},
+		},
+	}
+	expBuf := "error getting file stats: stat /tmp/*default/file: file already closed"
+	tc.Shutdown()
+	if rcv := logBuf.String(); !strings.Contains(rcv, expBuf) {
+		t.Errorf("Expected <%+v>, \nReceived <%+v>", expBuf, rcv)
+
+	}
+}
+
+func TestTranscacheShutdownNilCollector(t *testing.T) {
+	path := "/tmp/*default"
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(path); err != nil {
+			t.Errorf("Failed to delete temporary dir: %v", err)
+		}
+	}()
+	f, err := os.OpenFile(path+"/file", os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0644)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer f.Close()
+	}
+	f.Close()
+	var logBuf bytes.Buffer
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			DefaultCacheInstance: {},
+		},
+	}
+	tc.Shutdown()
+	if rcv := logBuf.String(); rcv != "" {
+		t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
+
+	}
+}
+
+func TestTranscacheShutdownIntervalWrite(t *testing.T) {
+	path := "/tmp/*default"
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(path); err != nil {
+			t.Errorf("Failed to delete temporary dir: %v", err)
+		}
+	}()
+	f, err := os.OpenFile(path+"/file", os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0644)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer f.Close()
+	}
+	f.Close()
+	var logBuf bytes.Buffer
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			DefaultCacheInstance: {
+				offCollector: &OfflineCollector{
+					dumpInterval:    5 * time.Second,
+					rewriteInterval: -1,
+					stopDump:        make(chan context.Context),
+					dumpStopped:     make(chan error),
+					logger:          &testLogger{log.New(&logBuf, "", 0)},
+					file:            f,
+				},
+			},
+		},
+	}
+	go func() {
+		err := tc.Shutdown()
+		expBuf := "error getting file stats: stat /tmp/*default/file: file already closed"
+		if rcv := logBuf.String(); !strings.Contains(rcv, expBuf) {
+			t.Errorf("Expected <%+v>, \nReceived <%+v>", expBuf, rcv)
+		}
+		if expErr := "cache <*default>: " + expBuf; err == nil || err.Error() != expErr {
+			t.Errorf("expected error <%v>, received <%v>", expErr, err)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for _, c := range tc.cache {
+		<-c.offCollector.stopDump
+		c.offCollector.dumpStopped <- nil
+	}
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestCloseFileSuccess(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test-success-*.txt")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+
+	fileName := tmpFile.Name()
+
+	err = closeFile(tmpFile)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("Expected file to be removed, but it still exists")
+	}
+}
+
+func TestCloseFileErr(t *testing.T) {
+	path := "/tmp/*default"
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(path); err != nil {
+			t.Errorf("Failed to delete temporary dir: %v", err)
+		}
+	}()
+	f, err := os.OpenFile(path+"/file", os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0644)
+	if err != nil {
+		t.Error(err)
+	} else {
+		defer f.Close()
+	}
+	f.Close()
+	expErr := "error getting file stats: stat /tmp/*default/file: file already closed"
+	if err := closeFile(f); err.Error() != expErr {
+		t.Errorf("Expected error <%+v>, \nReceived error <%+v>", expErr, err)
+	}
+}
+
+func TestNewTransCacheWithOfflineCollector(t *testing.T) {
+	path := "/tmp/internal_db"
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(path); err != nil {
+			t.Errorf("Failed to delete temporary dir: %v", err)
+		}
+	}()
+	var logBuf bytes.Buffer
+	opts := &TransCacheOpts{
+		DumpPath:        path,
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    10 * time.Second,
+		RewriteInterval: 10 * time.Second,
+		FileSizeLimit:   1000,
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, &testLogger{log.New(&logBuf, "", 0)})
+	if err != nil {
+		t.Error(err)
+	} else if rcv := logBuf.String(); !strings.Contains(rcv, "") {
+		t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
+	}
+	expTc := NewTransCache(map[string]*CacheConfig{})
+	expTc.offCollOpts = opts
+	expTc.offCollLogger = tc.offCollLogger
+	expTc.cacheMux.stats = tc.cacheMux.stats
+	expTc.cache[DefaultCacheInstance].lockStats = tc.cache[DefaultCacheInstance].lockStats
+	expTc.cache[DefaultCacheInstance].cleanerStop = tc.cache[DefaultCacheInstance].cleanerStop
+
+	expTc.cache[DefaultCacheInstance].onEvicted = tc.cache[DefaultCacheInstance].onEvicted
+	expTc.cache[DefaultCacheInstance].lruIdx = tc.cache[DefaultCacheInstance].lruIdx
+	expTc.cache[DefaultCacheInstance].ttlIdx = tc.cache[DefaultCacheInstance].ttlIdx
+	expTc.cache[DefaultCacheInstance].loadReport = &LoadReport{}
+	expTc.cache[DefaultCacheInstance].offCollector = &OfflineCollector{
+		dumpInterval:     10 * time.Second,
+		stopDump:         tc.cache[DefaultCacheInstance].offCollector.stopDump,
+		dumpStopped:      tc.cache[DefaultCacheInstance].offCollector.dumpStopped,
+		rewriteInterval:  10 * time.Second,
+		stopRewrite:      tc.cache[DefaultCacheInstance].offCollector.stopRewrite,
+		rewriteStopped:   tc.cache[DefaultCacheInstance].offCollector.rewriteStopped,
+		collection:       make(map[string]*CollectionEntity),
+		fldrPath:         path + "/" + DefaultCacheInstance,
+		collectSetEntity: true,
+		fileSizeLimit:    1000,
+		file:             tc.cache[DefaultCacheInstance].offCollector.file,
+		writer:           tc.cache[DefaultCacheInstance].offCollector.writer,
+		encoder:          tc.cache[DefaultCacheInstance].offCollector.encoder,
+		logger:           tc.cache[DefaultCacheInstance].offCollector.logger,
+	}
+
+	if !reflect.DeepEqual(expTc, tc) {
+		t.Errorf("expected <%#v>, \nreceived <%#v>", expTc, tc)
+	}
+}
+
+func TestNewTransCacheWithOfflineCollectorErr1(t *testing.T) {
+	var logBuf bytes.Buffer
+	opts := &TransCacheOpts{
+		DumpPath:        "/tmp/doesntExist" + DefaultCacheInstance,
+		StartTimeout:    10 * time.Second,
+		DumpInterval:    1 * time.Minute,
+		RewriteInterval: 10 * time.Second,
+		FileSizeLimit:   1000,
+	}
+	_, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, &testLogger{log.New(&logBuf, "", 0)})
+	expErr := "stat /tmp/doesntExist*default: no such file or directory"
+	if err == nil || expErr != err.Error() {
+		t.Errorf("expected error <%v>, received <%v>", expErr, err)
+	} else if rcv := logBuf.String(); !strings.Contains(rcv, "") {
+		t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
+	}
+
+}
+
+func TestNewTransCacheWithOfflineCollectorErr2(t *testing.T) {
+	path := "/root"
+	var logBuf bytes.Buffer
+	opts := &TransCacheOpts{
+		DumpPath:        path,
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    10 * time.Second,
+		RewriteInterval: 10 * time.Second,
+		FileSizeLimit:   1000,
+	}
+	_, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, &testLogger{log.New(&logBuf, "", 0)})
+	expErr := "mkdir /root/*default: permission denied"
+	if err == nil || expErr != err.Error() {
+		t.Errorf("expected error <%v>, received <%v>", expErr, err)
+	} else if rcv := logBuf.String(); !strings.Contains(rcv, "") {
+		t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
+	}
+
+}
+
+func TestNewTransCacheWithOfflineCollectorErr3(t *testing.T) {
+	path := "/tmp/internal_db"
+	if err := os.MkdirAll(path+"/*default", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path+"/*default/tmpfile", os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+		0644)
+	if err != nil {
+		t.Error(err)
+	}
+	f.WriteString("somethin not decodable by gob")
+	defer func() {
+		f.Close()
+		if err := os.RemoveAll(path); err != nil {
+			t.Errorf("Failed to delete temporary dir: %v", err)
+		}
+	}()
+	var logBuf bytes.Buffer
+	opts := &TransCacheOpts{
+		DumpPath:        path,
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    10 * time.Second,
+		RewriteInterval: 10 * time.Second,
+		FileSizeLimit:   1000,
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, &testLogger{log.New(&logBuf, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Shutdown()
+	expLog := "failed to decode OfflineCacheEntity at </tmp/internal_db/*default/tmpfile>: unexpected EOF>, recovering only the entities before"
+	if rcv := logBuf.String(); !strings.Contains(rcv, expLog) {
+		t.Errorf("Expected <%+v>, \nReceived <%+v>", expLog, rcv)
+	}
+}
+
+func TestTransCacheRewriteDuringWriteThrough(t *testing.T) {
+	path := t.TempDir()
+	opts := &TransCacheOpts{
+		DumpPath:        path,
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   500, // rotate often so rewrite finds many files
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const items = 2000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range items {
+			tc.Set("cache1", fmt.Sprintf("item%d", i), i, nil, true, "")
+		}
+	}()
+	for rewriting := true; rewriting; {
+		select {
+		case <-done:
+			rewriting = false
+		default:
+			if err := tc.RewriteAll(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tc.Shutdown()
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if rcv := tc.cache["cache1"].Len(); rcv != items {
+		t.Errorf("expected <%d> items recovered, received <%d>", items, rcv)
+	}
+}
+
+func TestTransCacheVerifyPersistence(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000,
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts,
+		map[string]*CacheConfig{"cache1": {MaxItems: -1}}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	tc.Set("cache1", "item1", "value1", []string{"grp1"}, true, "")
+	tc.Set("cache1", "item2", "value2", nil, true, "")
+	tc.Set("cache1", "item3", "value3", nil, true, "")
+	tc.Remove("cache1", "item3", true, "")
+	if matches, diffs, err := tc.VerifyPersistence("cache1"); err != nil {
+		t.Fatal(err)
+	} else if !matches {
+		t.Errorf("expected persistence to match, received diffs <%v>", diffs)
+	}
+
+	c := tc.cache["cache1"]
+	c.Lock() // change memory bypassing the collector
+	c.cache["item1"].value = "changed"
+	c.cache["item4"] = &cachedItem{itemID: "item4", value: "value4"}
+	delete(c.cache, "item2")
+	c.Unlock()
+	exp := []string{
+		"item <item1> value differs, memory <changed>, disk <value1>",
+		"item <item2> missing in memory",
+		"item <item4> missing on disk",
+	}
+	if matches, diffs, err := tc.VerifyPersistence("cache1"); err != nil {
+		t.Fatal(err)
+	} else if matches || !reflect.DeepEqual(exp, diffs) {
+		t.Errorf("expected <%q>, received <%q>", exp, diffs)
+	}
+	tc = NewTransCache(map[string]*CacheConfig{})
+	expErr := "<*default> instance is not persistent"
+	if _, _, err := tc.VerifyPersistence(DefaultCacheInstance); !errors.Is(err, ErrInstanceNotPersistent) ||
+		err.Error() != expErr {
+		t.Errorf("expected <%v>, received <%v>", expErr, err)
+	}
+	if _, _, err := tc.VerifyPersistence("cache2"); !errors.Is(err, ErrUnknownInstance) {
+		t.Errorf("expected <%v>, received <%v>", ErrUnknownInstance, err)
+	}
+	if err := tc.cache[DefaultCacheInstance].DumpToFile(); !errors.Is(err, ErrInstanceNotPersistent) {
+		t.Errorf("expected <%v>, received <%v>", ErrInstanceNotPersistent, err)
+	}
+}
+
+func TestTransCacheValidateEncodable(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:          t.TempDir(),
+		StartTimeout:      1 * time.Minute,
+		DumpInterval:      -1,
+		RewriteInterval:   0,
+		FileSizeLimit:     1000,
+		ValidateEncodable: true,
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts,
+		map[string]*CacheConfig{"cache1": {MaxItems: -1}}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if err := tc.Set("cache1", "item1", "value1", nil, true, ""); err != nil {
+		t.Error(err)
+	}
+	notEncodable := func() {}
+	if err := tc.Set("cache1", "item2", notEncodable, nil, true, ""); err == nil {
+		t.Error("expected encode error")
+	}
+	transID := tc.BeginTransaction()
+	if err := tc.Set("cache1", "item3", notEncodable, nil, false, transID); err == nil {
+		t.Error("expected encode error when buffering in transaction")
+	}
+	tc.CommitTransaction(transID)
+	if tc.HasItem("cache1", "item2") || tc.HasItem("cache1", "item3") {
+		t.Error("items not encodable should not be cached")
+	}
+}
+
+func TestNewTransCacheWithOfflineCollectorMigrateEntity(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	tc.Set("cache1", "item2", "value2", nil, true, "")
+	tc.Shutdown()
+
+	opts.MigrateEntity = func(oce *OfflineCacheEntity) (*OfflineCacheEntity, bool) {
+		if oce.ItemID == "item2" {
+			return nil, false
+		}
+		migrated := *oce
+		migrated.Value = strings.ToUpper(oce.Value.(string))
+		return &migrated, true
+	}
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if val, has := tc.Get("cache1", "item1"); !has || val != "VALUE1" {
+		t.Errorf("expected <VALUE1>, received <%v>", val)
+	}
+	if tc.HasItem("cache1", "item2") {
+		t.Error("item2 should have been dropped on migration")
+	}
+}
+
+func TestTransCacheRewriteHistory(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:           t.TempDir(),
+		StartTimeout:       1 * time.Minute,
+		DumpInterval:       -1,
+		RewriteInterval:    0,
+		FileSizeLimit:      1, // new dump file for each entity
+		KeepRewriteHistory: 2,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		tc.Set("cache1", fmt.Sprintf("item%d", i), i, nil, true, "")
+		tc.Remove("cache1", fmt.Sprintf("item%d", i-1), true, "")
+		if err := tc.RewriteAll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gens, err := tc.cache["cache1"].offCollector.rewriteGenerations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gens) != 2 {
+		t.Errorf("expected <2> generations kept, received <%d>", len(gens))
+	}
+	if err := tc.RestoreRewrite("cache1", 2); err == nil {
+		t.Error("expected error restoring a generation not kept")
+	}
+	if err := tc.RestoreRewrite("cache1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if gens, _ = tc.cache["cache1"].offCollector.rewriteGenerations(); len(gens) != 0 {
+		t.Errorf("expected restored generations to be consumed, received <%v>", gens)
+	}
+	tc.Shutdown()
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if rcv := tc.GetItemIDs("cache1", ""); !reflect.DeepEqual([]string{"item2"}, rcv) {
+		t.Errorf("expected <[item2]>, received <%v>", rcv)
+	}
+}
+
+func TestTransCacheRestoreRewriteRenameFailure(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:           t.TempDir(),
+		StartTimeout:       1 * time.Minute,
+		DumpInterval:       -1,
+		RewriteInterval:    0,
+		FileSizeLimit:      1, // new dump file for each entity
+		KeepRewriteHistory: 2,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		tc.Set("cache1", fmt.Sprintf("item%d", i), i, nil, true, "")
+		tc.Remove("cache1", fmt.Sprintf("item%d", i-1), true, "")
+		if err := tc.RewriteAll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	coll := tc.cache["cache1"].offCollector
+	gens, err := coll.rewriteGenerations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(gens[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocked string // dumped file of the generation, not renamed over a folder
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), rewriteFileName) {
+			blocked = filepath.Join(coll.fldrPath, entry.Name())
+		}
+	}
+	if err = os.MkdirAll(filepath.Join(blocked, "file"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = tc.RestoreRewrite("cache1", 1); err == nil {
+		t.Fatal("expected rename error")
+	}
+	if gens, err = coll.rewriteGenerations(); err != nil {
+		t.Fatal(err)
+	} else if len(gens) != 3 {
+		t.Fatalf("expected the rewrite files set aside as a new generation, received <%v>", gens)
+	}
+	if rewritten, _ := filepath.Glob(filepath.Join(gens[0], rewriteFileName+"*")); len(rewritten) == 0 {
+		t.Errorf("expected the rewrite files kept in <%s>", gens[0])
+	}
+	if err = os.RemoveAll(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if err = tc.RestoreRewrite("cache1", 2); err != nil { // the same generation, one newer in front
+		t.Fatal(err)
+	}
+	tc.Shutdown()
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if rcv := tc.GetItemIDs("cache1", ""); !reflect.DeepEqual([]string{"item2"}, rcv) {
+		t.Errorf("expected <[item2]>, received <%v>", rcv)
+	}
+}
+
+func TestNewTransCacheWithOfflineCollectorMaxRecoveryBytes(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", strings.Repeat("a", 100), nil, true, "")
+	tc.Shutdown()
+
+	limitOpts := *opts
+	limitOpts.MaxRecoveryBytes = 50
+	if _, err = NewTransCacheWithOfflineCollector(&limitOpts, cfg, nopLogger{}); err == nil ||
+		!strings.Contains(err.Error(), "over the recovery limit of <50> bytes") {
+		t.Errorf("expected recovery limit error, received <%v>", err)
+	}
+	recoverOpts := *opts
+	recoverOpts.MaxRecoveryBytes = 1000
+	if tc, err = NewTransCacheWithOfflineCollector(&recoverOpts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if !tc.HasItem("cache1", "item1") {
+		t.Error("expected item1 to be recovered")
+	}
+}
+
+func TestTransCacheShutdownRewriteThreshold(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:                 t.TempDir(),
+		StartTimeout:             1 * time.Minute,
+		DumpInterval:             -1,
+		RewriteInterval:          -2,
+		FileSizeLimit:            1, // each entity in its own file
+		ShutdownRewriteThreshold: 0.9,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	hasRewriteFile := func() bool {
+		entries, err := os.ReadDir(filepath.Join(opts.DumpPath, "cache1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), "0Rewrite") {
+				return true
+			}
+		}
+		return false
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tc.RewriteSavings("unknown"); !errors.Is(err, ErrUnknownInstance) {
+		t.Errorf("expected <%v>, received <%v>", ErrUnknownInstance, err)
+	}
+	for i := range 4 {
+		tc.Set("cache1", "item1", i, nil, true, "")
+	}
+	tc.Set("cache1", "item2", "value", nil, true, "")
+	// 4 entities in the closed files, only the last set of item1 is kept
+	if savings, err := tc.RewriteSavings("cache1"); err != nil {
+		t.Error(err)
+	} else if savings != 0.75 {
+		t.Errorf("expected <%v>, received <%v>", 0.75, savings)
+	}
+	tc.Shutdown()
+	if hasRewriteFile() {
+		t.Error("expected rewriting to be skipped below the threshold")
+	}
+
+	opts.ShutdownRewriteThreshold = 0.5
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	tc.Shutdown()
+	if !hasRewriteFile() {
+		t.Error("expected dump files to be rewritten on shutdown")
+	}
+}
+
+func TestTransCacheSetWithTagsPersisted(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tc.SetWithTags("cache1", "item1", "value1", map[string]string{"env": "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item2", "value2", nil, true, "")
+	tc.Shutdown()
+
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	exp := map[string]any{"item1": "value1"}
+	if rcv := tc.GetItemsByTag("cache1", "env", "prod"); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+}
+
+func TestTransCacheCommitTransactionDurable(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    time.Hour, // dump only when forced
+		RewriteInterval: 0,
+		FileSizeLimit:   1000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}, "cache2": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	transID := tc.BeginTransaction()
+	tc.Set("cache1", "item1", "value1", nil, false, transID)
+	tc.Set("cache2", "item2", "value2", nil, true, "") // outside the transaction
+	if err = tc.CommitTransactionDurable(transID); err != nil {
+		t.Fatal(err)
+	}
+	if !tc.HasItem("cache1", "item1") {
+		t.Error("expected item1 to be committed")
+	}
+	if rcv := len(tc.cache["cache1"].offCollector.collection); rcv != 0 {
+		t.Errorf("expected <%v>, received <%v>", 0, rcv)
+	}
+	if rcv := len(tc.cache["cache2"].offCollector.collection); rcv != 1 {
+		t.Errorf("expected <%v>, received <%v>", 1, rcv)
+	}
+}
+
+func TestTransCacheRejectOversizedValues(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:              t.TempDir(),
+		StartTimeout:          1 * time.Minute,
+		DumpInterval:          -1,
+		RewriteInterval:       0,
+		FileSizeLimit:         1000,
+		RejectOversizedValues: true,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if err = tc.Set("cache1", "big", strings.Repeat("a", 2000), nil, true, ""); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected <%v>, received <%v>", ErrValueTooLarge, err)
+	}
+	if tc.HasItem("cache1", "big") {
+		t.Error("expected oversized item not to be cached")
+	}
+	transID := tc.BeginTransaction()
+	if err = tc.Set("cache1", "big", strings.Repeat("a", 2000), nil, false, transID); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected <%v>, received <%v>", ErrValueTooLarge, err)
+	}
+	tc.RollbackTransaction(transID)
+	if err = tc.Set("cache1", "small", "value", nil, true, ""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransCacheCollectorConfig(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    time.Hour,
+		RewriteInterval: -2,
+		FileSizeLimit:   1000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	exp := CollectorInfo{
+		FolderPath:      filepath.Join(opts.DumpPath, "cache1"),
+		DumpInterval:    time.Hour,
+		RewriteInterval: -2,
+		FileSizeLimit:   1000,
+	}
+	if rcv, ok := tc.CollectorConfig("cache1"); !ok {
+		t.Error("expected cache1 to be dumped")
+	} else if rcv != exp {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	if _, ok := NewTransCache(map[string]*CacheConfig{}).CollectorConfig("cache1"); ok {
+		t.Error("expected no collector without dumping")
+	}
+}
+
+func TestTransCacheSetLogger(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000,
+		RecoverCaches:   []string{"cache1"}, // cache2 recovered on first access
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}, "cache2": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	var logBuf bytes.Buffer
+	l := &testLogger{log.New(&logBuf, "", 0)}
+	tc.SetLogger(l)
+	if rcv := tc.cache["cache1"].offCollector.log(); rcv != l {
+		t.Errorf("expected <%+v>, received <%+v>", l, rcv)
+	}
+	tc.HasItem("cache2", "item1") // recover with the logger set before
+	if rcv := tc.cache["cache2"].offCollector.log(); rcv != l {
+		t.Errorf("expected <%+v>, received <%+v>", l, rcv)
+	}
+	tc.SetLogger(nil)
+	if rcv := tc.cache["cache1"].offCollector.log(); rcv != (nopLogger{}) {
+		t.Errorf("expected <%+v>, received <%+v>", nopLogger{}, rcv)
+	}
+}
+
+func TestNewTransCacheWithOfflineCollectorStreamRecovery(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   200,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20 {
+		tc.Set("cache1", fmt.Sprintf("item%d", i), i, nil, true, "")
+	}
+	tc.Remove("cache1", "item3", true, "")
+	tc.Shutdown()
+
+	opts.StreamRecovery = true
+	cfg["cache1"].MaxItems = 10 // bounded while recovering
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if rcv := tc.GetItemIDs("cache1", ""); len(rcv) != 10 {
+		t.Errorf("expected <%v> items, received <%+v>", 10, rcv)
+	}
+	if val, has := tc.Get("cache1", "item19"); !has || val != 19 {
+		t.Errorf("expected <%v>, received <%v>", 19, val)
+	}
+}
+
+func TestTransCacheRemoveBatchSize(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000,
+		RemoveBatchSize: 3,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 7 {
+		tc.Set("cache1", fmt.Sprintf("item%d", i), i, []string{"grp1"}, true, "")
+	}
+	tc.Set("cache1", "item7", 7, nil, true, "")
+	tc.RemoveGroup("cache1", "grp1", true, "")
+	// removed and set back in the same batch, the set is written after the remove
+	tc.CommitBatch("cache1", map[string]any{"item7": 8}, []string{"item7"}, nil)
+	if rcv := len(tc.cache["cache1"].offCollector.pendingRemoves); rcv != 0 {
+		t.Errorf("expected <%v>, received <%v>", 0, rcv)
+	}
+	tc.Shutdown()
+
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	exp := []string{"item7"}
+	if rcv := tc.GetItemIDs("cache1", ""); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	if val, _ := tc.Get("cache1", "item7"); val != 8 {
+		t.Errorf("expected <%v>, received <%v>", 8, val)
+	}
+}
+
+func TestEnsureInstanceFolders(t *testing.T) {
+	rootPath := filepath.Join(t.TempDir(), "dump")
+	if err := EnsureInstanceFolders(rootPath, []string{"cache1", "cache2"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, chID := range []string{DefaultCacheInstance, "cache1", "cache2"} {
+		if info, err := os.Stat(filepath.Join(rootPath, chID)); err != nil {
+			t.Error(err)
+		} else if !info.IsDir() {
+			t.Errorf("expected <%s> to be a folder", chID)
+		}
+	}
+	if err := EnsureInstanceFolders(rootPath, []string{"cache1"}); err != nil { // already provisioned
+		t.Error(err)
+	}
+	opts := &TransCacheOpts{
+		DumpPath:        rootPath,
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000,
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{"cache1": {MaxItems: -1}}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Shutdown()
+}
+
+func TestTransCacheForkInstancePersistent(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    time.Hour,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000,
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{"cache1": {MaxItems: -1}}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	if err = tc.ForkInstance("cache1", "fork"); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("fork", "item2", "value2", nil, true, "")
+	if err = tc.DumpAll(); err != nil { // fork kept only in memory
+		t.Error(err)
+	}
+	if err = tc.RewriteAll(); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(filepath.Join(opts.DumpPath, "fork")); !os.IsNotExist(err) {
+		t.Errorf("expected no dump folder for the fork, received <%v>", err)
+	}
+}
+
+func TestTransCacheUpdateGroup(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", 1, []string{"grp1"}, true, "")
+	tc.Set("cache1", "item2", 2, []string{"grp1", "grp2"}, true, "")
+	tc.Set("cache1", "item3", 3, nil, true, "")
+	updated, err := tc.UpdateGroup("cache1", "grp1", func(itmID string, old any) (any, bool) {
+		if itmID == "item2" {
+			return nil, false
+		}
+		return old.(int) * 10, true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 1 {
+		t.Errorf("expected <%v>, received <%v>", 1, updated)
+	}
+	tc.Shutdown()
+
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	for itmID, exp := range map[string]int{"item1": 10, "item2": 2, "item3": 3} {
+		if rcv, _ := tc.Get("cache1", itmID); rcv != exp {
+			t.Errorf("expected <%v> for <%s>, received <%v>", exp, itmID, rcv)
+		}
+	}
+	exp := []string{"item1", "item2"}
+	rcv := tc.GetGroupItemIDs("cache1", "grp1")
+	slices.Sort(rcv)
+	if !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+}
+
+type decodeIntoItem struct {
+	Name  string
+	Count int
+}
+
+func TestNewTransCacheWithOfflineCollectorDecodeInto(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: -2,
+		FileSizeLimit:   1000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {
+		MaxItems:   -1,
+		DecodeInto: func() any { return new(decodeIntoItem) },
+	}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// decodeIntoItem is not registered with gob
+	tc.Set("cache1", "item1", &decodeIntoItem{Name: "first", Count: 1}, nil, true, "")
+	tc.Set("cache1", "item2", &decodeIntoItem{Name: "second", Count: 2}, nil, true, "")
+	tc.Set("cache1", "item1", &decodeIntoItem{Name: "first", Count: 3}, nil, true, "")
+	tc.Shutdown() // rewritten keeping the encoded values
+
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	exp := &decodeIntoItem{Name: "first", Count: 3}
+	if rcv, has := tc.Get("cache1", "item1"); !has || !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	if matches, diffs, err := tc.VerifyPersistence("cache1"); err != nil || !matches {
+		t.Errorf("expected persisted items to match, received <%+v> <%v>", diffs, err)
+	}
+}
+
+func TestTransCacheMaxWriteFailures(t *testing.T) {
+	var failed []string
+	opts := &TransCacheOpts{
+		DumpPath:         t.TempDir(),
+		StartTimeout:     1 * time.Minute,
+		DumpInterval:     -1,
+		RewriteInterval:  0,
+		FileSizeLimit:    1000,
+		MaxWriteFailures: 2,
+		OnBackgroundError: func(chID string, err error) {
+			failed = append(failed, chID)
+		},
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	tc.cache["cache1"].offCollector.file.Close() // make the following writes fail
+	tc.Set("cache1", "item2", "value2", nil, true, "")
+	if !tc.Healthy() {
+		t.Error("expected dumping to continue after the first failure")
+	}
+	tc.Set("cache1", "item3", "value3", nil, true, "")
+	if tc.Healthy() {
+		t.Error("expected dumping to stop after MaxWriteFailures")
+	}
+	tc.Set("cache1", "item4", "value4", nil, true, "") // collected while not dumping
+	tc.Remove("cache1", "item1", true, "")
+	if exp := []string{"cache1"}; !reflect.DeepEqual(exp, failed) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, failed)
+	}
+	if err = tc.FlushInstance("cache1"); err != nil {
+		t.Fatal(err)
+	}
+	if !tc.Healthy() {
+		t.Error("expected dumping to resume after flushing")
+	}
+	tc.Set("cache1", "item5", "value5", nil, true, "")
+	tc.Shutdown()
+
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	for itmID, exp := range map[string]bool{"item1": false, "item4": true, "item5": true} {
+		if rcv := tc.HasItem("cache1", itmID); rcv != exp {
+			t.Errorf("expected <%v> for <%s>, received <%v>", exp, itmID, rcv)
+		}
+	}
+}
+
+func TestTransCacheStatsSnapshot(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    1 * time.Hour,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}, "cache2": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", "value1", []string{"grp1"}, true, "")
+	tc.Set("cache1", "item2", "value2", nil, true, "")
+	ss := tc.StatsSnapshot([]string{"cache1"})
+	if len(ss) != 1 {
+		t.Fatalf("expected one snapshot, received <%+v>", ss)
+	}
+	is := ss["cache1"]
+	if !is.Persistent || is.Items != 2 || is.Groups != 1 || is.PendingEntities != 2 ||
+		is.DiskBytes != 0 || !is.LastDump.IsZero() {
+		t.Errorf("unexpected snapshot before dump <%+v>", is)
+	}
+	if err := tc.DumpAll(); err != nil {
+		t.Fatal(err)
+	}
+	is = tc.StatsSnapshot(nil)["cache1"]
+	if is.Items != 2 || is.PendingEntities != 0 || is.DiskFiles != 1 ||
+		is.DiskBytes == 0 || is.LastDump.IsZero() {
+		t.Errorf("unexpected snapshot after dump <%+v>", is)
+	}
+	if ss = tc.StatsSnapshot(nil); len(ss) != 3 {
+		t.Errorf("expected snapshots of all instances, received <%+v>", ss)
+	}
+	mem := NewTransCache(map[string]*CacheConfig{"cache1": {MaxItems: -1}})
+	mem.Set("cache1", "item1", "value1", nil, true, "")
+	if is = mem.StatsSnapshot(nil)["cache1"]; is.Persistent || is.Items != 1 {
+		t.Errorf("unexpected in-memory snapshot <%+v>", is)
+	}
+}
+
+func TestTransCacheCoalesceWindow(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+		CoalesceWindow:  1 * time.Hour, // only dumped on shutdown
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5 {
+		tc.Set("cache1", "item1", i, nil, true, "")
+	}
+	tc.Set("cache1", "item2", "value1", nil, true, "")
+	tc.Set("cache1", "item2", "value2", nil, true, "")
+	tc.Remove("cache1", "item2", true, "")
+	if val, has := tc.Get("cache1", "item1"); !has || val != 4 {
+		t.Errorf("expected <%+v>, received <%+v>", 4, val)
+	}
+	if is := tc.StatsSnapshot([]string{"cache1"})["cache1"]; is.PendingEntities != 2 {
+		t.Errorf("expected <%+v>, received <%+v>", 2, is.PendingEntities)
+	}
+	tc.Shutdown()
+	var read int
+	opts.MigrateEntity = func(oce *OfflineCacheEntity) (*OfflineCacheEntity, bool) {
+		read++
+		return oce, true
+	}
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	if read != 4 { // first and latest Set of each item, and the remove
+		t.Errorf("expected <%+v>, received <%+v>", 4, read)
+	}
+	if val, has := tc.Get("cache1", "item1"); !has || val != 4 {
+		t.Errorf("expected <%+v>, received <%+v>", 4, val)
+	}
+	if _, has := tc.Get("cache1", "item2"); has {
+		t.Error("expected item2 to be removed")
+	}
+	tc.Shutdown()
+
+	opts.MigrateEntity = nil
+	opts.CoalesceWindow = 10 * time.Millisecond
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	tc.Set("cache1", "item1", 5, nil, true, "")
+	tc.Set("cache1", "item1", 6, nil, true, "")
+	time.Sleep(50 * time.Millisecond)
+	if is := tc.StatsSnapshot([]string{"cache1"})["cache1"]; is.PendingEntities != 0 {
+		t.Errorf("expected the collected Set dumped at the end of the window, received <%+v>", is)
+	}
+}
 
-	if rcv, ok := tc.Get(chID, itmID); ok {
-		t.Errorf("\nexpected to not find item, ok: %v", ok)
-	} else if rcv != nil {
-		t.Fatalf("\nexpected nil, \nreceived: <%+v>", rcv)
+func TestTransCacheRecoveryFS(t *testing.T) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for _, oce := range []*OfflineCacheEntity{
+		{IsSet: true, ItemID: "item1", Value: "value1", GroupIDs: []string{"grp1"}},
+		{IsSet: true, ItemID: "item2", Value: "value2"},
+		{ItemID: "item2"},
+	} {
+		if err := enc.Encode(oce); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys := fstest.MapFS{
+		"cache1/1700000000000000000": {Data: buf.Bytes()},
+		"cache1/tmpRewrite1":         {Data: []byte("interrupted rewrite")},
+	}
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+		RecoveryFS:      fsys,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}, "cache2": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if val, has := tc.Get("cache1", "item1"); !has || val != "value1" {
+		t.Errorf("expected <%+v>, received <%+v>", "value1", val)
+	}
+	if exp, rcv := []string{"item1"}, tc.GetGroupItemIDs("cache1", "grp1"); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	if _, has := tc.Get("cache1", "item2"); has {
+		t.Error("expected item2 to be removed")
+	}
+	if _, has := fsys["cache1/tmpRewrite1"]; !has {
+		t.Error("expected the file of the interrupted rewrite to be kept")
+	}
+	if rcv := tc.GetItemIDs("cache2", ""); len(rcv) != 0 {
+		t.Errorf("expected nothing recovered for cache2, received <%+v>", rcv)
 	}
 
+	fsys["cache1/1700000000000000001"] = &fstest.MapFile{Data: []byte("corrupted")}
+	var logBuf bytes.Buffer
+	opts.DumpPath = t.TempDir()
+	tc2, err := NewTransCacheWithOfflineCollector(opts, cfg, &testLogger{log.New(&logBuf, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc2.Shutdown()
+	if val, has := tc2.Get("cache1", "item1"); !has || val != "value1" {
+		t.Errorf("expected <%+v>, received <%+v>", "value1", val)
+	}
+	if rcv := logBuf.String(); !strings.Contains(rcv, "cache1/1700000000000000001") {
+		t.Errorf("expected warning about the corrupted file, received <%v>", rcv)
+	}
 }
 
-func TestTranscacheGetClonedNotClonable(t *testing.T) {
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			"testChID": {
-				lruIdx: list.New(),
-				lruRefs: map[string]*list.Element{
-					"testItemID": {},
-				},
-				cache: map[string]*cachedItem{
-					"testItemID": {
-						value: 3,
-					},
-				},
-				clone: true,
-			},
-		},
+func TestTransCacheSetMulti(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:          t.TempDir(),
+		StartTimeout:      1 * time.Minute,
+		DumpInterval:      -1,
+		RewriteInterval:   0,
+		FileSizeLimit:     1000000,
+		ValidateEncodable: true,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: 2}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tc.SetMulti("cache1", map[string]any{"item1": 1, "item2": make(chan int)},
+		nil, true, ""); err == nil {
+		t.Error("expected error for the value which cannot be dumped")
+	}
+	if rcv := tc.GetItemIDs("cache1", ""); len(rcv) != 0 {
+		t.Errorf("expected no items set, received <%+v>", rcv)
+	}
+	if err = tc.SetMulti("cache1", map[string]any{"item1": 1, "item2": 2, "item3": 3},
+		[]string{"grp1"}, true, ""); err != nil {
+		t.Fatal(err)
+	}
+	itmIDs := tc.GetItemIDs("cache1", "") // one of the items evicted while setting
+	if len(itmIDs) != 2 {
+		t.Fatalf("expected 2 items, received <%+v>", itmIDs)
+	}
+	tc.Shutdown()
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	rcv := tc.GetGroupItemIDs("cache1", "grp1")
+	slices.Sort(itmIDs)
+	slices.Sort(rcv)
+	if !reflect.DeepEqual(itmIDs, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", itmIDs, rcv)
 	}
-	chID := "testChID"
-	itmID := "testItemID"
 
-	if rcv, ok := tc.Get(chID, itmID); !ok {
-		t.Error("Couldnt get cache value, ok: ", ok)
-	} else if rcv != 3 {
-		t.Fatalf("\nexpected <%+v>, \nreceived: <%+v>", 3, rcv)
+	transID := tc.BeginTransaction()
+	if err = tc.SetMulti("cache1", map[string]any{"item4": 4, "item5": 5}, nil, false, transID); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tc.transactionBuffer[transID]); n != 2 {
+		t.Errorf("expected <%+v>, received <%+v>", 2, n)
+	}
+	tc.CommitTransaction(transID)
+	if val, has := tc.Get("cache1", "item5"); !has || val != 5 {
+		t.Errorf("expected <%+v>, received <%+v>", 5, val)
+	}
+}
+
+func TestTransCacheRename(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: 3}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Hour)
+	tc.cacheInstance("cache1").SetWithExpiryTime("item1", 1, []string{"grp1"}, expiry)
+	tc.Set("cache1", "item2", 2, nil, true, "")
+	tc.Set("cache1", "item3", 3, nil, true, "")
+	if tc.Rename("cache1", "item4", "item5") {
+		t.Error("expected false renaming an item not cached")
+	}
+	if !tc.Rename("cache1", "item1", "item3") { // overwrites item3
+		t.Fatal("expected item renamed")
+	}
+	if _, has := tc.Get("cache1", "item1"); has {
+		t.Error("expected item1 gone after rename")
+	}
+	if rcv := tc.GetGroupItemIDs("cache1", "grp1"); !reflect.DeepEqual([]string{"item3"}, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", []string{"item3"}, rcv)
+	}
+	if issues := tc.cacheInstance("cache1").CheckConsistency(); len(issues) != 0 {
+		t.Errorf("expected consistent cache, received <%+v>", issues)
+	}
+	tc.Shutdown()
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if val, has := tc.Get("cache1", "item3"); !has || val != 1 {
+		t.Errorf("expected <%+v>, received <%+v>", 1, val)
+	}
+	if exp, _ := tc.GetItemExpiryTime("cache1", "item3"); !exp.Equal(expiry) {
+		t.Errorf("expected <%+v>, received <%+v>", expiry, exp)
+	}
+	if _, has := tc.Get("cache1", "item1"); has {
+		t.Error("expected item1 not recovered after rename")
+	}
+}
+
+func TestTransCacheRenameDumpDropped(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    time.Hour,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{"cache1": {MaxItems: -1}}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	c := tc.cache["cache1"]
+	c.Lock()
+	c.dumpDropped = true // dump folder of a removed instance
+	c.Unlock()
+	c.offCollector.collMux.Lock()
+	clear(c.offCollector.collection)
+	c.offCollector.collMux.Unlock()
+	if !c.Rename("item1", "item2") {
+		t.Fatal("expected item renamed")
+	}
+	if c.offCollector.hasCollected() {
+		t.Errorf("expected the rename not stored, received <%+v>", c.offCollector.collection)
+	}
+}
+
+func TestTransCacheAddRemoveGroup(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpIDs := []string{"grp1"}
+	tc.Set("cache1", "item1", 1, grpIDs, true, "")
+	if tc.AddToGroup("cache1", "item2", "grp2") {
+		t.Error("expected false for an item not cached")
+	}
+	if !tc.AddToGroup("cache1", "item1", "grp2") || !tc.AddToGroup("cache1", "item1", "grp3") {
+		t.Error("expected item added to groups")
+	}
+	if !tc.RemoveFromGroup("cache1", "item1", "grp1") {
+		t.Error("expected item removed from group")
+	}
+	if tc.HasGroup("cache1", "grp1") {
+		t.Error("expected grp1 emptied")
+	}
+	if grpIDs[0] != "grp1" {
+		t.Errorf("expected groups of the caller not changed, received <%+v>", grpIDs)
+	}
+	tc.Shutdown()
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if rcv := tc.GetItemGroups("cache1", "item1"); !reflect.DeepEqual([]string{"grp2", "grp3"}, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", []string{"grp2", "grp3"}, rcv)
+	}
+	if rcv := tc.GetGroupItemIDs("cache1", "grp3"); !reflect.DeepEqual([]string{"item1"}, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", []string{"item1"}, rcv)
+	}
+}
+
+func TestTransCacheJSONCodec(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1, // an entity per file, rewritten to drop item2
+		Codec:           JSONCodec{},
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", "val1", []string{"grp1"}, true, "")
+	tc.Set("cache1", "item2", "val2", nil, true, "")
+	tc.Remove("cache1", "item2", true, "")
+	tc.Set("cache1", "item3", "val3", nil, true, "")
+	if err = tc.RewriteAll(); err != nil {
+		t.Fatal(err)
+	}
+	tc.Shutdown()
+	filePaths, err := getFilePaths(filepath.Join(opts.DumpPath, "cache1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, fp := range filePaths {
+		b, err := os.ReadFile(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.Fields(string(b))...)
+	}
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], `{"IsSet":true,"ItemID":"item1","Value":"val1"`) {
+		t.Errorf("expected 2 JSON entities, received <%+v>", lines)
+	}
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if val, _ := tc.Get("cache1", "item1"); val != "val1" {
+		t.Errorf("expected <%+v>, received <%+v>", "val1", val)
+	}
+	if rcv := tc.GetGroupItemIDs("cache1", "grp1"); !reflect.DeepEqual([]string{"item1"}, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", []string{"item1"}, rcv)
+	}
+	if _, has := tc.Get("cache1", "item2"); has {
+		t.Error("expected item2 removed")
+	}
+}
+
+func TestTransCacheCodecChange(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", "val1", nil, true, "") // dumped in gob
+	tc.Shutdown()
+	opts.Codec = JSONCodec{}
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item2", "val2", nil, true, "")
+	tc.Shutdown()
+	opts.Codec = nil // back to gob, reading the JSON files as well
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item3", "val3", nil, true, "")
+	if err = tc.RewriteAll(); err != nil {
+		t.Fatal(err)
+	}
+	tc.Shutdown()
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	for itmID, exp := range map[string]string{"item1": "val1", "item2": "val2", "item3": "val3"} {
+		if val, has := tc.Get("cache1", itmID); !has || val != exp {
+			t.Errorf("expected <%+v> for <%s>, received <%+v>", exp, itmID, val)
+		}
+	}
+}
+
+func TestTransCacheCompression(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", "val1", nil, true, "") // dumped uncompressed
+	tc.Shutdown()
+	opts.Compression = true
+	opts.FileSizeLimit = 1 // an entity per file, rewritten together
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item2", strings.Repeat("val2", 100), []string{"grp1"}, true, "")
+	tc.Set("cache1", "item3", "val3", nil, true, "")
+	tc.Remove("cache1", "item3", true, "")
+	tc.Set("cache1", "item4", "val4", nil, true, "")
+	if err = tc.RewriteAll(); err != nil {
+		t.Fatal(err)
+	}
+	tc.Shutdown()
+	filePaths, err := getFilePaths(filepath.Join(opts.DumpPath, "cache1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fp := range filePaths {
+		b, err := os.ReadFile(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+			t.Errorf("expected file <%s> compressed", fp)
+		}
+	}
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	itmIDs := tc.GetItemIDs("cache1", "")
+	slices.Sort(itmIDs)
+	if exp := []string{"item1", "item2", "item4"}; !reflect.DeepEqual(exp, itmIDs) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, itmIDs)
+	}
+	if val, _ := tc.Get("cache1", "item2"); val != strings.Repeat("val2", 100) {
+		t.Errorf("expected <%+v>, received <%+v>", strings.Repeat("val2", 100), val)
+	}
+}
+
+func TestTransCacheTornDumpFile(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	tc.Set("cache1", "item2", "value2", nil, true, "")
+	if err = tc.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(filepath.Join(opts.DumpPath, "cache1"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 {
+		t.Fatalf("expected 1 dump file, received <%v>", files)
+	}
+	dumpFile := filepath.Join(opts.DumpPath, "cache1", files[0].Name())
+	data, err := os.ReadFile(dumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff // corrupt the last record
+	if err = os.WriteFile(dumpFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var logBuf bytes.Buffer
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, &testLogger{log.New(&logBuf, "", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if val, has := tc.Get("cache1", "item1"); !has || val != "value1" {
+		t.Errorf("expected <%+v>, received <%+v>", "value1", val)
+	}
+	if _, has := tc.Get("cache1", "item2"); has {
+		t.Error("expected the corrupted item2 to be skipped")
+	}
+	if rcv := logBuf.String(); !strings.Contains(rcv, "record checksum mismatch") {
+		t.Errorf("expected checksum warning, received <%v>", rcv)
+	}
+	tc.Shutdown()
+
+	if err = os.WriteFile(dumpFile, data[:len(data)-3], 0644); err != nil { // torn by a crash
+		t.Fatal(err)
+	}
+	logBuf.Reset()
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, &testLogger{log.New(&logBuf, "", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if val, has := tc.Get("cache1", "item1"); !has || val != "value1" {
+		t.Errorf("expected <%+v>, received <%+v>", "value1", val)
+	}
+	if rcv := logBuf.String(); !strings.Contains(rcv, "torn record") {
+		t.Errorf("expected torn record warning, received <%v>", rcv)
+	}
+}
+
+func TestTransCacheUndecodableDumpFile(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	record := []byte{0x03, 0xff, 0xff, 0xff} // intact record, not holding a gob message
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(record))
+	badFile := filepath.Join(opts.DumpPath, "cache1", "10000000000000000000") // not a suffix of the current file
+	if err = os.WriteFile(badFile, append(append([]byte(frameMagic), hdr[:]...), record...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = tc.RewriteAll(); !errors.Is(err, errDecodeEntity) {
+		t.Errorf("expected <%v>, received <%v>", errDecodeEntity, err)
+	}
+	if _, err = os.Stat(badFile); err != nil {
+		t.Errorf("expected the file not rewritten, received <%v>", err)
+	}
+	tc.Shutdown()
+
+	if _, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); !errors.Is(err, errDecodeEntity) {
+		t.Errorf("expected <%v>, received <%v>", errDecodeEntity, err)
+	}
+}
+
+type testGobWrapper struct{ Inner any }
+
+func TestTransCacheDumpAfterUnencodableValue(t *testing.T) {
+	type unregistered struct{ Field string }
+	gob.Register(testGobWrapper{})
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "bad1", unregistered{"value"}, nil, true, "") // gob fails after describing the entity
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	tc.Set("cache1", "bad2", testGobWrapper{unregistered{"value"}}, nil, true, "") // fails after describing the wrapper
+	tc.Set("cache1", "item2", testGobWrapper{"value2"}, nil, true, "")
+	tc.Shutdown()
+
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	for itmID, exp := range map[string]any{"item1": "value1", "item2": testGobWrapper{"value2"}} {
+		if val, has := tc.Get("cache1", itmID); !has || val != exp {
+			t.Errorf("expected <%+v> for <%s>, received <%+v>", exp, itmID, val)
+		}
+	}
+	if itmIDs := tc.GetItemIDs("cache1", "bad"); len(itmIDs) != 0 {
+		t.Errorf("expected the items failing to encode not dumped, received <%+v>", itmIDs)
 	}
 }
 
-func TestTranscacheRewriteAllErr1(t *testing.T) {
-	tmpFile, err := os.CreateTemp("", "test-")
+func TestTransCacheShutdownCtx(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    time.Hour,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
 	if err != nil {
-		t.Fatalf("Failed to create temporary file: %v", err)
+		t.Fatal(err)
 	}
-	defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
-	tc := TransCache{
-		cache: map[string]*Cache{
-			"testChID1": {
-				offCollector: &OfflineCollector{
-					fileSizeLimit:   1000,
-					file:            tmpFile,
-					dumpInterval:    -1,
-					rewriteInterval: -1,
-					fldrPath:        "/tmp/notexistent",
-				},
-			},
-		},
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	if err = tc.cache["cache1"].DumpToFile(); err != nil {
+		t.Fatal(err)
 	}
-	expErr := "error <lstat /tmp/notexistent: no such file or directory> walking path </tmp/notexistent>"
-	if err := tc.RewriteAll(); err == nil || err.Error() != expErr {
-		t.Errorf("Expected error <%+v>, \nReceived error <%+v>", expErr, err)
+	tc.Set("cache1", "item2", "value2", nil, true, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = tc.ShutdownCtx(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected <%v>, received <%v>", context.Canceled, err)
 	}
-}
 
-func TestTranscacheShutdownNil(t *testing.T) {
-	tc := &TransCache{}
-	exp := &TransCache{}
-	tc.Shutdown()
-	if !reflect.DeepEqual(exp, tc) {
-		t.Errorf("Expected TransCache to not change, received <%+v>", tc)
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	if val, has := tc.Get("cache1", "item1"); !has || val != "value1" {
+		t.Errorf("expected <%+v>, received <%+v>", "value1", val)
+	}
+	if _, has := tc.Get("cache1", "item2"); has {
+		t.Error("expected item2 not dumped before the deadline")
+	}
+	tc.Set("cache1", "item2", "value2", nil, true, "")
+	if err = tc.ShutdownCtx(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if val, has := tc.Get("cache1", "item2"); !has || val != "value2" {
+		t.Errorf("expected <%+v>, received <%+v>", "value2", val)
 	}
 }
 
-func TestTranscacheShutdownNoIntervalErr(t *testing.T) {
-	path := "/tmp/*default"
-	if err := os.MkdirAll(path, 0755); err != nil {
+func TestTransCacheFlush(t *testing.T) {
+	if err := NewTransCache(map[string]*CacheConfig{}).Flush(); err != nil {
+		t.Errorf("expected no error without offline collector, received <%v>", err)
+	}
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    time.Hour,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}, "cache2": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := os.RemoveAll(path); err != nil {
-			t.Errorf("Failed to delete temporary dir: %v", err)
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	tc.Set("cache2", "item2", "value2", nil, true, "")
+	var wg sync.WaitGroup
+	for range 4 { // concurrently with the sets collected meanwhile
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tc.Flush(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	tc.Set("cache1", "item3", "value3", nil, true, "")
+	wg.Wait()
+	if err = tc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, chID := range []string{"cache1", "cache2"} {
+		if n := len(tc.cache[chID].offCollector.collection); n != 0 {
+			t.Errorf("expected <%s> collection flushed, received <%d> entries", chID, n)
 		}
-	}()
-	f, err := os.OpenFile(path+"/file", os.O_APPEND|os.O_CREATE|os.O_WRONLY,
-		0644)
+	}
+	recovered, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}) // read while tc still runs
 	if err != nil {
-		t.Error(err)
-	} else {
-		defer f.Close()
+		t.Fatal(err)
 	}
-	f.Close()
-	var logBuf bytes.Buffer
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			DefaultCacheInstance: {
-				offCollector: &OfflineCollector{
-					fileSizeLimit:   1000,
-					dumpInterval:    -1,
-					rewriteInterval: -1,
-					logger:          &testLogger{log.New(&logBuf, "", 0)},
-					file:            f,
-				},
-			},
-		},
+	defer recovered.Shutdown()
+	if val, has := recovered.Get("cache1", "item3"); !has || val != "value3" {
+		t.Errorf("expected <%+v>, received <%+v>", "value3", val)
+	}
+	if val, has := recovered.Get("cache2", "item2"); !has || val != "value2" {
+		t.Errorf("expected <%+v>, received <%+v>", "value2", val)
 	}
-	expBuf := "error getting file stats: stat /tmp/*default/file: file already closed"
 	tc.Shutdown()
-	if rcv := logBuf.String(); !strings.Contains(rcv, expBuf) {
-		t.Errorf("Expected <%+v>, \nReceived <%+v>", expBuf, rcv)
+}
 
+func TestTransCacheAddInstance(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{})
+	cfg := &CacheConfig{MaxItems: -1}
+	if err := tc.AddInstance("tenant1", cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.MaxItems = 1
+	if rcv, has := tc.GetInstanceConfig("tenant1"); !has || rcv.MaxItems != -1 {
+		t.Errorf("expected the config copied on add, received <%+v>", rcv)
+	}
+	tc.Set("tenant1", "item1", "value1", nil, true, "")
+	if _, has := tc.Get(DefaultCacheInstance, "item1"); has {
+		t.Error("expected item1 set on tenant1 instead of the default instance")
+	}
+	expErr := "cache instance <tenant1> already exists"
+	if err := tc.AddInstance("tenant1", &CacheConfig{MaxItems: -1}); err == nil || err.Error() != expErr {
+		t.Errorf("expected error <%v>, received <%v>", expErr, err)
 	}
-}
 
-func TestTranscacheShutdownNilCollector(t *testing.T) {
-	path := "/tmp/*default"
-	if err := os.MkdirAll(path, 0755); err != nil {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	if tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, nopLogger{}); err != nil {
+		t.Fatal(err)
+	} else if err = tc.AddInstance("tenant1", &CacheConfig{MaxItems: -1}); err != nil {
 		t.Fatal(err)
+	} else {
+		tc.Set("tenant1", "item1", "value1", nil, true, "")
+		tc.Shutdown()
 	}
-	defer func() {
-		if err := os.RemoveAll(path); err != nil {
-			t.Errorf("Failed to delete temporary dir: %v", err)
-		}
-	}()
-	f, err := os.OpenFile(path+"/file", os.O_APPEND|os.O_CREATE|os.O_WRONLY,
-		0644)
+	if _, err := os.Stat(filepath.Join(opts.DumpPath, "tenant1")); err != nil {
+		t.Fatal(err)
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, nopLogger{})
 	if err != nil {
-		t.Error(err)
-	} else {
-		defer f.Close()
+		t.Fatal(err)
 	}
-	f.Close()
-	var logBuf bytes.Buffer
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			DefaultCacheInstance: {},
-		},
+	defer tc.Shutdown()
+	if err = tc.AddInstance("tenant1", &CacheConfig{MaxItems: -1}); err != nil {
+		t.Fatal(err)
 	}
-	tc.Shutdown()
-	if rcv := logBuf.String(); rcv != "" {
-		t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
+	if val, has := tc.Get("tenant1", "item1"); !has || val != "value1" {
+		t.Errorf("expected <%+v>, received <%+v>", "value1", val)
+	}
+}
 
+func TestTransCacheAddInstanceReserved(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	fldrPath := filepath.Join(opts.DumpPath, "tenant1")
+	if err = os.WriteFile(fldrPath, nil, 0644); err != nil { // not a folder, failing the recovery
+		t.Fatal(err)
+	}
+	if err = tc.AddInstance("tenant1", &CacheConfig{MaxItems: -1}); err == nil {
+		t.Error("expected error adding over a file")
+	}
+	if err = os.Remove(fldrPath); err != nil {
+		t.Fatal(err)
+	}
+	var added atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tc.AddInstance("tenant1", &CacheConfig{MaxItems: -1}) == nil {
+				added.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if rcv := added.Load(); rcv != 1 {
+		t.Errorf("expected <%+v>, received <%+v>", 1, rcv)
 	}
 }
 
-func TestTranscacheShutdownIntervalWrite(t *testing.T) {
-	path := "/tmp/*default"
-	if err := os.MkdirAll(path, 0755); err != nil {
+func TestTransCacheAddRemoveInstanceConcurrent(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    time.Hour,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, nopLogger{})
+	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := os.RemoveAll(path); err != nil {
-			t.Errorf("Failed to delete temporary dir: %v", err)
+	addRemove := func(prfx string) {
+		for i := range 20 {
+			chID := prfx + strconv.Itoa(i)
+			if err := tc.AddInstance(chID, &CacheConfig{MaxItems: -1}); err != nil {
+				t.Error(err)
+				return
+			}
+			tc.Set(chID, "item1", "value1", nil, true, "")
+			if err := tc.RemoveInstance(chID, ""); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		addRemove("tenant")
+	}()
+	go func() { // errors of the instances removed meanwhile are expected
+		defer wg.Done()
+		for range 20 {
+			tc.DumpAll()
+			tc.Flush()
+			tc.RewriteAll()
 		}
 	}()
-	f, err := os.OpenFile(path+"/file", os.O_APPEND|os.O_CREATE|os.O_WRONLY,
-		0644)
+	wg.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		addRemove("late")
+	}()
+	tc.Shutdown()
+	wg.Wait()
+}
+
+func TestTransCacheRemoveInstance(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+		RecoverCaches:   []string{DefaultCacheInstance, "tenant1"},
+	}
+	cfg := map[string]*CacheConfig{"tenant1": {MaxItems: -1}, "tenant2": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
 	if err != nil {
-		t.Error(err)
-	} else {
-		defer f.Close()
+		t.Fatal(err)
 	}
-	f.Close()
-	var logBuf bytes.Buffer
-	tc := &TransCache{
-		cache: map[string]*Cache{
-			DefaultCacheInstance: {
-				offCollector: &OfflineCollector{
-					dumpInterval:    5 * time.Second,
-					rewriteInterval: -1,
-					stopDump:        make(chan struct{}),
-					dumpStopped:     make(chan struct{}),
-					logger:          &testLogger{log.New(&logBuf, "", 0)},
-					file:            f,
-				},
-			},
-		},
+	defer tc.Shutdown()
+	tc.Set("tenant1", "item1", "value1", nil, true, "")
+	evCh := tc.EvictionChannel("tenant1", 1)
+	expErr := "cannot remove <*default>"
+	if err = tc.RemoveInstance(DefaultCacheInstance, ""); err == nil || err.Error() != expErr {
+		t.Errorf("expected error <%v>, received <%v>", expErr, err)
 	}
-	go func() {
-		tc.Shutdown()
-		expBuf := "error getting file stats: stat /tmp/*default/file: file already closed"
-		if rcv := logBuf.String(); !strings.Contains(rcv, expBuf) {
-			t.Errorf("Expected <%+v>, \nReceived <%+v>", expBuf, rcv)
+	for _, chID := range []string{"tenant1", "tenant2"} { // tenant2 still pending recovery
+		if err = tc.RemoveInstance(chID, ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(filepath.Join(opts.DumpPath, chID)); !os.IsNotExist(err) {
+			t.Errorf("expected dump folder of <%s> removed, received <%v>", chID, err)
 		}
-	}()
-	time.Sleep(50 * time.Millisecond)
-	for _, c := range tc.cache {
-		<-c.offCollector.stopDump
-		c.offCollector.dumpStopped <- struct{}{}
 	}
-	time.Sleep(50 * time.Millisecond)
+	exp := EvictionEvent{ItemID: "item1", Value: "value1", Reason: EvictionCleared}
+	if ev := <-evCh; ev != exp {
+		t.Errorf("expected <%+v>, received <%+v>", exp, ev)
+	}
+	if _, open := <-evCh; open {
+		t.Error("expected the eviction channel closed")
+	}
+	if err = tc.RemoveInstance("tenant1", ""); !errors.Is(err, ErrUnknownInstance) {
+		t.Errorf("expected <%v>, received <%v>", ErrUnknownInstance, err)
+	}
+	if _, has := tc.Get("tenant1", "item1"); has {
+		t.Error("expected item1 removed with tenant1")
+	}
+	tc.Set("tenant1", "item2", "value2", nil, true, "")
+	if val, has := tc.Get(DefaultCacheInstance, "item2"); !has || val != "value2" {
+		t.Errorf("expected <%+v>, received <%+v>", "value2", val)
+	}
+	if _, has := cfg["tenant1"]; !has {
+		t.Error("expected the configuration of the caller unchanged")
+	}
+
+	tc = NewTransCache(map[string]*CacheConfig{"tenant1": {MaxItems: -1}})
+	if err = tc.RemoveInstance("tenant1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, has := tc.cache["tenant1"]; has {
+		t.Error("expected tenant1 removed")
+	}
 }
 
-func TestCloseFileSuccess(t *testing.T) {
-	tmpFile, err := os.CreateTemp("", "test-success-*.txt")
+func TestTransCacheRemoveInstanceArchive(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    time.Hour,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	var evicted []string
+	cfg := map[string]*CacheConfig{"tenant1": {MaxItems: -1, OnEvicted: []func(itmID string, value any){
+		func(itmID string, _ any) { evicted = append(evicted, itmID) }}}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
 	if err != nil {
-		t.Fatalf("Failed to create temp file: %v", err)
+		t.Fatal(err)
 	}
+	defer tc.Shutdown()
+	tc.Set("tenant1", "item1", "value1", nil, true, "")
+	archivePath := filepath.Join(t.TempDir(), "archive")
+	if err = tc.RemoveInstance("tenant1", archivePath); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{"item1"}, evicted) {
+		t.Errorf("expected <%+v>, received <%+v>", []string{"item1"}, evicted)
+	}
+	if _, err = os.Stat(filepath.Join(opts.DumpPath, "tenant1")); !os.IsNotExist(err) {
+		t.Errorf("expected dump folder of <tenant1> moved, received <%v>", err)
+	}
+	archived, err := filepath.Glob(filepath.Join(archivePath, "tenant1_*"))
+	if err != nil || len(archived) != 1 {
+		t.Fatalf("expected one archived folder, received <%+v>, err <%v>", archived, err)
+	}
+	oceMap, err := readDumpFolder(archived[0], nil, nil, nil, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oce, has := oceMap["item1"]; !has || oce.Value != "value1" {
+		t.Errorf("expected item1 archived, received <%+v>", oceMap)
+	}
+}
 
-	fileName := tmpFile.Name()
-
-	err = closeFile(tmpFile)
+func TestTransCacheRemoveInstanceStopsCleaner(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{"src": {MaxItems: -1, TTL: time.Hour}})
+	defer tc.Shutdown()
+	before := runtime.NumGoroutine()
+	for i := range 50 {
+		chID := "tenant" + strconv.Itoa(i)
+		if err := tc.AddInstance(chID, &CacheConfig{MaxItems: -1, TTL: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.ForkInstance("src", chID+"_fork"); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{chID, chID + "_fork"} {
+			if err := tc.RemoveInstance(id, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("expected <%d> goroutines, received <%d>", before, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
 
+func TestTransCacheSetCtxWriteThrough(t *testing.T) {
+	path := t.TempDir()
+	opts := &TransCacheOpts{
+		DumpPath:        path,
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+	}
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	coll := tc.cache["cache1"].offCollector
+	coll.fileMux.Lock() // dump file busy
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	for _, itmID := range []string{"item1", "item2"} {
+		if err := tc.SetCtx(ctx, "cache1", itmID, itmID, nil, true, ""); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected <%v>, received <%v>", context.DeadlineExceeded, err)
+		}
+	}
+	coll.fileMux.Unlock()
+	if val, has := tc.Get("cache1", "item1"); !has || val != "item1" {
+		t.Errorf("expected <%+v>, received <%+v>", "item1", val)
+	}
+	if !coll.hasCollected() {
+		t.Error("expected the aborted writes to be collected")
+	}
+	tc.Remove("cache1", "item2", true, "")
+	if err := tc.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if tc, err = NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{"cache1": {MaxItems: -1}},
+		nopLogger{}); err != nil {
+		t.Fatal(err)
 	}
-
-	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
-		t.Errorf("Expected file to be removed, but it still exists")
+	defer tc.Shutdown()
+	if val, has := tc.Get("cache1", "item1"); !has || val != "item1" {
+		t.Errorf("expected <%+v>, received <%+v>", "item1", val)
+	}
+	if _, has := tc.Get("cache1", "item2"); has {
+		t.Error("expected removed item not to be recovered")
 	}
 }
 
-func TestCloseFileErr(t *testing.T) {
-	path := "/tmp/*default"
-	if err := os.MkdirAll(path, 0755); err != nil {
-		t.Fatal(err)
+func TestTransCacheGetOrSet(t *testing.T) {
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
 	}
-	defer func() {
-		if err := os.RemoveAll(path); err != nil {
-			t.Errorf("Failed to delete temporary dir: %v", err)
-		}
-	}()
-	f, err := os.OpenFile(path+"/file", os.O_APPEND|os.O_CREATE|os.O_WRONLY,
-		0644)
+	cfg := map[string]*CacheConfig{"cache1": {MaxItems: -1}}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
 	if err != nil {
-		t.Error(err)
-	} else {
-		defer f.Close()
+		t.Fatal(err)
 	}
-	f.Close()
-	expErr := "error getting file stats: stat /tmp/*default/file: file already closed"
-	if err := closeFile(f); err.Error() != expErr {
-		t.Errorf("Expected error <%+v>, \nReceived error <%+v>", expErr, err)
+	if actual, loaded := tc.GetOrSet("cache1", "item1", "value1", []string{"grp1"}); loaded || actual != "value1" {
+		t.Errorf("expected <%+v>, received <%+v>, loaded <%v>", "value1", actual, loaded)
 	}
-}
-
-func TestNewTransCacheWithOfflineCollector(t *testing.T) {
-	path := "/tmp/internal_db"
-	if err := os.MkdirAll(path, 0755); err != nil {
+	if actual, loaded := tc.GetOrSet("cache1", "item1", "value2", nil); !loaded || actual != "value1" {
+		t.Errorf("expected <%+v>, received <%+v>, loaded <%v>", "value1", actual, loaded)
+	}
+	tc.Shutdown()
+	var read int
+	opts.MigrateEntity = func(oce *OfflineCacheEntity) (*OfflineCacheEntity, bool) {
+		read++
+		return oce, true
+	}
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := os.RemoveAll(path); err != nil {
-			t.Errorf("Failed to delete temporary dir: %v", err)
-		}
-	}()
-	var logBuf bytes.Buffer
+	defer tc.Shutdown()
+	if read != 1 { // only the set is dumped
+		t.Errorf("expected <%+v>, received <%+v>", 1, read)
+	}
+	if exp, rcv := []string{"item1"}, tc.GetGroupItemIDs("cache1", "grp1"); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+}
+
+func TestTransCacheDumpAllConcurrency(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
 	opts := &TransCacheOpts{
-		DumpPath:        path,
+		DumpPath:        t.TempDir(),
 		StartTimeout:    1 * time.Minute,
-		DumpInterval:    10 * time.Second,
-		RewriteInterval: 10 * time.Second,
+		DumpInterval:    time.Hour, // collect items, dump only on DumpAll
+		RewriteInterval: 0,
 		FileSizeLimit:   1000,
+		DumpConcurrency: 1,
+		BeforeDump: func(_, _ string, value any) any {
+			if n := inFlight.Add(1); n > maxInFlight.Load() {
+				maxInFlight.Store(n)
+			}
+			time.Sleep(5 * time.Millisecond)
+			inFlight.Add(-1)
+			return value
+		},
 	}
-	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, &testLogger{log.New(&logBuf, "", 0)})
+	cfg := map[string]*CacheConfig{}
+	for i := range 4 {
+		cfg[fmt.Sprintf("cache%d", i)] = &CacheConfig{MaxItems: -1}
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
 	if err != nil {
-		t.Error(err)
-	} else if rcv := logBuf.String(); !strings.Contains(rcv, "") {
-		t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
+		t.Fatal(err)
 	}
-	expTc := NewTransCache(map[string]*CacheConfig{})
-
-	expTc.cache[DefaultCacheInstance].onEvicted = tc.cache[DefaultCacheInstance].onEvicted
-	expTc.cache[DefaultCacheInstance].lruIdx = tc.cache[DefaultCacheInstance].lruIdx
-	expTc.cache[DefaultCacheInstance].ttlIdx = tc.cache[DefaultCacheInstance].ttlIdx
-	expTc.cache[DefaultCacheInstance].offCollector = &OfflineCollector{
-		dumpInterval:     10 * time.Second,
-		stopDump:         tc.cache[DefaultCacheInstance].offCollector.stopDump,
-		dumpStopped:      tc.cache[DefaultCacheInstance].offCollector.dumpStopped,
-		rewriteInterval:  10 * time.Second,
-		stopRewrite:      tc.cache[DefaultCacheInstance].offCollector.stopRewrite,
-		rewriteStopped:   tc.cache[DefaultCacheInstance].offCollector.rewriteStopped,
-		collection:       make(map[string]*CollectionEntity),
-		fldrPath:         path + "/" + DefaultCacheInstance,
-		collectSetEntity: true,
-		fileSizeLimit:    1000,
-		file:             tc.cache[DefaultCacheInstance].offCollector.file,
-		writer:           tc.cache[DefaultCacheInstance].offCollector.writer,
-		encoder:          tc.cache[DefaultCacheInstance].offCollector.encoder,
-		logger:           tc.cache[DefaultCacheInstance].offCollector.logger,
+	defer tc.Shutdown()
+	for chID := range cfg {
+		tc.Set(chID, "item1", 1, nil, true, "")
 	}
-
-	if !reflect.DeepEqual(expTc, tc) {
-		t.Errorf("expected <%#v>, \nreceived <%#v>", expTc, tc)
+	if err := tc.DumpAll(); err != nil {
+		t.Fatal(err)
+	}
+	if rcv := maxInFlight.Load(); rcv != 1 {
+		t.Errorf("expected <1> instance dumping at once, received <%d>", rcv)
 	}
 }
 
-func TestNewTransCacheWithOfflineCollectorErr1(t *testing.T) {
-	var logBuf bytes.Buffer
+func TestTransCacheRenameCacheInstance(t *testing.T) {
 	opts := &TransCacheOpts{
-		DumpPath:        "/tmp/doesntExist" + DefaultCacheInstance,
-		StartTimeout:    10 * time.Second,
-		DumpInterval:    1 * time.Minute,
-		RewriteInterval: 10 * time.Second,
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
 		FileSizeLimit:   1000,
 	}
-	_, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, &testLogger{log.New(&logBuf, "", 0)})
-	expErr := "stat /tmp/doesntExist*default: no such file or directory"
-	if err == nil || expErr != err.Error() {
-		t.Errorf("expected error <%v>, received <%v>", expErr, err)
-	} else if rcv := logBuf.String(); !strings.Contains(rcv, "") {
-		t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
+	cfg := map[string]*CacheConfig{
+		"cache1": {MaxItems: -1},
+		"cache2": {MaxItems: -1},
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", 1, nil, true, "")
+	if err := tc.RenameCacheInstance("cache1", "cache2"); err == nil {
+		t.Error("expected error renaming to an existing instance")
+	}
+	if err := tc.RenameCacheInstance(DefaultCacheInstance, "cache3"); err == nil {
+		t.Error("expected error renaming the default instance")
+	}
+	expErr := "<cache4> unknown cache instance"
+	if err := tc.RenameCacheInstance("cache4", "cache3"); !errors.Is(err, ErrUnknownInstance) || err.Error() != expErr {
+		t.Errorf("expected <%v>, received <%v>", expErr, err)
+	}
+	if err := tc.RenameCacheInstance("cache1", "cache3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, has := cfg["cache3"]; has {
+		t.Error("configuration of the caller should not be modified")
+	}
+	tc.Set("cache3", "item2", 2, nil, true, "")
+	if val, has := tc.Get("cache3", "item1"); !has || val != 1 {
+		t.Errorf("expected <1>, received <%v>", val)
+	}
+	tc.Shutdown()
+	if _, err := os.Stat(filepath.Join(opts.DumpPath, "cache1")); !os.IsNotExist(err) {
+		t.Errorf("expected old dump folder to be moved, received <%v>", err)
 	}
 
+	cfg = map[string]*CacheConfig{"cache3": {MaxItems: -1}}
+	if tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	rcv := tc.GetItemIDs("cache3", "")
+	slices.Sort(rcv)
+	if exp := []string{"item1", "item2"}; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%v>, received <%v>", exp, rcv)
+	}
 }
 
-func TestNewTransCacheWithOfflineCollectorErr2(t *testing.T) {
-	path := "/root"
-	var logBuf bytes.Buffer
+func TestNewTransCacheWithOfflineCollectorRecoverCaches(t *testing.T) {
+	path := t.TempDir()
 	opts := &TransCacheOpts{
 		DumpPath:        path,
 		StartTimeout:    1 * time.Minute,
-		DumpInterval:    10 * time.Second,
-		RewriteInterval: 10 * time.Second,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
 		FileSizeLimit:   1000,
 	}
-	_, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, &testLogger{log.New(&logBuf, "", 0)})
-	expErr := "mkdir /root/*default: permission denied"
-	if err == nil || expErr != err.Error() {
-		t.Errorf("expected error <%v>, received <%v>", expErr, err)
-	} else if rcv := logBuf.String(); !strings.Contains(rcv, "") {
-		t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
+	cfg := map[string]*CacheConfig{
+		"cache1": {MaxItems: -1},
+		"cache2": {MaxItems: -1},
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	tc.Set("cache2", "item2", "value2", nil, true, "")
+	tc.Shutdown()
+
+	opts.RecoverCaches = []string{"cache1"}
+	tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcv := tc.cache["cache1"].Len(); rcv != 1 {
+		t.Errorf("expected <1> items in cache1, received <%d>", rcv)
+	}
+	if rcv := tc.cache["cache2"].Len(); rcv != 0 {
+		t.Errorf("expected cache2 not to be recovered, received <%d> items", rcv)
+	}
+	if !tc.pendingRecovery("cache2") {
+		t.Error("expected cache2 to be pending recovery")
+	}
+	if err := tc.DumpAll(); err != nil {
+		t.Error(err)
 	}
+	if val, has := tc.Get("cache2", "item2"); !has || val != "value2" {
+		t.Errorf("expected <value2>, received <%v>", val)
+	}
+	if tc.pendingRecovery("cache2") {
+		t.Error("expected cache2 to be recovered after first access")
+	}
+	tc.Set("cache2", "item3", "value3", nil, true, "")
+	tc.Shutdown()
 
+	opts.RecoverCaches = nil
+	tc, err = NewTransCacheWithOfflineCollector(opts, cfg, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if rcv := tc.GetItemIDs("cache2", ""); len(rcv) != 2 {
+		t.Errorf("expected <2> items in cache2, received <%v>", rcv)
+	}
 }
 
-func TestNewTransCacheWithOfflineCollectorErr3(t *testing.T) {
-	path := "/tmp/internal_db"
-	if err := os.MkdirAll(path+"/*default", 0755); err != nil {
+func TestNewTransCacheWithOfflineCollectorBeforeDumpAfterLoad(t *testing.T) {
+	path := t.TempDir()
+	opts := &TransCacheOpts{
+		DumpPath:      path,
+		StartTimeout:  1 * time.Minute,
+		DumpInterval:  -1,
+		FileSizeLimit: 1000,
+		BeforeDump: func(chID, itmID string, value any) any {
+			return chID + ":" + value.(string)
+		},
+		AfterLoad: func(chID, itmID string, value any) any {
+			return strings.TrimPrefix(value.(string), chID+":") + "_loaded"
+		},
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, nopLogger{})
+	if err != nil {
 		t.Fatal(err)
 	}
-	f, err := os.OpenFile(path+"/*default/tmpfile", os.O_APPEND|os.O_CREATE|os.O_WRONLY,
-		0644)
+	tc.Set(DefaultCacheInstance, "item1", "value1", nil, true, "")
+	if val, _ := tc.Get(DefaultCacheInstance, "item1"); val != "value1" {
+		t.Errorf("expected in memory value to be untouched, received <%v>", val)
+	}
+	tc.Shutdown()
+	var dumped []any
+	filePaths, err := getFilePaths(filepath.Join(path, DefaultCacheInstance))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	f.WriteString("somethin not decodable by gob")
-	defer func() {
-		f.Close()
-		if err := os.RemoveAll(path); err != nil {
-			t.Errorf("Failed to delete temporary dir: %v", err)
+	for _, fp := range filePaths {
+		if err := readAndDecodeFile(fp, nil, func(oce *OfflineCacheEntity) {
+			dumped = append(dumped, oce.Value)
+		}); err != nil {
+			t.Fatal(err)
 		}
-	}()
-	var logBuf bytes.Buffer
+	}
+	if exp := []any{DefaultCacheInstance + ":value1"}; !reflect.DeepEqual(exp, dumped) {
+		t.Errorf("expected <%v>, received <%v>", exp, dumped)
+	}
+	tc, err = NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if val, _ := tc.Get(DefaultCacheInstance, "item1"); val != "value1_loaded" {
+		t.Errorf("expected <value1_loaded>, received <%v>", val)
+	}
+}
+
+func TestTransCacheGetLoadReport(t *testing.T) {
+	path := t.TempDir()
 	opts := &TransCacheOpts{
-		DumpPath:        path,
-		StartTimeout:    1 * time.Minute,
-		DumpInterval:    10 * time.Second,
-		RewriteInterval: 10 * time.Second,
-		FileSizeLimit:   1000,
+		DumpPath:      path,
+		StartTimeout:  1 * time.Minute,
+		DumpInterval:  -1,
+		FileSizeLimit: 1000,
 	}
-	_, err = NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, &testLogger{log.New(&logBuf, "", 0)})
-	expErr := "failed to decode OfflineCacheEntity at </tmp/internal_db/*default/tmpfile>: unexpected EOF"
-	if err == nil || expErr != err.Error() {
-		t.Errorf("expected error <%v>, received <%v>", expErr, err)
-	} else if rcv := logBuf.String(); !strings.Contains(rcv, "") {
-		t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
+	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := map[string]*LoadReport{DefaultCacheInstance: {}}; !reflect.DeepEqual(exp, tc.GetLoadReport()) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, tc.GetLoadReport())
+	}
+	tc.Set("", "item1", 1, nil, true, "")
+	tc.Set("", "item1", 2, nil, true, "")
+	tc.Set("", "item1", 3, nil, true, "")
+	tc.Set("", "item2", 1, nil, true, "")
+	tc.Remove("", "item2", true, "")
+	tc.Shutdown()
+	if tc, err = NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, nopLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	exp := &LoadReport{Files: 1, Sets: 4, Removes: 1, Overwrites: 2, OverwriteRatio: 0.5}
+	if rcv := tc.GetLoadReport()[DefaultCacheInstance]; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+}
+
+func TestTransCacheInspect(t *testing.T) {
+	path := t.TempDir()
+	tc, err := NewTransCacheWithOfflineCollector(&TransCacheOpts{
+		DumpPath:      path,
+		StartTimeout:  1 * time.Minute,
+		DumpInterval:  1 * time.Hour,
+		FileSizeLimit: 1000,
+		RecoverCaches: []string{DefaultCacheInstance},
+	}, map[string]*CacheConfig{"lazy": {MaxItems: -1}}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	tc.Set(DefaultCacheInstance, "item1", 1, []string{"grp1"}, true, "")
+	tc.Set(DefaultCacheInstance, "item2", 2, nil, true, "")
+	rpt := tc.Inspect()
+	exp := &InstanceReport{Items: 2, Groups: 1, Persistent: true, PendingEntities: 2}
+	if rcv := rpt.Instances[DefaultCacheInstance]; !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("expected <%+v>, received <%+v>", exp, rcv)
+	}
+	if rcv := rpt.Instances["lazy"]; !rcv.PendingRecovery || !rcv.Persistent {
+		t.Errorf("expected lazy instance pending recovery, received <%+v>", rcv)
+	}
+	if err := tc.cache[DefaultCacheInstance].DumpToFile(); err != nil {
+		t.Fatal(err)
+	}
+	rcv := tc.Inspect().Instances[DefaultCacheInstance]
+	if rcv.PendingEntities != 0 || rcv.DiskBytes == 0 || rcv.LastDump.IsZero() || rcv.LastDumpError != "" {
+		t.Errorf("unexpected report after dump <%+v>", rcv)
 	}
 }
 
@@ -1008,12 +4283,47 @@ func TestTransCacheDumpAllDump0(t *testing.T) {
 	if !reflect.DeepEqual(expTc, tc) {
 		t.Errorf("Expected <%+v>, \nReceived <%+v>", expTc, tc)
 	}
-	expErr := "couldn't dump cache to file, *default offCollector is nil"
-	if err := NewTransCache(map[string]*CacheConfig{}).DumpAll(); err == nil || err.Error() != expErr {
+	expErr := "couldn't dump cache to file, *default instance is not persistent"
+	if err := NewTransCache(map[string]*CacheConfig{}).DumpAll(); !errors.Is(err, ErrInstanceNotPersistent) ||
+		err.Error() != expErr {
 		t.Errorf("Expected error <%+v>, \nReceived error <%+v>", expErr, err)
 	}
 }
 
+func TestTransCacheDumpAllNotPersistent(t *testing.T) {
+	var logBuf bytes.Buffer
+	tc := &TransCache{
+		cache: map[string]*Cache{
+			DefaultCacheInstance: {cache: map[string]*cachedItem{}},
+			"cache2": {
+				cache: map[string]*cachedItem{
+					"Item1": {
+						itemID: "Item1",
+						value:  "val",
+					},
+				},
+				offCollector: &OfflineCollector{
+					dumpInterval:  1 * time.Second,
+					fileSizeLimit: 1,
+					collection: map[string]*CollectionEntity{
+						"Item1": {
+							IsSet:  true,
+							ItemID: "Item1",
+						},
+					},
+					logger: &testLogger{log.New(&logBuf, "", 0)},
+				},
+			},
+		},
+	}
+	if err := tc.DumpAll(); !errors.Is(err, ErrInstanceNotPersistent) {
+		t.Errorf("Expected error <%+v>, \nReceived error <%+v>", ErrInstanceNotPersistent, err)
+	}
+	if rcv := logBuf.String(); rcv != "" { // no instance dumped
+		t.Errorf("Expected <%+v>, \nReceived <%+v>", "", rcv)
+	}
+}
+
 func TestTransCacheDumpAllDumpErr1(t *testing.T) {
 	var logBuf bytes.Buffer
 	tc := &TransCache{
@@ -1173,7 +4483,7 @@ func TestTransCacheAsyncRewriteEntitiesMinus1NoChanges(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	dc := gob.NewDecoder(f)
+	dc := gob.NewDecoder(unframed(f))
 	var rcv *OfflineCacheEntity
 	if err := dc.Decode(&rcv); err != nil {
 		t.Error(err)
@@ -1652,8 +4962,8 @@ func TestTransCacheBackupDumpFolderZip(t *testing.T) {
 }
 func TestTransCacheBackupDumpFolderErr1(t *testing.T) {
 	tc := NewTransCache(map[string]*CacheConfig{})
-	expErr := "cache offCollector is nil"
-	if err := tc.BackupDumpFolder("", false); err == nil || expErr != err.Error() {
+	expErr := "cache instance is not persistent"
+	if err := tc.BackupDumpFolder("", false); !errors.Is(err, ErrInstanceNotPersistent) || expErr != err.Error() {
 		t.Errorf("expected <%v>, received <%v>", expErr, err)
 	}
 }
@@ -2543,3 +5853,62 @@ func BenchmarkRestoreZip(b *testing.B) {
 		}
 	}
 }
+
+func TestTransCacheReclaimMemory(t *testing.T) {
+	tc := NewTransCache(map[string]*CacheConfig{
+		"cache1": {MaxItems: -1},
+		"cache2": {MaxItems: -1},
+	})
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	tc.Set("cache2", "item2", "value2", nil, true, "")
+	if rcv := tc.ReclaimMemory(15); rcv != 22 {
+		t.Errorf("expected <22>, received <%d>", rcv)
+	}
+	if tc.HasItem("cache1", "item1") || tc.HasItem("cache2", "item2") {
+		t.Error("expected items to be reclaimed")
+	}
+}
+
+func TestTransCacheClock(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	ownClock := &testClock{now: clock.Now()}
+	tc := NewTransCacheWithClock(map[string]*CacheConfig{
+		"cache1": {MaxItems: -1, TTL: time.Hour},
+		"cache2": {MaxItems: -1, TTL: time.Hour, Clock: ownClock},
+	}, clock)
+	for _, chID := range []string{DefaultCacheInstance, "cache1", "cache2"} {
+		tc.Set(chID, "item1", "value1", nil, true, "")
+	}
+	tc.cache[DefaultCacheInstance].SetWithExpiry("item2", "value2", nil, time.Hour) // no TTL configured
+	clock.advance(time.Hour)
+	if _, has := tc.Get(DefaultCacheInstance, "item2"); has {
+		t.Error("expected item2 expired on the clock of the TransCache")
+	}
+	if _, has := tc.Get("cache1", "item1"); has {
+		t.Error("expected item1 of cache1 expired on the clock of the TransCache")
+	}
+	if _, has := tc.Get("cache2", "item1"); !has {
+		t.Error("expected item1 of cache2 not expired on its own clock")
+	}
+
+	opts := &TransCacheOpts{
+		DumpPath:        t.TempDir(),
+		StartTimeout:    1 * time.Minute,
+		DumpInterval:    -1,
+		RewriteInterval: 0,
+		FileSizeLimit:   1000000,
+		Clock:           clock,
+	}
+	tc, err := NewTransCacheWithOfflineCollector(opts, map[string]*CacheConfig{}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Shutdown()
+	if err = tc.AddInstance("cache1", &CacheConfig{MaxItems: -1, TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	tc.Set("cache1", "item1", "value1", nil, true, "")
+	if exp, _ := tc.GetItemExpiryTime("cache1", "item1"); !exp.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("expected <%v>, received <%v>", clock.Now().Add(time.Hour), exp)
+	}
+}
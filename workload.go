@@ -0,0 +1,97 @@
+//go:build ltcache_workload
+
+/*
+workload.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM GmbH. All Rights Reserved.
+
+Mixed Set/Get workload harness, compiled in only with the ltcache_workload build tag
+*/
+
+package ltcache
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// WorkloadConfig describes a mixed Set/Get workload run by RunMixedWorkload
+type WorkloadConfig struct {
+	Instances  int           // number of cache instances, named cache0, cache1..
+	MaxItems   int           // MaxItems of each instance
+	Keys       int           // distinct item keys used per instance
+	Workers    int           // goroutines issuing operations concurrently
+	WriteRatio float64       // fraction of operations being Set, the rest are Get
+	Duration   time.Duration // how long the workload runs
+	Seed       int64         // seed for choosing operations, keys and instances, for reproducible runs
+}
+
+// WorkloadResult holds the measurements of a workload run
+type WorkloadResult struct {
+	Ops        int           // total operations executed
+	Sets       int           // operations being Set
+	Gets       int           // operations being Get
+	Throughput float64       // operations per second
+	P50        time.Duration // median operation latency
+	P99        time.Duration // 99th percentile operation latency
+}
+
+// RunMixedWorkload drives concurrent Set/Get operations on a new TransCache, through its public
+// API only, reporting throughput and latency. Meant to compare locking designs reproducibly.
+// Returns an empty result without running if there are no instances, keys or workers
+func RunMixedWorkload(cfg WorkloadConfig) (wr WorkloadResult) {
+	if cfg.Instances < 1 || cfg.Keys < 1 || cfg.Workers < 1 { // nothing to choose operations from
+		return
+	}
+	chCfg := make(map[string]*CacheConfig, cfg.Instances)
+	chIDs := make([]string, cfg.Instances)
+	for i := range chIDs {
+		chIDs[i] = fmt.Sprintf("cache%d", i)
+		chCfg[chIDs[i]] = &CacheConfig{MaxItems: cfg.MaxItems}
+	}
+	tc := NewTransCache(chCfg)
+	keys := make([]string, cfg.Keys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("item%d", i)
+	}
+	latencies := make([][]time.Duration, cfg.Workers) // per worker to avoid locking while measuring
+	sets := make([]int, cfg.Workers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(cfg.Duration)
+	for w := range cfg.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(cfg.Seed + int64(w)))
+			for now := time.Now(); now.Before(deadline); now = time.Now() {
+				chID, key := chIDs[rnd.Intn(len(chIDs))], keys[rnd.Intn(len(keys))]
+				if rnd.Float64() < cfg.WriteRatio {
+					tc.Set(chID, key, now, nil, true, "")
+					sets[w]++
+				} else {
+					tc.Get(chID, key)
+				}
+				latencies[w] = append(latencies[w], time.Since(now))
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	all := slices.Concat(latencies...)
+	for _, s := range sets {
+		wr.Sets += s
+	}
+	wr.Ops = len(all)
+	wr.Gets = wr.Ops - wr.Sets
+	if wr.Ops == 0 {
+		return
+	}
+	slices.Sort(all)
+	wr.Throughput = float64(wr.Ops) / elapsed.Seconds()
+	wr.P50 = all[wr.Ops/2]
+	wr.P99 = all[(wr.Ops*99)/100]
+	return
+}
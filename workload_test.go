@@ -0,0 +1,47 @@
+//go:build ltcache_workload
+
+/*
+workload_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM GmbH. All Rights Reserved.
+*/
+
+package ltcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunMixedWorkload(t *testing.T) {
+	wr := RunMixedWorkload(WorkloadConfig{
+		Instances:  4,
+		MaxItems:   100,
+		Keys:       200,
+		Workers:    8,
+		WriteRatio: 0.2,
+		Duration:   50 * time.Millisecond,
+		Seed:       1,
+	})
+	if wr.Ops == 0 || wr.Sets+wr.Gets != wr.Ops {
+		t.Errorf("expected operations to be counted, received <%+v>", wr)
+	}
+	if wr.Sets == 0 || wr.Gets < wr.Sets {
+		t.Errorf("expected mostly gets, received <%+v>", wr)
+	}
+	if wr.Throughput <= 0 || wr.P99 < wr.P50 {
+		t.Errorf("expected throughput and ordered percentiles, received <%+v>", wr)
+	}
+}
+
+func TestRunMixedWorkloadEmpty(t *testing.T) {
+	for _, cfg := range []WorkloadConfig{
+		{Keys: 10, Workers: 2},
+		{Instances: 2, Workers: 2},
+		{Instances: -1, Keys: -1, Workers: 2},
+	} {
+		cfg.Duration = 10 * time.Millisecond
+		if wr := RunMixedWorkload(cfg); wr != (WorkloadResult{}) {
+			t.Errorf("expected an empty result for <%+v>, received <%+v>", cfg, wr)
+		}
+	}
+}